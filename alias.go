@@ -0,0 +1,426 @@
+// Copyright 2016 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/olekukonko/tablewriter"
+
+	"v.io/x/lib/cmdline"
+)
+
+// builtinCommands keeps all the built-in madb commands by their names. This is
+// populated in init(), instead of being initialized directly with cmdMadb, in
+// order to avoid an initialization loop.
+var builtinCommands = map[string]*cmdline.Command{}
+
+func init() {
+	for _, cmd := range cmdMadb.Children {
+		builtinCommands[cmd.Name] = cmd
+	}
+}
+
+var cmdMadbAlias = &cmdline.Command{
+	Children:         []*cmdline.Command{cmdMadbAliasSet, cmdMadbAliasUnset, cmdMadbAliasList, cmdMadbAliasClearAll},
+	Name:             "alias",
+	DontInheritFlags: true,
+	Short:            "Manage command aliases",
+	Long: `
+Manages command aliases, each of which runs a sequence of madb commands on the
+specified devices.
+
+Once an alias is defined, it can be invoked just like any other madb command.
+For example, after running the following command:
+
+    madb alias set fresh 'clear-data && start -force-install'
+
+running 'madb -n Tablets fresh' is equivalent to running the following commands
+one after another:
+
+    madb -n Tablets clear-data
+    madb -n Tablets start -force-install
+
+The device specifier flags (e.g., '-n', '-d', '-e') and the other global flags
+given to the alias are applied to every step. The steps are run in order on each
+device, and a device on which a step fails is excluded from the subsequent
+steps.
+`,
+}
+
+var cmdMadbAliasSet = &cmdline.Command{
+	Runner: subCommandRunnerWithFilepath{runMadbAliasSet, getDefaultConfigFilePath},
+	Name:   "set",
+	Short:  "Define a command alias",
+	Long: `
+Defines a command alias. If the alias already exists, its definition is replaced
+with the newly provided one.
+`,
+	ArgsName: "<alias_name> <definition>",
+	ArgsLong: `
+<alias_name> is an alpha-numeric string with no special characters or spaces.
+This name must not be the name of a built-in madb command.
+
+<definition> is one or more madb commands joined by '&&'. Each command consists
+of a madb command name that runs on devices (e.g., 'clear-data', 'exec',
+'install', 'start', 'stop', 'uninstall') followed by its flags and arguments.
+The global flags such as '-n' cannot be used within the definition. The
+definition should be quoted, so that the shell does not interpret '&&'.
+`,
+}
+
+func runMadbAliasSet(env *cmdline.Env, args []string, filename string) error {
+	// Check if the arguments are valid.
+	if len(args) != 2 {
+		return env.UsageErrorf("There must be exactly two arguments.")
+	}
+
+	name, definition := args[0], args[1]
+	if !isValidName(name) {
+		return fmt.Errorf("Not a valid alias name: %q", name)
+	}
+	if _, ok := builtinCommands[name]; ok || name == "help" {
+		return fmt.Errorf("The alias name %q conflicts with a built-in madb command.", name)
+	}
+
+	// Make sure that the definition can be parsed, and that all the flags are valid.
+	steps, err := parseAliasDefinition(definition)
+	if err != nil {
+		return err
+	}
+	for _, step := range steps {
+		if _, err := step.parseFlags(); err != nil {
+			return fmt.Errorf("Invalid flags for the %q command: %v", step.cmd.Name, err)
+		}
+		resetFlags(&step.cmd.Flags)
+	}
+
+	cfg, err := readConfig(filename)
+	if err != nil {
+		return err
+	}
+
+	cfg.Aliases[name] = definition
+	return writeConfig(cfg, filename)
+}
+
+var cmdMadbAliasUnset = &cmdline.Command{
+	Runner: subCommandRunnerWithFilepath{runMadbAliasUnset, getDefaultConfigFilePath},
+	Name:   "unset",
+	Short:  "Unset a command alias",
+	Long: `
+Unsets command aliases defined by the 'madb alias set' command.
+`,
+	ArgsName: "<alias_name1> [<alias_name2> ...]",
+	ArgsLong: `
+<alias_name> is the name of an existing alias.
+You can specify more than one alias names.
+`,
+}
+
+func runMadbAliasUnset(env *cmdline.Env, args []string, filename string) error {
+	// Check if the arguments are valid.
+	if len(args) < 1 {
+		return env.UsageErrorf("There must be at least one argument.")
+	}
+
+	cfg, err := readConfig(filename)
+	if err != nil {
+		return err
+	}
+	for _, name := range args {
+		if _, ok := cfg.Aliases[name]; !ok {
+			return fmt.Errorf("Not an existing alias name: %q", name)
+		}
+	}
+
+	for _, name := range args {
+		delete(cfg.Aliases, name)
+	}
+
+	return writeConfig(cfg, filename)
+}
+
+var cmdMadbAliasList = &cmdline.Command{
+	Runner: subCommandRunnerWithFilepath{runMadbAliasList, getDefaultConfigFilePath},
+	Name:   "list",
+	Short:  "List all the existing command aliases",
+	Long: `
+Lists the name and definition of all the existing command aliases.
+`,
+}
+
+func runMadbAliasList(env *cmdline.Env, args []string, filename string) error {
+	cfg, err := readConfig(filename)
+	if err != nil {
+		return err
+	}
+
+	tw := tablewriter.NewWriter(os.Stdout)
+	tw.SetHeader([]string{"Alias", "Definition"})
+	tw.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+	tw.SetAutoFormatHeaders(false)
+	tw.SetAlignment(tablewriter.ALIGN_LEFT)
+
+	data := make([][]string, 0, len(cfg.Aliases))
+	for name, definition := range cfg.Aliases {
+		data = append(data, []string{name, definition})
+	}
+
+	sort.Sort(byFirstElement(data))
+
+	for _, row := range data {
+		tw.Append(row)
+	}
+	tw.Render()
+
+	return nil
+}
+
+var cmdMadbAliasClearAll = &cmdline.Command{
+	Runner: subCommandRunnerWithFilepath{runMadbAliasClearAll, getDefaultConfigFilePath},
+	Name:   "clear-all",
+	Short:  "Clear all the existing command aliases",
+	Long: `
+Clears all the existing command aliases.
+`,
+}
+
+func runMadbAliasClearAll(env *cmdline.Env, args []string, filename string) error {
+	cfg, err := readConfig(filename)
+	if err != nil {
+		return err
+	}
+
+	cfg.Aliases = make(map[string]string)
+	return writeConfig(cfg, filename)
+}
+
+// aliasStep is a single madb command within an alias definition.
+type aliasStep struct {
+	text   string
+	cmd    *cmdline.Command
+	runner subCommandRunner
+	args   []string
+}
+
+// parseFlags resets the flags of the step command to their default values, and
+// then parses the flags given in the alias definition. The remaining arguments
+// are returned.
+func (s aliasStep) parseFlags() ([]string, error) {
+	resetFlags(&s.cmd.Flags)
+	if err := s.cmd.Flags.Parse(s.args); err != nil {
+		return nil, err
+	}
+
+	return s.cmd.Flags.Args(), nil
+}
+
+// resetFlags sets all the flags in the given flag set back to their default values.
+func resetFlags(flags *flag.FlagSet) {
+	flags.VisitAll(func(f *flag.Flag) {
+		f.Value.Set(f.DefValue)
+	})
+}
+
+// parseAliasDefinition splits the given alias definition into steps. Each step
+// must start with the name of a built-in madb command that runs on devices.
+func parseAliasDefinition(definition string) ([]aliasStep, error) {
+	steps := []aliasStep{}
+
+	for _, stepStr := range strings.Split(definition, "&&") {
+		fields, err := splitArgs(stepStr)
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("The alias definition %q contains an empty command.", definition)
+		}
+
+		cmd, ok := builtinCommands[fields[0]]
+		if !ok {
+			return nil, fmt.Errorf("Unknown madb command %q in the alias definition.", fields[0])
+		}
+
+		runner, ok := cmd.Runner.(subCommandRunner)
+		if !ok {
+			return nil, fmt.Errorf("The madb command %q does not run on devices, and cannot be used in an alias.", fields[0])
+		}
+
+		steps = append(steps, aliasStep{strings.Join(fields, " "), cmd, runner, fields[1:]})
+	}
+
+	return steps, nil
+}
+
+// splitArgs splits the given string into arguments separated by whitespaces.
+// Single or double quotes can be used for arguments containing whitespaces.
+func splitArgs(s string) ([]string, error) {
+	result := []string{}
+
+	var current []rune
+	var quote rune
+	inArg := false
+
+	for _, r := range s {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			current = append(current, r)
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				result = append(result, string(current))
+				current = nil
+				inArg = false
+			}
+		default:
+			current = append(current, r)
+			inArg = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("Unterminated quote in %q.", s)
+	}
+	if inArg {
+		result = append(result, string(current))
+	}
+
+	return result, nil
+}
+
+// aliasRunner runs the steps of an alias on the specified devices.
+type aliasRunner struct {
+	definition string
+}
+
+var _ cmdline.Runner = (*aliasRunner)(nil)
+
+func (a aliasRunner) Run(env *cmdline.Env, args []string) error {
+	if len(args) > 0 {
+		return env.UsageErrorf("An alias does not take any arguments.")
+	}
+
+	steps, err := parseAliasDefinition(a.definition)
+	if err != nil {
+		return err
+	}
+
+	if err := validatePrefixFlag(); err != nil {
+		return err
+	}
+
+	if err := startAdbServer(); err != nil {
+		return err
+	}
+
+	devices, err := getSpecifiedDevices()
+	if err != nil {
+		return err
+	}
+
+	var errs []string
+	for i, step := range steps {
+		// Stop when the previous steps failed on all the devices.
+		if len(devices) == 0 {
+			break
+		}
+
+		fmt.Printf("Running step %v/%v: madb %v\n", i+1, len(steps), step.text)
+
+		stepArgs, err := step.parseFlags()
+		if err != nil {
+			return fmt.Errorf("Invalid flags for the %q command: %v", step.cmd.Name, err)
+		}
+
+		failed, err := step.runner.runOnDevices(env, stepArgs, devices)
+		if err != nil {
+			// When no devices are returned, the error is not specific to any
+			// devices, so the rest of the steps cannot be run.
+			if len(failed) == 0 {
+				return err
+			}
+
+			errs = append(errs, err.Error())
+			devices = excludeDevices(devices, failed)
+		}
+	}
+
+	if errs != nil {
+		return errors.New(strings.Join(errs, "\n"))
+	}
+
+	return nil
+}
+
+// excludeDevices returns a new slice formed by removing all the devices in
+// excluded from devices.
+func excludeDevices(devices, excluded []device) []device {
+	result := make([]device, 0, len(devices))
+
+	for _, d := range devices {
+		found := false
+		for _, e := range excluded {
+			if d.Serial == e.Serial {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			result = append(result, d)
+		}
+	}
+
+	return result
+}
+
+// registerAliases reads the aliases from the config file, and adds them to the
+// given root command as child commands.
+func registerAliases(root *cmdline.Command) {
+	configFile, err := getDefaultConfigFilePath()
+	if err != nil {
+		return
+	}
+
+	cfg, err := readConfig(configFile)
+	if err != nil {
+		return
+	}
+
+	names := make([]string, 0, len(cfg.Aliases))
+	for name := range cfg.Aliases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if _, ok := builtinCommands[name]; ok {
+			fmt.Fprintf(os.Stderr, "WARNING: The alias %q is ignored, because it conflicts with a built-in madb command.\n", name)
+			continue
+		}
+
+		definition := cfg.Aliases[name]
+		root.Children = append(root.Children, &cmdline.Command{
+			Runner: aliasRunner{definition},
+			Name:   name,
+			Short:  fmt.Sprintf("Alias for '%v'", definition),
+			Long: fmt.Sprintf(`
+Runs the following madb commands on the specified devices, as defined by 'madb alias set':
+
+    %v
+`, definition),
+		})
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2016 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestMadbAliasSet(t *testing.T) {
+	filename := tempFilename(t)
+	defer os.Remove(filename)
+
+	var cfg *config
+	var err error
+
+	// Set a new alias.
+	if err = runMadbAliasSet(nil, []string{"fresh", "clear-data && start -force-install"}, filename); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg, err = readConfig(filename); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cfg.Aliases, map[string]string{"fresh": "clear-data && start -force-install"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unmatched results: got %v, want %v", got, want)
+	}
+
+	// The flags used for validation should be reset to their default values.
+	if forceInstallFlag {
+		t.Fatalf("the flags were not reset after validating the alias definition.")
+	}
+
+	// The following definitions should not be accepted.
+	invalid := [][]string{
+		{"install", "clear-data"},                    // Conflicts with a built-in command
+		{"help", "clear-data"},                       // Conflicts with the help command
+		{"bad name", "clear-data"},                   // Invalid alias name
+		{"unknown", "clear-data && unknown"},         // Unknown command
+		{"nodevice", "name list"},                    // Command not running on devices
+		{"empty", "clear-data && "},                  // Empty step
+		{"badflag", "start -no-such-flag"},           // Unknown flag
+		{"quote", "exec shell 'echo hello && start"}, // Unterminated quote
+	}
+
+	for i, args := range invalid {
+		if err = runMadbAliasSet(nil, args, filename); err == nil {
+			t.Fatalf("expected an error for invalid[%v] but succeeded.", i)
+		}
+	}
+}
+
+func TestMadbAliasUnset(t *testing.T) {
+	filename := tempFilename(t)
+	defer os.Remove(filename)
+
+	// Set up some aliases first.
+	runMadbAliasSet(nil, []string{"fresh", "clear-data && start"}, filename)
+	runMadbAliasSet(nil, []string{"restart", "stop && start"}, filename)
+	runMadbAliasSet(nil, []string{"reinstall", "uninstall && install"}, filename)
+
+	var cfg *config
+	var err error
+
+	if err = runMadbAliasUnset(nil, []string{"fresh", "restart"}, filename); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg, err = readConfig(filename); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cfg.Aliases, map[string]string{"reinstall": "uninstall && install"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unmatched results: got %v, want %v", got, want)
+	}
+
+	// When the alias is not found.
+	if err = runMadbAliasUnset(nil, []string{"fresh"}, filename); err == nil {
+		t.Fatalf("expected an error but succeeded.")
+	}
+}
+
+func ExampleMadbAliasList() {
+	filename := tempFilename(nil)
+	defer os.Remove(filename)
+
+	// Set up some aliases first.
+	runMadbAliasSet(nil, []string{"restart", "stop && start"}, filename)
+	runMadbAliasSet(nil, []string{"fresh", "clear-data && start -build"}, filename)
+
+	// Call the list command.
+	runMadbAliasList(nil, []string{}, filename)
+
+	// Output:
+	// +---------+----------------------------+
+	// | Alias   | Definition                 |
+	// +---------+----------------------------+
+	// | fresh   | clear-data && start -build |
+	// | restart | stop && start              |
+	// +---------+----------------------------+
+}
+
+func TestParseAliasDefinition(t *testing.T) {
+	steps, err := parseAliasDefinition(`clear-data &&start -force-install&& exec shell "echo hello world"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		text string
+		name string
+		args []string
+	}
+
+	got := []result{}
+	for _, step := range steps {
+		got = append(got, result{step.text, step.cmd.Name, step.args})
+	}
+
+	want := []result{
+		{"clear-data", "clear-data", []string{}},
+		{"start -force-install", "start", []string{"-force-install"}},
+		{"exec shell echo hello world", "exec", []string{"shell", "echo hello world"}},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unmatched results: got %v, want %v", got, want)
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []string
+	}{
+		{"", []string{}},
+		{"  start  -force-install ", []string{"start", "-force-install"}},
+		{`exec shell "echo hello world"`, []string{"exec", "shell", "echo hello world"}},
+		{`exec shell 'echo "quoted"'`, []string{"exec", "shell", `echo "quoted"`}},
+		{`exec shell ''`, []string{"exec", "shell", ""}},
+	}
+
+	for i, test := range tests {
+		got, err := splitArgs(test.input)
+		if err != nil {
+			t.Fatalf("error occurred for tests[%v]: %v", i, err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Fatalf("unmatched results for tests[%v]: got %q, want %q", i, got, test.want)
+		}
+	}
+}
+
+func TestExcludeDevices(t *testing.T) {
+	d1 := device{Serial: "deviceid01", Index: 1}
+	d2 := device{Serial: "deviceid02", Index: 2}
+	d3 := device{Serial: "deviceid03", Index: 3}
+
+	got := excludeDevices([]device{d1, d2, d3}, []device{d2})
+	if want := []device{d1, d3}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unmatched results: got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,821 @@
+// Copyright 2016 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/zip"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// apkInfo contains the information read from an .apk file, without running any build tools.
+type apkInfo struct {
+	PackageName      string
+	VersionCode      int
+	MinSdkVersion    int
+	TargetSdkVersion int
+	// SplitName is the name of the split (e.g., "config.arm64_v8a" or "feature1"). Empty for the
+	// base .apk.
+	SplitName string
+	// Abis lists the ABIs for which the .apk contains native libraries.
+	Abis []string
+	// ScreenDensities lists the distinct screen densities declared in the <compatible-screens>
+	// element, which is added to the manifest of the density split .apk files.
+	ScreenDensities []int
+	// LaunchableActivities and LeanbackActivities are the fully-qualified names of the activities
+	// with the MAIN action and the LAUNCHER or LEANBACK_LAUNCHER category, respectively.
+	LaunchableActivities []string
+	LeanbackActivities   []string
+	// SignatureHash is the hash of the signing certificate, in the same format as the signatures
+	// shown by "adb shell dumpsys package". The certificate is read from the APK Signature Scheme v3
+	// or v2 block, or the v1 (JAR) signature. Empty if the .apk is not signed.
+	SignatureHash string
+}
+
+// readApkInfo reads the binary AndroidManifest.xml file and the native library entries of the given
+// .apk file.
+func readApkInfo(filename string) (apkInfo, error) {
+	r, err := zip.OpenReader(filename)
+	if err != nil {
+		return apkInfo{}, fmt.Errorf("Could not open the .apk file %q: %v", filename, err)
+	}
+	defer r.Close()
+
+	var manifest *xmlElement
+	abis := []string{}
+	signatureHash := ""
+	for _, f := range r.File {
+		// The v1 signature block is located at "META-INF/<signer>.{RSA|DSA|EC}".
+		if dir, name := filepath.Split(f.Name); dir == "META-INF/" && signatureHash == "" {
+			switch strings.ToUpper(filepath.Ext(name)) {
+			case ".RSA", ".DSA", ".EC":
+				if data, err := readZipFile(f); err == nil {
+					signatureHash = getSignatureHash(data)
+				}
+			}
+		}
+
+		// The native libraries are located at "lib/<abi>/<library_name>.so".
+		if parts := strings.Split(f.Name, "/"); len(parts) == 3 && parts[0] == "lib" && strings.HasSuffix(parts[2], ".so") {
+			if !isStringInSlice(parts[1], abis) {
+				abis = append(abis, parts[1])
+			}
+		}
+
+		if f.Name != "AndroidManifest.xml" {
+			continue
+		}
+
+		data, err := readZipFile(f)
+		if err != nil {
+			return apkInfo{}, err
+		}
+
+		if manifest, err = parseBinaryXML(data); err != nil {
+			return apkInfo{}, fmt.Errorf("Could not parse the manifest of the .apk file %q: %v", filename, err)
+		}
+	}
+
+	if manifest == nil {
+		return apkInfo{}, fmt.Errorf("Could not find the manifest in the .apk file %q.", filename)
+	}
+
+	info, err := newApkInfo(manifest)
+	if err != nil {
+		return apkInfo{}, fmt.Errorf("Invalid manifest in the .apk file %q: %v", filename, err)
+	}
+
+	// The v2 and v3 signatures take precedence, since the v1 signature is omitted for the apps with
+	// minSdkVersion 24 or higher.
+	if cert, err := readSigningBlockCertificate(filename); err == nil && cert != nil {
+		signatureHash = getCertificateHash(cert)
+	}
+
+	sort.Strings(abis)
+	info.Abis = abis
+	info.SignatureHash = signatureHash
+	return info, nil
+}
+
+// readZipFile reads the entire contents of the given file in a zip archive.
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return ioutil.ReadAll(rc)
+}
+
+// pkcs7ContentInfo and pkcs7SignedData are the ASN.1 structures of a PKCS #7 signature block, as
+// defined in RFC 2315. Only the certificates are used.
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	ContentInfo      asn1.RawValue
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      asn1.RawValue
+}
+
+// getSignatureHash extracts the first certificate from the given PKCS #7 signature block, and
+// returns its hash in the same way as the Android framework computes the hash code of a signature
+// (i.e., java.util.Arrays.hashCode() of the DER-encoded certificate, in hexadecimal). Returns an
+// empty string if the certificate cannot be extracted.
+func getSignatureHash(block []byte) string {
+	var contentInfo pkcs7ContentInfo
+	if _, err := asn1.Unmarshal(block, &contentInfo); err != nil {
+		return ""
+	}
+
+	var signedData pkcs7SignedData
+	if _, err := asn1.Unmarshal(contentInfo.Content.Bytes, &signedData); err != nil {
+		return ""
+	}
+
+	// The certificates field is a set of certificates, and the first one is the signing certificate.
+	var cert asn1.RawValue
+	if _, err := asn1.Unmarshal(signedData.Certificates.Bytes, &cert); err != nil {
+		return ""
+	}
+
+	return getCertificateHash(cert.FullBytes)
+}
+
+// getCertificateHash returns the hash of the given DER-encoded certificate, which is
+// java.util.Arrays.hashCode() of the certificate in hexadecimal.
+func getCertificateHash(cert []byte) string {
+	var hash int32 = 1
+	for _, b := range cert {
+		hash = 31*hash + int32(int8(b))
+	}
+
+	return strconv.FormatUint(uint64(uint32(hash)), 16)
+}
+
+// The IDs of the signature scheme blocks in the APK Signing Block.
+const (
+	apkSignatureSchemeV2BlockID = 0x7109871a
+	apkSignatureSchemeV3BlockID = 0xf05368c0
+)
+
+// apkSigningBlockMagic is the magic at the end of the APK Signing Block.
+const apkSigningBlockMagic = "APK Sig Block 42"
+
+// readSigningBlockCertificate reads the signing certificate from the APK Signing Block of the given
+// .apk file. Returns nil if the .apk file does not have a v2 or v3 signature.
+func readSigningBlockCertificate(filename string) ([]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return parseSigningBlockCertificate(f, stat.Size())
+}
+
+// parseSigningBlockCertificate finds the APK Signing Block, which is located right before the
+// central directory of the zip archive, and returns the DER-encoded certificate of the first signer
+// in the v3 block, or the v2 block if there is no v3 block. Returns nil if there is no such block.
+// See https://source.android.com/security/apksigning/v2 for the format.
+func parseSigningBlockCertificate(r io.ReaderAt, size int64) ([]byte, error) {
+	// Find the end of central directory record, which may be followed by a comment of up to 64KB.
+	tailSize := int64(22 + 0xffff)
+	if tailSize > size {
+		tailSize = size
+	}
+	tail := make([]byte, tailSize)
+	if _, err := r.ReadAt(tail, size-tailSize); err != nil {
+		return nil, err
+	}
+
+	eocd := -1
+	for i := len(tail) - 22; i >= 0; i-- {
+		if binary.LittleEndian.Uint32(tail[i:]) == 0x06054b50 && int(binary.LittleEndian.Uint16(tail[i+20:])) == len(tail)-i-22 {
+			eocd = i
+			break
+		}
+	}
+	if eocd < 0 {
+		return nil, fmt.Errorf("Could not find the end of central directory record.")
+	}
+
+	// The APK Signing Block ends with its size and the magic.
+	cdOffset := int64(binary.LittleEndian.Uint32(tail[eocd+16:]))
+	if cdOffset < 32 {
+		return nil, nil
+	}
+	footer := make([]byte, 24)
+	if _, err := r.ReadAt(footer, cdOffset-24); err != nil {
+		return nil, err
+	}
+	if string(footer[8:]) != apkSigningBlockMagic {
+		return nil, nil
+	}
+
+	blockSize := int64(binary.LittleEndian.Uint64(footer))
+	start := cdOffset - blockSize - 8
+	if blockSize < 24 || start < 0 {
+		return nil, fmt.Errorf("Invalid APK Signing Block size %v.", blockSize)
+	}
+	block := make([]byte, blockSize+8)
+	if _, err := r.ReadAt(block, start); err != nil {
+		return nil, err
+	}
+	if int64(binary.LittleEndian.Uint64(block)) != blockSize {
+		return nil, fmt.Errorf("Unmatched APK Signing Block sizes.")
+	}
+
+	// The block consists of the ID-value pairs, each prefixed by its 8-byte length.
+	schemeBlocks := map[uint32][]byte{}
+	pairs := block[8 : len(block)-24]
+	for len(pairs) > 0 {
+		if len(pairs) < 12 {
+			return nil, fmt.Errorf("Truncated APK Signing Block.")
+		}
+		length := binary.LittleEndian.Uint64(pairs)
+		if length < 4 || length > uint64(len(pairs)-8) {
+			return nil, fmt.Errorf("Invalid length %v of an APK Signing Block entry.", length)
+		}
+		id := binary.LittleEndian.Uint32(pairs[8:])
+		schemeBlocks[id] = pairs[12 : 8+length]
+		pairs = pairs[8+length:]
+	}
+
+	for _, id := range []uint32{apkSignatureSchemeV3BlockID, apkSignatureSchemeV2BlockID} {
+		if value, ok := schemeBlocks[id]; ok {
+			return parseSignatureSchemeCertificate(value)
+		}
+	}
+
+	return nil, nil
+}
+
+// parseSignatureSchemeCertificate returns the first certificate of the first signer in the given v2
+// or v3 signature scheme block. The block is a sequence of signers, each of which starts with the
+// signed data consisting of the digests and the certificates. All of these are prefixed by their
+// 4-byte lengths.
+func parseSignatureSchemeCertificate(value []byte) ([]byte, error) {
+	var signers, signer, signedData, certs, cert []byte
+	var err error
+	if signers, _, err = readLengthPrefixed(value); err != nil {
+		return nil, err
+	}
+	if signer, _, err = readLengthPrefixed(signers); err != nil {
+		return nil, err
+	}
+	if signedData, _, err = readLengthPrefixed(signer); err != nil {
+		return nil, err
+	}
+	// Skip the digests.
+	if _, certs, err = readLengthPrefixed(signedData); err != nil {
+		return nil, err
+	}
+	if certs, _, err = readLengthPrefixed(certs); err != nil {
+		return nil, err
+	}
+	if cert, _, err = readLengthPrefixed(certs); err != nil {
+		return nil, err
+	}
+
+	return cert, nil
+}
+
+// readLengthPrefixed reads a value prefixed by its 4-byte little-endian length, and returns the
+// value and the remaining bytes.
+func readLengthPrefixed(data []byte) ([]byte, []byte, error) {
+	if len(data) < 4 {
+		return nil, nil, fmt.Errorf("Truncated APK signature scheme block.")
+	}
+	length := binary.LittleEndian.Uint32(data)
+	if uint64(length) > uint64(len(data)-4) {
+		return nil, nil, fmt.Errorf("Invalid length %v in the APK signature scheme block.", length)
+	}
+
+	return data[4 : 4+length], data[4+length:], nil
+}
+
+// newApkInfo extracts the app information from the given manifest element.
+func newApkInfo(manifest *xmlElement) (apkInfo, error) {
+	if manifest.Name != "manifest" {
+		return apkInfo{}, fmt.Errorf("The root element is %q, not \"manifest\".", manifest.Name)
+	}
+
+	info := apkInfo{
+		PackageName: manifest.Attrs["package"],
+		SplitName:   manifest.Attrs["split"],
+	}
+	if info.PackageName == "" {
+		return apkInfo{}, fmt.Errorf("The package name is not specified.")
+	}
+
+	if versionCode, ok := manifest.Attrs["versionCode"]; ok {
+		value, err := strconv.Atoi(versionCode)
+		if err != nil {
+			return apkInfo{}, fmt.Errorf("Invalid version code %q.", versionCode)
+		}
+		info.VersionCode = value
+	}
+
+	for _, child := range manifest.Children {
+		switch child.Name {
+		case "uses-sdk":
+			// The SDK versions can be codenames for the preview platforms, which are ignored.
+			if value, err := strconv.Atoi(child.Attrs["minSdkVersion"]); err == nil {
+				info.MinSdkVersion = value
+			}
+			if value, err := strconv.Atoi(child.Attrs["targetSdkVersion"]); err == nil {
+				info.TargetSdkVersion = value
+			}
+
+		case "application":
+			info.LaunchableActivities, info.LeanbackActivities = getLaunchableActivitiesFromManifest(child, info.PackageName)
+
+		case "compatible-screens":
+			seen := map[int]bool{}
+			for _, screen := range child.Children {
+				value, err := strconv.Atoi(screen.Attrs["screenDensity"])
+				if screen.Name != "screen" || err != nil || seen[value] {
+					continue
+				}
+				seen[value] = true
+				info.ScreenDensities = append(info.ScreenDensities, value)
+			}
+		}
+	}
+
+	return info, nil
+}
+
+// getLaunchableActivitiesFromManifest returns the fully-qualified names of the enabled activities and
+// activity aliases with the MAIN action, which have the LAUNCHER category and the LEANBACK_LAUNCHER
+// category, respectively. The activities are listed in the order of their appearance in the manifest.
+func getLaunchableActivitiesFromManifest(application *xmlElement, packageName string) ([]string, []string) {
+	launchable, leanback := []string{}, []string{}
+	for _, component := range application.Children {
+		if component.Name != "activity" && component.Name != "activity-alias" {
+			continue
+		}
+		if component.Attrs["enabled"] == "false" {
+			continue
+		}
+
+		// Resolve the relative activity names in the same way as the Gradle script does.
+		name := component.Attrs["name"]
+		if strings.HasPrefix(name, ".") {
+			name = packageName + name
+		} else if !strings.Contains(name, ".") {
+			name = packageName + "." + name
+		}
+
+		if hasMainIntentFilter(component, "android.intent.category.LAUNCHER") && !isStringInSlice(name, launchable) {
+			launchable = append(launchable, name)
+		}
+		if hasMainIntentFilter(component, "android.intent.category.LEANBACK_LAUNCHER") && !isStringInSlice(name, leanback) {
+			leanback = append(leanback, name)
+		}
+	}
+
+	return launchable, leanback
+}
+
+// hasMainIntentFilter determines whether the given activity has an intent filter with the MAIN action
+// and the given category.
+func hasMainIntentFilter(activity *xmlElement, category string) bool {
+	for _, intentFilter := range activity.Children {
+		if intentFilter.Name != "intent-filter" {
+			continue
+		}
+
+		hasAction, hasCategory := false, false
+		for _, child := range intentFilter.Children {
+			switch {
+			case child.Name == "action" && child.Attrs["name"] == "android.intent.action.MAIN":
+				hasAction = true
+			case child.Name == "category" && child.Attrs["name"] == category:
+				hasCategory = true
+			}
+		}
+
+		if hasAction && hasCategory {
+			return true
+		}
+	}
+
+	return false
+}
+
+// xmlElement is an element of a decoded binary XML document. The attribute values are converted to
+// strings, and the namespaces are dropped from the attribute names.
+type xmlElement struct {
+	Name     string
+	Attrs    map[string]string
+	Children []*xmlElement
+}
+
+// Chunk types and value types of the binary XML format, as defined in ResourceTypes.h of the
+// Android framework.
+const (
+	resStringPoolType       = 0x0001
+	resXMLType              = 0x0003
+	resXMLStartElementType  = 0x0102
+	resXMLEndElementType    = 0x0103
+	resXMLResourceMapType   = 0x0180
+	resStringPoolUTF8Flag   = 1 << 8
+	resValueTypeReference   = 0x01
+	resValueTypeString      = 0x03
+	resValueTypeIntDec      = 0x10
+	resValueTypeIntHex      = 0x11
+	resValueTypeIntBoolean  = 0x12
+	resNoEntry              = 0xffffffff
+	resXMLNodeHeaderSize    = 16
+	resXMLAttributeMinSize  = 20
+	resStringPoolHeaderSize = 28
+)
+
+// androidAttrNames maps the resource IDs of the framework attributes used by madb to their names.
+// Some build tools strip the attribute names from the string pool, in which case the names can only
+// be determined from the resource IDs.
+var androidAttrNames = map[uint32]string{
+	0x01010003: "name",
+	0x0101000e: "enabled",
+	0x0101020c: "minSdkVersion",
+	0x0101021b: "versionCode",
+	0x0101021c: "versionName",
+	0x010102cb: "screenDensity",
+	0x01010270: "targetSdkVersion",
+}
+
+// parseBinaryXML decodes the given binary XML document (e.g., the AndroidManifest.xml file in an
+// .apk file), and returns its root element.
+func parseBinaryXML(data []byte) (*xmlElement, error) {
+	le := binary.LittleEndian
+	if len(data) < 8 || le.Uint16(data) != resXMLType {
+		return nil, fmt.Errorf("Not a binary XML document.")
+	}
+
+	var pool []string
+	var resourceIDs []uint32
+	var root *xmlElement
+	stack := []*xmlElement{}
+
+	getString := func(index uint32) string {
+		if index == resNoEntry || int(index) >= len(pool) {
+			return ""
+		}
+		return pool[index]
+	}
+
+	offset := int(le.Uint16(data[2:]))
+	for offset+8 <= len(data) {
+		chunkType := le.Uint16(data[offset:])
+		headerSize := int(le.Uint16(data[offset+2:]))
+		chunkSize := int(le.Uint32(data[offset+4:]))
+		if chunkSize < 8 || offset+chunkSize > len(data) {
+			return nil, fmt.Errorf("Invalid chunk size at offset %v.", offset)
+		}
+		chunk := data[offset : offset+chunkSize]
+
+		switch chunkType {
+		case resStringPoolType:
+			var err error
+			if pool, err = parseStringPool(chunk); err != nil {
+				return nil, err
+			}
+
+		case resXMLResourceMapType:
+			for i := headerSize; i+4 <= chunkSize; i += 4 {
+				resourceIDs = append(resourceIDs, le.Uint32(chunk[i:]))
+			}
+
+		case resXMLStartElementType:
+			// The element extension (20 bytes) follows the header of the chunk.
+			if headerSize < 8 || headerSize+20 > chunkSize {
+				return nil, fmt.Errorf("Invalid element at offset %v.", offset)
+			}
+			ext := chunk[headerSize:]
+			element := &xmlElement{
+				Name:  getString(le.Uint32(ext[4:])),
+				Attrs: map[string]string{},
+			}
+
+			attrStart := int(le.Uint16(ext[8:]))
+			attrSize := int(le.Uint16(ext[10:]))
+			attrCount := int(le.Uint16(ext[12:]))
+			if attrSize < resXMLAttributeMinSize || attrStart+attrCount*attrSize > len(ext) {
+				return nil, fmt.Errorf("Invalid attributes at offset %v.", offset)
+			}
+
+			for i := 0; i < attrCount; i++ {
+				attr := ext[attrStart+i*attrSize:]
+				nameIndex := le.Uint32(attr[4:])
+				name := getString(nameIndex)
+				if int(nameIndex) < len(resourceIDs) {
+					if androidName, ok := androidAttrNames[resourceIDs[nameIndex]]; ok {
+						name = androidName
+					}
+				}
+
+				element.Attrs[name] = formatAttributeValue(attr, getString)
+			}
+
+			if len(stack) == 0 {
+				if root != nil {
+					return nil, fmt.Errorf("Multiple root elements found.")
+				}
+				root = element
+			} else {
+				parent := stack[len(stack)-1]
+				parent.Children = append(parent.Children, element)
+			}
+			stack = append(stack, element)
+
+		case resXMLEndElementType:
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("Unexpected end of element at offset %v.", offset)
+			}
+			stack = stack[:len(stack)-1]
+		}
+
+		offset += chunkSize
+	}
+
+	if root == nil {
+		return nil, fmt.Errorf("No elements found.")
+	}
+
+	return root, nil
+}
+
+// formatAttributeValue converts the typed value of the given binary XML attribute into a string.
+// The resource references cannot be resolved without the resource table, and are formatted as
+// "@0x<resource_id>".
+func formatAttributeValue(attr []byte, getString func(uint32) string) string {
+	le := binary.LittleEndian
+	rawValue := le.Uint32(attr[8:])
+	dataType := attr[15]
+	value := le.Uint32(attr[16:])
+
+	switch dataType {
+	case resValueTypeString:
+		return getString(value)
+	case resValueTypeIntDec, resValueTypeIntHex:
+		return strconv.FormatInt(int64(int32(value)), 10)
+	case resValueTypeIntBoolean:
+		return strconv.FormatBool(value != 0)
+	case resValueTypeReference:
+		return fmt.Sprintf("@0x%08x", value)
+	}
+
+	if rawValue != resNoEntry {
+		return getString(rawValue)
+	}
+	return fmt.Sprint(value)
+}
+
+// parseStringPool decodes the given string pool chunk of a binary XML document.
+func parseStringPool(chunk []byte) ([]string, error) {
+	le := binary.LittleEndian
+	if len(chunk) < resStringPoolHeaderSize {
+		return nil, fmt.Errorf("Invalid string pool.")
+	}
+
+	headerSize := int(le.Uint16(chunk[2:]))
+	count := int(le.Uint32(chunk[8:]))
+	utf8 := le.Uint32(chunk[16:])&resStringPoolUTF8Flag != 0
+	stringsStart := int(le.Uint32(chunk[20:]))
+	if headerSize+count*4 > len(chunk) || stringsStart > len(chunk) {
+		return nil, fmt.Errorf("Invalid string pool.")
+	}
+
+	result := make([]string, count)
+	for i := range result {
+		pos := stringsStart + int(le.Uint32(chunk[headerSize+i*4:]))
+		var err error
+		if utf8 {
+			result[i], err = decodeUTF8PoolString(chunk, pos)
+		} else {
+			result[i], err = decodeUTF16PoolString(chunk, pos)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// decodeUTF8PoolString decodes the UTF-8 string at the given position of the string pool. The string
+// is prefixed with its UTF-16 length and its UTF-8 length, each of which takes one or two bytes.
+func decodeUTF8PoolString(chunk []byte, pos int) (string, error) {
+	readLength := func() (int, bool) {
+		if pos >= len(chunk) {
+			return 0, false
+		}
+		length := int(chunk[pos])
+		pos++
+		if length&0x80 != 0 {
+			if pos >= len(chunk) {
+				return 0, false
+			}
+			length = (length&0x7f)<<8 | int(chunk[pos])
+			pos++
+		}
+		return length, true
+	}
+
+	if _, ok := readLength(); !ok {
+		return "", fmt.Errorf("Invalid string in the string pool.")
+	}
+	length, ok := readLength()
+	if !ok || pos+length > len(chunk) {
+		return "", fmt.Errorf("Invalid string in the string pool.")
+	}
+
+	return string(chunk[pos : pos+length]), nil
+}
+
+// decodeUTF16PoolString decodes the UTF-16 string at the given position of the string pool. The
+// string is prefixed with its length, which takes one or two 16-bit units.
+func decodeUTF16PoolString(chunk []byte, pos int) (string, error) {
+	le := binary.LittleEndian
+	if pos+2 > len(chunk) {
+		return "", fmt.Errorf("Invalid string in the string pool.")
+	}
+
+	length := int(le.Uint16(chunk[pos:]))
+	pos += 2
+	if length&0x8000 != 0 {
+		if pos+2 > len(chunk) {
+			return "", fmt.Errorf("Invalid string in the string pool.")
+		}
+		length = (length&0x7fff)<<16 | int(le.Uint16(chunk[pos:]))
+		pos += 2
+	}
+
+	if pos+length*2 > len(chunk) {
+		return "", fmt.Errorf("Invalid string in the string pool.")
+	}
+
+	units := make([]uint16, length)
+	for i := range units {
+		units[i] = le.Uint16(chunk[pos+i*2:])
+	}
+
+	return string(utf16.Decode(units)), nil
+}
+
+// isApkArgs determines whether the given command arguments are all .apk files.
+func isApkArgs(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+
+	for _, arg := range args {
+		if !strings.EqualFold(filepath.Ext(arg), ".apk") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// getPropertiesFromApks reads the given .apk files and returns the variant properties, so that the
+// .apk files can be handled in the same way as the outputs of a Gradle project. The .apk files must
+// be of the same app. The base .apk files become the variant outputs, the config splits become the
+// split outputs, and the feature splits become the feature modules.
+func getPropertiesFromApks(filenames []string) (variantProperties, error) {
+	properties := variantProperties{fromApkFiles: true}
+
+	for _, filename := range filenames {
+		path, err := filepath.Abs(filename)
+		if err != nil {
+			return variantProperties{}, err
+		}
+
+		info, err := readApkInfo(path)
+		if err != nil {
+			return variantProperties{}, err
+		}
+
+		if properties.AppID == "" {
+			properties.AppID = info.PackageName
+		} else if properties.AppID != info.PackageName {
+			return variantProperties{}, fmt.Errorf("The .apk files must be of the same app, but found both %q and %q.", properties.AppID, info.PackageName)
+		}
+
+		output := variantOutput{
+			Name:           strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)),
+			OutputFilePath: path,
+			VersionCode:    info.VersionCode,
+			Filters:        []filter{},
+		}
+
+		switch {
+		case info.SplitName == "":
+			// A base .apk with the native libraries for a single ABI only works on the devices
+			// supporting that ABI. Likewise, a base .apk compatible with a single screen density is
+			// intended for the devices with that density.
+			if len(info.Abis) == 1 {
+				output.Filters = append(output.Filters, filter{"ABI", info.Abis[0]})
+			}
+			if len(info.ScreenDensities) == 1 {
+				output.Filters = append(output.Filters, filter{"DENSITY", getDensityResourceName(info.ScreenDensities[0])})
+			}
+			properties.VariantOutputs = append(properties.VariantOutputs, output)
+
+			// The activities are read from the first base .apk.
+			if properties.Activity == "" {
+				properties.LaunchableActivities = info.LaunchableActivities
+				properties.LeanbackActivities = info.LeanbackActivities
+				if len(info.LaunchableActivities) > 0 {
+					properties.Activity = info.LaunchableActivities[0]
+				} else if len(info.LeanbackActivities) > 0 {
+					properties.Activity = info.LeanbackActivities[0]
+				}
+			}
+
+		case strings.HasPrefix(info.SplitName, "config."):
+			output.Filters = append(output.Filters, getSplitFilter(strings.TrimPrefix(info.SplitName, "config.")))
+			properties.SplitOutputs = append(properties.SplitOutputs, output)
+
+		default:
+			properties.FeatureModules = append(properties.FeatureModules, featureModule{
+				ProjectPath:    info.SplitName,
+				VariantOutputs: []variantOutput{output},
+			})
+		}
+	}
+
+	if len(properties.VariantOutputs) == 0 {
+		return variantProperties{}, fmt.Errorf("The base .apk file must be provided along with the split .apk files.")
+	}
+
+	// computeBestOutput breaks the ties by the order of the outputs, so put the more specific outputs
+	// first, so that they are preferred over the universal .apk with the same version code.
+	sort.Stable(byNumFilters(properties.VariantOutputs))
+
+	return properties, nil
+}
+
+// getPropertiesFromApkDir reads all the .apk files in the given directory, and returns the variant
+// properties in the same way as getPropertiesFromApks.
+func getPropertiesFromApkDir(dir string) (variantProperties, error) {
+	filenames, err := filepath.Glob(filepath.Join(dir, "*.apk"))
+	if err != nil {
+		return variantProperties{}, err
+	}
+	if len(filenames) == 0 {
+		return variantProperties{}, fmt.Errorf("Could not find any .apk files in the directory %q.", dir)
+	}
+	sort.Strings(filenames)
+
+	return getPropertiesFromApks(filenames)
+}
+
+// byNumFilters implements sort.Interface for sorting the variant outputs in the descending order of
+// the number of filters.
+type byNumFilters []variantOutput
+
+func (a byNumFilters) Len() int           { return len(a) }
+func (a byNumFilters) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byNumFilters) Less(i, j int) bool { return len(a[i].Filters) > len(a[j].Filters) }
+
+// getSplitFilter returns the filter of a config split, given the config part of the split name
+// (e.g., "arm64_v8a", "xxhdpi", or "fr").
+func getSplitFilter(config string) filter {
+	abi := strings.Replace(config, "_", "-", -1)
+	for _, knownAbi := range []string{"armeabi", "armeabi-v7a", "arm64-v8a", "x86", "x86_64", "mips", "mips64"} {
+		if config == knownAbi || abi == knownAbi {
+			return filter{"ABI", knownAbi}
+		}
+	}
+
+	if getDensityValue(config) != 0 || config == "anydpi" {
+		return filter{"DENSITY", config}
+	}
+
+	return filter{"LANGUAGE", config}
+}
@@ -0,0 +1,582 @@
+// Copyright 2016 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/asn1"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"unicode/utf16"
+)
+
+// testAttr is an attribute of a test binary XML element. The value is either a string, an int, or a
+// bool.
+type testAttr struct {
+	name  string
+	resID uint32
+	value interface{}
+}
+
+type testElement struct {
+	name     string
+	attrs    []testAttr
+	children []testElement
+}
+
+// encodeBinaryXML encodes the given element in the binary XML format, in the same way as aapt does.
+// The attributes with resource IDs are placed at the beginning of the string pool, so that they can
+// be mapped by the resource map chunk.
+func encodeBinaryXML(root testElement, utf8 bool) []byte {
+	le := binary.LittleEndian
+	pool := []string{}
+	resIDs := []uint32{}
+	indices := map[string]uint32{}
+
+	var collectAttrNames func(e testElement)
+	collectAttrNames = func(e testElement) {
+		for _, attr := range e.attrs {
+			if _, ok := indices[attr.name]; attr.resID != 0 && !ok {
+				indices[attr.name] = uint32(len(pool))
+				pool = append(pool, attr.name)
+				resIDs = append(resIDs, attr.resID)
+			}
+		}
+		for _, child := range e.children {
+			collectAttrNames(child)
+		}
+	}
+	collectAttrNames(root)
+
+	index := func(s string) uint32 {
+		if i, ok := indices[s]; ok {
+			return i
+		}
+		indices[s] = uint32(len(pool))
+		pool = append(pool, s)
+		return indices[s]
+	}
+
+	// Encode the element chunks first, so that all the strings are collected in the pool.
+	nodes := bytes.Buffer{}
+	var encodeElement func(e testElement)
+	encodeElement = func(e testElement) {
+		start := make([]byte, 36+20*len(e.attrs))
+		le.PutUint16(start[0:], resXMLStartElementType)
+		le.PutUint16(start[2:], 16)
+		le.PutUint32(start[4:], uint32(len(start)))
+		le.PutUint32(start[12:], resNoEntry)
+		le.PutUint32(start[16:], resNoEntry)
+		le.PutUint32(start[20:], index(e.name))
+		le.PutUint16(start[24:], 20)
+		le.PutUint16(start[26:], 20)
+		le.PutUint16(start[28:], uint16(len(e.attrs)))
+
+		for i, attr := range e.attrs {
+			a := start[36+20*i:]
+			le.PutUint32(a[0:], resNoEntry)
+			le.PutUint32(a[4:], index(attr.name))
+			le.PutUint32(a[8:], resNoEntry)
+			le.PutUint16(a[12:], 8)
+			switch v := attr.value.(type) {
+			case string:
+				le.PutUint32(a[8:], index(v))
+				a[15] = resValueTypeString
+				le.PutUint32(a[16:], index(v))
+			case int:
+				a[15] = resValueTypeIntDec
+				le.PutUint32(a[16:], uint32(v))
+			case bool:
+				a[15] = resValueTypeIntBoolean
+				if v {
+					le.PutUint32(a[16:], 0xffffffff)
+				}
+			}
+		}
+		nodes.Write(start)
+
+		for _, child := range e.children {
+			encodeElement(child)
+		}
+
+		end := make([]byte, 24)
+		le.PutUint16(end[0:], resXMLEndElementType)
+		le.PutUint16(end[2:], 16)
+		le.PutUint32(end[4:], 24)
+		le.PutUint32(end[12:], resNoEntry)
+		le.PutUint32(end[16:], resNoEntry)
+		le.PutUint32(end[20:], index(e.name))
+		nodes.Write(end)
+	}
+	encodeElement(root)
+
+	// Encode the string pool.
+	stringData := bytes.Buffer{}
+	offsets := make([]byte, 4*len(pool))
+	for i, s := range pool {
+		le.PutUint32(offsets[4*i:], uint32(stringData.Len()))
+		if utf8 {
+			stringData.Write([]byte{byte(len(utf16.Encode([]rune(s)))), byte(len(s))})
+			stringData.WriteString(s)
+			stringData.WriteByte(0)
+		} else {
+			units := utf16.Encode([]rune(s))
+			binary.Write(&stringData, le, uint16(len(units)))
+			binary.Write(&stringData, le, units)
+			binary.Write(&stringData, le, uint16(0))
+		}
+	}
+	for stringData.Len()%4 != 0 {
+		stringData.WriteByte(0)
+	}
+
+	poolHeader := make([]byte, resStringPoolHeaderSize)
+	le.PutUint16(poolHeader[0:], resStringPoolType)
+	le.PutUint16(poolHeader[2:], resStringPoolHeaderSize)
+	le.PutUint32(poolHeader[4:], uint32(len(poolHeader)+len(offsets)+stringData.Len()))
+	le.PutUint32(poolHeader[8:], uint32(len(pool)))
+	if utf8 {
+		le.PutUint32(poolHeader[16:], resStringPoolUTF8Flag)
+	}
+	le.PutUint32(poolHeader[20:], uint32(len(poolHeader)+len(offsets)))
+
+	// Encode the resource map.
+	resMap := make([]byte, 8+4*len(resIDs))
+	le.PutUint16(resMap[0:], resXMLResourceMapType)
+	le.PutUint16(resMap[2:], 8)
+	le.PutUint32(resMap[4:], uint32(len(resMap)))
+	for i, id := range resIDs {
+		le.PutUint32(resMap[8+4*i:], id)
+	}
+
+	body := bytes.Buffer{}
+	body.Write(poolHeader)
+	body.Write(offsets)
+	body.Write(stringData.Bytes())
+	body.Write(resMap)
+	body.Write(nodes.Bytes())
+
+	header := make([]byte, 8)
+	le.PutUint16(header[0:], resXMLType)
+	le.PutUint16(header[2:], 8)
+	le.PutUint32(header[4:], uint32(8+body.Len()))
+
+	return append(header, body.Bytes()...)
+}
+
+// writeTestApk writes an .apk file containing the given manifest and empty native libraries for the
+// given ABIs.
+func writeTestApk(t *testing.T, filename string, manifest testElement, abis ...string) {
+	buf := bytes.Buffer{}
+	w := zip.NewWriter(&buf)
+
+	f, err := w.Create("AndroidManifest.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(encodeBinaryXML(manifest, false))
+
+	for _, abi := range abis {
+		if _, err := w.Create("lib/" + abi + "/libnative.so"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filename, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testManifest returns a test manifest element with the given package name, version code, and split
+// name.
+func testManifest(packageName string, versionCode int, split string) testElement {
+	attrs := []testAttr{
+		{"versionCode", 0x0101021b, versionCode},
+		{"package", 0, packageName},
+	}
+	if split != "" {
+		attrs = append(attrs, testAttr{"split", 0, split})
+	}
+
+	mainAction := testElement{name: "action", attrs: []testAttr{{"name", 0x01010003, "android.intent.action.MAIN"}}}
+	category := func(name string) testElement {
+		return testElement{name: "category", attrs: []testAttr{{"name", 0x01010003, "android.intent.category." + name}}}
+	}
+
+	return testElement{
+		name:  "manifest",
+		attrs: attrs,
+		children: []testElement{
+			{name: "uses-sdk", attrs: []testAttr{{"minSdkVersion", 0x0101020c, 21}}},
+			{name: "application", children: []testElement{
+				{name: "activity", attrs: []testAttr{{"name", 0x01010003, ".DisabledActivity"}, {"enabled", 0x0101000e, false}}, children: []testElement{
+					{name: "intent-filter", children: []testElement{mainAction, category("LAUNCHER")}},
+				}},
+				{name: "activity", attrs: []testAttr{{"name", 0x01010003, ".MainActivity"}}, children: []testElement{
+					{name: "intent-filter", children: []testElement{{name: "action", attrs: []testAttr{{"name", 0x01010003, "android.intent.action.VIEW"}}}}},
+					{name: "intent-filter", children: []testElement{mainAction, category("LAUNCHER")}},
+				}},
+				{name: "activity", attrs: []testAttr{{"name", 0x01010003, "com.example.tv.TvActivity"}}, children: []testElement{
+					{name: "intent-filter", children: []testElement{mainAction, category("LEANBACK_LAUNCHER")}},
+				}},
+			}},
+		},
+	}
+}
+
+func TestParseBinaryXML(t *testing.T) {
+	root := testElement{
+		name:  "manifest",
+		attrs: []testAttr{{"package", 0, "com.example.app"}, {"versionCode", 0x0101021b, 7}},
+		children: []testElement{
+			{name: "application", attrs: []testAttr{{"debuggable", 0, true}, {"label", 0, "앱"}}},
+		},
+	}
+
+	want := &xmlElement{
+		Name:  "manifest",
+		Attrs: map[string]string{"package": "com.example.app", "versionCode": "7"},
+		Children: []*xmlElement{
+			{Name: "application", Attrs: map[string]string{"debuggable": "true", "label": "앱"}},
+		},
+	}
+
+	for _, utf8 := range []bool{false, true} {
+		got, err := parseBinaryXML(encodeBinaryXML(root, utf8))
+		if err != nil {
+			t.Fatalf("utf8=%v: %v", utf8, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("utf8=%v: unmatched results: got %v, want %v", utf8, got, want)
+		}
+	}
+
+	if _, err := parseBinaryXML([]byte("<manifest/>")); err == nil {
+		t.Fatalf("expected an error for a text XML document but succeeded.")
+	}
+}
+
+func TestParseBinaryXMLFromAapt(t *testing.T) {
+	// The binary manifest built by aapt, taken from the test data of golang.org/x/mobile/internal/binres
+	// (Copyright 2014 The Go Authors; BSD-style license).
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "manifests", "aapt_bootstrap.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := parseBinaryXML(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := newApkInfo(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := apkInfo{
+		PackageName:          "com.zentus.balloon",
+		VersionCode:          42,
+		LaunchableActivities: []string{"android.app.NativeActivity"},
+		LeanbackActivities:   []string{},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unmatched results: got %v, want %v", got, want)
+	}
+}
+
+func TestParseBinaryXMLMalformed(t *testing.T) {
+	valid := encodeBinaryXML(testElement{name: "manifest", attrs: []testAttr{{"package", 0, "com.example.app"}}}, false)
+
+	// Find the start element chunk, and corrupt its header size.
+	le := binary.LittleEndian
+	offset := int(le.Uint16(valid[2:]))
+	for le.Uint16(valid[offset:]) != resXMLStartElementType {
+		offset += int(le.Uint32(valid[offset+4:]))
+	}
+
+	for _, headerSize := range []uint16{0, 4, 0xfff0} {
+		data := append([]byte{}, valid...)
+		le.PutUint16(data[offset+2:], headerSize)
+		if _, err := parseBinaryXML(data); err == nil {
+			t.Fatalf("expected an error for the header size %v but succeeded.", headerSize)
+		}
+	}
+
+	// Truncated documents should not cause a panic.
+	for i := 8; i < len(valid); i += 7 {
+		data := append([]byte{}, valid[:i]...)
+		le.PutUint32(data[4:], uint32(i))
+		parseBinaryXML(data)
+	}
+}
+
+func TestReadApkInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "madb_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "app.apk")
+	writeTestApk(t, filename, testManifest("com.example.app", 42, ""), "x86", "arm64-v8a")
+
+	got, err := readApkInfo(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := apkInfo{
+		PackageName:          "com.example.app",
+		VersionCode:          42,
+		MinSdkVersion:        21,
+		Abis:                 []string{"arm64-v8a", "x86"},
+		LaunchableActivities: []string{"com.example.app.MainActivity"},
+		LeanbackActivities:   []string{"com.example.tv.TvActivity"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unmatched results: got %v, want %v", got, want)
+	}
+}
+
+func TestGetPropertiesFromApks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "madb_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	base := filepath.Join(dir, "base.apk")
+	splitAbi := filepath.Join(dir, "split_config.arm64_v8a.apk")
+	splitDensity := filepath.Join(dir, "split_config.xxhdpi.apk")
+	splitLanguage := filepath.Join(dir, "split_config.fr.apk")
+	feature := filepath.Join(dir, "feature.apk")
+
+	writeTestApk(t, base, testManifest("com.example.app", 3, ""))
+	writeTestApk(t, splitAbi, testManifest("com.example.app", 3, "config.arm64_v8a"), "arm64-v8a")
+	writeTestApk(t, splitDensity, testManifest("com.example.app", 3, "config.xxhdpi"))
+	writeTestApk(t, splitLanguage, testManifest("com.example.app", 3, "config.fr"))
+	writeTestApk(t, feature, testManifest("com.example.app", 3, "feature"))
+
+	got, err := getPropertiesFromApks([]string{base, splitAbi, splitDensity, splitLanguage, feature})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.AppID != "com.example.app" || got.Activity != "com.example.app.MainActivity" || !got.fromApkFiles {
+		t.Fatalf("unexpected properties: %v", got)
+	}
+	if len(got.VariantOutputs) != 1 || got.VariantOutputs[0].OutputFilePath != base || got.VariantOutputs[0].VersionCode != 3 {
+		t.Fatalf("unexpected variant outputs: %v", got.VariantOutputs)
+	}
+
+	wantFilters := []filter{{"ABI", "arm64-v8a"}, {"DENSITY", "xxhdpi"}, {"LANGUAGE", "fr"}}
+	gotFilters := []filter{}
+	for _, split := range got.SplitOutputs {
+		gotFilters = append(gotFilters, split.Filters...)
+	}
+	if !reflect.DeepEqual(gotFilters, wantFilters) {
+		t.Fatalf("unmatched split filters: got %v, want %v", gotFilters, wantFilters)
+	}
+
+	if len(got.FeatureModules) != 1 || got.FeatureModules[0].ProjectPath != "feature" {
+		t.Fatalf("unexpected feature modules: %v", got.FeatureModules)
+	}
+
+	// The .apk files of different apps cannot be mixed.
+	other := filepath.Join(dir, "other.apk")
+	writeTestApk(t, other, testManifest("com.example.other", 1, ""))
+	if _, err := getPropertiesFromApks([]string{base, other}); err == nil {
+		t.Fatalf("expected an error but succeeded.")
+	}
+
+	// The base .apk is required.
+	if _, err := getPropertiesFromApks([]string{splitAbi}); err == nil {
+		t.Fatalf("expected an error but succeeded.")
+	}
+}
+
+func TestGetPropertiesFromApkDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "madb_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Add the <compatible-screens> element for the xhdpi density split.
+	xhdpiManifest := testManifest("com.example.app", 5, "")
+	screens := testElement{name: "compatible-screens"}
+	for _, size := range []string{"small", "normal", "large", "xlarge"} {
+		screens.children = append(screens.children, testElement{name: "screen", attrs: []testAttr{
+			{"screenSize", 0x010102ca, size},
+			{"screenDensity", 0x010102cb, 320},
+		}})
+	}
+	xhdpiManifest.children = append(xhdpiManifest.children, screens)
+
+	writeTestApk(t, filepath.Join(dir, "app-universal-release.apk"), testManifest("com.example.app", 5, ""), "arm64-v8a", "x86")
+	writeTestApk(t, filepath.Join(dir, "app-arm64-v8a-release.apk"), testManifest("com.example.app", 5, ""), "arm64-v8a")
+	writeTestApk(t, filepath.Join(dir, "app-xhdpi-release.apk"), xhdpiManifest, "arm64-v8a", "x86")
+
+	props, err := getPropertiesFromApkDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		deviceDensity int
+		deviceAbis    []string
+		want          string
+	}{
+		{320, []string{"x86"}, "app-xhdpi-release"},
+		{480, []string{"arm64-v8a", "armeabi-v7a"}, "app-arm64-v8a-release"},
+		{480, []string{"x86_64", "x86"}, "app-universal-release"},
+	}
+
+	for i, test := range tests {
+		got := computeBestOutput(props.VariantOutputs, props.AbiFilters, test.deviceDensity, test.deviceAbis)
+		if got == nil || got.Name != test.want {
+			t.Fatalf("unmatched results for tests[%v]: got %v, want %v", i, got, test.want)
+		}
+	}
+
+	if _, err := getPropertiesFromApkDir(filepath.Join(dir, "missing")); err == nil {
+		t.Fatalf("expected an error but succeeded.")
+	}
+}
+
+func TestGetSignatureHash(t *testing.T) {
+	// A fake certificate, which is an empty DER-encoded sequence.
+	cert := []byte{0x30, 0x00}
+
+	signedData, err := asn1.Marshal(pkcs7SignedData{
+		Version:          1,
+		DigestAlgorithms: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true},
+		ContentInfo:      asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSequence, IsCompound: true},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: cert},
+		CRLs:             asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 1, IsCompound: true},
+		SignerInfos:      asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, err := asn1.Marshal(pkcs7ContentInfo{
+		ContentType: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2},
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signedData},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// java.util.Arrays.hashCode(new byte[] {0x30, 0x00}) == (31 + 0x30) * 31 + 0x00 == 2449
+	if got, want := getSignatureHash(block), "991"; got != want {
+		t.Fatalf("unmatched results: got %v, want %v", got, want)
+	}
+
+	if got := getSignatureHash([]byte("not a signature block")); got != "" {
+		t.Fatalf("expected an empty hash but got %v", got)
+	}
+}
+
+// lengthPrefixed concatenates the given values, and prefixes the result by its 4-byte length.
+func lengthPrefixed(values ...[]byte) []byte {
+	value := bytes.Join(values, nil)
+	result := make([]byte, 4, 4+len(value))
+	binary.LittleEndian.PutUint32(result, uint32(len(value)))
+	return append(result, value...)
+}
+
+// addSigningBlock inserts an APK Signing Block with the given signature scheme blocks right before
+// the central directory of the given zip archive.
+func addSigningBlock(t *testing.T, archive []byte, schemeBlocks map[uint32][]byte, ids ...uint32) []byte {
+	pairs := []byte{}
+	for _, id := range ids {
+		pair := make([]byte, 12)
+		binary.LittleEndian.PutUint64(pair, uint64(4+len(schemeBlocks[id])))
+		binary.LittleEndian.PutUint32(pair[8:], id)
+		pairs = append(append(pairs, pair...), schemeBlocks[id]...)
+	}
+
+	size := make([]byte, 8)
+	binary.LittleEndian.PutUint64(size, uint64(len(pairs)+24))
+	block := bytes.Join([][]byte{size, pairs, size, []byte(apkSigningBlockMagic)}, nil)
+
+	// The end of central directory record is at the end, since there is no comment.
+	eocd := len(archive) - 22
+	if binary.LittleEndian.Uint32(archive[eocd:]) != 0x06054b50 {
+		t.Fatalf("could not find the end of central directory record.")
+	}
+	cdOffset := binary.LittleEndian.Uint32(archive[eocd+16:])
+
+	result := bytes.Join([][]byte{archive[:cdOffset], block, archive[cdOffset:]}, nil)
+	binary.LittleEndian.PutUint32(result[len(result)-22+16:], cdOffset+uint32(len(block)))
+	return result
+}
+
+func TestParseSigningBlockCertificate(t *testing.T) {
+	buffer := bytes.Buffer{}
+	w := zip.NewWriter(&buffer)
+	if _, err := w.Create("classes.dex"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	archive := buffer.Bytes()
+
+	// A signer consists of the signed data (the digests, the certificates, ...), the signatures, and
+	// the public key.
+	newSchemeBlock := func(cert []byte) []byte {
+		signedData := bytes.Join([][]byte{lengthPrefixed(), lengthPrefixed(lengthPrefixed(cert)), lengthPrefixed()}, nil)
+		return lengthPrefixed(lengthPrefixed(lengthPrefixed(signedData), lengthPrefixed(), lengthPrefixed()))
+	}
+	v2Cert, v3Cert := []byte{0x30, 0x00}, []byte{0x30, 0x01, 0x00}
+	schemeBlocks := map[uint32][]byte{
+		apkSignatureSchemeV2BlockID: newSchemeBlock(v2Cert),
+		apkSignatureSchemeV3BlockID: newSchemeBlock(v3Cert),
+		0x42726577:                  make([]byte, 16), // Verity padding.
+	}
+
+	tests := []struct {
+		data []byte
+		want []byte
+	}{
+		{archive, nil},
+		{addSigningBlock(t, archive, schemeBlocks, apkSignatureSchemeV2BlockID), v2Cert},
+		{addSigningBlock(t, archive, schemeBlocks, apkSignatureSchemeV2BlockID, apkSignatureSchemeV3BlockID, 0x42726577), v3Cert},
+		{addSigningBlock(t, archive, schemeBlocks, 0x42726577), nil},
+	}
+
+	for i, test := range tests {
+		got, err := parseSigningBlockCertificate(bytes.NewReader(test.data), int64(len(test.data)))
+		if err != nil {
+			t.Fatalf("error occurred for tests[%v]: %v", i, err)
+		}
+		if !bytes.Equal(got, test.want) {
+			t.Fatalf("unmatched results for tests[%v]: got %v, want %v", i, got, test.want)
+		}
+
+		// The archive should still be readable.
+		if _, err := zip.NewReader(bytes.NewReader(test.data), int64(len(test.data))); err != nil {
+			t.Fatalf("invalid archive for tests[%v]: %v", i, err)
+		}
+	}
+
+	// A truncated signature scheme block should fail.
+	truncated := map[uint32][]byte{apkSignatureSchemeV2BlockID: lengthPrefixed([]byte{0xff, 0xff, 0xff, 0xff})}
+	data := addSigningBlock(t, archive, truncated, apkSignatureSchemeV2BlockID)
+	if _, err := parseSigningBlockCertificate(bytes.NewReader(data), int64(len(data))); err == nil {
+		t.Fatalf("expected an error but succeeded.")
+	}
+}
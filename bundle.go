@@ -0,0 +1,205 @@
+// Copyright 2016 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"v.io/x/lib/gosh"
+)
+
+// bundleDeviceSpec is the device specification used by bundletool for generating the APKs
+// targeting a particular device from an Android App Bundle.
+type bundleDeviceSpec struct {
+	SupportedAbis    []string `json:"supportedAbis"`
+	SupportedLocales []string `json:"supportedLocales"`
+	ScreenDensity    int      `json:"screenDensity"`
+	SdkVersion       int      `json:"sdkVersion"`
+}
+
+// getBundleDeviceSpec probes the given device and returns its device specification.
+func getBundleDeviceSpec(d device) (bundleDeviceSpec, error) {
+	abis, err := getSupportedAbisForDevice(d)
+	if err != nil {
+		return bundleDeviceSpec{}, err
+	}
+
+	density, err := getScreenDensityForDevice(d)
+	if err != nil {
+		return bundleDeviceSpec{}, err
+	}
+
+	props, err := getDeviceProperties(d.Serial)
+	if err != nil {
+		return bundleDeviceSpec{}, err
+	}
+
+	return newBundleDeviceSpec(abis, density, props)
+}
+
+// newBundleDeviceSpec creates a device specification from the given ABIs, the screen density, and
+// the Android system properties of a device.
+func newBundleDeviceSpec(abis []string, density int, props map[string]string) (bundleDeviceSpec, error) {
+	sdkVersion, err := strconv.Atoi(props["ro.build.version.sdk"])
+	if err != nil {
+		return bundleDeviceSpec{}, fmt.Errorf("Could not determine the SDK version of the device: %v", err)
+	}
+
+	return bundleDeviceSpec{
+		SupportedAbis:    abis,
+		SupportedLocales: getDeviceLocales(props),
+		ScreenDensity:    density,
+		SdkVersion:       sdkVersion,
+	}, nil
+}
+
+// getDeviceLocales returns the locales of a device, determined from its Android system properties.
+// The user-selected locales take precedence over the default locale of the product. Returns
+// "en-US" when no locale information is available.
+func getDeviceLocales(props map[string]string) []string {
+	for _, key := range []string{"persist.sys.locale", "ro.product.locale"} {
+		if value := props[key]; value != "" {
+			return strings.Split(value, ",")
+		}
+	}
+
+	// Older devices specify the language and the region separately.
+	if language := props["persist.sys.language"]; language != "" {
+		if country := props["persist.sys.country"]; country != "" {
+			return []string{language + "-" + country}
+		}
+		return []string{language}
+	}
+
+	return []string{"en-US"}
+}
+
+// installBundleToDevice generates the APKs targeting the given device from the app bundle using
+// bundletool, and installs them on the device all together.
+func installBundleToDevice(d device, properties variantProperties, forceInstall bool) error {
+	if properties.BundleFilePath == "" {
+		return fmt.Errorf("The Android Gradle Plugin used by this project does not support app bundles.")
+	}
+	if _, err := os.Stat(properties.BundleFilePath); err != nil {
+		return fmt.Errorf("Could not find the app bundle %q. Make sure that the bundle is built, by providing the \"-build\" flag.", properties.BundleFilePath)
+	}
+
+	// Determine whether the app should be installed on the given device.
+	if !checkInstallationForDevice(d, properties, nil, nil, forceInstall) {
+		return nil
+	}
+
+	spec, err := getBundleDeviceSpec(d)
+	if err != nil {
+		return err
+	}
+
+	sh := gosh.NewShell(nil)
+	defer sh.Cleanup()
+
+	sh.ContinueOnError = true
+
+	// Write the device specification in a temporary directory, where the APKs are generated.
+	tmpDir := sh.MakeTempDir()
+	specFile := filepath.Join(tmpDir, "device-spec.json")
+	apksFile := filepath.Join(tmpDir, "app.apks")
+	outputDir := filepath.Join(tmpDir, "apks")
+
+	bytes, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(specFile, bytes, 0644); err != nil {
+		return err
+	}
+
+	// Generate the APK set for the device, and then extract the APKs from the APK set.
+	cmd := bundletoolCmd(sh, buildApksArgs(properties.BundleFilePath, apksFile, specFile)...)
+	if err := runGoshCommandForDevice(cmd, d, false); err != nil {
+		return fmt.Errorf("Failed to generate the APKs from the app bundle: %v", err)
+	}
+
+	cmd = bundletoolCmd(sh, "extract-apks", "--apks="+apksFile, "--output-dir="+outputDir, "--device-spec="+specFile)
+	if err := runGoshCommandForDevice(cmd, d, false); err != nil {
+		return fmt.Errorf("Failed to extract the APKs from the APK set: %v", err)
+	}
+
+	apks, err := filepath.Glob(filepath.Join(outputDir, "*.apk"))
+	if err != nil {
+		return err
+	}
+	if len(apks) == 0 {
+		return fmt.Errorf("No APKs were generated from the app bundle for device %q.", d.displayName())
+	}
+	apks = sortBundleApks(apks)
+
+	// Check whether the app can be installed on the device, using the base .apk.
+	if !skipChecksFlag {
+		if err := runPreInstallChecks(d, properties.AppID, apks, spec.SupportedAbis); err != nil {
+			return err
+		}
+	}
+
+	// Install all the APKs at once.
+	return installApksToDevice(d, properties.AppID, apks)
+}
+
+// sortBundleApks sorts the APKs extracted from an APK set, placing the base .apk (i.e.,
+// "base-master.apk") first.
+func sortBundleApks(apks []string) []string {
+	sorted := append([]string{}, apks...)
+	sort.Strings(sorted)
+
+	result := []string{}
+	for _, apk := range sorted {
+		if filepath.Base(apk) == "base-master.apk" {
+			result = append([]string{apk}, result...)
+		} else {
+			result = append(result, apk)
+		}
+	}
+
+	return result
+}
+
+// buildApksArgs returns the bundletool arguments for generating the APK set of a device from the
+// given app bundle. The APKs are signed with the keystore given by the "-ks" flag, if any, so that
+// they can be installed over an app signed with the release key.
+func buildApksArgs(bundleFile, apksFile, specFile string) []string {
+	args := []string{"build-apks", "--bundle=" + bundleFile, "--output=" + apksFile, "--device-spec=" + specFile, "--overwrite"}
+	if ksFlag == "" {
+		return args
+	}
+
+	args = append(args, "--ks="+ksFlag)
+	if ksKeyAliasFlag != "" {
+		args = append(args, "--ks-key-alias="+ksKeyAliasFlag)
+	}
+	if ksPassFlag != "" {
+		args = append(args, "--ks-pass="+ksPassFlag)
+	}
+	if keyPassFlag != "" {
+		args = append(args, "--key-pass="+keyPassFlag)
+	}
+
+	return args
+}
+
+// bundletoolCmd returns a command which runs bundletool with the given arguments. When the
+// "-bundletool" flag points to a .jar file, the bundletool is run with "java -jar".
+func bundletoolCmd(sh *gosh.Shell, args ...string) *gosh.Cmd {
+	if strings.HasSuffix(bundletoolFlag, ".jar") {
+		return sh.Cmd("java", append([]string{"-jar", bundletoolFlag}, args...)...)
+	}
+
+	return sh.Cmd(bundletoolFlag, args...)
+}
@@ -0,0 +1,107 @@
+// Copyright 2016 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestNewBundleDeviceSpec(t *testing.T) {
+	abis := []string{"arm64-v8a", "armeabi-v7a"}
+
+	testCases := []struct {
+		props map[string]string
+		want  bundleDeviceSpec
+	}{
+		{
+			map[string]string{"ro.build.version.sdk": "28", "persist.sys.locale": "ko-KR"},
+			bundleDeviceSpec{abis, []string{"ko-KR"}, 420, 28},
+		},
+		{
+			map[string]string{"ro.build.version.sdk": "24", "ro.product.locale": "en-US,fr-FR"},
+			bundleDeviceSpec{abis, []string{"en-US", "fr-FR"}, 420, 24},
+		},
+		{
+			map[string]string{"ro.build.version.sdk": "19", "persist.sys.language": "ja", "persist.sys.country": "JP"},
+			bundleDeviceSpec{abis, []string{"ja-JP"}, 420, 19},
+		},
+		{
+			map[string]string{"ro.build.version.sdk": "21"},
+			bundleDeviceSpec{abis, []string{"en-US"}, 420, 21},
+		},
+	}
+
+	for i, testCase := range testCases {
+		got, err := newBundleDeviceSpec(abis, 420, testCase.props)
+		if err != nil {
+			t.Fatalf("error occurred for tests[%v]: %v", i, err)
+		}
+		if !reflect.DeepEqual(got, testCase.want) {
+			t.Fatalf("unmatched results for tests[%v]: got %v, want %v", i, got, testCase.want)
+		}
+	}
+
+	// The SDK version is required.
+	if _, err := newBundleDeviceSpec(abis, 420, map[string]string{}); err == nil {
+		t.Fatalf("expected an error but succeeded.")
+	}
+
+	// The device spec should be encoded in the format bundletool expects.
+	spec := bundleDeviceSpec{[]string{"x86"}, []string{"en-US"}, 480, 26}
+	bytes, err := json.Marshal(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"supportedAbis":["x86"],"supportedLocales":["en-US"],"screenDensity":480,"sdkVersion":26}`
+	if got := string(bytes); got != want {
+		t.Fatalf("unmatched results: got %v, want %v", got, want)
+	}
+}
+
+func TestBuildApksArgs(t *testing.T) {
+	defer func(ks, alias, ksPass, keyPass string) {
+		ksFlag, ksKeyAliasFlag, ksPassFlag, keyPassFlag = ks, alias, ksPass, keyPass
+	}(ksFlag, ksKeyAliasFlag, ksPassFlag, keyPassFlag)
+
+	testCases := []struct {
+		ks, alias, ksPass, keyPass string
+		want                       []string
+	}{
+		{
+			"", "", "", "",
+			[]string{"build-apks", "--bundle=app.aab", "--output=app.apks", "--device-spec=spec.json", "--overwrite"},
+		},
+		{
+			"release.jks", "upload", "pass:secret", "",
+			[]string{"build-apks", "--bundle=app.aab", "--output=app.apks", "--device-spec=spec.json", "--overwrite", "--ks=release.jks", "--ks-key-alias=upload", "--ks-pass=pass:secret"},
+		},
+		{
+			"release.jks", "upload", "file:ks.pass", "file:key.pass",
+			[]string{"build-apks", "--bundle=app.aab", "--output=app.apks", "--device-spec=spec.json", "--overwrite", "--ks=release.jks", "--ks-key-alias=upload", "--ks-pass=file:ks.pass", "--key-pass=file:key.pass"},
+		},
+		{
+			// The keystore options are ignored without the keystore.
+			"", "upload", "pass:secret", "",
+			[]string{"build-apks", "--bundle=app.aab", "--output=app.apks", "--device-spec=spec.json", "--overwrite"},
+		},
+	}
+
+	for i, testCase := range testCases {
+		ksFlag, ksKeyAliasFlag, ksPassFlag, keyPassFlag = testCase.ks, testCase.alias, testCase.ksPass, testCase.keyPass
+		if got := buildApksArgs("app.aab", "app.apks", "spec.json"); !reflect.DeepEqual(got, testCase.want) {
+			t.Fatalf("unmatched results for tests[%v]: got %v, want %v", i, got, testCase.want)
+		}
+	}
+}
+
+func TestSortBundleApks(t *testing.T) {
+	apks := []string{"apks/base-arm64_v8a.apk", "apks/base-master.apk", "apks/base-en.apk", "apks/feature-master.apk"}
+	want := []string{"apks/base-master.apk", "apks/base-arm64_v8a.apk", "apks/base-en.apk", "apks/feature-master.apk"}
+	if got := sortBundleApks(apks); !reflect.DeepEqual(got, want) {
+		t.Fatalf("unmatched results: got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2016 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/olekukonko/tablewriter"
+
+	"v.io/x/lib/cmdline"
+)
+
+var cmdMadbCache = &cmdline.Command{
+	Children:         []*cmdline.Command{cmdMadbCacheList, cmdMadbCacheShow, cmdMadbCacheClear, cmdMadbCachePrune},
+	Name:             "cache",
+	DontInheritFlags: true,
+	Short:            "Manage the cached variant properties",
+	Long: `
+Manages the variant properties (e.g., the application ID, the main activity name,
+and the output .apk files) extracted from the Gradle scripts and cached by the
+'madb install' and 'madb start' commands.
+
+The cached properties are re-extracted automatically when any of the Gradle
+scripts, Gradle properties, or Android manifests of the project change. These
+commands can be used for inspecting what is cached, and for cleaning up the
+cache.
+`,
+}
+
+var cmdMadbCacheList = &cmdline.Command{
+	Runner: subCommandRunnerWithFilepath{runMadbCacheList, getDefaultCacheFilePath},
+	Name:   "list",
+	Short:  "List all the cached variant properties",
+	Long: `
+Lists the project directory, module, variant, application ID, main activity
+name, and output files of all the cache entries.
+`,
+}
+
+func runMadbCacheList(env *cmdline.Env, args []string, filename string) error {
+	cache, err := readPropertyCacheMap(filename)
+	if err != nil {
+		return err
+	}
+
+	tw := tablewriter.NewWriter(os.Stdout)
+	tw.SetHeader([]string{"Project Dir", "Module", "Variant", "App ID", "Activity", "Outputs"})
+	tw.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+	tw.SetAutoFormatHeaders(false)
+	tw.SetAlignment(tablewriter.ALIGN_LEFT)
+
+	for _, entry := range sortedCacheEntries(cache) {
+		outputs := make([]string, 0, len(entry.Properties.VariantOutputs))
+		for _, output := range entry.Properties.VariantOutputs {
+			outputs = append(outputs, filepath.Base(output.OutputFilePath))
+		}
+
+		tw.Append([]string{
+			entry.Key.Dir,
+			entry.Key.Module,
+			entry.Key.Variant,
+			entry.Properties.AppID,
+			entry.Properties.Activity,
+			strings.Join(outputs, " "),
+		})
+	}
+	tw.Render()
+
+	return nil
+}
+
+var cmdMadbCacheShow = &cmdline.Command{
+	Runner: subCommandRunnerWithFilepath{runMadbCacheShow, getDefaultCacheFilePath},
+	Name:   "show",
+	Short:  "Show the details of the cached variant properties",
+	Long: `
+Shows all the cached properties of the given project in JSON format, including
+the fingerprints of the project files used for detecting stale cache entries.
+When no project directory is given, the cache entries of all the projects are
+shown.
+`,
+	ArgsName: "[<project_dir>]",
+	ArgsLong: `
+<project_dir> is the directory of a Gradle project, which was the working
+directory when 'madb install' or 'madb start' was run.
+`,
+}
+
+func runMadbCacheShow(env *cmdline.Env, args []string, filename string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("There must be at most one argument.")
+	}
+
+	cache, err := readPropertyCacheMap(filename)
+	if err != nil {
+		return err
+	}
+
+	entries := sortedCacheEntries(cache)
+	if len(args) == 1 {
+		dir, err := filepath.Abs(args[0])
+		if err != nil {
+			return err
+		}
+
+		if entries = filterCacheEntriesByDir(entries, dir); len(entries) == 0 {
+			return fmt.Errorf("No cached properties for the project %q.", dir)
+		}
+	}
+
+	bytes, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(bytes))
+	return nil
+}
+
+var cmdMadbCacheClear = &cmdline.Command{
+	Runner: subCommandRunnerWithFilepath{runMadbCacheClear, getDefaultCacheFilePath},
+	Name:   "clear",
+	Short:  "Clear the cached variant properties",
+	Long: `
+Clears the cached properties of the given project. When no project directory is
+given, the entire cache is cleared.
+`,
+	ArgsName: "[<project_dir>]",
+	ArgsLong: `
+<project_dir> is the directory of a Gradle project, which was the working
+directory when 'madb install' or 'madb start' was run.
+`,
+}
+
+func runMadbCacheClear(env *cmdline.Env, args []string, filename string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("There must be at most one argument.")
+	}
+
+	if len(args) == 0 {
+		return writePropertyCacheMap(propertyCache{}, filename)
+	}
+
+	dir, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+
+	cache, err := readPropertyCacheMap(filename)
+	if err != nil {
+		return err
+	}
+
+	entries := filterCacheEntriesByDir(sortedCacheEntries(cache), dir)
+	if len(entries) == 0 {
+		return fmt.Errorf("No cached properties for the project %q.", dir)
+	}
+
+	for _, entry := range entries {
+		delete(cache, entry.Key)
+	}
+
+	return writePropertyCacheMap(cache, filename)
+}
+
+var cmdMadbCachePrune = &cmdline.Command{
+	Runner: subCommandRunnerWithFilepath{runMadbCachePrune, getDefaultCacheFilePath},
+	Name:   "prune",
+	Short:  "Remove the cache entries of projects that no longer exist",
+	Long: `
+Removes the cached properties of the projects whose directories no longer exist.
+`,
+}
+
+func runMadbCachePrune(env *cmdline.Env, args []string, filename string) error {
+	cache, err := readPropertyCacheMap(filename)
+	if err != nil {
+		return err
+	}
+
+	removed := 0
+	for key := range cache {
+		if _, err := os.Stat(key.Dir); os.IsNotExist(err) {
+			delete(cache, key)
+			removed++
+		}
+	}
+
+	if err := writePropertyCacheMap(cache, filename); err != nil {
+		return err
+	}
+
+	fmt.Printf("Removed %v cache entries.\n", removed)
+	return nil
+}
+
+// filterCacheEntriesByDir returns the cache entries of the given project directory.
+func filterCacheEntriesByDir(entries []propertyCacheEntry, dir string) []propertyCacheEntry {
+	result := []propertyCacheEntry{}
+	for _, entry := range entries {
+		if filepath.Clean(entry.Key.Dir) == filepath.Clean(dir) {
+			result = append(result, entry)
+		}
+	}
+
+	return result
+}
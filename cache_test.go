@@ -0,0 +1,124 @@
+// Copyright 2016 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestCacheEntries writes cache entries for the given keys, with fake properties.
+func writeTestCacheEntries(t *testing.T, filename string, keys ...variantKey) {
+	cache := propertyCache{}
+	for _, key := range keys {
+		cache[key] = propertyCacheEntry{
+			Key: key,
+			Properties: variantProperties{
+				AppID:    "com.example.app",
+				Activity: "MainActivity",
+				VariantOutputs: []variantOutput{
+					{Name: "debug", OutputFilePath: "/build/outputs/apk/app-debug.apk"},
+				},
+			},
+		}
+	}
+
+	if err := writePropertyCacheMap(cache, filename); err != nil {
+		t.Fatalf("could not write the cache file: %v", err)
+	}
+}
+
+func ExampleMadbCacheList() {
+	filename := tempFilename(nil)
+	defer os.Remove(filename)
+
+	writeTestCacheEntries(nil, filename,
+		variantKey{"/projects/b", "", ""},
+		variantKey{"/projects/a", "app", "debug"},
+	)
+
+	runMadbCacheList(nil, []string{}, filename)
+
+	// Output:
+	// +-------------+--------+---------+-----------------+--------------+---------------+
+	// | Project Dir | Module | Variant | App ID          | Activity     | Outputs       |
+	// +-------------+--------+---------+-----------------+--------------+---------------+
+	// | /projects/a | app    | debug   | com.example.app | MainActivity | app-debug.apk |
+	// | /projects/b |        |         | com.example.app | MainActivity | app-debug.apk |
+	// +-------------+--------+---------+-----------------+--------------+---------------+
+}
+
+func TestMadbCacheClear(t *testing.T) {
+	filename := tempFilename(t)
+	defer os.Remove(filename)
+
+	writeTestCacheEntries(t, filename,
+		variantKey{"/projects/a", "", ""},
+		variantKey{"/projects/a", "app", "debug"},
+		variantKey{"/projects/b", "", ""},
+	)
+
+	// Clear a single project.
+	if err := runMadbCacheClear(nil, []string{"/projects/a/"}, filename); err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := readPropertyCacheMap(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache[variantKey{"/projects/b", "", ""}]; !ok || len(cache) != 1 {
+		t.Fatalf("unexpected cache entries after clearing a project: %v", cache)
+	}
+
+	// Clearing a project which is not in the cache should fail.
+	if err := runMadbCacheClear(nil, []string{"/projects/c"}, filename); err == nil {
+		t.Fatalf("expected an error but succeeded.")
+	}
+
+	// Clear everything.
+	if err := runMadbCacheClear(nil, []string{}, filename); err != nil {
+		t.Fatal(err)
+	}
+	if cache, err = readPropertyCacheMap(filename); err != nil {
+		t.Fatal(err)
+	}
+	if len(cache) != 0 {
+		t.Fatalf("unexpected cache entries after clearing all: %v", cache)
+	}
+}
+
+func TestMadbCachePrune(t *testing.T) {
+	filename := tempFilename(t)
+	defer os.Remove(filename)
+
+	existingDir, err := ioutil.TempDir("", "madb_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(existingDir)
+
+	missingDir := filepath.Join(existingDir, "missing")
+
+	writeTestCacheEntries(t, filename,
+		variantKey{existingDir, "", ""},
+		variantKey{missingDir, "", ""},
+		variantKey{missingDir, "app", "release"},
+	)
+
+	if err := runMadbCachePrune(nil, []string{}, filename); err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := readPropertyCacheMap(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache[variantKey{existingDir, "", ""}]; !ok || len(cache) != 1 {
+		t.Fatalf("unexpected cache entries after pruning: %v", cache)
+	}
+}
@@ -13,17 +13,19 @@ import (
 
 func init() {
 	initializePropertyCacheFlags(&cmdMadbClearData.Flags)
+	initializeUsersFlags(&cmdMadbClearData.Flags)
 }
 
 var cmdMadbClearData = &cmdline.Command{
-	Runner: subCommandRunner{initMadbClearData, runMadbClearDataForDevice, true},
+	Runner: subCommandRunner{initMadbClearData, forEachUser(runMadbClearDataForDevice), true},
 	Name:   "clear-data",
 	Short:  "Clear your app data from all devices",
 	Long: `
 Clears your app data from all devices.
 
 To specify which user's data should be cleared, use 'madb user set' command to set the default user
-ID for that device. (See 'madb help user' for more details.)
+ID for that device. (See 'madb help user' for more details.) To clear the data of multiple users at
+once, use the '-all-users' or '-users' flag.
 
 `,
 	ArgsName: "[<application_id>]",
@@ -35,15 +37,15 @@ ID for that device. (See 'madb help user' for more details.)
 If the application ID is not specified, madb automatically determines which app to be cleared, based
 on the build scripts found in the current working directory.
 
-If the working directory contains a Gradle Android project (i.e., has "build.gradle"), run a small
-Gradle script to extract the application ID. In this case, the extracted ID is cached, so that
-"madb clear-data" can be repeated without even running the Gradle script again. The ID can be
-re-extracted by clearing the cache by providing "-clear-cache" flag.
+If the working directory contains a Gradle Android project (i.e., has "build.gradle" or
+"build.gradle.kts"), run a small Gradle script to extract the application ID. In this case, the
+extracted ID is cached, so that "madb clear-data" can be repeated without even running the Gradle
+script again. The ID can be re-extracted by clearing the cache by providing "-clear-cache" flag.
 `,
 }
 
-func initMadbClearData(env *cmdline.Env, args []string, properties variantProperties) ([]string, error) {
-	return initMadbCommand(env, args, properties, false, false)
+func initMadbClearData(env *cmdline.Env, args []string, properties *variantProperties) ([]string, error) {
+	return initMadbCommand(env, args, *properties, false, false)
 }
 
 func runMadbClearDataForDevice(env *cmdline.Env, args []string, d device, properties variantProperties) error {
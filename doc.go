@@ -15,6 +15,8 @@ Usage:
    madb [flags] <command>
 
 The madb commands are:
+   alias       Manage command aliases
+   cache       Manage the cached variant properties
    clear-data  Clear your app data from all devices
    exec        Run the provided adb command on all devices and emulators
                concurrently
@@ -27,8 +29,10 @@ The madb commands are:
                concurrently
    start       Launch your app on all devices
    stop        Stop your app on all devices
+   tag         Manage device tags and metadata
    uninstall   Uninstall your app from all devices
    user        Manage default user settings for each device
+   variants    List the application modules, product flavors, and build variants
    version     Print the madb version number
    help        Display help for commands or topics
 
@@ -39,10 +43,11 @@ The madb flags are:
    Restrict the command to only run on emulators.
  -n=
    Comma-separated device serials, qualifiers, device indices (e.g., '@1',
-   '@2'), nicknames (set by 'madb name'), or group names (set by 'madb group').
-   A device index is specified by an '@' sign followed by the index of the
-   device in the output of 'adb devices' command, starting from 1. Command will
-   be run only on specified devices.
+   '@2'), nicknames (set by 'madb name'), group names (set by 'madb group'),
+   tags (e.g., 'tag:flaky'), or metadata (e.g., 'rack=3') (set by 'madb tag'). A
+   device index is specified by an '@' sign followed by the index of the device
+   in the output of 'adb devices' command, starting from 1. Command will be run
+   only on specified devices.
  -prefix=name
    Specify which output prefix to use. You can choose from the following
    options:
@@ -59,13 +64,144 @@ The global flags are:
  -time=false
    Dump timing information to stderr before exiting the program.
 
+Madb alias - Manage command aliases
+
+Manages command aliases, each of which runs a sequence of madb commands on the
+specified devices.
+
+Once an alias is defined, it can be invoked just like any other madb command.
+For example, after running the following command:
+
+    madb alias set fresh 'clear-data && start -force-install'
+
+running 'madb -n Tablets fresh' is equivalent to running the following commands
+one after another:
+
+    madb -n Tablets clear-data
+    madb -n Tablets start -force-install
+
+The device specifier flags (e.g., '-n', '-d', '-e') and the other global flags
+given to the alias are applied to every step. The steps are run in order on each
+device, and a device on which a step fails is excluded from the subsequent
+steps.
+
+Usage:
+   madb alias [flags] <command>
+
+The madb alias commands are:
+   set         Define a command alias
+   unset       Unset a command alias
+   list        List all the existing command aliases
+   clear-all   Clear all the existing command aliases
+
+Madb alias set - Define a command alias
+
+Defines a command alias. If the alias already exists, its definition is replaced
+with the newly provided one.
+
+Usage:
+   madb alias set [flags] <alias_name> <definition>
+
+<alias_name> is an alpha-numeric string with no special characters or spaces.
+This name must not be the name of a built-in madb command.
+
+<definition> is one or more madb commands joined by '&&'. Each command consists
+of a madb command name that runs on devices (e.g., 'clear-data', 'exec',
+'install', 'start', 'stop', 'uninstall') followed by its flags and arguments.
+The global flags such as '-n' cannot be used within the definition. The
+definition should be quoted, so that the shell does not interpret '&&'.
+
+Madb alias unset - Unset a command alias
+
+Unsets command aliases defined by the 'madb alias set' command.
+
+Usage:
+   madb alias unset [flags] <alias_name1> [<alias_name2> ...]
+
+<alias_name> is the name of an existing alias. You can specify more than one
+alias names.
+
+Madb alias list - List all the existing command aliases
+
+Lists the name and definition of all the existing command aliases.
+
+Usage:
+   madb alias list [flags]
+
+Madb alias clear-all - Clear all the existing command aliases
+
+Clears all the existing command aliases.
+
+Usage:
+   madb alias clear-all [flags]
+
+Madb cache - Manage the cached variant properties
+
+Manages the variant properties (e.g., the application ID, the main activity
+name, and the output .apk files) extracted from the Gradle scripts and cached by
+the 'madb install' and 'madb start' commands.
+
+The cached properties are re-extracted automatically when any of the Gradle
+scripts, Gradle properties, or Android manifests of the project change. These
+commands can be used for inspecting what is cached, and for cleaning up the
+cache.
+
+Usage:
+   madb cache [flags] <command>
+
+The madb cache commands are:
+   list        List all the cached variant properties
+   show        Show the details of the cached variant properties
+   clear       Clear the cached variant properties
+   prune       Remove the cache entries of projects that no longer exist
+
+Madb cache list - List all the cached variant properties
+
+Lists the project directory, module, variant, application ID, main activity
+name, and output files of all the cache entries.
+
+Usage:
+   madb cache list [flags]
+
+Madb cache show - Show the details of the cached variant properties
+
+Shows all the cached properties of the given project in JSON format, including
+the fingerprints of the project files used for detecting stale cache entries.
+When no project directory is given, the cache entries of all the projects are
+shown.
+
+Usage:
+   madb cache show [flags] [<project_dir>]
+
+<project_dir> is the directory of a Gradle project, which was the working
+directory when 'madb install' or 'madb start' was run.
+
+Madb cache clear - Clear the cached variant properties
+
+Clears the cached properties of the given project. When no project directory is
+given, the entire cache is cleared.
+
+Usage:
+   madb cache clear [flags] [<project_dir>]
+
+<project_dir> is the directory of a Gradle project, which was the working
+directory when 'madb install' or 'madb start' was run.
+
+Madb cache prune - Remove the cache entries of projects that no longer exist
+
+Removes the cached properties of the projects whose directories no longer exist.
+
+Usage:
+   madb cache prune [flags]
+
 Madb clear-data - Clear your app data from all devices
 
 Clears your app data from all devices.
 
 To specify which user's data should be cleared, use 'madb user set' command to
 set the default user ID for that device. (See 'madb help user' for more
-details.)
+details.) To clear the data of multiple users at once, use the '-all-users' or
+'-users' flag.
 
 Usage:
    madb clear-data [flags] [<application_id>]
@@ -79,12 +215,15 @@ to be cleared, based on the build scripts found in the current working
 directory.
 
 If the working directory contains a Gradle Android project (i.e., has
-"build.gradle"), run a small Gradle script to extract the application ID. In
-this case, the extracted ID is cached, so that "madb clear-data" can be repeated
-without even running the Gradle script again. The ID can be re-extracted by
-clearing the cache by providing "-clear-cache" flag.
+"build.gradle" or "build.gradle.kts"), run a small Gradle script to extract the
+application ID. In this case, the extracted ID is cached, so that "madb
+clear-data" can be repeated without even running the Gradle script again. The ID
+can be re-extracted by clearing the cache by providing "-clear-cache" flag.
 
 The madb clear-data flags are:
+ -all-users=false
+   Run the command once for each of the available users on each device, instead
+   of only for the default user. Cannot be used with the -users flag.
  -clear-cache=false
    Clear the cache and re-extract the variant properties such as the application
    ID and the main activity name. Only takes effect when no arguments are
@@ -92,11 +231,30 @@ The madb clear-data flags are:
  -module=
    Specify which application module to use, when the current directory is the
    top level Gradle project containing multiple sub-modules. When not specified,
-   the first available application module is used. Only takes effect when no
-   arguments are provided.
+   the first available application module is used. A comma-separated list of
+   modules (e.g., 'client,server'), or 'all' for all the application modules,
+   can be specified as well, in which case 'madb install' and 'madb start'
+   install the apps of all the modules, and the other commands use the first
+   module. The available modules can be listed with 'madb variants'. Only takes
+   effect when no arguments are provided.
+ -users=
+   Comma-separated user IDs (e.g., '0,10') for which the command should be run
+   on each device, instead of only for the default user. Cannot be used with the
+   -all-users flag.
  -variant=
    Specify which build variant to use. When not specified, the first available
-   build variant is used. Only takes effect when no arguments are provided.
+   build variant is used. The available variants can be listed with 'madb
+   variants'. Only takes effect when no arguments are provided.
+ -variant-map=
+   Comma-separated entries mapping the devices to different application modules
+   or build variants, in the form of '<device_specifier>=<target>' (e.g.,
+   'Tablets=tabletDebug,tag:wear=:wear'). The device specifier is any specifier
+   accepted by the -n flag. The target is either '<variant>' for a build variant
+   of the default module, ':<module>' for the default build variant of a module,
+   or ':<module>:<variant>'. The first entry matching a device is used, and the
+   devices matching none of the entries use the -module and -variant flags. Each
+   of the needed variants is extracted and built only once. Cannot be used when
+   the arguments are provided.
 
  -d=false
    Restrict the command to only run on real devices.
@@ -104,10 +262,11 @@ The madb clear-data flags are:
    Restrict the command to only run on emulators.
  -n=
    Comma-separated device serials, qualifiers, device indices (e.g., '@1',
-   '@2'), nicknames (set by 'madb name'), or group names (set by 'madb group').
-   A device index is specified by an '@' sign followed by the index of the
-   device in the output of 'adb devices' command, starting from 1. Command will
-   be run only on specified devices.
+   '@2'), nicknames (set by 'madb name'), group names (set by 'madb group'),
+   tags (e.g., 'tag:flaky'), or metadata (e.g., 'rack=3') (set by 'madb tag'). A
+   device index is specified by an '@' sign followed by the index of the device
+   in the output of 'adb devices' command, starting from 1. Command will be run
+   only on specified devices.
  -prefix=name
    Specify which output prefix to use. You can choose from the following
    options:
@@ -159,10 +318,11 @@ The madb exec flags are:
    Restrict the command to only run on emulators.
  -n=
    Comma-separated device serials, qualifiers, device indices (e.g., '@1',
-   '@2'), nicknames (set by 'madb name'), or group names (set by 'madb group').
-   A device index is specified by an '@' sign followed by the index of the
-   device in the output of 'adb devices' command, starting from 1. Command will
-   be run only on specified devices.
+   '@2'), nicknames (set by 'madb name'), group names (set by 'madb group'),
+   tags (e.g., 'tag:flaky'), or metadata (e.g., 'rack=3') (set by 'madb tag'). A
+   device index is specified by an '@' sign followed by the index of the device
+   in the output of 'adb devices' command, starting from 1. Command will be run
+   only on specified devices.
  -prefix=name
    Specify which output prefix to use. You can choose from the following
    options:
@@ -212,10 +372,11 @@ The madb extern flags are:
    Restrict the command to only run on emulators.
  -n=
    Comma-separated device serials, qualifiers, device indices (e.g., '@1',
-   '@2'), nicknames (set by 'madb name'), or group names (set by 'madb group').
-   A device index is specified by an '@' sign followed by the index of the
-   device in the output of 'adb devices' command, starting from 1. Command will
-   be run only on specified devices.
+   '@2'), nicknames (set by 'madb name'), group names (set by 'madb group'),
+   tags (e.g., 'tag:flaky'), or metadata (e.g., 'rack=3') (set by 'madb tag'). A
+   device index is specified by an '@' sign followed by the index of the device
+   in the output of 'adb devices' command, starting from 1. Command will be run
+   only on specified devices.
  -prefix=name
    Specify which output prefix to use. You can choose from the following
    options:
@@ -232,16 +393,22 @@ Manages device groups, each of which can have one or more device members. The
 device groups can be used for specifying the target devices of other madb
 commands.
 
+A device group can either be a static group with a fixed list of members (see:
+madb help group add), or a dynamic group whose members are determined by a query
+(see: madb help group define).
+
 Usage:
    madb group [flags] <command>
 
 The madb group commands are:
    add         Add members to a device group
    clear-all   Clear all the existing device groups
+   define      Define a dynamic device group with a query
    delete      Delete an existing device group
    list        List all the existing device groups
    remove      Remove members from a device group
    rename      Rename an existing device group
+   show        Show how a device group is resolved
 
 Madb group add - Add members to a device group
 
@@ -271,6 +438,53 @@ Clears all the existing device groups.
 Usage:
    madb group clear-all [flags]
 
+Madb group define - Define a dynamic device group with a query
+
+Defines a dynamic device group, whose members are determined by evaluating the
+given query against the currently connected devices whenever the group is
+referenced. If the dynamic group already exists, its query is replaced with the
+newly provided one.
+
+For example, running the following command:
+
+    madb group define Modern 'sdk>=31 & type=RealDevice'
+
+defines the 'Modern' group, which includes all the real devices running Android
+API level 31 or higher. Running 'madb -n Modern exec reboot' will then reboot
+only those devices.
+
+A query consists of one or more terms in the form of '<key><op><value>', joined
+by '&' (and) or '|' (or). '&' takes precedence over '|'. The supported operators
+are '=', '!=', '>=', '<=', '>', and '<'. The values are compared numerically
+when both sides are numbers, and as strings otherwise.
+
+The following keys can be used in a query:
+
+    type         - 'RealDevice' or 'Emulator'.
+    serial       - The device serial.
+    name         - The nickname of the device, or the serial if not set.
+    index        - The device index, starting from 1.
+    tag          - A tag set by 'madb tag'. Only '=' and '!=' are supported.
+    sdk          - The API level of the device (ro.build.version.sdk).
+    release      - The Android version of the device (ro.build.version.release).
+    abi          - The primary ABI of the device (ro.product.cpu.abi).
+    manufacturer - The manufacturer of the device (ro.product.manufacturer).
+    brand        - The brand of the device (ro.product.brand).
+
+Any metadata keys set by 'madb tag', qualifier names from 'adb devices -l'
+(e.g., 'model', 'product'), and Android system property names (e.g.,
+'ro.build.type') can also be used as keys. Terms referring to a property that
+the device does not have never match the device.
+
+Usage:
+   madb group define [flags] <group_name> <query>
+
+<group_name> is an alpha-numeric string with no special characters or spaces.
+This name must not be an existing device nickname or a static group name.
+
+<query> is the query that determines the members of the group. The query should
+be quoted, so that the shell does not interpret the special characters.
+
 Madb group delete - Delete an existing device group
 
 Deletes an existing device group.
@@ -283,7 +497,8 @@ group names.
 
 Madb group list - List all the existing device groups
 
-Lists the name and members of all the existing device groups.
+Lists the name and members of all the existing device groups. For the dynamic
+groups, the query is shown instead of the members.
 
 Usage:
    madb group list [flags]
@@ -304,7 +519,7 @@ device index (e.g., '@1', '@2'), device nickname, or another device group.
 
 Madb group rename - Rename an existing device group
 
-Renames an existing device group.
+Renames an existing device group, either static or dynamic.
 
 Usage:
    madb group rename [flags] <old_name> <new_name>
@@ -315,19 +530,128 @@ Usage:
 string with no special characters or spaces, and must not conflict with another
 existing device or group name.
 
+Madb group show - Show how a device group is resolved
+
+Shows how a device group is resolved into the currently connected devices.
+
+The members of the group are printed as a tree, where the nested groups are
+expanded in the same way as when the group is used in the '-n' flag. Each member
+is marked with the connected devices it resolves to, or one of the following:
+
+    not connected - The member is a valid device specifier, but no currently
+                    connected device matches it.
+    UNKNOWN       - The member is neither a nickname nor a group, and no
+                    currently connected device has it as its serial. This
+                    usually means that the member refers to a deleted nickname
+                    or group.
+    INVALID       - The member is not a valid device specifier.
+    CYCLE         - The member is a group that is already being expanded. Such
+                    members are ignored when the group is resolved.
+
+At the end, the list of all the devices that the group resolves to is printed.
+
+Usage:
+   madb group show [flags] <group_name>
+
+<group_name> is the name of an existing device group, either static or dynamic.
+
 Madb install - Install your app on all devices
 
 Installs your app on all devices.
 
 If the working directory contains a Gradle Android project (i.e., has
-"build.gradle"), this command will first run a small Gradle script to extract
-the variant properties, which will be used to find the best matching .apk for
-each device. These extracted properties are cached, and "madb install" can be
-repeated without running this Gradle script again. The properties can be
+"build.gradle" or "build.gradle.kts"), this command will first run a small
+Gradle script to extract the variant properties, which will be used to find the
+best matching .apk for each device. These extracted properties are cached, and
+"madb install" can be repeated without running this Gradle script again. The
+properties are re-extracted automatically when any of the Gradle scripts, Gradle
+properties, or Android manifests of the project change, and can also be
 re-extracted by clearing the cache by providing "-clear-cache" flag.
 
 Once the variant properties are extracted, the best matching .apk for each
-device will be installed in parallel.
+device will be installed in parallel. When the app has config split .apk files
+(i.e., the .apk files containing the code or the resources only for specific
+ABIs, densities, or languages) or dynamic feature modules, the splits matching
+each device and the best matching .apk of each feature module are installed
+along with the base .apk using "adb install-multiple". The .apk files of the
+feature modules are also compared with the installed app when determining
+whether the app is up to date.
+
+Note that the config split .apk files of a Gradle project are only found with
+the older Android Gradle Plugins which provide the legacy variant API. With
+Android Gradle Plugin 7 and above, only the base .apk files and the feature
+modules are installed; use the "-bundle" flag to install the config splits
+generated from the app bundle instead.
+
+When the project contains multiple application modules which should be installed
+together (e.g., a client app and a server app, or an app and its companion test
+app), a comma-separated list of modules or "all" can be given to the "-module"
+flag (e.g., "-module=client,server"). In this case, the properties of all the
+modules are extracted with a single Gradle run, all the modules are built with a
+single Gradle build, and then the app of each module is installed on each
+device. When the project has a module named "all", "-module=all" refers to that
+module instead, and all the modules must be listed explicitly.
+
+When different devices need different build variants or modules (e.g., a tablet
+variant for the tablets, and a separate module for the wear devices), the
+"-variant-map" flag can be used to map the device specifiers to the variants.
+For example, running the following command:
+
+    madb install -variant-map 'Tablets=tabletDebug,tag:wear=:wear'
+
+installs the "tabletDebug" variant on the devices in the "Tablets" group, the
+default variant of the "wear" module on the devices tagged with "wear", and the
+default variant on the other devices. The properties of each needed variant are
+extracted, and the variant is built, only once.
+
+When the "-bundle" flag is provided, the Android App Bundle (.aab) of the
+variant is built instead, and the APKs generated from the bundle for each device
+are installed in parallel. For each device, a device specification (i.e., the
+supported ABIs, the screen density, the SDK version, and the locales of the
+device) is generated, and then bundletool is used to generate the
+device-specific APKs, which are then installed with "adb install-multiple". The
+bundletool command can be specified with the "-bundletool" flag. By default,
+bundletool signs the generated APKs with the debug keystore, so a release bundle
+cannot be installed over an app signed with the release key. In that case, the
+release keystore can be given with the "-ks", "-ks-key-alias", "-ks-pass", and
+"-key-pass" flags, which are passed to bundletool as is.
+
+Before installing the app, madb checks whether the app can be installed on each
+device, so that the installation does not fail with cryptic "INSTALL_FAILED_*"
+errors. The following are checked:
+ - the minSdkVersion of the app is not higher than the API level of the device
+ - the targetSdkVersion of the app is not too low for the API level of the device
+ - the device supports at least one of the ABIs of the native libraries in the app
+ - the device has enough free space in /data
+ - the app is signed with the same key as the installed app, if any
+When any of the checks fails, the reasons and the remedies are reported for the
+device, and the installation is skipped for that device. These checks can be
+skipped with the "-skip-checks" flag.
+
+The signing certificate is read from the APK Signature Scheme v3 or v2 block of
+the .apk file, or from its v1 (JAR) signature. The checks are also performed
+when installing from the app bundle, using the base .apk generated by
+bundletool.
+
+When the "-progress" flag is specified, the progress of each device (i.e., the
+bytes pushed, the percentage, the throughput, and the phase: push,
+verify/dexopt, or done) is reported while installing the app. On a terminal, the
+progress of all the devices is shown as a multi-line status display updated in
+place, and the other output (e.g., the output of "am start") is printed above
+the display. Otherwise, the progress lines are printed whenever the phase
+changes, and periodically while pushing the .apk files. The bytes pushed are
+only tracked on the devices running API level 21 and above, where the .apk files
+are streamed to the device with an install session. Without the flag, "adb
+install" is used as is.
+
+When the installation fails, the failure code reported by adb (e.g.,
+"INSTALL_FAILED_*") is classified and explained along with the remedy. Some of
+the common failures can be resolved automatically with the following flags, in
+which case the installation is retried and the actions taken are reported for
+each device:
+ - "-on-signature-mismatch=uninstall" for INSTALL_FAILED_UPDATE_INCOMPATIBLE
+ - "-allow-downgrade" for INSTALL_FAILED_VERSION_DOWNGRADE
+ - "-allow-test-only" for INSTALL_FAILED_TEST_ONLY
 
 This command is similar to running "gradlew :<moduleName>:<variantName>Install",
 but "madb install" is more flexible: 1) you can install the app to a subset of
@@ -340,29 +664,112 @@ devices.
 
 To install your app for a specific user on a particular device, use 'madb user
 set' command to set the default user ID for that device. (See 'madb help user'
-for more details.)
-
-To install a specific .apk file to all devices, use "madb exec install
-<path_to_apk>" instead.
+for more details.) To install your app for multiple users at once, use the
+'-all-users' or '-users' flag.
+
+To install specific .apk files to all devices, provide the .apk files as the
+arguments. (See below.) To install the app from a directory of prebuilt .apk
+files (e.g., "app-arm64-v8a-release.apk" and "app-xhdpi-release.apk"), use the
+"-apk-dir" flag. In this case, the ABI and the density filters and the version
+code of each .apk are read from the .apk file itself. (i.e., the native
+libraries and the <compatible-screens> element of the manifest.) Then the best
+matching .apk for each device is installed in parallel, in the same way as the
+outputs of a Gradle project.
 
 Usage:
-   madb install [flags]
+   madb install [flags] [<apk_file> ...]
+
+<apk_file> is the path to an .apk file to be installed. When .apk files are
+provided, the app information such as the application ID and the version code is
+read directly from the .apk files, without running any Gradle scripts. Multiple
+.apk files of the same app can be provided, such as the base .apk files for
+different ABIs, the config split .apk files, and the dynamic feature .apk files.
+In this case, the best matching base .apk and the matching splits are installed
+on each device, in the same way as the outputs of a Gradle project.
 
 The madb install flags are:
+ -all-users=false
+   Run the command once for each of the available users on each device, instead
+   of only for the default user. Cannot be used with the -users flag.
+ -allow-downgrade=false
+   Retry the installation allowing the version code downgrade, when the
+   installed app has a higher version code (INSTALL_FAILED_VERSION_DOWNGRADE).
+ -allow-test-only=false
+   Retry the installation allowing the test-only app, when the app is marked as
+   test-only (INSTALL_FAILED_TEST_ONLY).
+ -apk-dir=
+   Install the app from the prebuilt .apk files in the given directory, instead
+   of building the app from the current project. The best matching .apk for each
+   device is chosen based on the ABIs and the screen densities read from the
+   .apk files. Cannot be used when the arguments are provided.
  -build=true
    Build the target app variant before installing or running the app.
+ -bundle=false
+   Build the Android App Bundle (.aab) of the target app variant, and install
+   the device-specific APKs generated from the bundle using bundletool, instead
+   of the .apk outputs.
+ -bundletool=bundletool
+   The bundletool command, or the path to the bundletool .jar file. Only used
+   when the "-bundle" flag is set.
  -clear-cache=false
    Clear the cache and re-extract the variant properties such as the application
    ID and the main activity name. Only takes effect when no arguments are
    provided.
+ -key-pass=
+   The password of the signing key, in the form of 'pass:<password>' or
+   'file:<password_file>'. Defaults to the keystore password.
+ -ks=
+   The keystore used by bundletool for signing the APKs generated from the app
+   bundle. When not specified, the APKs are signed with the debug keystore. Only
+   used when the "-bundle" flag is set.
+ -ks-key-alias=
+   The alias of the signing key in the keystore given by the "-ks" flag.
+ -ks-pass=
+   The password of the keystore given by the "-ks" flag, in the form of
+   'pass:<password>' or 'file:<password_file>'.
  -module=
    Specify which application module to use, when the current directory is the
    top level Gradle project containing multiple sub-modules. When not specified,
-   the first available application module is used. Only takes effect when no
-   arguments are provided.
+   the first available application module is used. A comma-separated list of
+   modules (e.g., 'client,server'), or 'all' for all the application modules,
+   can be specified as well, in which case 'madb install' and 'madb start'
+   install the apps of all the modules, and the other commands use the first
+   module. The available modules can be listed with 'madb variants'. Only takes
+   effect when no arguments are provided.
+ -on-signature-mismatch=fail
+   Specify what to do when the installed app is signed with a different key
+   (INSTALL_FAILED_UPDATE_INCOMPATIBLE). You can choose from the following
+   options:
+       fail      - Report the failure and skip the device.
+       uninstall - Uninstall the existing app for all users on the device, and retry the installation.
+                   Note that this removes all the data of the app.
+ -progress=false
+   Report the installation progress of each device (i.e., the bytes pushed, the
+   percentage, the throughput, and the phase). On a terminal, the progress of
+   all the devices is shown as a status display updated in place. Otherwise, the
+   progress lines are printed periodically. When this flag is not specified,
+   "adb install" is used as is.
+ -skip-checks=false
+   Skip the compatibility checks performed before installing the app (i.e., the
+   SDK versions, the ABIs, the free space, and the signature).
+ -users=
+   Comma-separated user IDs (e.g., '0,10') for which the command should be run
+   on each device, instead of only for the default user. Cannot be used with the
+   -all-users flag.
  -variant=
    Specify which build variant to use. When not specified, the first available
-   build variant is used. Only takes effect when no arguments are provided.
+   build variant is used. The available variants can be listed with 'madb
+   variants'. Only takes effect when no arguments are provided.
+ -variant-map=
+   Comma-separated entries mapping the devices to different application modules
+   or build variants, in the form of '<device_specifier>=<target>' (e.g.,
+   'Tablets=tabletDebug,tag:wear=:wear'). The device specifier is any specifier
+   accepted by the -n flag. The target is either '<variant>' for a build variant
+   of the default module, ':<module>' for the default build variant of a module,
+   or ':<module>:<variant>'. The first entry matching a device is used, and the
+   devices matching none of the entries use the -module and -variant flags. Each
+   of the needed variants is extracted and built only once. Cannot be used when
+   the arguments are provided.
 
  -d=false
    Restrict the command to only run on real devices.
@@ -370,10 +777,11 @@ The madb install flags are:
    Restrict the command to only run on emulators.
  -n=
    Comma-separated device serials, qualifiers, device indices (e.g., '@1',
-   '@2'), nicknames (set by 'madb name'), or group names (set by 'madb group').
-   A device index is specified by an '@' sign followed by the index of the
-   device in the output of 'adb devices' command, starting from 1. Command will
-   be run only on specified devices.
+   '@2'), nicknames (set by 'madb name'), group names (set by 'madb group'),
+   tags (e.g., 'tag:flaky'), or metadata (e.g., 'rack=3') (set by 'madb tag'). A
+   device index is specified by an '@' sign followed by the index of the device
+   in the output of 'adb devices' command, starting from 1. Command will be run
+   only on specified devices.
  -prefix=name
    Specify which output prefix to use. You can choose from the following
    options:
@@ -424,6 +832,19 @@ There can only be one nickname for a device serial. When the 'madb name set'
 command is invoked with a device serial with an already assigned nickname, the
 old one will be replaced with the newly provided one.
 
+When a device is connected over Wi-Fi (e.g., after running 'adb tcpip'), its
+device serial becomes the network address of the device, such as
+'192.168.0.10:5555', which can change over time. To keep the nickname attached
+to the device regardless of how it is connected, the nickname can be given to
+the hardware serial of the device instead:
+
+    madb name set -hardware-serial 192.168.0.10:5555 MyTablet
+
+which resolves the hardware serial of the currently connected device (e.g.,
+'HT4BVWV00023') and assigns the nickname to 'serialno:HT4BVWV00023'. The
+'serialno:<hardware_serial>' specifier can also be given directly, in which case
+the device does not have to be connected.
+
 Usage:
    madb name set [flags] <device_serial> <nickname>
 
@@ -431,6 +852,14 @@ Usage:
 device qualifier (e.g., 'usb:3-3.4.2') obtained from 'adb devices -l' command
 <nickname> is an alpha-numeric string with no special characters or spaces.
 
+The madb name set flags are:
+ -hardware-serial=false
+   Resolve the given device to its hardware serial number (i.e., 'ro.serialno'
+   property) and store the setting under the 'serialno:<hardware_serial>'
+   specifier, so that the setting follows the device even when its adb serial
+   changes (e.g., when connected over Wi-Fi using 'adb tcpip'). The device must
+   be currently connected.
+
 Madb name unset
 
 Unsets a nickname assigned by the 'madb name set' command. Either the device
@@ -494,10 +923,11 @@ The madb shell flags are:
    Restrict the command to only run on emulators.
  -n=
    Comma-separated device serials, qualifiers, device indices (e.g., '@1',
-   '@2'), nicknames (set by 'madb name'), or group names (set by 'madb group').
-   A device index is specified by an '@' sign followed by the index of the
-   device in the output of 'adb devices' command, starting from 1. Command will
-   be run only on specified devices.
+   '@2'), nicknames (set by 'madb name'), group names (set by 'madb group'),
+   tags (e.g., 'tag:flaky'), or metadata (e.g., 'rack=3') (set by 'madb tag'). A
+   device index is specified by an '@' sign followed by the index of the device
+   in the output of 'adb devices' command, starting from 1. Command will be run
+   only on specified devices.
  -prefix=name
    Specify which output prefix to use. You can choose from the following
    options:
@@ -518,20 +948,36 @@ After the project build is completed, this command will install the best
 matching .apk for each device, only if one or more of the following conditions
 are met:
  - the app is not found on the device
- - the installed app is outdated (determined by comparing the last update time of the
-   installed app and the last modification time of the local .apk file)
+ - the version code of the installed app is different from that of the local .apk file
+ - the installed .apk file is different from the local .apk file (determined by comparing their
+   SHA-256 hashes, including the .apk files of the dynamic feature modules), or the installed app is
+   older than the local .apk file when the hash cannot be computed on the device
  - "-force-install" flag is set
 
+The decision and its reason are reported for each device.
+
 If you would like to run the same version of the app repeatedly (e.g., for QA
 testing), you can explicitly turn off the build flag by providing "-build=false"
 to skip the build step.
 
+To install the app from its Android App Bundle (.aab), provide the "-bundle"
+flag. In this case, the bundle is built instead of the .apk files, and the APKs
+generated by bundletool for each device are installed. (See 'madb help install'
+for more details.)
+
+When the installation fails because the installed app is signed with a different
+key (e.g., a debug build installed over a release build), provide
+"-on-signature-mismatch=uninstall" flag to uninstall the existing app and retry
+the installation automatically. Similarly, "-allow-downgrade" flag allows
+installing an app with a lower version code.
+
 To run your app as a specific user on a particular device, use 'madb user set'
 command to set the default user ID for that device. (See 'madb help user' for
-more details.)
+more details.) To run your app as multiple users at once, use the '-all-users'
+or '-users' flag.
 
 Usage:
-   madb start [flags] [<application_id> <activity_name>]
+   madb start [flags] [<application_id> <activity_name> | <apk_file> ...]
 
 <application_id> is usually the package name where the activities are defined.
 (See:
@@ -545,6 +991,11 @@ com.yourcompany.yourapp.MainActivity).
 If either <application_id> or <activity_name> is provided, the other must be
 provided as well.
 
+If .apk files are provided instead, the application ID and the launcher
+activities are read directly from the manifest of the base .apk file, and the
+.apk files are installed first if the installed app is outdated. (See 'madb help
+install' for more details.)
+
 If no arguments are specified, madb automatically determines which app to
 launch, based on the build scripts found in the current working directory.
 
@@ -553,15 +1004,57 @@ launch, based on the build scripts found in the current working directory.
 serial>" for all the specified devices.
 
 2) If the working directory contains a Gradle Android project (i.e., has
-"build.gradle"), this command will run a small Gradle script to extract the
-application ID and the main activity name. In this case, the extracted IDs are
-cached, so that "madb start" can be repeated without even running the Gradle
-script again. The IDs can be re-extracted by clearing the cache by providing
-"-clear-cache" flag.
+"build.gradle" or "build.gradle.kts"), this command will run a small Gradle
+script to extract the application ID and the main activity name. In this case,
+the extracted IDs are cached, so that "madb start" can be repeated without even
+running the Gradle script again. The IDs are re-extracted automatically when any
+of the Gradle scripts, Gradle properties, or Android manifests of the project
+change, and can also be re-extracted by clearing the cache by providing
+"-clear-cache" flag. The "-variant-map" flag can be used to launch different
+build variants or modules on different devices, in the same way as "madb
+install". When multiple modules are given to the "-module" flag, the apps of all
+the modules are installed, and the app of the first module is launched.
+
+The main activity is chosen among the launcher activities (i.e., the activities
+and activity aliases with the MAIN action and the LAUNCHER category) found in
+the merged manifest of the build variant, which includes the activities
+contributed by the libraries. When there are multiple launcher activities, the
+first one is chosen unless the "-activity" flag is provided.
+
+On Android TV devices, the leanback launcher activity (i.e., the activity with
+the MAIN action and the LEANBACK_LAUNCHER category) is launched instead, if the
+app has one. A device is considered an Android TV device when it has the
+"android.software.leanback" feature, or when its "ro.build.characteristics"
+system property contains "tv".
 
 The madb start flags are:
+ -activity=
+   The launcher activity to start, when the app has more than one launcher
+   activity. Can be either a fully-qualified name or a simple name. Only takes
+   effect when no arguments are provided.
+ -all-users=false
+   Run the command once for each of the available users on each device, instead
+   of only for the default user. Cannot be used with the -users flag.
+ -allow-downgrade=false
+   Retry the installation allowing the version code downgrade, when the
+   installed app has a higher version code (INSTALL_FAILED_VERSION_DOWNGRADE).
+ -allow-test-only=false
+   Retry the installation allowing the test-only app, when the app is marked as
+   test-only (INSTALL_FAILED_TEST_ONLY).
+ -apk-dir=
+   Install the app from the prebuilt .apk files in the given directory, instead
+   of building the app from the current project. The best matching .apk for each
+   device is chosen based on the ABIs and the screen densities read from the
+   .apk files. Cannot be used when the arguments are provided.
  -build=true
    Build the target app variant before installing or running the app.
+ -bundle=false
+   Build the Android App Bundle (.aab) of the target app variant, and install
+   the device-specific APKs generated from the bundle using bundletool, instead
+   of the .apk outputs.
+ -bundletool=bundletool
+   The bundletool command, or the path to the bundletool .jar file. Only used
+   when the "-bundle" flag is set.
  -clear-cache=false
    Clear the cache and re-extract the variant properties such as the application
    ID and the main activity name. Only takes effect when no arguments are
@@ -570,14 +1063,61 @@ The madb start flags are:
    Force install the target app before starting the activity.
  -force-stop=true
    Force stop the target app before starting the activity.
+ -key-pass=
+   The password of the signing key, in the form of 'pass:<password>' or
+   'file:<password_file>'. Defaults to the keystore password.
+ -ks=
+   The keystore used by bundletool for signing the APKs generated from the app
+   bundle. When not specified, the APKs are signed with the debug keystore. Only
+   used when the "-bundle" flag is set.
+ -ks-key-alias=
+   The alias of the signing key in the keystore given by the "-ks" flag.
+ -ks-pass=
+   The password of the keystore given by the "-ks" flag, in the form of
+   'pass:<password>' or 'file:<password_file>'.
  -module=
    Specify which application module to use, when the current directory is the
    top level Gradle project containing multiple sub-modules. When not specified,
-   the first available application module is used. Only takes effect when no
-   arguments are provided.
+   the first available application module is used. A comma-separated list of
+   modules (e.g., 'client,server'), or 'all' for all the application modules,
+   can be specified as well, in which case 'madb install' and 'madb start'
+   install the apps of all the modules, and the other commands use the first
+   module. The available modules can be listed with 'madb variants'. Only takes
+   effect when no arguments are provided.
+ -on-signature-mismatch=fail
+   Specify what to do when the installed app is signed with a different key
+   (INSTALL_FAILED_UPDATE_INCOMPATIBLE). You can choose from the following
+   options:
+       fail      - Report the failure and skip the device.
+       uninstall - Uninstall the existing app for all users on the device, and retry the installation.
+                   Note that this removes all the data of the app.
+ -progress=false
+   Report the installation progress of each device (i.e., the bytes pushed, the
+   percentage, the throughput, and the phase). On a terminal, the progress of
+   all the devices is shown as a status display updated in place. Otherwise, the
+   progress lines are printed periodically. When this flag is not specified,
+   "adb install" is used as is.
+ -skip-checks=false
+   Skip the compatibility checks performed before installing the app (i.e., the
+   SDK versions, the ABIs, the free space, and the signature).
+ -users=
+   Comma-separated user IDs (e.g., '0,10') for which the command should be run
+   on each device, instead of only for the default user. Cannot be used with the
+   -all-users flag.
  -variant=
    Specify which build variant to use. When not specified, the first available
-   build variant is used. Only takes effect when no arguments are provided.
+   build variant is used. The available variants can be listed with 'madb
+   variants'. Only takes effect when no arguments are provided.
+ -variant-map=
+   Comma-separated entries mapping the devices to different application modules
+   or build variants, in the form of '<device_specifier>=<target>' (e.g.,
+   'Tablets=tabletDebug,tag:wear=:wear'). The device specifier is any specifier
+   accepted by the -n flag. The target is either '<variant>' for a build variant
+   of the default module, ':<module>' for the default build variant of a module,
+   or ':<module>:<variant>'. The first entry matching a device is used, and the
+   devices matching none of the entries use the -module and -variant flags. Each
+   of the needed variants is extracted and built only once. Cannot be used when
+   the arguments are provided.
 
  -d=false
    Restrict the command to only run on real devices.
@@ -585,10 +1125,11 @@ The madb start flags are:
    Restrict the command to only run on emulators.
  -n=
    Comma-separated device serials, qualifiers, device indices (e.g., '@1',
-   '@2'), nicknames (set by 'madb name'), or group names (set by 'madb group').
-   A device index is specified by an '@' sign followed by the index of the
-   device in the output of 'adb devices' command, starting from 1. Command will
-   be run only on specified devices.
+   '@2'), nicknames (set by 'madb name'), group names (set by 'madb group'),
+   tags (e.g., 'tag:flaky'), or metadata (e.g., 'rack=3') (set by 'madb tag'). A
+   device index is specified by an '@' sign followed by the index of the device
+   in the output of 'adb devices' command, starting from 1. Command will be run
+   only on specified devices.
  -prefix=name
    Specify which output prefix to use. You can choose from the following
    options:
@@ -605,7 +1146,8 @@ Stops your app on all devices.
 
 To stop your app for a specific user on a particular device, use 'madb user set'
 command to set the default user ID for that device. (See 'madb help user' for
-more details.)
+more details.) To stop your app for multiple users at once, use the '-all-users'
+or '-users' flag.
 
 Usage:
    madb stop [flags] [<application_id>]
@@ -622,12 +1164,15 @@ to stop, based on the build scripts found in the current working directory.
 serial>" for all the specified devices.
 
 2) If the working directory contains a Gradle Android project (i.e., has
-"build.gradle"), run a small Gradle script to extract the application ID. In
-this case, the extracted ID is cached, so that "madb stop" can be repeated
-without even running the Gradle script again. The ID can be re-extracted by
-clearing the cache by providing "-clear-cache" flag.
+"build.gradle" or "build.gradle.kts"), run a small Gradle script to extract the
+application ID. In this case, the extracted ID is cached, so that "madb stop"
+can be repeated without even running the Gradle script again. The ID can be
+re-extracted by clearing the cache by providing "-clear-cache" flag.
 
 The madb stop flags are:
+ -all-users=false
+   Run the command once for each of the available users on each device, instead
+   of only for the default user. Cannot be used with the -users flag.
  -clear-cache=false
    Clear the cache and re-extract the variant properties such as the application
    ID and the main activity name. Only takes effect when no arguments are
@@ -635,11 +1180,30 @@ The madb stop flags are:
  -module=
    Specify which application module to use, when the current directory is the
    top level Gradle project containing multiple sub-modules. When not specified,
-   the first available application module is used. Only takes effect when no
-   arguments are provided.
+   the first available application module is used. A comma-separated list of
+   modules (e.g., 'client,server'), or 'all' for all the application modules,
+   can be specified as well, in which case 'madb install' and 'madb start'
+   install the apps of all the modules, and the other commands use the first
+   module. The available modules can be listed with 'madb variants'. Only takes
+   effect when no arguments are provided.
+ -users=
+   Comma-separated user IDs (e.g., '0,10') for which the command should be run
+   on each device, instead of only for the default user. Cannot be used with the
+   -all-users flag.
  -variant=
    Specify which build variant to use. When not specified, the first available
-   build variant is used. Only takes effect when no arguments are provided.
+   build variant is used. The available variants can be listed with 'madb
+   variants'. Only takes effect when no arguments are provided.
+ -variant-map=
+   Comma-separated entries mapping the devices to different application modules
+   or build variants, in the form of '<device_specifier>=<target>' (e.g.,
+   'Tablets=tabletDebug,tag:wear=:wear'). The device specifier is any specifier
+   accepted by the -n flag. The target is either '<variant>' for a build variant
+   of the default module, ':<module>' for the default build variant of a module,
+   or ':<module>:<variant>'. The first entry matching a device is used, and the
+   devices matching none of the entries use the -module and -variant flags. Each
+   of the needed variants is extracted and built only once. Cannot be used when
+   the arguments are provided.
 
  -d=false
    Restrict the command to only run on real devices.
@@ -647,10 +1211,11 @@ The madb stop flags are:
    Restrict the command to only run on emulators.
  -n=
    Comma-separated device serials, qualifiers, device indices (e.g., '@1',
-   '@2'), nicknames (set by 'madb name'), or group names (set by 'madb group').
-   A device index is specified by an '@' sign followed by the index of the
-   device in the output of 'adb devices' command, starting from 1. Command will
-   be run only on specified devices.
+   '@2'), nicknames (set by 'madb name'), group names (set by 'madb group'),
+   tags (e.g., 'tag:flaky'), or metadata (e.g., 'rack=3') (set by 'madb tag'). A
+   device index is specified by an '@' sign followed by the index of the device
+   in the output of 'adb devices' command, starting from 1. Command will be run
+   only on specified devices.
  -prefix=name
    Specify which output prefix to use. You can choose from the following
    options:
@@ -661,31 +1226,145 @@ The madb stop flags are:
  -seq=false
    Run the command sequentially, instead of running it in parallel.
 
+Madb tag - Manage device tags and metadata
+
+Manages free-form tags and key/value metadata attached to devices.
+
+Tags and metadata can be used for keeping track of various information about the
+devices (e.g., the owner of the device, or where the device is located), and for
+selecting devices in the other madb commands. Use 'tag:<tag>' to specify all the
+devices with the given tag, and '<key>=<value>' to specify all the devices with
+the given metadata. For example, the following command:
+
+    madb -n tag:flaky,rack=3 exec reboot
+
+will reboot all the devices tagged 'flaky' and all the devices on rack 3.
+
+Usage:
+   madb tag [flags] <command>
+
+The madb tag commands are:
+   add         Add tags and metadata to the given device.
+   remove      Remove tags and metadata from the given device.
+   list        List all the existing tags and metadata.
+   clear-all   Clear all the existing tags and metadata.
+
+Madb tag add
+
+Adds tags and key/value metadata to the specified device.
+
+For example, running the following command:
+
+    madb tag add MyPhone owner=alice rack=3 flaky
+
+will attach the 'flaky' tag to the device 'MyPhone', along with the metadata
+'owner=alice' and 'rack=3'. When a metadata key already exists for the device,
+its value will be replaced with the newly provided one.
+
+The tags and metadata are stored under the device serial, even when the device
+is specified by its nickname. Provide the "-hardware-serial" flag to store them
+under the hardware serial of the device instead. (See 'madb help name set' for
+more details.)
+
+A device qualifier (e.g., 'model:Nexus_5X'), or a nickname referring to a device
+qualifier, can also be given instead of a device serial. In that case, the tags
+and metadata are stored under the qualifier, and they apply to all the devices
+with the qualifier.
+
+Usage:
+   madb tag add [flags] <device_serial | qualifier | nickname> <tag | key=value> [<tag | key=value> ...]
+
+<device_serial | qualifier | nickname> is a device serial or a qualifier
+obtained from 'adb devices -l', or a nickname set by 'madb name'. <tag> is a
+string consisting of alpha-numeric characters, '-', '.', and '_'. <key=value> is
+a metadata entry, where the key follows the same rules as the tag.
+
+The madb tag add flags are:
+ -hardware-serial=false
+   Resolve the given device to its hardware serial number (i.e., 'ro.serialno'
+   property) and store the setting under the 'serialno:<hardware_serial>'
+   specifier, so that the setting follows the device even when its adb serial
+   changes (e.g., when connected over Wi-Fi using 'adb tcpip'). The device must
+   be currently connected.
+
+Madb tag remove
+
+Removes tags and metadata from the specified device. A metadata entry is removed
+by providing its key.
+
+For example, running the following command:
+
+    madb tag remove MyPhone owner flaky
+
+will remove the 'flaky' tag and the 'owner' metadata from the device 'MyPhone'.
+
+Provide the "-hardware-serial" flag to remove the tags and metadata stored under
+the hardware serial of the device, which were added with the same flag.
+
+Usage:
+   madb tag remove [flags] <device_serial | qualifier | nickname> <tag | key> [<tag | key> ...]
+
+<device_serial | qualifier | nickname> is a device serial or a qualifier
+obtained from 'adb devices -l', or a nickname set by 'madb name'. <tag | key> is
+a tag or a metadata key previously added by 'madb tag add'.
+
+The madb tag remove flags are:
+ -hardware-serial=false
+   Resolve the given device to its hardware serial number (i.e., 'ro.serialno'
+   property) and store the setting under the 'serialno:<hardware_serial>'
+   specifier, so that the setting follows the device even when its adb serial
+   changes (e.g., when connected over Wi-Fi using 'adb tcpip'). The device must
+   be currently connected.
+
+Madb tag list
+
+Lists all the currently stored tags and metadata of devices.
+
+Usage:
+   madb tag list [flags]
+
+Madb tag clear-all
+
+Clears all the currently stored tags and metadata of devices.
+
+This command clears the tags and metadata regardless of whether the device is
+currently connected or not.
+
+Usage:
+   madb tag clear-all [flags]
+
 Madb uninstall - Uninstall your app from all devices
 
 Uninstall your app from all devices.
 
 To uninstall your app for a specific user on a particular device, use 'madb user
 set' command to set the default user ID for that device. (See 'madb help user'
-for more details.)
+for more details.) To uninstall your app for multiple users at once, use the
+'-all-users' or '-users' flag.
 
 Usage:
-   madb uninstall [flags] [<application_id>]
+   madb uninstall [flags] [<application_id> | <apk_file>]
 
 <application_id> is usually the package name where the activities are defined.
 (See:
 http://tools.android.com/tech-docs/new-build-system/applicationid-vs-packagename)
 
+<apk_file> is the path to an .apk file of the app to be uninstalled. The
+application ID is read directly from the manifest of the .apk file.
+
 If the application_id is not specified, madb automatically determines which app
 to uninstall, based on the build scripts found in the current working directory.
 
 If the working directory contains a Gradle Android project (i.e., has
-"build.gradle"), run a small Gradle script to extract the application ID. In
-this case, the extracted ID is cached, so that "madb uninstall" can be repeated
-without even running the Gradle script again. The ID can be re-extracted by
-clearing the cache by providing "-clear-cache" flag.
+"build.gradle" or "build.gradle.kts"), run a small Gradle script to extract the
+application ID. In this case, the extracted ID is cached, so that "madb
+uninstall" can be repeated without even running the Gradle script again. The ID
+can be re-extracted by clearing the cache by providing "-clear-cache" flag.
 
 The madb uninstall flags are:
+ -all-users=false
+   Run the command once for each of the available users on each device, instead
+   of only for the default user. Cannot be used with the -users flag.
  -clear-cache=false
    Clear the cache and re-extract the variant properties such as the application
    ID and the main activity name. Only takes effect when no arguments are
@@ -696,11 +1375,30 @@ The madb uninstall flags are:
  -module=
    Specify which application module to use, when the current directory is the
    top level Gradle project containing multiple sub-modules. When not specified,
-   the first available application module is used. Only takes effect when no
-   arguments are provided.
+   the first available application module is used. A comma-separated list of
+   modules (e.g., 'client,server'), or 'all' for all the application modules,
+   can be specified as well, in which case 'madb install' and 'madb start'
+   install the apps of all the modules, and the other commands use the first
+   module. The available modules can be listed with 'madb variants'. Only takes
+   effect when no arguments are provided.
+ -users=
+   Comma-separated user IDs (e.g., '0,10') for which the command should be run
+   on each device, instead of only for the default user. Cannot be used with the
+   -all-users flag.
  -variant=
    Specify which build variant to use. When not specified, the first available
-   build variant is used. Only takes effect when no arguments are provided.
+   build variant is used. The available variants can be listed with 'madb
+   variants'. Only takes effect when no arguments are provided.
+ -variant-map=
+   Comma-separated entries mapping the devices to different application modules
+   or build variants, in the form of '<device_specifier>=<target>' (e.g.,
+   'Tablets=tabletDebug,tag:wear=:wear'). The device specifier is any specifier
+   accepted by the -n flag. The target is either '<variant>' for a build variant
+   of the default module, ':<module>' for the default build variant of a module,
+   or ':<module>:<variant>'. The first entry matching a device is used, and the
+   devices matching none of the entries use the -module and -variant flags. Each
+   of the needed variants is extracted and built only once. Cannot be used when
+   the arguments are provided.
 
  -d=false
    Restrict the command to only run on real devices.
@@ -708,10 +1406,11 @@ The madb uninstall flags are:
    Restrict the command to only run on emulators.
  -n=
    Comma-separated device serials, qualifiers, device indices (e.g., '@1',
-   '@2'), nicknames (set by 'madb name'), or group names (set by 'madb group').
-   A device index is specified by an '@' sign followed by the index of the
-   device in the output of 'adb devices' command, starting from 1. Command will
-   be run only on specified devices.
+   '@2'), nicknames (set by 'madb name'), group names (set by 'madb group'),
+   tags (e.g., 'tag:flaky'), or metadata (e.g., 'rack=3') (set by 'madb tag'). A
+   device index is specified by an '@' sign followed by the index of the device
+   in the output of 'adb devices' command, starting from 1. Command will be run
+   only on specified devices.
  -prefix=name
    Specify which output prefix to use. You can choose from the following
    options:
@@ -748,69 +1447,125 @@ settings:
     madb stop
     madb uninstall
 
-For more details on how to obtain the user ID from an Android device, see 'madb
-user help set'.
+To see all the available users on the devices, use 'madb user list-available'
+command. The users and work profiles can also be created, removed, and switched
+on all the specified devices using the 'madb user create', 'madb user
+create-work-profile', 'madb user remove', and 'madb user switch' commands.
 
 Usage:
    madb user [flags] <command>
 
 The madb user commands are:
-   set         Set a default user ID to be used for the given device.
+   set         Set a default user ID to be used for the given devices.
    unset       Unset the default user ID set by the 'madb user set' command.
    list        List all the existing default user IDs.
+   list-available List all the available users on the devices.
    clear-all   Clear all the existing default user settings.
+   create      Create a new user on all devices.
+   create-work-profile Create a new work profile on all devices.
+   remove      Remove a user from all devices.
+   switch      Switch the foreground user on all devices.
+
+The madb user flags are:
+ -d=false
+   Restrict the command to only run on real devices.
+ -e=false
+   Restrict the command to only run on emulators.
+ -n=
+   Comma-separated device serials, qualifiers, device indices (e.g., '@1',
+   '@2'), nicknames (set by 'madb name'), group names (set by 'madb group'),
+   tags (e.g., 'tag:flaky'), or metadata (e.g., 'rack=3') (set by 'madb tag'). A
+   device index is specified by an '@' sign followed by the index of the device
+   in the output of 'adb devices' command, starting from 1. Command will be run
+   only on specified devices.
+ -prefix=name
+   Specify which output prefix to use. You can choose from the following
+   options:
+       name   - Display the nickname of the device. The serial number is used instead if the
+                nickname is not set for the given device.
+       serial - Display the serial number of the device.
+       none   - Do not display the output prefix.
+ -seq=false
+   Run the command sequentially, instead of running it in parallel.
 
 Madb user set
 
-Sets a default user ID to be used for the specified device, when there are
+Sets a default user ID to be used for the specified devices, when there are
 multiple user accounts on a single device.
 
-The user IDs can be obtained using the 'adb [<device_serial>] shell pm list
-users' command. Alternatively, you can use 'madb exec' if you want to specify
-the device with a nickname. For example, running the following command:
+The available users and their IDs can be obtained using the 'madb user
+list-available' command. For example, running the following command:
 
-    madb -n=MyPhone exec shell pm list users
+    madb -n=MyPhone user list-available
 
 will list the available users and their IDs on the MyPhone device. Consider the
 following example output:
 
-    [MyPhone]       Users:
-    [MyPhone]               UserInfo{0:John Doe:13} running
-    [MyPhone]               UserInfo{10:Work profile:30} running
+    +---------+---------+--------------+---------+---------+
+    | Device  | User ID | User Name    | Running | Default |
+    +---------+---------+--------------+---------+---------+
+    | MyPhone | 0       | John Doe     | yes     |         |
+    | MyPhone | 10      | Work profile | yes     |         |
+    +---------+---------+--------------+---------+---------+
 
 There are two available users, "John Doe" and "Work profile". Each user is
-assigned a "user ID", which appears on the left of the user name. In this case,
-the user ID of "John Doe" is "0", and the user ID of the "Work profile" is "10".
+assigned a "user ID". In this case, the user ID of "John Doe" is "0", and the
+user ID of the "Work profile" is "10".
 
 To use the "Work profile" as the default user when running madb commands on this
-device, run the following command:
+device, run either of the following commands:
 
     madb user set MyPhone 10
+    madb user set MyPhone "Work profile"
 
 and then madb will use "Work profile" as the default user for device "MyPhone"
 in any of the subsequence madb commands.
 
-Usage:
-   madb user set [flags] <device_serial> <user_id>
+The device can be specified in any form accepted by the '-n' flag, including
+device indices and device groups. When the specifier refers to multiple devices,
+the default user is set for all of them. When the user is specified by its name,
+the user ID is looked up on each connected device.
+
+When the device is specified by a device qualifier (e.g., 'model:Nexus_9'), or
+by a nickname referring to a qualifier, the default user ID is stored under the
+qualifier and applied to all the devices with the qualifier.
 
-<device_serial> is the unique serial number for the device, which can be
-obtained from 'adb devices'. <user_id> is one of the user IDs obtained from 'adb
-shell pm list users' command.
+If the device is connected over Wi-Fi, provide the "-hardware-serial" flag to
+store the default user ID under the hardware serial of the device, so that the
+setting is still applied when the network address of the device changes. (See
+'madb help name set' for more details.)
+
+Usage:
+   madb user set [flags] <device_specifier> <user_id | user_name>
+
+<device_specifier> can be anything that is accepted in the '-n' flag (see 'madb
+help'), such as a device serial, nickname, index, or a device group name.
+<user_id> is one of the user IDs obtained from 'madb user list-available'
+command. <user_name> is one of the user names obtained from 'madb user
+list-available' command.
+
+The madb user set flags are:
+ -hardware-serial=false
+   Resolve the given device to its hardware serial number (i.e., 'ro.serialno'
+   property) and store the setting under the 'serialno:<hardware_serial>'
+   specifier, so that the setting follows the device even when its adb serial
+   changes (e.g., when connected over Wi-Fi using 'adb tcpip'). The device must
+   be currently connected.
 
 Madb user unset
 
 Unsets the default user ID assigned by the 'madb user set' command for the
-specified device.
+specified devices.
 
-Running this command without any device specifiers will unset the default users
-only for the currently available devices and emulators, while keeping the
-default user IDs for the other devices.
+When the device specifier refers to connected devices (e.g., a device index or a
+device group), the default user IDs are unset for all the matching devices,
+whether they are stored under the device serial or the hardware serial.
 
 Usage:
-   madb user unset [flags] <device_serial>
+   madb user unset [flags] <device_specifier>
 
-<device_serial> is the unique serial number for the device, which can be
-obtained from 'adb devices'.
+<device_specifier> can be anything that is accepted in the '-n' flag (see 'madb
+help'), such as a device serial, nickname, index, or a device group name.
 
 Madb user list
 
@@ -819,6 +1574,40 @@ Lists all the currently stored default user IDs for devices.
 Usage:
    madb user list [flags]
 
+Madb user list-available
+
+Lists all the available users on the specified devices, by running 'pm list
+users' command on each device. The users currently set as the default user by
+'madb user set' are marked in the "Default" column.
+
+The device specifier flags (e.g., '-n', '-d', '-e') can be used for choosing the
+devices.
+
+Usage:
+   madb user list-available [flags]
+
+The madb user list-available flags are:
+ -d=false
+   Restrict the command to only run on real devices.
+ -e=false
+   Restrict the command to only run on emulators.
+ -n=
+   Comma-separated device serials, qualifiers, device indices (e.g., '@1',
+   '@2'), nicknames (set by 'madb name'), group names (set by 'madb group'),
+   tags (e.g., 'tag:flaky'), or metadata (e.g., 'rack=3') (set by 'madb tag'). A
+   device index is specified by an '@' sign followed by the index of the device
+   in the output of 'adb devices' command, starting from 1. Command will be run
+   only on specified devices.
+ -prefix=name
+   Specify which output prefix to use. You can choose from the following
+   options:
+       name   - Display the nickname of the device. The serial number is used instead if the
+                nickname is not set for the given device.
+       serial - Display the serial number of the device.
+       none   - Do not display the output prefix.
+ -seq=false
+   Run the command sequentially, instead of running it in parallel.
+
 Madb user clear-all
 
 Clears all the currently stored default user IDs for devices.
@@ -829,6 +1618,188 @@ currently connected or not.
 Usage:
    madb user clear-all [flags]
 
+Madb user create
+
+Creates a new user with the given name on all the specified devices, by running
+'pm create-user' command on each device.
+
+When the "-set-default" flag is provided, the created user is set as the default
+user of each device, as if 'madb user set' command is run with the created user
+ID.
+
+Usage:
+   madb user create [flags] <user_name>
+
+<user_name> is the name of the new user.
+
+The madb user create flags are:
+ -set-default=false
+   Set the created user as the default user of each device.
+
+ -d=false
+   Restrict the command to only run on real devices.
+ -e=false
+   Restrict the command to only run on emulators.
+ -n=
+   Comma-separated device serials, qualifiers, device indices (e.g., '@1',
+   '@2'), nicknames (set by 'madb name'), group names (set by 'madb group'),
+   tags (e.g., 'tag:flaky'), or metadata (e.g., 'rack=3') (set by 'madb tag'). A
+   device index is specified by an '@' sign followed by the index of the device
+   in the output of 'adb devices' command, starting from 1. Command will be run
+   only on specified devices.
+ -prefix=name
+   Specify which output prefix to use. You can choose from the following
+   options:
+       name   - Display the nickname of the device. The serial number is used instead if the
+                nickname is not set for the given device.
+       serial - Display the serial number of the device.
+       none   - Do not display the output prefix.
+ -seq=false
+   Run the command sequentially, instead of running it in parallel.
+
+Madb user create-work-profile
+
+Creates a new managed profile (i.e., work profile) on all the specified devices,
+by running 'pm create-user --profileOf <parent_user_id> --managed' command on
+each device. The parent of the work profile is the default user of each device
+set by 'madb user set', or the system user (0) when the default user is not set.
+The created work profile is started right away.
+
+Note that the created work profile does not have a profile owner. To test apps
+that require a device policy controller, install and set the profile owner app
+for the created profile separately.
+
+When the "-set-default" flag is provided, the created work profile is set as the
+default user of each device, as if 'madb user set' command is run with the
+created user ID.
+
+Usage:
+   madb user create-work-profile [flags] [<profile_name>]
+
+<profile_name> is the name of the new work profile. If not provided, "Work
+profile" is used.
+
+The madb user create-work-profile flags are:
+ -set-default=false
+   Set the created work profile as the default user of each device.
+
+ -d=false
+   Restrict the command to only run on real devices.
+ -e=false
+   Restrict the command to only run on emulators.
+ -n=
+   Comma-separated device serials, qualifiers, device indices (e.g., '@1',
+   '@2'), nicknames (set by 'madb name'), group names (set by 'madb group'),
+   tags (e.g., 'tag:flaky'), or metadata (e.g., 'rack=3') (set by 'madb tag'). A
+   device index is specified by an '@' sign followed by the index of the device
+   in the output of 'adb devices' command, starting from 1. Command will be run
+   only on specified devices.
+ -prefix=name
+   Specify which output prefix to use. You can choose from the following
+   options:
+       name   - Display the nickname of the device. The serial number is used instead if the
+                nickname is not set for the given device.
+       serial - Display the serial number of the device.
+       none   - Do not display the output prefix.
+ -seq=false
+   Run the command sequentially, instead of running it in parallel.
+
+Madb user remove
+
+Removes the given user from all the specified devices, by running 'pm
+remove-user' command on each device. When the removed user is the default user
+of a device, the default user setting of that device is unset as well.
+
+The system user (0) cannot be removed.
+
+Usage:
+   madb user remove [flags] <user_id | user_name>
+
+<user_id> is one of the user IDs obtained from 'madb user list-available'
+command. <user_name> is one of the user names obtained from 'madb user
+list-available' command.
+
+The madb user remove flags are:
+ -d=false
+   Restrict the command to only run on real devices.
+ -e=false
+   Restrict the command to only run on emulators.
+ -n=
+   Comma-separated device serials, qualifiers, device indices (e.g., '@1',
+   '@2'), nicknames (set by 'madb name'), group names (set by 'madb group'),
+   tags (e.g., 'tag:flaky'), or metadata (e.g., 'rack=3') (set by 'madb tag'). A
+   device index is specified by an '@' sign followed by the index of the device
+   in the output of 'adb devices' command, starting from 1. Command will be run
+   only on specified devices.
+ -prefix=name
+   Specify which output prefix to use. You can choose from the following
+   options:
+       name   - Display the nickname of the device. The serial number is used instead if the
+                nickname is not set for the given device.
+       serial - Display the serial number of the device.
+       none   - Do not display the output prefix.
+ -seq=false
+   Run the command sequentially, instead of running it in parallel.
+
+Madb user switch
+
+Switches the foreground user to the given user on all the specified devices, by
+running 'am switch-user' command on each device.
+
+Usage:
+   madb user switch [flags] <user_id | user_name>
+
+<user_id> is one of the user IDs obtained from 'madb user list-available'
+command. <user_name> is one of the user names obtained from 'madb user
+list-available' command.
+
+The madb user switch flags are:
+ -d=false
+   Restrict the command to only run on real devices.
+ -e=false
+   Restrict the command to only run on emulators.
+ -n=
+   Comma-separated device serials, qualifiers, device indices (e.g., '@1',
+   '@2'), nicknames (set by 'madb name'), group names (set by 'madb group'),
+   tags (e.g., 'tag:flaky'), or metadata (e.g., 'rack=3') (set by 'madb tag'). A
+   device index is specified by an '@' sign followed by the index of the device
+   in the output of 'adb devices' command, starting from 1. Command will be run
+   only on specified devices.
+ -prefix=name
+   Specify which output prefix to use. You can choose from the following
+   options:
+       name   - Display the nickname of the device. The serial number is used instead if the
+                nickname is not set for the given device.
+       serial - Display the serial number of the device.
+       none   - Do not display the output prefix.
+ -seq=false
+   Run the command sequentially, instead of running it in parallel.
+
+Madb variants - List the application modules, product flavors, and build variants
+
+Lists all the application modules of the Gradle Android project in the current
+directory, along with their product flavor dimensions and build variants. For
+each build variant, the build type, the product flavors, and the application ID
+are shown.
+
+The listed module and variant names can be given to the "-module" and the
+"-variant" flags of the other madb commands (e.g., 'madb install', 'madb
+start'). The default module and variant, which are chosen automatically when
+these flags are not specified, are marked as "(default)" in the table. In JSON
+format, they are indicated by the "Default" fields.
+
+This command runs a small Gradle script to list the variants, and the results
+are not cached.
+
+Usage:
+   madb variants [flags]
+
+The madb variants flags are:
+ -format=table
+   Specify the output format. You can choose from the following options:
+       table - Display the variants in a human-readable table.
+       json  - Print the modules and their variants in JSON format, which can be used for scripting.
+
 Madb version - Print the madb version number
 
 Prints the madb version number to the console.
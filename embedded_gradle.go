@@ -15,42 +15,202 @@ import groovy.json.*;
 
 allprojects {
 
+    // Collect the application variants using the variant API of Android Gradle Plugin 7.0 and above.
+    // The callback must be registered when the plugin is applied, before the project is evaluated.
+    project.plugins.withId('com.android.application') {
+        registerVariantCallback(project)
+    }
+
+    // The variants of the dynamic feature modules are collected as well, so that the feature .apk
+    // files can be installed along with the application.
+    project.plugins.withId('com.android.dynamic-feature') {
+        registerVariantCallback(project)
+    }
+
     // Add the extract task only to the project in the current directory.
     if (project.projectDir == gradle.startParameter.currentDir) {
-        task madbExtractVariantProperties << {
-            extract(project)
+        // NOTE: The 'task << {}' syntax cannot be used here, as it was removed in Gradle 5.0.
+        task madbExtractVariantProperties {
+            // Process the manifests of the target variants beforehand, so that the launchable
+            // activities can be read from the merged manifests.
+            dependsOn { getProcessManifestTasks(project) }
+
+            doLast {
+                extract(project)
+            }
+        }
+
+        // Lists the application modules and their build variants for 'madb variants' command.
+        task madbListVariants {
+            doLast {
+                listVariants(project)
+            }
         }
     }
 }
 
 // Main driver of the property extraction script.
 void extract(project) {
-    project = getApplicationModule(project)
-    if (project == null) {
+    def modules = getApplicationModules(project)
+    if (modules.isEmpty()) {
+        def errMsg = 'The current project is not an Android application module, '
+            + 'nor does it contain any application sub-modules. '
+            + 'Please run the madb command from an Android application project directory.'
+        throw new GradleException(errMsg)
+    }
+
+    // When multiple application modules are requested, the properties of the first module are
+    // placed at the top level, and those of the other modules are listed as the additional modules.
+    def results = modules.collect { extractModule(it) }
+    def result = results.first()
+    result.AdditionalModules = results.drop(1)
+
+    // Format the resulting map into JSON and print it.
+    def resultJson = JsonOutput.prettyPrint(JsonOutput.toJson(result))
+    printResult(project, resultJson)
+}
+
+// Lists the product flavor dimensions and the build variants of all the application modules in the
+// given project. The variants are listed in the same order as they are considered when the variant
+// is not specified, so the first variant of each module is the default one.
+void listVariants(project) {
+    def modules = ([project] + project.subprojects).findAll { isApplicationModule(it) }
+    if (modules.isEmpty()) {
         def errMsg = 'The current project is not an Android application module, '
             + 'nor does it contain any application sub-modules. '
             + 'Please run the madb command from an Android application project directory.'
         throw new GradleException(errMsg)
     }
 
-    // Get the target variant.
+    def result = modules.collect { module ->
+        def allVariants = usesVariantApi(module) ? module.ext.madbVariants : module.android.applicationVariants
+        return [
+            // The module directory relative to the current project, which can be given to the
+            // -module flag.
+            Module:           project.projectDir.toPath().relativize(module.projectDir.toPath()).toString(),
+            ProjectPath:      module.path,
+            FlavorDimensions: getFlavorDimensions(module),
+            Variants:         allVariants.collect { getVariantInfo(module, it) }
+        ]
+    }
+
+    printResult(project, JsonOutput.prettyPrint(JsonOutput.toJson(result)))
+}
+
+// Returns the product flavor dimensions of the given application module, in the order of priority.
+List getFlavorDimensions(project) {
+    // Android Gradle Plugin 7.0 and above provides the dimensions as a list in 'flavorDimensions',
+    // while the older plugins provide them in 'flavorDimensionList'.
+    try {
+        def dimensions = isPluginVersionAtLeast(project, 7)
+            ? project.android.flavorDimensions
+            : project.android.flavorDimensionList
+        return dimensions != null ? dimensions.collect { it.toString() } : []
+    } catch (all) {
+        // The very old plugins do not support the flavor dimensions.
+        return []
+    }
+}
+
+// Returns the name, the build type, the product flavors, and the application ID of the given
+// variant. The product flavors are listed in the order of the flavor dimensions.
+Map getVariantInfo(project, variant) {
+    if (usesVariantApi(project)) {
+        return [
+            Name:      variant.name,
+            BuildType: variant.buildType,
+            Flavors:   variant.productFlavors.collect { it.second },
+            AppID:     variant.applicationId.get()
+        ]
+    }
+
+    return [
+        Name:      variant.name,
+        BuildType: variant.buildType.name,
+        Flavors:   variant.productFlavors.collect { it.name },
+        AppID:     getApplicationId(project, variant)
+    ]
+}
+
+// Extracts the variant properties of the given application module.
+Map extractModule(project) {
+    // Choose the extraction strategy based on the Android Gradle Plugin version.
+    return usesVariantApi(project) ? extractUsingVariantApi(project) : extractUsingLegacyApi(project)
+}
+
+// Extracts the variant properties using the 'applicationVariants' API, which is the only available
+// API in the older versions of Android Gradle Plugin.
+Map extractUsingLegacyApi(project) {
+    // Get the target variant and its launchable activities.
     def targetVariant = getTargetVariant(project)
+    def activities = getLaunchableActivities(project, targetVariant)
 
     // Collect the variant properties in a map, so that it can be printed out as a JSON.
-    def result = [
-        ProjectPath:    project.path,
-        VariantName:    targetVariant.name,
-        CleanTask:      project.path + ":clean",
-        AssembleTask:   targetVariant.assemble.path,
-        AppID:          getApplicationId(project, targetVariant),
-        Activity:       getMainActivity(project),
-        AbiFilters:     getAbiFilters(targetVariant),
-        VariantOutputs: getVariantOutputs(targetVariant)
+    return [
+        ProjectPath:          project.path,
+        VariantName:          targetVariant.name,
+        CleanTask:            project.path + ":clean",
+        AssembleTask:         targetVariant.assemble.path,
+        AppID:                getApplicationId(project, targetVariant),
+        Activity:             getDefaultActivity(activities),
+        LaunchableActivities: activities['LAUNCHER'],
+        LeanbackActivities:   activities['LEANBACK_LAUNCHER'],
+        AbiFilters:           getAbiFilters(project, targetVariant),
+        VariantOutputs:       getVariantOutputs(project, targetVariant),
+        SplitOutputs:         getSplitOutputs(project, targetVariant),
+        FeatureModules:       getFeatureModules(project, targetVariant),
+        BundleTask:           getBundleTask(project, targetVariant),
+        BundleFilePath:       getBundleFilePath(project, targetVariant)
     ]
+}
 
-    // Format the resulting map into JSON and print it.
-    def resultJson = JsonOutput.prettyPrint(JsonOutput.toJson(result))
-    printResult(project, resultJson)
+// Extracts the variant properties using the variant API and the artifacts API of Android Gradle
+// Plugin 7.0 and above, where the application ID is obtained from the merged variant configuration.
+Map extractUsingVariantApi(project) {
+    // Get the target variant and its launchable activities.
+    def targetVariant = getTargetVariant(project)
+    def activities = getLaunchableActivities(project, targetVariant)
+
+    // Collect the variant properties in a map, so that it can be printed out as a JSON.
+    return [
+        ProjectPath:          project.path,
+        VariantName:          targetVariant.name,
+        CleanTask:            project.path + ":clean",
+        AssembleTask:         project.path + ":assemble" + targetVariant.name.capitalize(),
+        AppID:                targetVariant.applicationId.get(),
+        Activity:             getDefaultActivity(activities),
+        LaunchableActivities: activities['LAUNCHER'],
+        LeanbackActivities:   activities['LEANBACK_LAUNCHER'],
+        AbiFilters:           getVariantApiAbiFilters(project, targetVariant),
+        VariantOutputs:       getVariantApiOutputs(project, targetVariant),
+        SplitOutputs:         [],
+        FeatureModules:       getFeatureModules(project, targetVariant),
+        BundleTask:           getBundleTask(project, targetVariant),
+        BundleFilePath:       getBundleFilePath(project, targetVariant)
+    ]
+}
+
+// Returns true iff the variants of the given application module should be obtained from the
+// variant API, rather than the legacy 'applicationVariants' API.
+boolean usesVariantApi(project) {
+    return isPluginVersionAtLeast(project, 7) &&
+        project.ext.has('madbVariants') && !project.ext.madbVariants.isEmpty()
+}
+
+// Registers a callback which collects all the application variants of the given project, using the
+// variant API. The collected variants are stored in the 'madbVariants' extra property.
+void registerVariantCallback(project) {
+    project.ext.madbVariants = []
+
+    try {
+        def androidComponents = project.extensions.getByName('androidComponents')
+        androidComponents.onVariants(androidComponents.selector().all(), { variant ->
+            project.ext.madbVariants.add(variant)
+        })
+    } catch (all) {
+        // The variant API is not available in the older versions of Android Gradle Plugin.
+        // In such cases, the legacy 'applicationVariants' API is used instead.
+    }
 }
 
 // Prints the given result to the desired output stream.
@@ -72,11 +232,52 @@ void printResult(project, result) {
     }
 }
 
+// Returns the Android application modules from which the properties are extracted.
+// If the 'madbModules' property was set from the command line, the listed modules are returned. The
+// property is either a comma-separated list of the module paths relative to the given project, or
+// 'all' for all the application modules in the given project.
+// Otherwise, a single application module is returned, or an empty list if there is none.
+List getApplicationModules(project) {
+    if (!project.properties.containsKey('madbModules')) {
+        def module = getApplicationModule(project)
+        return module != null ? [module] : []
+    }
+
+    def names = project.properties['madbModules']
+    if (names == 'all') {
+        return ([project] + project.subprojects).findAll { isApplicationModule(it) }
+    }
+
+    def modules = []
+    for (def name : names.tokenize(',')) {
+        // The module is given as a directory, which is mapped to the Gradle project path assuming
+        // the default project layout.
+        def module = project.findProject(name.trim().replace('/', ':'))
+        if (module == null || !isApplicationModule(module)) {
+            throw new GradleException('Module "' + name.trim() + '" is not an Android application module.')
+        }
+        modules.add(module)
+    }
+
+    return modules
+}
+
 // Returns an Android application module from the given project.
+// The result is memoized, so that the notes are printed only once even when this is called multiple
+// times.
+Object getApplicationModule(project) {
+    if (!project.ext.has('madbApplicationModule')) {
+        project.ext.madbApplicationModule = findApplicationModule(project)
+    }
+
+    return project.ext.madbApplicationModule
+}
+
+// Finds an Android application module from the given project.
 // The given project is returned immediately, if itself is an application module.
 // Otherwise, the first available application sub-module is returned, if any.
 // Returns null if no Android application modules were found from the given project.
-Object getApplicationModule(project) {
+Object findApplicationModule(project) {
     if (isApplicationModule(project)) {
         return project
     }
@@ -90,7 +291,8 @@ Object getApplicationModule(project) {
     if (subApplicationModules.size() > 1) {
         print 'Multiple application sub-modules were detected. '
         println 'The first application module "' + result.name + '" is chosen automatically.'
-        println '(NOTE: Application module can be explicitly specified using -module=<name> flag.)'
+        println '(NOTE: Application module can be explicitly specified using -module=<name> flag.'
+        println '       Run "madb variants" to list all the application modules.)'
     }
 
     return result
@@ -101,16 +303,69 @@ boolean isApplicationModule(project) {
     return project.plugins.hasPlugin('com.android.application')
 }
 
-// Returns the target application variant for the project.
+// Returns the Android Gradle Plugin applied to the given module, which is either an application
+// module or a dynamic feature module. Returns null if neither plugin is applied.
+Object getAndroidPlugin(project) {
+    def plugin = project.plugins.findPlugin('com.android.application')
+    return plugin != null ? plugin : project.plugins.findPlugin('com.android.dynamic-feature')
+}
+
+// Returns the major version of the Android Gradle Plugin applied to the given module.
+// The version class is loaded from the class loader of the plugin, because the init script cannot
+// refer to the plugin classes directly. Returns 0 if the version cannot be determined, which is
+// only the case for the very old plugins.
+int getPluginMajorVersion(project) {
+    def plugin = getAndroidPlugin(project)
+    if (plugin == null) {
+        return 0
+    }
+
+    // The version class was moved to 'com.android.Version' in Android Gradle Plugin 3.1.
+    def classNames = ['com.android.Version', 'com.android.builder.model.Version']
+    for (def className : classNames) {
+        try {
+            def versionClass = plugin.getClass().classLoader.loadClass(className)
+            def version = versionClass.getField('ANDROID_GRADLE_PLUGIN_VERSION').get(null)
+            return version.tokenize('.-').first().toInteger()
+        } catch (all) {
+            // Try the next class name.
+        }
+    }
+
+    return 0
+}
+
+// Returns true iff the Android Gradle Plugin applied to the project is at least the given major
+// version. The result is used for choosing the right extraction strategy, since many of the internal
+// APIs used by the older plugins were removed from the newer ones.
+boolean isPluginVersionAtLeast(project, major) {
+    if (!project.ext.has('madbPluginMajorVersion')) {
+        project.ext.madbPluginMajorVersion = getPluginMajorVersion(project)
+    }
+
+    return project.ext.madbPluginMajorVersion >= major
+}
+
+// Returns the target application variant of the given application module.
+// The result is memoized, so that the notes are printed only once even when this is called multiple
+// times.
+Object getTargetVariant(project) {
+    if (!project.ext.has('madbTargetVariant')) {
+        def allVariants = usesVariantApi(project) ? project.ext.madbVariants : project.android.applicationVariants
+        project.ext.madbTargetVariant = findTargetVariant(project, allVariants)
+    }
+
+    return project.ext.madbTargetVariant
+}
+
+// Finds the target application variant among the given variants of the project.
 // If the 'madbVariant' property was explicitly set from the command line, the
 // matching variant is returned.
 // If there is no variant with the provided name, it throws an exception.
 //
 // If the 'madbVariant' property is not provided, the first available variant is
 // returned. Usually the first available variant would be 'debug'.
-Object getTargetVariant(project) {
-    def allVariants = project.android.applicationVariants
-
+Object findTargetVariant(project, allVariants) {
     if (project.properties.containsKey('madbVariant')) {
         def variantName = project.properties['madbVariant']
         def targetVariant = allVariants.find { variantName.equalsIgnoreCase(it.name) }
@@ -123,7 +378,8 @@ Object getTargetVariant(project) {
         def targetVariant = allVariants.iterator().next()
         print 'Build variant not specified. '
         println 'The first variant "' + targetVariant.name + '" is chosen automatically.'
-        println '(NOTE: Variant can be explicitly specified using -variant=<name> flag.)'
+        println '(NOTE: Variant can be explicitly specified using -variant=<name> flag.'
+        println '       Run "madb variants" to list all the build variants.)'
 
         return targetVariant
     }
@@ -131,6 +387,12 @@ Object getTargetVariant(project) {
 
 // Returns the application ID for the given variant.
 String getApplicationId(project, variant) {
+    // Android Gradle Plugin 3.0 and above provides the final application ID of the variant, which is
+    // computed from the merged flavors, the build type suffixes, and the namespace.
+    if (isPluginVersionAtLeast(project, 3)) {
+        return variant.applicationId
+    }
+
     def suffix = variant.buildType.applicationIdSuffix
     if (suffix == null) {
         suffix = ""
@@ -142,40 +404,153 @@ String getApplicationId(project, variant) {
     // See the bottom notes at:
     // http://tools.android.com/tech-docs/new-build-system/applicationid-vs-packagename
     if (appId == null) {
-        appId = getApplicationIdFromManifest(project)
+        appId = getPackageName(project)
     }
 
     return appId + suffix
 }
 
-// Returns the application ID extracted from the AndroidManifest.xml file.
-String getApplicationIdFromManifest(project) {
-    def manifestFile = getAndroidManifestLocation(project)
+// Returns the package name of the application module, which is used for resolving the relative
+// activity names. Android Gradle Plugin 7.0 and above uses the 'namespace' property in the build
+// script, while the older plugins use the 'package' attribute in the AndroidManifest.xml file.
+String getPackageName(project) {
+    if (isPluginVersionAtLeast(project, 7)) {
+        def namespace = project.android.namespace
+        if (namespace != null) {
+            return namespace
+        }
+    }
 
     // Parse the xml file and find the package name.
-    def manifest = new XmlSlurper().parse(manifestFile)
+    def manifest = new XmlSlurper().parse(getAndroidManifestLocation(project))
     return manifest.'@package'.text()
 }
 
-String getMainActivity(project) {
-    def manifestFile = getAndroidManifestLocation(project)
+// Returns the manifest processing tasks of the target variants of the application modules, which
+// produce the merged manifests. The result can be directly used as a task dependency.
+List getProcessManifestTasks(project) {
+    def tasks = []
+    for (def module : getApplicationModules(project)) {
+        def task = findProcessManifestTask(module, getTargetVariant(module))
+        if (task != null) {
+            tasks.add(task)
+        }
+    }
 
-    // Parse the xml file and find the main activity.
+    return tasks
+}
+
+// Finds the manifest processing task of the given variant. Returns null if there is no such task.
+Object findProcessManifestTask(project, variant) {
+    // The task which merges the manifests of the application module and the libraries is named
+    // 'process<Variant>MainManifest' in Android Gradle Plugin 7.0 and above.
+    def variantName = variant.name.capitalize()
+    for (def taskName : ['process' + variantName + 'Manifest', 'process' + variantName + 'MainManifest']) {
+        def task = project.tasks.findByName(taskName)
+        if (task != null) {
+            return task
+        }
+    }
+
+    return null
+}
+
+// Returns the launcher categories for which the launchable activities are collected. 'LAUNCHER' is
+// used by the phones and tablets, and 'LEANBACK_LAUNCHER' is used by the Android TV devices.
+List getLauncherCategories() {
+    return ['LAUNCHER', 'LEANBACK_LAUNCHER']
+}
+
+// Returns the fully-qualified names of all the launchable activities of the given variant, grouped
+// by the launcher categories. A launchable activity is an enabled activity or activity alias with
+// the MAIN action and a launcher category. The activities are listed in the order of their
+// appearance in the manifest. For an activity alias, the alias name is returned, as it is the name
+// used for launching the target activity.
+//
+// The activities are read from the merged manifest of the variant, so that the activities defined
+// in the variant-specific manifests and the libraries are also considered. The main source set
+// manifest is used instead when the merged manifest is not available.
+Map getLaunchableActivities(project, variant) {
+    def manifestFile = getMergedManifestLocation(project, variant)
+    if (manifestFile == null) {
+        manifestFile = getAndroidManifestLocation(project)
+    }
+
+    // Parse the xml file and find the launchable activities.
     def manifest = new XmlSlurper().parse(manifestFile)
-    def mainActivity = manifest.application.activity.find { isMainActivity(it) }
-    def name = mainActivity.'@android:name'.text()
+    def packageName = manifest.'@package'.text()
+    if (packageName.isEmpty()) {
+        packageName = getPackageName(project)
+    }
 
-    // If the activity name is using the shorthand syntax starting with a dot,
-    // make it a fully-qualified name by prepending it with the package name.
-    if (name.startsWith('.')) {
-        return manifest.'@package'.text() + name
-    } else {
-        return name
+    def result = getLauncherCategories().collectEntries { [it, []] }
+    for (def component : manifest.application.'*') {
+        if (!(component.name() in ['activity', 'activity-alias'])) {
+            continue
+        }
+        if (component.'@android:enabled'.text() == 'false') {
+            continue
+        }
+
+        // If the activity name is using the shorthand syntax starting with a dot,
+        // make it a fully-qualified name by prepending it with the package name.
+        // A name without any dots is also relative to the package name.
+        def name = component.'@android:name'.text()
+        if (name.startsWith('.')) {
+            name = packageName + name
+        } else if (!name.contains('.')) {
+            name = packageName + '.' + name
+        }
+
+        for (def category : getLauncherCategories()) {
+            if (isMainActivity(component, category) && !result[category].contains(name)) {
+                result[category].add(name)
+            }
+        }
+    }
+
+    return result
+}
+
+// Returns the default activity to be launched among the given launchable activities. The LAUNCHER
+// activities take precedence, and the LEANBACK_LAUNCHER activities are used for the TV-only apps.
+String getDefaultActivity(activities) {
+    for (def category : getLauncherCategories()) {
+        if (!activities[category].isEmpty()) {
+            return activities[category].first()
+        }
+    }
+
+    return null
+}
+
+// Returns the location of the merged "AndroidManifest.xml" file produced by the manifest processing
+// task of the given variant. Returns null if the merged manifest cannot be found.
+File getMergedManifestLocation(project, variant) {
+    def task = findProcessManifestTask(project, variant)
+    if (task == null) {
+        return null
+    }
+
+    try {
+        def candidates = []
+        for (def output : task.outputs.files.files) {
+            if (output.isDirectory()) {
+                candidates.addAll(project.fileTree(output).matching { include '**/AndroidManifest.xml' }.files)
+            } else if (output.name == 'AndroidManifest.xml' && output.exists()) {
+                candidates.add(output)
+            }
+        }
+
+        // Prefer the least nested manifest, as the other ones are the intermediate manifests
+        // written for specific purposes (e.g., for aapt or instant run).
+        return candidates.isEmpty() ? null : candidates.min { it.absolutePath.length() }
+    } catch (all) {
+        return null
     }
 }
 
-// Returns the location of the "AndroidManifest.xml" file.
-// TODO(youngseokyoon): investigate whether we can obtain the merged manifest.
+// Returns the location of the "AndroidManifest.xml" file of the main source set.
 File getAndroidManifestLocation(project) {
     try {
         return project.android.sourceSets.main.manifest.srcFile
@@ -184,12 +559,15 @@ File getAndroidManifestLocation(project) {
     }
 }
 
-// Determines whether the given activity is the main activity or not.
-boolean isMainActivity(activity) {
+// Determines whether the given activity is a launchable activity of the given launcher category.
+// An activity can have multiple intent filters, each of which can have multiple actions and
+// categories.
+boolean isMainActivity(activity, category) {
     try {
-        def intentFilter = activity.'intent-filter'
-        return  intentFilter.action.'@android:name'.text() == 'android.intent.action.MAIN' &&
-                intentFilter.category.'@android:name'.text() == 'android.intent.category.LAUNCHER'
+        return activity.'intent-filter'.any { intentFilter ->
+            intentFilter.action.any { it.'@android:name'.text() == 'android.intent.action.MAIN' } &&
+                intentFilter.category.any { it.'@android:name'.text() == 'android.intent.category.' + category }
+        }
     } catch (all) {
         return false
     }
@@ -197,26 +575,166 @@ boolean isMainActivity(activity) {
 
 // Returns the list of supported ABIs for the given variant.
 // Returns null if there are no ABI filters specified.
-Object getAbiFilters(variant) {
+Object getAbiFilters(project, variant) {
+    // The variant configuration is no longer available in Android Gradle Plugin 3.0 and above.
+    // Read the ABI filters of the NDK configuration from the merged flavor instead.
+    if (isPluginVersionAtLeast(project, 3)) {
+        def abiFilters = variant.mergedFlavor.ndkConfig.abiFilters
+        return abiFilters == null || abiFilters.isEmpty() ? null : abiFilters.toList()
+    }
+
     return variant.variantData.variantConfiguration.supportedAbis
 }
 
 // Gets the outputs and their properties of the given variant.
 // The returned object is a list of variant outputs, each of which is a map containing the
 // properties of a variant output, such as the absolute path of the .apk file, and its filters.
-Object getVariantOutputs(variant) {
+Object getVariantOutputs(project, variant) {
+    // The 'mainOutputFile' property was removed in Android Gradle Plugin 3.0, and the filters and the
+    // output file are directly available from the variant output.
+    def modern = isPluginVersionAtLeast(project, 3)
+
     def variantOutputs = []
     for (def variantOutput : variant.outputs) {
+        // The config split outputs are not standalone .apk files, and are collected separately.
+        if (isSplitOutput(variantOutput)) {
+            continue
+        }
+
+        def mainOutput = modern ? variantOutput : variantOutput.mainOutputFile
+
         def filters = []
-        for (def filter : variantOutput.mainOutputFile.filters) {
+        for (def filter : mainOutput.filters) {
             filters.add([FilterType: filter.filterType, Identifier: filter.identifier])
         }
 
         def result = [
             Name: variantOutput.name,
-            OutputFilePath: variantOutput.mainOutputFile.outputFile.absolutePath,
+            OutputFilePath: mainOutput.outputFile.absolutePath,
+            VersionCode: variantOutput.versionCode,
+            Filters: filters
+        ]
+
+        variantOutputs.add(result)
+    }
+
+    return variantOutputs
+}
+
+// Returns true iff the given variant output is a config split .apk, which only contains the code or
+// the resources for a specific ABI, density, or language, and must be installed along with the base
+// .apk. Such outputs are produced when 'generatePureSplits' is enabled in the older versions of
+// Android Gradle Plugin.
+boolean isSplitOutput(variantOutput) {
+    try {
+        return variantOutput.outputType == 'SPLIT'
+    } catch (all) {
+        return false
+    }
+}
+
+// Gets the config split outputs of the given variant. The returned object has the same structure as
+// the one returned by getVariantOutputs().
+Object getSplitOutputs(project, variant) {
+    // The output type is not available prior to Android Gradle Plugin 3.0.
+    if (!isPluginVersionAtLeast(project, 3)) {
+        return []
+    }
+
+    def splitOutputs = []
+    for (def variantOutput : variant.outputs) {
+        if (!isSplitOutput(variantOutput)) {
+            continue
+        }
+
+        def filters = []
+        for (def filter : variantOutput.filters) {
+            filters.add([FilterType: filter.filterType, Identifier: filter.identifier])
+        }
+
+        splitOutputs.add([
+            Name: variantOutput.name,
+            OutputFilePath: variantOutput.outputFile.absolutePath,
             VersionCode: variantOutput.versionCode,
             Filters: filters
+        ])
+    }
+
+    return splitOutputs
+}
+
+// Gets the dynamic feature modules of the given application module, along with the outputs of their
+// variants matching the given application variant. Each feature module is a map containing the
+// project path, the assemble task, and the variant outputs of the module. The feature modules which
+// do not have the matching variant are skipped.
+Object getFeatureModules(project, variant) {
+    def featurePaths
+    try {
+        featurePaths = project.android.dynamicFeatures
+    } catch (all) {
+        // Dynamic feature modules are not supported prior to Android Gradle Plugin 3.2.
+        return []
+    }
+
+    def featureModules = []
+    for (def featurePath : featurePaths) {
+        def feature = project.rootProject.findProject(featurePath)
+        if (feature == null) {
+            continue
+        }
+
+        // The variants of a feature module have the same names as those of the application module.
+        def allVariants = usesVariantApi(feature) ? feature.ext.madbVariants : feature.android.applicationVariants
+        def featureVariant = allVariants.find { it.name == variant.name }
+        if (featureVariant == null) {
+            continue
+        }
+
+        featureModules.add([
+            ProjectPath: feature.path,
+            AssembleTask: feature.path + ':assemble' + featureVariant.name.capitalize(),
+            VariantOutputs: usesVariantApi(feature)
+                ? getVariantApiOutputs(feature, featureVariant)
+                : getVariantOutputs(feature, featureVariant)
+        ])
+    }
+
+    return featureModules
+}
+
+// Returns the list of supported ABIs for the given variant, using the variant API.
+// The ABI filters of the NDK configuration are collected from the default config and the product
+// flavors of the variant. Returns null if there are no ABI filters specified.
+Object getVariantApiAbiFilters(project, variant) {
+    def abiFilters = new LinkedHashSet()
+    abiFilters.addAll(project.android.defaultConfig.ndk.abiFilters)
+
+    // The product flavors are given as a list of (dimension, flavor name) pairs.
+    for (def flavor : variant.productFlavors) {
+        abiFilters.addAll(project.android.productFlavors.getByName(flavor.second).ndk.abiFilters)
+    }
+
+    return abiFilters.isEmpty() ? null : abiFilters.toList()
+}
+
+// Gets the outputs and their properties of the given variant, using the variant API and the
+// artifacts API. The returned object has the same structure as the one returned by
+// getVariantOutputs().
+Object getVariantApiOutputs(project, variant) {
+    def apkDir = getApkDirectory(project, variant)
+
+    def variantOutputs = []
+    for (def variantOutput : variant.outputs) {
+        def filters = []
+        for (def filter : variantOutput.filters) {
+            filters.add([FilterType: filter.filterType.name(), Identifier: filter.identifier])
+        }
+
+        def result = [
+            Name: variant.name,
+            OutputFilePath: new File(apkDir, getOutputFileName(project, variant, variantOutput)).absolutePath,
+            VersionCode: variantOutput.versionCode.getOrElse(0),
+            Filters: filters
         ]
 
         variantOutputs.add(result)
@@ -224,4 +742,80 @@ Object getVariantOutputs(variant) {
 
     return variantOutputs
 }
+
+// Returns the directory where the .apk files of the given variant are written.
+// The location is obtained from the artifacts API, and falls back to the default location when the
+// artifacts API is not accessible.
+File getApkDirectory(project, variant) {
+    try {
+        return variant.artifacts.get(getSingleArtifact(project, 'APK')).get().asFile
+    } catch (all) {
+        def flavorDir = variant.flavorName ? variant.flavorName + '/' : ''
+        return new File(project.buildDir, 'outputs/apk/' + flavorDir + variant.buildType)
+    }
+}
+
+// Returns the .apk file name of the given variant output.
+// The 'outputFileName' property is not a part of the public variant API, so the default file name
+// is constructed when the property is not accessible.
+String getOutputFileName(project, variant, variantOutput) {
+    try {
+        return variantOutput.outputFileName.get()
+    } catch (all) {
+        def segments = [project.name]
+        segments.addAll(variant.productFlavors.collect { it.second })
+        segments.addAll(variantOutput.filters.collect { it.identifier })
+        segments.add(variant.buildType)
+        return segments.join('-') + '.apk'
+    }
+}
+
+// Returns the artifact type object with the given name (e.g., 'APK', 'BUNDLE') defined in the
+// artifacts API. The class is loaded from the class loader of the plugin, because the init script
+// cannot refer to the plugin classes directly.
+Object getSingleArtifact(project, name) {
+    def plugin = getAndroidPlugin(project)
+    def artifactClass = plugin.getClass().classLoader.loadClass('com.android.build.api.artifact.SingleArtifact$' + name)
+    return artifactClass.getField('INSTANCE').get(null)
+}
+
+// Returns the base name of the given variant, which consists of the product flavor names and the
+// build type name joined by dashes (e.g., 'lite-debug'). This is used in the default output file
+// names.
+String getVariantBaseName(project, variant) {
+    if (usesVariantApi(project)) {
+        def segments = variant.productFlavors.collect { it.second }
+        segments.add(variant.buildType)
+        return segments.join('-')
+    }
+
+    return variant.baseName
+}
+
+// Returns the path of the task which builds the Android App Bundle (.aab) of the given variant.
+// Returns null if the task is not found, which is the case for Android Gradle Plugin prior to 3.2.
+String getBundleTask(project, variant) {
+    def task = project.tasks.findByName('bundle' + variant.name.capitalize())
+    return task != null ? task.path : null
+}
+
+// Returns the absolute path of the Android App Bundle (.aab) file of the given variant. The location
+// is obtained from the artifacts API if available, and falls back to the default location.
+// Returns null if the app bundles are not supported.
+String getBundleFilePath(project, variant) {
+    if (getBundleTask(project, variant) == null) {
+        return null
+    }
+
+    if (usesVariantApi(project)) {
+        try {
+            return variant.artifacts.get(getSingleArtifact(project, 'BUNDLE')).get().asFile.absolutePath
+        } catch (all) {
+            // Fall back to the default location.
+        }
+    }
+
+    def fileName = project.name + '-' + getVariantBaseName(project, variant) + '.aab'
+    return new File(project.buildDir, 'outputs/bundle/' + variant.name + '/' + fileName).absolutePath
+}
 `
@@ -6,6 +6,7 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"sort"
 	"strings"
@@ -19,10 +20,12 @@ var cmdMadbGroup = &cmdline.Command{
 	Children: []*cmdline.Command{
 		cmdMadbGroupAdd,
 		cmdMadbGroupClearAll,
+		cmdMadbGroupDefine,
 		cmdMadbGroupDelete,
 		cmdMadbGroupList,
 		cmdMadbGroupRemove,
 		cmdMadbGroupRename,
+		cmdMadbGroupShow,
 	},
 	Name:             "group",
 	DontInheritFlags: true,
@@ -31,6 +34,10 @@ var cmdMadbGroup = &cmdline.Command{
 Manages device groups, each of which can have one or more device members. The
 device groups can be used for specifying the target devices of other madb
 commands.
+
+A device group can either be a static group with a fixed list of members (see:
+madb help group add), or a dynamic group whose members are determined by a query
+(see: madb help group define).
 `,
 }
 
@@ -77,6 +84,9 @@ func runMadbGroupAdd(env *cmdline.Env, args []string, filename string) error {
 	if isDeviceNickname(groupName, cfg) {
 		return fmt.Errorf("The group name %q conflicts with a device nickname.", groupName)
 	}
+	if isDynamicGroupName(groupName, cfg) {
+		return fmt.Errorf("The group name %q conflicts with a dynamic group.", groupName)
+	}
 
 	members := removeDuplicates(args[1:])
 	for _, member := range members {
@@ -111,10 +121,92 @@ func runMadbGroupClearAll(env *cmdline.Env, args []string, filename string) erro
 
 	// Reset the groups
 	cfg.Groups = make(map[string][]string)
+	cfg.Queries = make(map[string]string)
 
 	return writeConfig(cfg, filename)
 }
 
+var cmdMadbGroupDefine = &cmdline.Command{
+	Runner: subCommandRunnerWithFilepath{runMadbGroupDefine, getDefaultConfigFilePath},
+	Name:   "define",
+	Short:  "Define a dynamic device group with a query",
+	Long: `
+Defines a dynamic device group, whose members are determined by evaluating the
+given query against the currently connected devices whenever the group is
+referenced. If the dynamic group already exists, its query is replaced with the
+newly provided one.
+
+For example, running the following command:
+
+    madb group define Modern 'sdk>=31 & type=RealDevice'
+
+defines the 'Modern' group, which includes all the real devices running Android
+API level 31 or higher. Running 'madb -n Modern exec reboot' will then reboot
+only those devices.
+
+A query consists of one or more terms in the form of '<key><op><value>', joined
+by '&' (and) or '|' (or). '&' takes precedence over '|'. The supported operators
+are '=', '!=', '>=', '<=', '>', and '<'. The values are compared numerically
+when both sides are numbers, and as strings otherwise.
+
+The following keys can be used in a query:
+
+    type         - 'RealDevice' or 'Emulator'.
+    serial       - The device serial.
+    name         - The nickname of the device, or the serial if not set.
+    index        - The device index, starting from 1.
+    tag          - A tag set by 'madb tag'. Only '=' and '!=' are supported.
+    sdk          - The API level of the device (ro.build.version.sdk).
+    release      - The Android version of the device (ro.build.version.release).
+    abi          - The primary ABI of the device (ro.product.cpu.abi).
+    manufacturer - The manufacturer of the device (ro.product.manufacturer).
+    brand        - The brand of the device (ro.product.brand).
+
+Any metadata keys set by 'madb tag', qualifier names from 'adb devices -l'
+(e.g., 'model', 'product'), and Android system property names (e.g.,
+'ro.build.type') can also be used as keys. Terms referring to a property that
+the device does not have never match the device.
+`,
+	ArgsName: "<group_name> <query>",
+	ArgsLong: `
+<group_name> is an alpha-numeric string with no special characters or spaces.
+This name must not be an existing device nickname or a static group name.
+
+<query> is the query that determines the members of the group. The query should
+be quoted, so that the shell does not interpret the special characters.
+`,
+}
+
+func runMadbGroupDefine(env *cmdline.Env, args []string, filename string) error {
+	// Check if the arguments are valid.
+	if len(args) != 2 {
+		return env.UsageErrorf("There must be exactly two arguments.")
+	}
+
+	groupName, query := args[0], args[1]
+	if !isValidName(groupName) {
+		return fmt.Errorf("Not a valid group name: %q", groupName)
+	}
+
+	if _, err := parseDeviceQuery(query); err != nil {
+		return err
+	}
+
+	cfg, err := readConfig(filename)
+	if err != nil {
+		return err
+	}
+	if isDeviceNickname(groupName, cfg) {
+		return fmt.Errorf("The group name %q conflicts with a device nickname.", groupName)
+	}
+	if isGroupName(groupName, cfg) {
+		return fmt.Errorf("The group name %q conflicts with a static group.", groupName)
+	}
+
+	cfg.Queries[groupName] = query
+	return writeConfig(cfg, filename)
+}
+
 var cmdMadbGroupDelete = &cmdline.Command{
 	Runner: subCommandRunnerWithFilepath{runMadbGroupDelete, getDefaultConfigFilePath},
 	Name:   "delete",
@@ -140,7 +232,7 @@ func runMadbGroupDelete(env *cmdline.Env, args []string, filename string) error
 		return err
 	}
 	for _, groupName := range args {
-		if !isGroupName(groupName, cfg) {
+		if !isGroupName(groupName, cfg) && !isDynamicGroupName(groupName, cfg) {
 			return fmt.Errorf("Not an existing group name: %q", groupName)
 		}
 	}
@@ -148,6 +240,7 @@ func runMadbGroupDelete(env *cmdline.Env, args []string, filename string) error
 	// Delete the groups
 	for _, groupName := range args {
 		delete(cfg.Groups, groupName)
+		delete(cfg.Queries, groupName)
 	}
 
 	return writeConfig(cfg, filename)
@@ -158,7 +251,8 @@ var cmdMadbGroupList = &cmdline.Command{
 	Name:   "list",
 	Short:  "List all the existing device groups",
 	Long: `
-Lists the name and members of all the existing device groups.
+Lists the name and members of all the existing device groups. For the dynamic
+groups, the query is shown instead of the members.
 `,
 }
 
@@ -174,10 +268,13 @@ func runMadbGroupList(env *cmdline.Env, args []string, filename string) error {
 	tw.SetAutoFormatHeaders(false)
 	tw.SetAlignment(tablewriter.ALIGN_LEFT)
 
-	data := make([][]string, 0, len(cfg.Groups))
+	data := make([][]string, 0, len(cfg.Groups)+len(cfg.Queries))
 	for group, members := range cfg.Groups {
 		data = append(data, []string{group, strings.Join(members, " ")})
 	}
+	for group, query := range cfg.Queries {
+		data = append(data, []string{group, "query: " + query})
+	}
 
 	sort.Sort(byFirstElement(data))
 
@@ -242,7 +339,7 @@ var cmdMadbGroupRename = &cmdline.Command{
 	Name:   "rename",
 	Short:  "Rename an existing device group",
 	Long: `
-Renames an existing device group.
+Renames an existing device group, either static or dynamic.
 `,
 	ArgsName: "<old_name> <new_name>",
 	ArgsLong: `
@@ -272,19 +369,253 @@ func runMadbGroupRename(env *cmdline.Env, args []string, filename string) error
 	if err != nil {
 		return err
 	}
-	if !isGroupName(oldName, cfg) {
+	if !isGroupName(oldName, cfg) && !isDynamicGroupName(oldName, cfg) {
 		return fmt.Errorf("Not an existing group name: %q", oldName)
 	}
 	if isNameInUse(newName, cfg) {
 		return fmt.Errorf("The provided name is already in use: %q", newName)
 	}
 
-	cfg.Groups[newName] = cfg.Groups[oldName]
-	delete(cfg.Groups, oldName)
+	if isDynamicGroupName(oldName, cfg) {
+		cfg.Queries[newName] = cfg.Queries[oldName]
+		delete(cfg.Queries, oldName)
+	} else {
+		cfg.Groups[newName] = cfg.Groups[oldName]
+		delete(cfg.Groups, oldName)
+	}
 
 	return writeConfig(cfg, filename)
 }
 
+var cmdMadbGroupShow = &cmdline.Command{
+	Runner: subCommandRunnerWithFilepath{runMadbGroupShow, getDefaultConfigFilePath},
+	Name:   "show",
+	Short:  "Show how a device group is resolved",
+	Long: `
+Shows how a device group is resolved into the currently connected devices.
+
+The members of the group are printed as a tree, where the nested groups are
+expanded in the same way as when the group is used in the '-n' flag. Each member
+is marked with the connected devices it resolves to, or one of the following:
+
+    not connected - The member is a valid device specifier, but no currently
+                    connected device matches it.
+    UNKNOWN       - The member is neither a nickname nor a group, and no
+                    currently connected device has it as its serial. This
+                    usually means that the member refers to a deleted nickname
+                    or group.
+    INVALID       - The member is not a valid device specifier.
+    CYCLE         - The member is a group that is already being expanded. Such
+                    members are ignored when the group is resolved.
+
+At the end, the list of all the devices that the group resolves to is printed.
+`,
+	ArgsName: "<group_name>",
+	ArgsLong: `
+<group_name> is the name of an existing device group, either static or dynamic.
+`,
+}
+
+func runMadbGroupShow(env *cmdline.Env, args []string, filename string) error {
+	// Check if the arguments are valid.
+	if len(args) != 1 {
+		return env.UsageErrorf("There must be exactly one argument.")
+	}
+
+	groupName := args[0]
+
+	cfg, err := readConfig(filename)
+	if err != nil {
+		return err
+	}
+	if !isGroupName(groupName, cfg) && !isDynamicGroupName(groupName, cfg) {
+		return fmt.Errorf("Not an existing group name: %q", groupName)
+	}
+
+	// The group can still be shown without the connected devices.
+	devices := []device{}
+	if err := startAdbServer(); err != nil {
+		fmt.Fprintf(os.Stderr, "WARNING: %v\n", err)
+	} else if devices, err = getDevices(cfg, []string{groupName}); err != nil {
+		fmt.Fprintf(os.Stderr, "WARNING: Could not get the connected devices: %v\n", err)
+		devices = []device{}
+	}
+
+	getprop := memoizeDeviceProperties(getDeviceProperties)
+	tree := buildGroupTree(groupName, cfg, devices, getprop)
+
+	resolved, err := filterSpecifiedDevices(devices, cfg, false, false, []string{groupName}, getprop)
+	if err != nil {
+		return err
+	}
+
+	printGroupTree(os.Stdout, tree, resolved)
+	return nil
+}
+
+type memberStatus int
+
+const (
+	connected memberStatus = iota
+	notConnected
+	unknownMember
+	invalidMember
+	cyclicMember
+)
+
+// groupTreeNode represents a member of a device group, as shown by 'madb group show'.
+type groupTreeNode struct {
+	member string
+	status memberStatus
+	// isGroup and query are set when the member is a static or a dynamic group.
+	isGroup bool
+	query   string
+	// serial is set when the member is a device nickname.
+	serial string
+	// err explains why the member is invalid.
+	err error
+	// devices are the connected devices that this member resolves to.
+	devices  []device
+	children []*groupTreeNode
+}
+
+// buildGroupTree expands the given group into a tree, resolving each member
+// against the given connected devices. Unlike expandGroups, a group appearing
+// in multiple places is expanded in each of them, and the groups that are
+// already being expanded are reported as cycles.
+func buildGroupTree(groupName string, cfg *config, devices []device, getprop devicePropertiesFunc) *groupTreeNode {
+	return buildGroupTreeNode(groupName, cfg, devices, getprop, map[string]bool{})
+}
+
+func buildGroupTreeNode(member string, cfg *config, devices []device, getprop devicePropertiesFunc, path map[string]bool) *groupTreeNode {
+	node := &groupTreeNode{member: member}
+
+	if isGroupName(member, cfg) || isDynamicGroupName(member, cfg) {
+		node.isGroup = true
+		node.query = cfg.Queries[member]
+
+		if path[member] {
+			node.status = cyclicMember
+			return node
+		}
+
+		if isGroupName(member, cfg) {
+			path[member] = true
+			for _, child := range cfg.Groups[member] {
+				node.children = append(node.children, buildGroupTreeNode(child, cfg, devices, getprop, path))
+			}
+			delete(path, member)
+		}
+	} else if err := isValidDeviceSpecifier(member); err != nil {
+		node.status = invalidMember
+		node.err = err
+		return node
+	} else if isDeviceNickname(member, cfg) {
+		node.serial = cfg.Names[member]
+	}
+
+	// Resolve the member against the connected devices.
+	specs, err := getDeviceSpecsFromTokens(expandGroups([]string{member}, cfg), cfg)
+	if err != nil {
+		node.status = invalidMember
+		node.err = err
+		return node
+	}
+
+	for _, d := range devices {
+		if shouldIncludeDevice(d, specs, false, false, getprop) {
+			node.devices = append(node.devices, d)
+		}
+	}
+
+	switch {
+	case len(node.devices) > 0:
+		node.status = connected
+	case node.isGroup || node.serial != "" || isSpecialDeviceSpecifier(member):
+		node.status = notConnected
+	default:
+		node.status = unknownMember
+	}
+
+	return node
+}
+
+// isSpecialDeviceSpecifier determines whether the given member is a device
+// specifier other than a plain serial or a nickname, such as a device index or
+// a qualifier.
+func isSpecialDeviceSpecifier(member string) bool {
+	if strings.HasPrefix(member, "@") || strings.Contains(member, ":") {
+		return true
+	}
+
+	_, _, ok := parseMetadataEntry(member)
+	return ok
+}
+
+// printGroupTree prints the given group tree followed by the list of the
+// resolved devices.
+func printGroupTree(w io.Writer, root *groupTreeNode, resolved []device) {
+	printGroupTreeNode(w, root, 0)
+
+	names := make([]string, 0, len(resolved))
+	for _, d := range resolved {
+		names = append(names, deviceLabel(d))
+	}
+
+	fmt.Fprintln(w)
+	if len(names) == 0 {
+		fmt.Fprintf(w, "%v resolves to no connected devices.\n", root.member)
+	} else {
+		fmt.Fprintf(w, "%v resolves to %v connected device(s): %v\n", root.member, len(names), strings.Join(names, ", "))
+	}
+}
+
+func printGroupTreeNode(w io.Writer, node *groupTreeNode, depth int) {
+	label := node.member
+	if node.query != "" {
+		label += fmt.Sprintf(" (dynamic group: %v)", node.query)
+	} else if node.isGroup {
+		label += " (group)"
+	}
+
+	var status string
+	switch node.status {
+	case connected:
+		names := make([]string, 0, len(node.devices))
+		for _, d := range node.devices {
+			names = append(names, deviceLabel(d))
+		}
+		status = "connected: " + strings.Join(names, ", ")
+	case notConnected:
+		status = "not connected"
+		if node.serial != "" {
+			status += fmt.Sprintf(" (nickname of %v)", node.serial)
+		}
+	case unknownMember:
+		status = "UNKNOWN: not a nickname or a group, and no connected device has this serial"
+	case invalidMember:
+		status = fmt.Sprintf("INVALID: %v", node.err)
+	case cyclicMember:
+		status = "CYCLE: already being expanded, ignored"
+	}
+
+	fmt.Fprintf(w, "%v%v - %v\n", strings.Repeat("    ", depth), label, status)
+
+	for _, child := range node.children {
+		printGroupTreeNode(w, child, depth+1)
+	}
+}
+
+// deviceLabel returns the nickname of the device followed by its serial, or
+// just the serial if the nickname is not set.
+func deviceLabel(d device) string {
+	if d.Nickname != "" {
+		return fmt.Sprintf("%v (%v)", d.Nickname, d.Serial)
+	}
+
+	return d.Serial
+}
+
 // removeDuplicates takes a string slice and removes all the duplicates.
 func removeDuplicates(s []string) []string {
 	result := make([]string, 0, len(s))
@@ -323,7 +654,9 @@ func subtractSlices(s1, s2 []string) []string {
 // where all the group name tokens are expanded to include all their members.
 // The expansion process is transitive; if a group includes other groups, all
 // the members of the other groups are also included in the returned slice. Each
-// group is processed at most once, in order to avoid infinite loops.
+// group is processed at most once, in order to avoid infinite loops. The names
+// of the dynamic groups are kept as they are, since their members can only be
+// determined by evaluating the queries against the connected devices.
 func expandGroups(tokens []string, cfg *config) []string {
 	expanded := make([]string, 0, len(tokens))
 
@@ -192,6 +192,77 @@ func TestMadbGroupClearAll(t *testing.T) {
 	runGroupTests(t, tests)
 }
 
+func TestMadbGroupDefine(t *testing.T) {
+	filename := tempFilename(t)
+	defer os.Remove(filename)
+
+	var cfg *config
+	var err error
+
+	// Define a new dynamic group.
+	if err = runMadbGroupDefine(nil, []string{"Modern", "sdk>=31 & type=RealDevice"}, filename); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg, err = readConfig(filename); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cfg.Queries, map[string]string{"Modern": "sdk>=31 & type=RealDevice"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unmatched results: got %v, want %v", got, want)
+	}
+
+	// Replace the query of the existing dynamic group.
+	if err = runMadbGroupDefine(nil, []string{"Modern", "sdk>=33"}, filename); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg, err = readConfig(filename); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cfg.Queries, map[string]string{"Modern": "sdk>=33"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unmatched results: got %v, want %v", got, want)
+	}
+
+	// Try an invalid query and see if it fails.
+	if err = runMadbGroupDefine(nil, []string{"Invalid", "sdk>="}, filename); err == nil {
+		t.Fatalf("expected an error but succeeded.")
+	}
+
+	// Try names conflicting with a nickname or a static group and see if it fails.
+	runMadbNameSet(nil, []string{"SERIAL1", "NICKNAME1"}, filename)
+	runMadbGroupAdd(nil, []string{"GROUP1", "SERIAL1"}, filename)
+	if err = runMadbGroupDefine(nil, []string{"NICKNAME1", "sdk>=31"}, filename); err == nil {
+		t.Fatalf("expected an error but succeeded.")
+	}
+	if err = runMadbGroupDefine(nil, []string{"GROUP1", "sdk>=31"}, filename); err == nil {
+		t.Fatalf("expected an error but succeeded.")
+	}
+	if err = runMadbGroupAdd(nil, []string{"Modern", "SERIAL1"}, filename); err == nil {
+		t.Fatalf("expected an error but succeeded.")
+	}
+
+	// Rename and delete the dynamic group.
+	if err = runMadbGroupRename(nil, []string{"Modern", "Recent"}, filename); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err = readConfig(filename); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cfg.Queries, map[string]string{"Recent": "sdk>=33"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unmatched results: got %v, want %v", got, want)
+	}
+
+	if err = runMadbGroupDelete(nil, []string{"Recent"}, filename); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err = readConfig(filename); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cfg.Queries, map[string]string{}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unmatched results: got %v, want %v", got, want)
+	}
+}
+
 func TestMadbGroupDelete(t *testing.T) {
 	tests := []testSequence{
 		{
@@ -273,6 +344,7 @@ func ExampleMadbGroupList() {
 	// Set some device groups.
 	runMadbGroupAdd(nil, []string{"GROUP1", "SERIAL1", "NICKNAME1", "@1"}, filename)
 	runMadbGroupAdd(nil, []string{"GROUP2", "GROUP1", "SERIAL2"}, filename)
+	runMadbGroupDefine(nil, []string{"GROUP3", "sdk>=31"}, filename)
 
 	// Call the list command.
 	runMadbGroupList(nil, []string{}, filename)
@@ -283,9 +355,56 @@ func ExampleMadbGroupList() {
 	// +------------+----------------------+
 	// | GROUP1     | SERIAL1 NICKNAME1 @1 |
 	// | GROUP2     | GROUP1 SERIAL2       |
+	// | GROUP3     | query: sdk>=31       |
 	// +------------+----------------------+
 }
 
+func ExampleMadbGroupShow() {
+	cfg := &config{
+		Names: map[string]string{
+			"MyPhone":  "deviceid01",
+			"OldPhone": "deviceid09",
+		},
+		Groups: map[string][]string{
+			"Regression": []string{"MyPhone", "Tablets", "Modern", "Removed", "Cyclic"},
+			"Tablets":    []string{"model:Nexus_9", "@7", "OldPhone"},
+			"Cyclic":     []string{"Regression", "emulator-5554"},
+		},
+		Queries: map[string]string{
+			"Modern": "sdk>=31",
+		},
+	}
+
+	devices := []device{
+		device{Serial: "deviceid01", Type: realDevice, Qualifiers: []string{"model:Nexus_5X"}, Nickname: "MyPhone", Index: 1},
+		device{Serial: "deviceid02", Type: realDevice, Qualifiers: []string{"model:Nexus_9"}, Index: 2},
+		device{Serial: "emulator-5554", Type: emulator, Qualifiers: []string{"model:sdk_phone_armv7"}, Index: 3},
+	}
+
+	getprop := func(serial string) (map[string]string, error) {
+		return map[string]string{"ro.build.version.sdk": "25"}, nil
+	}
+
+	tree := buildGroupTree("Regression", cfg, devices, getprop)
+	resolved, _ := filterSpecifiedDevices(devices, cfg, false, false, []string{"Regression"}, getprop)
+	printGroupTree(os.Stdout, tree, resolved)
+
+	// Output:
+	// Regression (group) - connected: MyPhone (deviceid01), deviceid02, emulator-5554
+	//     MyPhone - connected: MyPhone (deviceid01)
+	//     Tablets (group) - connected: deviceid02
+	//         model:Nexus_9 - connected: deviceid02
+	//         @7 - not connected
+	//         OldPhone - not connected (nickname of deviceid09)
+	//     Modern (dynamic group: sdk>=31) - not connected
+	//     Removed - UNKNOWN: not a nickname or a group, and no connected device has this serial
+	//     Cyclic (group) - connected: MyPhone (deviceid01), deviceid02, emulator-5554
+	//         Regression (group) - CYCLE: already being expanded, ignored
+	//         emulator-5554 - connected: emulator-5554
+	//
+	// Regression resolves to 3 connected device(s): MyPhone (deviceid01), deviceid02, emulator-5554
+}
+
 func TestMadbGroupRemove(t *testing.T) {
 	tests := []testSequence{
 		{
@@ -7,9 +7,12 @@ package main
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"v.io/x/lib/cmdline"
 	"v.io/x/lib/gosh"
@@ -17,24 +20,99 @@ import (
 
 func init() {
 	initializePropertyCacheFlags(&cmdMadbInstall.Flags)
+	initializeUsersFlags(&cmdMadbInstall.Flags)
 	initializeBuildFlags(&cmdMadbInstall.Flags)
+	initializeApkDirFlag(&cmdMadbInstall.Flags)
+	initializeSkipChecksFlag(&cmdMadbInstall.Flags)
+	initializeInstallFailureFlags(&cmdMadbInstall.Flags)
+	initializeProgressFlag(&cmdMadbInstall.Flags)
 }
 
 var cmdMadbInstall = &cmdline.Command{
-	Runner: subCommandRunner{initMadbInstall, runMadbInstallForDevice, true},
+	Runner: subCommandRunner{initMadbInstall, forEachUser(runMadbInstallForDevice), true},
 	Name:   "install",
 	Short:  "Install your app on all devices",
 	Long: `
 Installs your app on all devices.
 
-If the working directory contains a Gradle Android project (i.e., has "build.gradle"), this command
-will first run a small Gradle script to extract the variant properties, which will be used to find
-the best matching .apk for each device. These extracted properties are cached, and "madb install"
-can be repeated without running this Gradle script again. The properties can be re-extracted by
-clearing the cache by providing "-clear-cache" flag.
+If the working directory contains a Gradle Android project (i.e., has "build.gradle" or
+"build.gradle.kts"), this command will first run a small Gradle script to extract the variant
+properties, which will be used to find the best matching .apk for each device. These extracted
+properties are cached, and "madb install" can be repeated without running this Gradle script again.
+The properties are re-extracted automatically when any of the Gradle scripts, Gradle properties, or
+Android manifests of the project change, and can also be re-extracted by clearing the cache by
+providing "-clear-cache" flag.
 
 Once the variant properties are extracted, the best matching .apk for each device will be installed
-in parallel.
+in parallel. When the app has config split .apk files (i.e., the .apk files containing the code or
+the resources only for specific ABIs, densities, or languages) or dynamic feature modules, the splits
+matching each device and the best matching .apk of each feature module are installed along with the
+base .apk using "adb install-multiple". The .apk files of the feature modules are also compared with
+the installed app when determining whether the app is up to date.
+
+Note that the config split .apk files of a Gradle project are only found with the older Android
+Gradle Plugins which provide the legacy variant API. With Android Gradle Plugin 7 and above, only the
+base .apk files and the feature modules are installed; use the "-bundle" flag to install the config
+splits generated from the app bundle instead.
+
+When the project contains multiple application modules which should be installed together (e.g., a
+client app and a server app, or an app and its companion test app), a comma-separated list of
+modules or "all" can be given to the "-module" flag (e.g., "-module=client,server"). In this case,
+the properties of all the modules are extracted with a single Gradle run, all the modules are built
+with a single Gradle build, and then the app of each module is installed on each device. When the
+project has a module named "all", "-module=all" refers to that module instead, and all the modules
+must be listed explicitly.
+
+When different devices need different build variants or modules (e.g., a tablet variant for the
+tablets, and a separate module for the wear devices), the "-variant-map" flag can be used to map the
+device specifiers to the variants. For example, running the following command:
+
+    madb install -variant-map 'Tablets=tabletDebug,tag:wear=:wear'
+
+installs the "tabletDebug" variant on the devices in the "Tablets" group, the default variant of the
+"wear" module on the devices tagged with "wear", and the default variant on the other devices. The
+properties of each needed variant are extracted, and the variant is built, only once.
+
+When the "-bundle" flag is provided, the Android App Bundle (.aab) of the variant is built instead,
+and the APKs generated from the bundle for each device are installed in parallel. For each device,
+a device specification (i.e., the supported ABIs, the screen density, the SDK version, and the
+locales of the device) is generated, and then bundletool is used to generate the device-specific
+APKs, which are then installed with "adb install-multiple". The bundletool command can be specified
+with the "-bundletool" flag. By default, bundletool signs the generated APKs with the debug keystore,
+so a release bundle cannot be installed over an app signed with the release key. In that case, the
+release keystore can be given with the "-ks", "-ks-key-alias", "-ks-pass", and "-key-pass" flags,
+which are passed to bundletool as is.
+
+Before installing the app, madb checks whether the app can be installed on each device, so that the
+installation does not fail with cryptic "INSTALL_FAILED_*" errors. The following are checked:
+ - the minSdkVersion of the app is not higher than the API level of the device
+ - the targetSdkVersion of the app is not too low for the API level of the device
+ - the device supports at least one of the ABIs of the native libraries in the app
+ - the device has enough free space in /data
+ - the app is signed with the same key as the installed app, if any
+When any of the checks fails, the reasons and the remedies are reported for the device, and the
+installation is skipped for that device. These checks can be skipped with the "-skip-checks" flag.
+
+The signing certificate is read from the APK Signature Scheme v3 or v2 block of the .apk file, or
+from its v1 (JAR) signature. The checks are also performed when installing from the app bundle, using
+the base .apk generated by bundletool.
+
+When the "-progress" flag is specified, the progress of each device (i.e., the bytes pushed, the
+percentage, the throughput, and the phase: push, verify/dexopt, or done) is reported while
+installing the app. On a terminal, the progress of all the devices is shown as a multi-line status
+display updated in place, and the other output (e.g., the output of "am start") is printed above
+the display. Otherwise, the progress lines are printed whenever the phase changes, and periodically
+while pushing the .apk files. The bytes pushed are only tracked on the devices running API level 21
+and above, where the .apk files are streamed to the device with an install session. Without the
+flag, "adb install" is used as is.
+
+When the installation fails, the failure code reported by adb (e.g., "INSTALL_FAILED_*") is
+classified and explained along with the remedy. Some of the common failures can be resolved
+automatically with the following flags, in which case the installation is retried and the actions
+taken are reported for each device:
+ - "-on-signature-mismatch=uninstall" for INSTALL_FAILED_UPDATE_INCOMPATIBLE
+ - "-allow-downgrade" for INSTALL_FAILED_VERSION_DOWNGRADE
+ - "-allow-test-only" for INSTALL_FAILED_TEST_ONLY
 
 This command is similar to running "gradlew :<moduleName>:<variantName>Install", but "madb install"
 is more flexible: 1) you can install the app to a subset of the devices, and 2) the app is installed
@@ -46,16 +124,36 @@ run "flutter install --device-id <device serial>" for all devices.
 
 
 To install your app for a specific user on a particular device, use 'madb user set' command to set
-the default user ID for that device. (See 'madb help user' for more details.)
-
-To install a specific .apk file to all devices, use "madb exec install <path_to_apk>" instead.
+the default user ID for that device. (See 'madb help user' for more details.) To install your app
+for multiple users at once, use the '-all-users' or '-users' flag.
+
+To install specific .apk files to all devices, provide the .apk files as the arguments. (See below.)
+To install the app from a directory of prebuilt .apk files (e.g., "app-arm64-v8a-release.apk" and
+"app-xhdpi-release.apk"), use the "-apk-dir" flag. In this case, the ABI and the density filters and
+the version code of each .apk are read from the .apk file itself. (i.e., the native libraries and
+the <compatible-screens> element of the manifest.) Then the best matching .apk for each device is
+installed in parallel, in the same way as the outputs of a Gradle project.
+`,
+	ArgsName: "[<apk_file> ...]",
+	ArgsLong: `
+<apk_file> is the path to an .apk file to be installed. When .apk files are provided, the app
+information such as the application ID and the version code is read directly from the .apk files,
+without running any Gradle scripts. Multiple .apk files of the same app can be provided, such as the
+base .apk files for different ABIs, the config split .apk files, and the dynamic feature .apk files.
+In this case, the best matching base .apk and the matching splits are installed on each device, in
+the same way as the outputs of a Gradle project.
 `,
 }
 
-func initMadbInstall(env *cmdline.Env, args []string, properties variantProperties) ([]string, error) {
+func initMadbInstall(env *cmdline.Env, args []string, properties *variantProperties) ([]string, error) {
+	if err := validateInstallFailureFlags(); err != nil {
+		return nil, err
+	}
+	setUpInstallProgress()
+
 	// If the "-build" flag is set, first run the relevant gradle tasks to build the .apk files
 	// before installing the app to the devices.
-	if isGradleProject(wd) && buildFlag {
+	if isGradleProject(wd) && buildFlag && !properties.fromApkFiles {
 		sh := gosh.NewShell(nil)
 		defer sh.Cleanup()
 
@@ -68,8 +166,29 @@ func initMadbInstall(env *cmdline.Env, args []string, properties variantProperti
 			return nil, err
 		}
 
-		// Build the project by running ":<module>:assemble<Variant>" task.
-		cmdArgs := []string{"--daemon", properties.AssembleTask}
+		cmdArgs := []string{"--daemon"}
+
+		// Build the project by running ":<module>:assemble<Variant>" task, or ":<module>:bundle<Variant>"
+		// task when installing from the app bundle. When multiple application modules are specified,
+		// all of them are built in a single Gradle invocation.
+		for _, module := range properties.modules() {
+			task := module.AssembleTask
+			if bundleFlag {
+				if module.BundleTask == "" {
+					return nil, fmt.Errorf("The Android Gradle Plugin used by this project does not support app bundles.")
+				}
+				task = module.BundleTask
+			}
+			cmdArgs = append(cmdArgs, task)
+
+			// The dynamic feature modules are included in the app bundle, but their .apk files should
+			// be built separately.
+			if !bundleFlag {
+				for _, feature := range module.FeatureModules {
+					cmdArgs = append(cmdArgs, feature.AssembleTask)
+				}
+			}
+		}
 		cmd := sh.Cmd(wrapper, cmdArgs...)
 		cmd.Run()
 
@@ -87,11 +206,26 @@ func runMadbInstallForDevice(env *cmdline.Env, args []string, d device, properti
 }
 
 func installVariantToDevice(d device, properties variantProperties, forceInstall bool) error {
+	// Install the app of each application module one by one, when multiple modules are specified.
+	if len(properties.AdditionalModules) > 0 {
+		for _, module := range properties.modules() {
+			if err := installVariantToDevice(d, module, forceInstall); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
 	sh := gosh.NewShell(nil)
 	defer sh.Cleanup()
 
 	sh.ContinueOnError = true
-	if isGradleProject(wd) {
+	if properties.fromApkFiles || isGradleProject(wd) {
+		// Install the device-specific APKs generated from the app bundle, if requested.
+		if bundleFlag && !properties.fromApkFiles {
+			return installBundleToDevice(d, properties, forceInstall)
+		}
+
 		// Get the necessary device properties.
 		deviceAbis, err := getSupportedAbisForDevice(d)
 		if err != nil {
@@ -109,25 +243,33 @@ func installVariantToDevice(d device, properties variantProperties, forceInstall
 			return fmt.Errorf("Could not find the matching .apk for device %q", d.displayName())
 		}
 
+		// Compute the best output of each dynamic feature module, which is compared with the installed
+		// app along with the base .apk.
+		featureOutputs, err := getFeatureOutputsForDevice(d, properties, deviceDensity, deviceAbis)
+		if err != nil {
+			return err
+		}
+
 		// Determine whether the app should be installed on the given device.
-		shouldInstall, err := shouldInstallVariant(d, properties, bestOutput, forceInstall)
+		if !checkInstallationForDevice(d, properties, bestOutput, featureOutputs, forceInstall) {
+			return nil
+		}
+
+		// Collect the config splits and the dynamic feature .apk files to be installed along with the
+		// base .apk.
+		apks, err := getApksForDevice(d, properties, bestOutput, featureOutputs, deviceDensity, deviceAbis)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Warning: Could not determine whether the app should be installed on device %q. Attempting to install...", d.displayName())
-			shouldInstall = true
+			return err
 		}
 
-		// Run the "adb install" command to perform the installation.
-		if shouldInstall {
-			cmdArgs := []string{"-s", d.Serial, "install", "-r"}
-			if d.UserID != "" {
-				cmdArgs = append(cmdArgs, "--user", d.UserID)
+		// Check whether the app can be installed on the device, before pushing the .apk files.
+		if !skipChecksFlag {
+			if err := runPreInstallChecks(d, properties.AppID, apks, deviceAbis); err != nil {
+				return err
 			}
-			cmdArgs = append(cmdArgs, bestOutput.OutputFilePath)
-			cmd := sh.Cmd("adb", cmdArgs...)
-			return runGoshCommandForDevice(cmd, d, true)
 		}
 
-		fmt.Printf("Device %q has the most recent version of the app already. Skipping the installation.\n", d.displayName())
+		return installApksToDevice(d, properties.AppID, apks)
 	}
 
 	if isFlutterProject(wd) {
@@ -139,24 +281,461 @@ func installVariantToDevice(d device, properties variantProperties, forceInstall
 	return fmt.Errorf("Could not find the target app to be installed. Try running 'madb install' from a Gradle or Flutter project directory.")
 }
 
-// shouldInstallVariant determines whether the app should be installed on the given device or not.
-func shouldInstallVariant(d device, properties variantProperties, bestOutput *variantOutput, forceInstall bool) (bool, error) {
+// getFeatureOutputsForDevice returns the best matching output of each dynamic feature module for the
+// given device, keyed on the split name of the feature module.
+func getFeatureOutputsForDevice(d device, properties variantProperties, deviceDensity int, deviceAbis []string) (map[string]variantOutput, error) {
+	result := map[string]variantOutput{}
+	for _, feature := range properties.FeatureModules {
+		featureOutput := computeBestOutput(feature.VariantOutputs, properties.AbiFilters, deviceDensity, deviceAbis)
+		if featureOutput == nil {
+			return nil, fmt.Errorf("Could not find the matching .apk of the feature module %q for device %q", feature.ProjectPath, d.displayName())
+		}
+		result[featureSplitName(feature)] = *featureOutput
+	}
+
+	return result, nil
+}
+
+// featureSplitName returns the split name of the given dynamic feature module, which is the name of
+// the module (e.g., "camera" for ":features:camera").
+func featureSplitName(feature featureModule) string {
+	return feature.ProjectPath[strings.LastIndex(feature.ProjectPath, ":")+1:]
+}
+
+// getApksForDevice returns all the .apk files to be installed on the given device, starting with the
+// given base .apk. The config splits matching the device, and the given outputs of the dynamic
+// feature modules are included as well.
+func getApksForDevice(d device, properties variantProperties, bestOutput *variantOutput, featureOutputs map[string]variantOutput, deviceDensity int, deviceAbis []string) ([]string, error) {
+	apks := []string{bestOutput.OutputFilePath}
+
+	if len(properties.SplitOutputs) > 0 {
+		// The device locales are only needed for choosing the language splits.
+		props, err := getDeviceProperties(d.Serial)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, split := range selectSplitOutputs(properties.SplitOutputs, deviceDensity, deviceAbis, getDeviceLocales(props)) {
+			apks = append(apks, split.OutputFilePath)
+		}
+	}
+
+	// Keep the order of the feature modules.
+	for _, feature := range properties.FeatureModules {
+		apks = append(apks, featureOutputs[featureSplitName(feature)].OutputFilePath)
+	}
+
+	return apks, nil
+}
+
+// selectSplitOutputs returns the config split outputs matching the given device properties. For the
+// ABI splits, only the split for the most preferred ABI of the device is chosen. For the density
+// splits, the split with the closest density is chosen. For the language splits, all the splits
+// matching any of the device locales are chosen.
+func selectSplitOutputs(splitOutputs []variantOutput, deviceDensity int, deviceAbis []string, deviceLocales []string) []variantOutput {
+	result := []variantOutput{}
+
+	// Find the preferred ABI and density among the available splits.
+	abiSplits := map[string]variantOutput{}
+	var densitySplit *variantOutput
+	densityValue, densityDiff := 0, 0
+
+	for i, split := range splitOutputs {
+		for _, filter := range split.Filters {
+			switch filter.FilterType {
+			case "ABI":
+				abiSplits[filter.Identifier] = split
+
+			case "DENSITY":
+				// Prefer the higher density when the differences are the same, since scaling down
+				// looks better than scaling up.
+				value := getDensityValue(filter.Identifier)
+				diff := value - deviceDensity
+				if diff < 0 {
+					diff = -diff
+				}
+				if densitySplit == nil || diff < densityDiff || (diff == densityDiff && value > densityValue) {
+					densitySplit, densityValue, densityDiff = &splitOutputs[i], value, diff
+				}
+
+			case "LANGUAGE":
+				if matchesAnyLocale(filter.Identifier, deviceLocales) {
+					result = append(result, split)
+				}
+			}
+		}
+	}
+
+	for _, abi := range deviceAbis {
+		if split, ok := abiSplits[abi]; ok {
+			result = append(result, split)
+			break
+		}
+	}
+
+	if densitySplit != nil {
+		result = append(result, *densitySplit)
+	}
+
+	return result
+}
+
+// getDensityValue converts the given density resource name such as "mdpi" or "280dpi" into its
+// numeric density value. This is the inverse of getDensityResourceName. Returns 0 for unknown
+// names.
+func getDensityValue(name string) int {
+	for _, density := range []int{120, 160, 213, 240, 320, 480, 640} {
+		if getDensityResourceName(density) == name {
+			return density
+		}
+	}
+
+	value, err := strconv.Atoi(strings.TrimSuffix(name, "dpi"))
+	if err != nil {
+		return 0
+	}
+
+	return value
+}
+
+// matchesAnyLocale determines whether the given language split identifier matches any of the given
+// device locales. The identifier can contain multiple comma-separated resource qualifiers such as
+// "fr" and "fr-rCA", and only the language parts are compared with the device locales (e.g.,
+// "fr-CA").
+func matchesAnyLocale(identifier string, deviceLocales []string) bool {
+	for _, qualifier := range strings.Split(identifier, ",") {
+		language := strings.SplitN(strings.TrimSpace(qualifier), "-", 2)[0]
+		for _, locale := range deviceLocales {
+			if strings.EqualFold(language, strings.SplitN(locale, "-", 2)[0]) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// checkInstallationForDevice determines whether the app should be installed on the given device,
+// and reports the decision along with its reason. When the decision cannot be made, the app is
+// installed anyway.
+func checkInstallationForDevice(d device, properties variantProperties, bestOutput *variantOutput, featureOutputs map[string]variantOutput, forceInstall bool) bool {
+	// The user explicitly asked for the installation, so there is nothing to report.
 	if forceInstall {
-		return true, nil
+		return true
+	}
+
+	shouldInstall, reason, err := shouldInstallVariant(d, properties, bestOutput, featureOutputs)
+	if err != nil {
+		printMessage(os.Stderr, "WARNING: Could not determine whether the app should be installed on device %q: %v. Attempting to install...\n", d.displayName(), err)
+		return true
+	}
+
+	if shouldInstall {
+		printMessage(os.Stdout, "Installing the app on device %q, because %v.\n", d.displayName(), reason)
+	} else {
+		printMessage(os.Stdout, "Skipping the installation on device %q, because %v.\n", d.displayName(), reason)
 	}
 
+	return shouldInstall
+}
+
+// shouldInstallVariant determines whether the app should be installed on the given device or not,
+// by comparing the installed app with the local build. The bestOutput is the .apk file to be
+// installed, or nil when the app is installed from the app bundle. The featureOutputs are the .apk
+// files of the dynamic feature modules to be installed along with it, keyed on their split names.
+// Returns the reason of the decision along with the decision itself.
+func shouldInstallVariant(d device, properties variantProperties, bestOutput *variantOutput, featureOutputs map[string]variantOutput) (bool, string, error) {
 	// Check if the app is installed on this device.
 	installed, err := isInstalled(d, properties)
 	if err != nil {
-		return false, err
+		return false, "", err
 	}
 	if !installed {
-		return true, nil
+		return true, "the app is not installed", nil
+	}
+
+	info, err := getInstalledAppInfo(d, properties.AppID)
+	if err != nil {
+		return false, "", err
+	}
+
+	// Gather the same information from the local build. The .apk files generated from an app bundle
+	// differ from the bundle itself, so the hash is only compared for the regular .apk outputs.
+	local := localAppInfo{}
+	localFile := properties.BundleFilePath
+	if bestOutput != nil {
+		localFile = bestOutput.OutputFilePath
+		local.VersionCode = bestOutput.VersionCode
+		local.ApkHash = hashFile(localFile)
+	}
+
+	stat, err := os.Stat(localFile)
+	if err != nil {
+		return false, "", err
+	}
+	local.LastModifiedTime = stat.ModTime()
+
+	// The feature modules are compared in the same way as the base .apk, and the local build is as
+	// new as its most recently modified .apk file.
+	if len(featureOutputs) > 0 {
+		local.FeatureApkHashes = map[string]string{}
+		for name, output := range featureOutputs {
+			stat, err := os.Stat(output.OutputFilePath)
+			if err != nil {
+				return false, "", err
+			}
+			if stat.ModTime().After(local.LastModifiedTime) {
+				local.LastModifiedTime = stat.ModTime()
+			}
+			local.FeatureApkHashes[name] = hashFile(output.OutputFilePath)
+		}
+	}
+
+	shouldInstall, reason := compareInstalledApp(info, local)
+	return shouldInstall, reason, nil
+}
+
+// installedAppInfo contains the information of an app installed on a device, which is used for
+// determining whether the app is up to date.
+type installedAppInfo struct {
+	VersionCode    int
+	LastUpdateTime time.Time
+	// ApkHash is the SHA-256 hash of the installed base .apk file. Empty if the hash could not be
+	// computed on the device.
+	ApkHash string
+	// SplitApkHashes are the SHA-256 hashes of the installed split .apk files other than the config
+	// splits, keyed on the split names. The hash is empty if it could not be computed on the device.
+	SplitApkHashes map[string]string
+}
+
+// localAppInfo contains the information of the locally built app.
+type localAppInfo struct {
+	// VersionCode is zero if the version code of the local build is not known.
+	VersionCode      int
+	LastModifiedTime time.Time
+	// ApkHash is empty if the hash of the local build should not be compared.
+	ApkHash string
+	// FeatureApkHashes are the SHA-256 hashes of the .apk files of the dynamic feature modules, keyed
+	// on their split names.
+	FeatureApkHashes map[string]string
+}
+
+// compareInstalledApp decides whether the locally built app should be installed, replacing the
+// given installed app. Returns the reason of the decision along with the decision itself.
+func compareInstalledApp(installed installedAppInfo, local localAppInfo) (bool, string) {
+	if local.VersionCode != 0 && installed.VersionCode != local.VersionCode {
+		return true, fmt.Sprintf("the installed version code (%v) is different from the local version code (%v)", installed.VersionCode, local.VersionCode)
+	}
+
+	features := make([]string, 0, len(local.FeatureApkHashes))
+	for name := range local.FeatureApkHashes {
+		features = append(features, name)
+	}
+	sort.Strings(features)
+
+	for _, name := range features {
+		if _, ok := installed.SplitApkHashes[name]; !ok {
+			return true, fmt.Sprintf("the feature module %q is not installed", name)
+		}
+	}
+
+	// The hashes are the most reliable source, if available for all the .apk files.
+	if installed.ApkHash != "" && local.ApkHash != "" {
+		if installed.ApkHash != local.ApkHash {
+			return true, "the installed .apk is different from the local .apk"
+		}
+
+		identical := true
+		for _, name := range features {
+			installedHash, localHash := installed.SplitApkHashes[name], local.FeatureApkHashes[name]
+			if installedHash == "" || localHash == "" {
+				identical = false
+				continue
+			}
+			if installedHash != localHash {
+				return true, fmt.Sprintf("the installed .apk of the feature module %q is different from the local .apk", name)
+			}
+		}
+
+		if identical {
+			return false, "the installed .apk is identical to the local .apk"
+		}
+	}
+
+	if !installed.LastUpdateTime.IsZero() {
+		if local.LastModifiedTime.After(installed.LastUpdateTime) {
+			return true, "the local build is newer than the installed app"
+		}
+		return false, "the installed app was updated after the local build"
+	}
+
+	return true, "the installed app could not be compared with the local build"
+}
+
+// getInstalledAppInfo returns the version code, the last update time, and the hash of the app
+// installed on the given device.
+func getInstalledAppInfo(d device, appID string) (installedAppInfo, error) {
+	sh := gosh.NewShell(nil)
+	defer sh.Cleanup()
+
+	sh.ContinueOnError = true
+
+	// Run "adb shell dumpsys package <app_id>" to get the version code and the last update time.
+	cmd := sh.Cmd("adb", "-s", d.Serial, "shell", "dumpsys", "package", appID)
+	dump := cmd.Stdout()
+
+	// The last update time is shown in the local time of the device, so the time zone offset of the
+	// device is needed as well.
+	cmd = sh.Cmd("adb", "-s", d.Serial, "shell", "date", "+%z")
+	offset := cmd.Stdout()
+
+	// Run "adb shell pm path --user <user_id> <app_id>" to get the location of the installed .apk.
+	cmdArgs := []string{"-s", d.Serial, "shell", "pm", "path"}
+	if d.UserID != "" {
+		cmdArgs = append(cmdArgs, "--user", d.UserID)
+	}
+	cmdArgs = append(cmdArgs, appID)
+	cmd = sh.Cmd("adb", cmdArgs...)
+	paths := cmd.Stdout()
+
+	if sh.Err != nil {
+		return installedAppInfo{}, sh.Err
+	}
+
+	info, err := parsePackageDump(dump, offset)
+	if err != nil {
+		return installedAppInfo{}, err
+	}
+
+	// Compute the hash of the installed .apk on the device. Older devices do not have the "sha256sum"
+	// command, in which case the hash is left empty.
+	if apkPath := parseBaseApkPath(paths); apkPath != "" {
+		cmd = sh.Cmd("adb", "-s", d.Serial, "shell", "sha256sum", apkPath)
+		output := cmd.Stdout()
+		if sh.Err == nil {
+			info.ApkHash = parseSha256Output(output)
+		}
 	}
 
-	// TODO(youngseokyoon): check the "lastUpdateTime" property of the installed app.
-	// For now, assume the app is outdated, and just return true to install.
-	return true, nil
+	// Compute the hashes of the installed split .apk files as well, so that the dynamic feature
+	// modules can be compared.
+	splitPaths := parseSplitApkPaths(paths)
+	if len(splitPaths) > 0 {
+		info.SplitApkHashes = map[string]string{}
+	}
+	for name, apkPath := range splitPaths {
+		info.SplitApkHashes[name] = ""
+		if info.ApkHash == "" || sh.Err != nil {
+			continue
+		}
+
+		cmd = sh.Cmd("adb", "-s", d.Serial, "shell", "sha256sum", apkPath)
+		output := cmd.Stdout()
+		if sh.Err == nil {
+			info.SplitApkHashes[name] = parseSha256Output(output)
+		}
+	}
+
+	return info, nil
+}
+
+// parsePackageDump takes the output of "adb shell dumpsys package <app_id>" command and the time
+// zone offset of the device (e.g., "-0700"), and extracts the version code and the last update time
+// of the installed app.
+func parsePackageDump(output, offset string) (installedAppInfo, error) {
+	info := installedAppInfo{}
+
+	// The output may contain multiple package sections (e.g., for a system app which is updated).
+	// The first section is for the currently installed package.
+	versionCodeExp := regexp.MustCompile(`versionCode=(\d+)`)
+	matches := versionCodeExp.FindStringSubmatch(output)
+	if matches == nil {
+		return info, fmt.Errorf("Could not extract the version code from the package information.")
+	}
+	versionCode, err := strconv.Atoi(matches[1])
+	if err != nil {
+		return info, err
+	}
+	info.VersionCode = versionCode
+
+	lastUpdateTimeExp := regexp.MustCompile(`lastUpdateTime=(\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2})`)
+	if matches = lastUpdateTimeExp.FindStringSubmatch(output); matches != nil {
+		lastUpdateTime, err := time.Parse("2006-01-02 15:04:05 -0700", matches[1]+" "+strings.TrimSpace(offset))
+		if err != nil {
+			return info, fmt.Errorf("Could not parse the last update time of the app: %v", err)
+		}
+		info.LastUpdateTime = lastUpdateTime
+	}
+
+	return info, nil
+}
+
+// parseApkPaths takes the output of "adb shell pm path <app_id>" command, where each line has the
+// format "package:<path>", and returns all the .apk paths.
+func parseApkPaths(output string) []string {
+	paths := []string{}
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "package:") {
+			paths = append(paths, strings.TrimPrefix(line, "package:"))
+		}
+	}
+
+	return paths
+}
+
+// parseSplitApkPaths takes the output of "adb shell pm path <app_id>" command, and extracts the
+// paths of the split .apk files other than the config splits, keyed on their split names. The split
+// .apk files are named "split_<split_name>.apk".
+func parseSplitApkPaths(output string) map[string]string {
+	result := map[string]string{}
+	for _, path := range parseApkPaths(output) {
+		name := filepath.Base(path)
+		if !strings.HasPrefix(name, "split_") || !strings.HasSuffix(name, ".apk") {
+			continue
+		}
+
+		splitName := strings.TrimSuffix(strings.TrimPrefix(name, "split_"), ".apk")
+		if !strings.HasPrefix(splitName, "config.") {
+			result[splitName] = path
+		}
+	}
+
+	return result
+}
+
+// parseBaseApkPath takes the output of "adb shell pm path <app_id>" command, and extracts the path
+// of the base .apk file. Returns an empty string if no path is found.
+func parseBaseApkPath(output string) string {
+	// When the app consists of multiple split .apk files, the base .apk is the one named "base.apk".
+	paths := parseApkPaths(output)
+	for _, path := range paths {
+		if filepath.Base(path) == "base.apk" {
+			return path
+		}
+	}
+	if len(paths) > 0 {
+		return paths[0]
+	}
+
+	return ""
+}
+
+// parseSha256Output takes the output of "adb shell sha256sum <path>" command, and extracts the
+// hash. Returns an empty string when the output does not contain a valid hash, which happens when
+// the command is not available on the device.
+func parseSha256Output(output string) string {
+	fields := strings.Fields(output)
+	if len(fields) == 0 {
+		return ""
+	}
+
+	hash := strings.ToLower(fields[0])
+	if matched, _ := regexp.MatchString(`^[0-9a-f]{64}$`, hash); !matched {
+		return ""
+	}
+
+	return hash
 }
 
 // isInstalled determines whether the app variant is already installed on the given device.
@@ -219,6 +798,16 @@ func parseSupportedAbis(output string) ([]string, error) {
 	return nil, fmt.Errorf("Could not extract the abi list from the device configuration output.")
 }
 
+// getSdkVersionForDevice returns the API level of the given device.
+func getSdkVersionForDevice(d device) (int, error) {
+	props, err := getDeviceProperties(d.Serial)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(props["ro.build.version.sdk"])
+}
+
 // getScreenDensityForDevice returns the numeric screen dpi value of the given device.
 func getScreenDensityForDevice(d device) (int, error) {
 	sh := gosh.NewShell(nil)
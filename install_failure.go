@@ -0,0 +1,263 @@
+// Copyright 2016 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"v.io/x/lib/gosh"
+)
+
+var (
+	onSignatureMismatchFlag string
+	allowDowngradeFlag      bool
+	allowTestOnlyFlag       bool
+)
+
+// initializeInstallFailureFlags sets up the flags for resolving the common installation failures.
+func initializeInstallFailureFlags(flags *flag.FlagSet) {
+	flags.StringVar(&onSignatureMismatchFlag, "on-signature-mismatch", "fail", `Specify what to do when the installed app is signed with a different key (INSTALL_FAILED_UPDATE_INCOMPATIBLE). You can choose from the following options:
+    fail      - Report the failure and skip the device.
+    uninstall - Uninstall the existing app for all users on the device, and retry the installation.
+                Note that this removes all the data of the app.`)
+	flags.BoolVar(&allowDowngradeFlag, "allow-downgrade", false, `Retry the installation allowing the version code downgrade, when the installed app has a higher version code (INSTALL_FAILED_VERSION_DOWNGRADE).`)
+	flags.BoolVar(&allowTestOnlyFlag, "allow-test-only", false, `Retry the installation allowing the test-only app, when the app is marked as test-only (INSTALL_FAILED_TEST_ONLY).`)
+}
+
+// validateInstallFailureFlags checks whether the flags for resolving the installation failures have
+// the allowed values.
+func validateInstallFailureFlags() error {
+	allowed := []string{"fail", "uninstall"}
+	if !isStringInSlice(onSignatureMismatchFlag, allowed) {
+		return fmt.Errorf("The -on-signature-mismatch flag value must be one of %v", strings.Join(allowed, ", "))
+	}
+
+	return nil
+}
+
+// installFailure is a failure reported by "adb install", classified by its failure code.
+type installFailure struct {
+	// Code is the failure code (e.g., "INSTALL_FAILED_VERSION_DOWNGRADE").
+	Code string
+	// Detail is the message following the failure code, if any.
+	Detail string
+}
+
+// installFailureDescription describes a known installation failure in a human-readable form.
+type installFailureDescription struct {
+	Reason string
+	Remedy string
+}
+
+// installFailureDescriptions contains the descriptions of the common installation failures. The
+// remedies are also reported for the problems found by the pre-install checks.
+var installFailureDescriptions = map[string]installFailureDescription{
+	"INSTALL_FAILED_UPDATE_INCOMPATIBLE": {
+		"The installed app is signed with a different key (e.g., a release build installed over a debug build).",
+		"Uninstall the existing app first (e.g., by running 'madb uninstall'), sign the app with the same key, or use '-on-signature-mismatch=uninstall' flag.",
+	},
+	"INSTALL_FAILED_VERSION_DOWNGRADE": {
+		"The installed app has a higher version code than the app being installed.",
+		"Uninstall the existing app first, or use '-allow-downgrade' flag.",
+	},
+	"INSTALL_FAILED_INSUFFICIENT_STORAGE": {
+		"The device does not have enough storage space.",
+		"Free up some space on the device, for example by uninstalling unused apps or clearing app data.",
+	},
+	"INSTALL_FAILED_TEST_ONLY": {
+		"The app is marked as test-only, which is the case for the builds run from Android Studio.",
+		"Build the app with Gradle, or use '-allow-test-only' flag.",
+	},
+	"INSTALL_FAILED_OLDER_SDK": {
+		"The minSdkVersion of the app is higher than the API level of the device.",
+		"Use a device or an emulator running a newer version of Android, or lower the minSdkVersion of the app.",
+	},
+	"INSTALL_FAILED_NO_MATCHING_ABIS": {
+		"The app does not contain native libraries for any of the ABIs supported by the device.",
+		"Build the app for one of the ABIs supported by the device, or install the universal .apk.",
+	},
+	"INSTALL_FAILED_DEPRECATED_SDK_VERSION": {
+		"The targetSdkVersion of the app is too low for the API level of the device.",
+		"Raise the targetSdkVersion of the app.",
+	},
+	"INSTALL_FAILED_DUPLICATE_PERMISSION": {
+		"Another app installed on the device defines the same custom permission.",
+		"Uninstall the other app which defines the permission.",
+	},
+	"INSTALL_FAILED_CONFLICTING_PROVIDER": {
+		"Another app installed on the device uses the same content provider authority.",
+		"Uninstall the other app, or change the authority of the content provider.",
+	},
+	"INSTALL_FAILED_MISSING_SHARED_LIBRARY": {
+		"The device does not have a shared library required by the app.",
+		"Use a device with the required library (e.g., a device with the Google APIs).",
+	},
+	"INSTALL_FAILED_MISSING_SPLIT": {
+		"The app requires a split .apk which is not being installed.",
+		"Install all the required split .apk files together.",
+	},
+	"INSTALL_FAILED_USER_RESTRICTED": {
+		"The user of the device does not allow installing apps via USB.",
+		"Enable \"Install via USB\" in the developer options of the device.",
+	},
+	"INSTALL_PARSE_FAILED_NO_CERTIFICATES": {
+		"The .apk file is not signed.",
+		"Sign the .apk file, or build a signed variant.",
+	},
+}
+
+// parseInstallFailure takes the output of "adb install" command, and extracts the failure, if any.
+// Returns nil when the output does not contain any failure codes.
+func parseInstallFailure(output string) *installFailure {
+	// The failure is printed as "Failure [<code>]" or "Failure [<code>: <detail>]", possibly preceded
+	// by "adb: failed to install <apk>: ".
+	exp := regexp.MustCompile(`\[(INSTALL_(?:PARSE_)?FAILED_[A-Z0-9_]+)(?::\s*([^\]]*))?\]`)
+	matches := exp.FindStringSubmatch(output)
+	if matches == nil {
+		return nil
+	}
+
+	return &installFailure{Code: matches[1], Detail: strings.TrimSpace(matches[2])}
+}
+
+// String returns the human-readable description of the failure, including the remedy if known.
+func (f installFailure) String() string {
+	result := f.Code
+	if f.Detail != "" {
+		result += ": " + f.Detail
+	}
+
+	if desc, ok := installFailureDescriptions[f.Code]; ok {
+		result += "\n" + desc.Reason + " " + desc.Remedy
+	}
+
+	return result
+}
+
+// installRemediation is an action which resolves an installation failure before retrying the
+// installation.
+type installRemediation struct {
+	// Description describes the action taken, which is reported for the device.
+	Description string
+	// InstallArgs are the additional arguments for the "adb install" command when retrying.
+	InstallArgs []string
+	// Uninstall indicates that the existing app should be uninstalled before retrying.
+	Uninstall bool
+}
+
+// getInstallRemediation returns the remediation for the given failure allowed by the flags.
+// Returns nil if the failure should not be resolved automatically.
+func getInstallRemediation(failure installFailure) *installRemediation {
+	switch {
+	case failure.Code == "INSTALL_FAILED_UPDATE_INCOMPATIBLE" && onSignatureMismatchFlag == "uninstall":
+		return &installRemediation{Description: "uninstalled the existing app signed with a different key", Uninstall: true}
+	case failure.Code == "INSTALL_FAILED_VERSION_DOWNGRADE" && allowDowngradeFlag:
+		return &installRemediation{Description: "allowed the version code downgrade", InstallArgs: []string{"-d"}}
+	case failure.Code == "INSTALL_FAILED_TEST_ONLY" && allowTestOnlyFlag:
+		return &installRemediation{Description: "allowed the test-only app", InstallArgs: []string{"-t"}}
+	}
+
+	return nil
+}
+
+// installApksToDevice installs the given .apk files on the given device. A single .apk is installed
+// with "adb install", and multiple .apk files are installed atomically with "adb install-multiple".
+// When the installation fails, the failure is classified and resolved automatically as allowed by
+// the flags, and the installation is retried. The actions taken are reported for the device.
+func installApksToDevice(d device, appID string, apks []string) error {
+	installArgs := []string{}
+	actions := []string{}
+
+	for {
+		failure, err := runInstallCommand(d, apks, installArgs)
+		if failure == nil {
+			if err == nil && len(actions) > 0 {
+				printDeviceMessage(d, "Installed the app after resolving the failures (%v).", strings.Join(actions, ", "))
+			}
+			return err
+		}
+
+		remediation := getInstallRemediation(*failure)
+		if remediation == nil || isStringInSlice(remediation.Description, actions) {
+			if len(actions) > 0 {
+				return fmt.Errorf("Failed to install the app on device %q after resolving the failures (%v): %v", d.displayName(), strings.Join(actions, ", "), failure)
+			}
+			return fmt.Errorf("Failed to install the app on device %q: %v", d.displayName(), failure)
+		}
+
+		if remediation.Uninstall {
+			if err := uninstallAppForAllUsers(d, appID); err != nil {
+				return fmt.Errorf("Failed to uninstall the existing app on device %q: %v", d.displayName(), err)
+			}
+		}
+
+		installArgs = append(installArgs, remediation.InstallArgs...)
+		actions = append(actions, remediation.Description)
+		printDeviceMessage(d, "Installation failed with %v. Retrying the installation after this action: %v.", failure.Code, remediation.Description)
+	}
+}
+
+// runInstallCommand runs the "adb install" or "adb install-multiple" command with the given
+// additional arguments, and returns the failure parsed from the output, if any. Older versions of
+// adb exit successfully even when the installation fails, so the output is always inspected.
+func runInstallCommand(d device, apks []string, installArgs []string) (*installFailure, error) {
+	// Use an install session for tracking the progress, if supported by the device.
+	if installProgressReporter != nil {
+		if sdkVersion, err := getSdkVersionForDevice(d); err == nil && sdkVersion >= 21 {
+			return runSessionInstallCommand(d, apks, installArgs)
+		}
+		installProgressReporter.setPhase(progressName(d), phaseAdbInstall)
+	}
+
+	sh := gosh.NewShell(nil)
+	defer sh.Cleanup()
+
+	sh.ContinueOnError = true
+
+	installCmd := "install"
+	if len(apks) > 1 {
+		installCmd = "install-multiple"
+	}
+
+	cmdArgs := []string{"-s", d.Serial, installCmd, "-r"}
+	cmdArgs = append(cmdArgs, installArgs...)
+	if d.UserID != "" {
+		cmdArgs = append(cmdArgs, "--user", d.UserID)
+	}
+	cmdArgs = append(cmdArgs, apks...)
+	cmd := sh.Cmd("adb", cmdArgs...)
+
+	output := bytes.Buffer{}
+	err := runGoshCommandForDeviceWithWriters(cmd, d, true, io.MultiWriter(os.Stdout, &output), io.MultiWriter(os.Stderr, &output))
+	failure := parseInstallFailure(output.String())
+
+	if installProgressReporter != nil {
+		phase := phaseDone
+		if err != nil || failure != nil {
+			phase = phaseFailed
+		}
+		installProgressReporter.setPhase(progressName(d), phase)
+	}
+
+	return failure, err
+}
+
+// uninstallAppForAllUsers uninstalls the given app for all users on the given device. The app must
+// be removed for all users, because the signature is shared among the users.
+func uninstallAppForAllUsers(d device, appID string) error {
+	sh := gosh.NewShell(nil)
+	defer sh.Cleanup()
+
+	sh.ContinueOnError = true
+
+	cmd := sh.Cmd("adb", "-s", d.Serial, "uninstall", appID)
+	return runGoshCommandForDevice(cmd, d, false)
+}
@@ -0,0 +1,70 @@
+// Copyright 2016 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseInstallFailure(t *testing.T) {
+	tests := []struct {
+		output string
+		want   *installFailure
+	}{
+		{
+			"Performing Streamed Install\nadb: failed to install app-debug.apk: Failure [INSTALL_FAILED_UPDATE_INCOMPATIBLE: Package com.example.app signatures do not match previously installed version; ignoring!]\n",
+			&installFailure{"INSTALL_FAILED_UPDATE_INCOMPATIBLE", "Package com.example.app signatures do not match previously installed version; ignoring!"},
+		},
+		{
+			"\tpkg: /data/local/tmp/app-debug.apk\r\nFailure [INSTALL_FAILED_VERSION_DOWNGRADE]\r\n",
+			&installFailure{"INSTALL_FAILED_VERSION_DOWNGRADE", ""},
+		},
+		{
+			"Failure [INSTALL_PARSE_FAILED_NO_CERTIFICATES: Failed to collect certificates from /data/app/vmdl.tmp/base.apk]",
+			&installFailure{"INSTALL_PARSE_FAILED_NO_CERTIFICATES", "Failed to collect certificates from /data/app/vmdl.tmp/base.apk"},
+		},
+		{"Performing Streamed Install\nSuccess\n", nil},
+	}
+
+	for i, test := range tests {
+		if got := parseInstallFailure(test.output); !reflect.DeepEqual(got, test.want) {
+			t.Fatalf("unmatched results for tests[%v]: got %v, want %v", i, got, test.want)
+		}
+	}
+}
+
+func TestGetInstallRemediation(t *testing.T) {
+	defer func(mismatch string, downgrade, testOnly bool) {
+		onSignatureMismatchFlag, allowDowngradeFlag, allowTestOnlyFlag = mismatch, downgrade, testOnly
+	}(onSignatureMismatchFlag, allowDowngradeFlag, allowTestOnlyFlag)
+
+	mismatch := installFailure{Code: "INSTALL_FAILED_UPDATE_INCOMPATIBLE"}
+	downgrade := installFailure{Code: "INSTALL_FAILED_VERSION_DOWNGRADE"}
+	testOnly := installFailure{Code: "INSTALL_FAILED_TEST_ONLY"}
+	storage := installFailure{Code: "INSTALL_FAILED_INSUFFICIENT_STORAGE"}
+
+	// Nothing is resolved automatically by default.
+	onSignatureMismatchFlag, allowDowngradeFlag, allowTestOnlyFlag = "fail", false, false
+	for _, failure := range []installFailure{mismatch, downgrade, testOnly, storage} {
+		if got := getInstallRemediation(failure); got != nil {
+			t.Fatalf("unexpected remediation for %v: %v", failure.Code, got)
+		}
+	}
+
+	onSignatureMismatchFlag, allowDowngradeFlag, allowTestOnlyFlag = "uninstall", true, true
+	if got := getInstallRemediation(mismatch); got == nil || !got.Uninstall {
+		t.Fatalf("unexpected remediation for %v: %v", mismatch.Code, got)
+	}
+	if got := getInstallRemediation(downgrade); got == nil || !reflect.DeepEqual(got.InstallArgs, []string{"-d"}) {
+		t.Fatalf("unexpected remediation for %v: %v", downgrade.Code, got)
+	}
+	if got := getInstallRemediation(testOnly); got == nil || !reflect.DeepEqual(got.InstallArgs, []string{"-t"}) {
+		t.Fatalf("unexpected remediation for %v: %v", testOnly.Code, got)
+	}
+	if got := getInstallRemediation(storage); got != nil {
+		t.Fatalf("unexpected remediation for %v: %v", storage.Code, got)
+	}
+}
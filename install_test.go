@@ -10,6 +10,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestParseSupportedAbis(t *testing.T) {
@@ -151,3 +152,152 @@ func TestComputeBestOutputForDensitySplits(t *testing.T) {
 		}
 	}
 }
+
+func TestParsePackageDump(t *testing.T) {
+	output := `Packages:
+  Package [com.example.app] (3d8f1a2):
+    userId=10123
+    pkg=Package{9b0c3e4 com.example.app}
+    codePath=/data/app/com.example.app-1
+    versionCode=42 minSdk=21 targetSdk=28
+    versionName=1.2.0
+    firstInstallTime=2016-05-10 10:27:54
+    lastUpdateTime=2016-05-11 09:01:02
+`
+
+	got, err := parsePackageDump(output, "-0700\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := installedAppInfo{
+		VersionCode:    42,
+		LastUpdateTime: time.Date(2016, 5, 11, 16, 1, 2, 0, time.UTC),
+	}
+	if got.VersionCode != want.VersionCode || !got.LastUpdateTime.Equal(want.LastUpdateTime) {
+		t.Fatalf("unmatched results: got %v, want %v", got, want)
+	}
+
+	if _, err := parsePackageDump("Unable to find package: com.example.app", "+0000"); err == nil {
+		t.Fatalf("expected an error but succeeded.")
+	}
+}
+
+func TestParseBaseApkPath(t *testing.T) {
+	tests := []struct {
+		output string
+		want   string
+	}{
+		{"package:/data/app/com.example.app-1/base.apk\n", "/data/app/com.example.app-1/base.apk"},
+		{
+			"package:/data/app/com.example.app-1/split_config.arm64_v8a.apk\r\npackage:/data/app/com.example.app-1/base.apk\r\n",
+			"/data/app/com.example.app-1/base.apk",
+		},
+		{"package:/data/app/com.example.app-1.apk", "/data/app/com.example.app-1.apk"},
+		{"", ""},
+	}
+
+	for i, test := range tests {
+		if got := parseBaseApkPath(test.output); got != test.want {
+			t.Fatalf("unmatched results for tests[%v]: got %v, want %v", i, got, test.want)
+		}
+	}
+}
+
+func TestParseSplitApkPaths(t *testing.T) {
+	output := "package:/data/app/com.example.app-1/base.apk\r\n" +
+		"package:/data/app/com.example.app-1/split_config.arm64_v8a.apk\r\n" +
+		"package:/data/app/com.example.app-1/split_camera.apk\r\n"
+
+	got := parseSplitApkPaths(output)
+	want := map[string]string{"camera": "/data/app/com.example.app-1/split_camera.apk"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unmatched results: got %v, want %v", got, want)
+	}
+}
+
+func TestParseSha256Output(t *testing.T) {
+	hash := "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	tests := []struct {
+		output string
+		want   string
+	}{
+		{hash + "  /data/app/com.example.app-1/base.apk\r\n", hash},
+		{"/system/bin/sh: sha256sum: not found", ""},
+		{"", ""},
+	}
+
+	for i, test := range tests {
+		if got := parseSha256Output(test.output); got != test.want {
+			t.Fatalf("unmatched results for tests[%v]: got %v, want %v", i, got, test.want)
+		}
+	}
+}
+
+func TestCompareInstalledApp(t *testing.T) {
+	updated := time.Date(2016, 5, 11, 16, 1, 2, 0, time.UTC)
+	before, after := updated.Add(-time.Hour), updated.Add(time.Hour)
+
+	tests := []struct {
+		installed installedAppInfo
+		local     localAppInfo
+		want      bool
+	}{
+		// Different version codes.
+		{installedAppInfo{1, updated, "a", nil}, localAppInfo{2, before, "a", nil}, true},
+		// Identical hashes take precedence over the timestamps.
+		{installedAppInfo{1, updated, "a", nil}, localAppInfo{1, after, "a", nil}, false},
+		{installedAppInfo{1, updated, "a", nil}, localAppInfo{1, before, "b", nil}, true},
+		// No hashes; compare the timestamps.
+		{installedAppInfo{1, updated, "", nil}, localAppInfo{1, after, "b", nil}, true},
+		{installedAppInfo{1, updated, "", nil}, localAppInfo{1, before, "b", nil}, false},
+		// Unknown local version code (e.g., app bundles).
+		{installedAppInfo{1, updated, "a", nil}, localAppInfo{0, before, "", nil}, false},
+		// Nothing to compare.
+		{installedAppInfo{1, time.Time{}, "", nil}, localAppInfo{1, before, "", nil}, true},
+		// The feature modules are compared along with the base .apk.
+		{installedAppInfo{1, updated, "a", map[string]string{"camera": "c"}}, localAppInfo{1, after, "a", map[string]string{"camera": "c"}}, false},
+		{installedAppInfo{1, updated, "a", map[string]string{"camera": "c"}}, localAppInfo{1, before, "a", map[string]string{"camera": "d"}}, true},
+		{installedAppInfo{1, updated, "a", nil}, localAppInfo{1, before, "a", map[string]string{"camera": "c"}}, true},
+		// The hash of a feature module is not available; compare the timestamps.
+		{installedAppInfo{1, updated, "a", map[string]string{"camera": ""}}, localAppInfo{1, after, "a", map[string]string{"camera": "c"}}, true},
+		{installedAppInfo{1, updated, "a", map[string]string{"camera": ""}}, localAppInfo{1, before, "a", map[string]string{"camera": "c"}}, false},
+	}
+
+	for i, test := range tests {
+		if got, reason := compareInstalledApp(test.installed, test.local); got != test.want {
+			t.Fatalf("unmatched results for tests[%v]: got %v (%v), want %v", i, got, reason, test.want)
+		}
+	}
+}
+
+func TestSelectSplitOutputs(t *testing.T) {
+	splitArm := variantOutput{Name: "arm64", Filters: []filter{{"ABI", "arm64-v8a"}}}
+	splitX86 := variantOutput{Name: "x86", Filters: []filter{{"ABI", "x86"}}}
+	splitMdpi := variantOutput{Name: "mdpi", Filters: []filter{{"DENSITY", "mdpi"}}}
+	splitXhdpi := variantOutput{Name: "xhdpi", Filters: []filter{{"DENSITY", "xhdpi"}}}
+	splitXxhdpi := variantOutput{Name: "xxhdpi", Filters: []filter{{"DENSITY", "xxhdpi"}}}
+	splitFr := variantOutput{Name: "fr", Filters: []filter{{"LANGUAGE", "fr,fr-rCA"}}}
+	splitKo := variantOutput{Name: "ko", Filters: []filter{{"LANGUAGE", "ko"}}}
+
+	splits := []variantOutput{splitArm, splitX86, splitMdpi, splitXhdpi, splitXxhdpi, splitFr, splitKo}
+
+	tests := []struct {
+		deviceDensity int
+		deviceAbis    []string
+		deviceLocales []string
+		want          []variantOutput
+	}{
+		{320, []string{"arm64-v8a", "armeabi-v7a"}, []string{"fr-CA"}, []variantOutput{splitFr, splitArm, splitXhdpi}},
+		// The higher density wins the tie between xhdpi (320) and xxhdpi (480).
+		{400, []string{"x86_64", "x86"}, []string{"en-US"}, []variantOutput{splitX86, splitXxhdpi}},
+		{120, []string{"mips"}, []string{"ko-KR", "fr-FR"}, []variantOutput{splitFr, splitKo, splitMdpi}},
+		{280, []string{"x86"}, []string{"en-US"}, []variantOutput{splitX86, splitXhdpi}},
+	}
+
+	for i, test := range tests {
+		if got := selectSplitOutputs(splits, test.deviceDensity, test.deviceAbis, test.deviceLocales); !reflect.DeepEqual(got, test.want) {
+			t.Fatalf("unmatched results for tests[%v]: got %v, want %v", i, got, test.want)
+		}
+	}
+}
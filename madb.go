@@ -16,6 +16,7 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -44,7 +45,20 @@ var (
 	moduleFlag     string
 	variantFlag    string
 
-	buildFlag bool
+	buildFlag      bool
+	bundleFlag     bool
+	bundletoolFlag string
+	ksFlag         string
+	ksKeyAliasFlag string
+	ksPassFlag     string
+	keyPassFlag    string
+
+	apkDirFlag string
+
+	hardwareSerialFlag bool
+
+	allUsersFlag bool
+	usersFlag    string
 
 	wd string // working directory
 )
@@ -52,7 +66,7 @@ var (
 func init() {
 	cmdMadb.Flags.BoolVar(&allDevicesFlag, "d", false, `Restrict the command to only run on real devices.`)
 	cmdMadb.Flags.BoolVar(&allEmulatorsFlag, "e", false, `Restrict the command to only run on emulators.`)
-	cmdMadb.Flags.StringVar(&devicesFlag, "n", "", `Comma-separated device serials, qualifiers, device indices (e.g., '@1', '@2'), nicknames (set by 'madb name'), or group names (set by 'madb group'). A device index is specified by an '@' sign followed by the index of the device in the output of 'adb devices' command, starting from 1. Command will be run only on specified devices.`)
+	cmdMadb.Flags.StringVar(&devicesFlag, "n", "", `Comma-separated device serials, qualifiers, device indices (e.g., '@1', '@2'), nicknames (set by 'madb name'), group names (set by 'madb group'), tags (e.g., 'tag:flaky'), or metadata (e.g., 'rack=3') (set by 'madb tag'). A device index is specified by an '@' sign followed by the index of the device in the output of 'adb devices' command, starting from 1. Command will be run only on specified devices.`)
 	cmdMadb.Flags.BoolVar(&sequentialFlag, "seq", false, `Run the command sequentially, instead of running it in parallel.`)
 	cmdMadb.Flags.StringVar(&prefixFlag, "prefix", "name", `Specify which output prefix to use. You can choose from the following options:
     name   - Display the nickname of the device. The serial number is used instead if the
@@ -71,17 +85,42 @@ func init() {
 // initializePropertyCacheFlags sets up the flags related to extracting and caching project properties.
 func initializePropertyCacheFlags(flags *flag.FlagSet) {
 	flags.BoolVar(&clearCacheFlag, "clear-cache", false, `Clear the cache and re-extract the variant properties such as the application ID and the main activity name. Only takes effect when no arguments are provided.`)
-	flags.StringVar(&moduleFlag, "module", "", `Specify which application module to use, when the current directory is the top level Gradle project containing multiple sub-modules. When not specified, the first available application module is used. Only takes effect when no arguments are provided.`)
-	flags.StringVar(&variantFlag, "variant", "", `Specify which build variant to use. When not specified, the first available build variant is used. Only takes effect when no arguments are provided.`)
+	flags.StringVar(&moduleFlag, "module", "", `Specify which application module to use, when the current directory is the top level Gradle project containing multiple sub-modules. When not specified, the first available application module is used. A comma-separated list of modules (e.g., 'client,server'), or 'all' for all the application modules, can be specified as well, in which case 'madb install' and 'madb start' install the apps of all the modules, and the other commands use the first module. The available modules can be listed with 'madb variants'. Only takes effect when no arguments are provided.`)
+	flags.StringVar(&variantFlag, "variant", "", `Specify which build variant to use. When not specified, the first available build variant is used. The available variants can be listed with 'madb variants'. Only takes effect when no arguments are provided.`)
+	flags.StringVar(&variantMapFlag, "variant-map", "", `Comma-separated entries mapping the devices to different application modules or build variants, in the form of '<device_specifier>=<target>' (e.g., 'Tablets=tabletDebug,tag:wear=:wear'). The device specifier is any specifier accepted by the -n flag. The target is either '<variant>' for a build variant of the default module, ':<module>' for the default build variant of a module, or ':<module>:<variant>'. The first entry matching a device is used, and the devices matching none of the entries use the -module and -variant flags. Each of the needed variants is extracted and built only once. Cannot be used when the arguments are provided.`)
+}
+
+// initializeUsersFlags sets up the flags for running the command for multiple users on each device.
+func initializeUsersFlags(flags *flag.FlagSet) {
+	flags.BoolVar(&allUsersFlag, "all-users", false, `Run the command once for each of the available users on each device, instead of only for the default user. Cannot be used with the -users flag.`)
+	flags.StringVar(&usersFlag, "users", "", `Comma-separated user IDs (e.g., '0,10') for which the command should be run on each device, instead of only for the default user. Cannot be used with the -all-users flag.`)
+}
+
+// initializeHardwareSerialFlag sets up the flag for keying the config entries on the hardware serial.
+func initializeHardwareSerialFlag(flags *flag.FlagSet) {
+	flags.BoolVar(&hardwareSerialFlag, "hardware-serial", false, `Resolve the given device to its hardware serial number (i.e., 'ro.serialno' property) and store the setting under the 'serialno:<hardware_serial>' specifier, so that the setting follows the device even when its adb serial changes (e.g., when connected over Wi-Fi using 'adb tcpip'). The device must be currently connected.`)
 }
 
 // initializeBuildFlags sets up the flags related to running Gradle build tasks.
 func initializeBuildFlags(flags *flag.FlagSet) {
 	flags.BoolVar(&buildFlag, "build", true, `Build the target app variant before installing or running the app.`)
+	flags.BoolVar(&bundleFlag, "bundle", false, `Build the Android App Bundle (.aab) of the target app variant, and install the device-specific APKs generated from the bundle using bundletool, instead of the .apk outputs.`)
+	flags.StringVar(&bundletoolFlag, "bundletool", "bundletool", `The bundletool command, or the path to the bundletool .jar file. Only used when the "-bundle" flag is set.`)
+	flags.StringVar(&ksFlag, "ks", "", `The keystore used by bundletool for signing the APKs generated from the app bundle. When not specified, the APKs are signed with the debug keystore. Only used when the "-bundle" flag is set.`)
+	flags.StringVar(&ksKeyAliasFlag, "ks-key-alias", "", `The alias of the signing key in the keystore given by the "-ks" flag.`)
+	flags.StringVar(&ksPassFlag, "ks-pass", "", `The password of the keystore given by the "-ks" flag, in the form of 'pass:<password>' or 'file:<password_file>'.`)
+	flags.StringVar(&keyPassFlag, "key-pass", "", `The password of the signing key, in the form of 'pass:<password>' or 'file:<password_file>'. Defaults to the keystore password.`)
+}
+
+// initializeApkDirFlag sets up the flag for installing the app from a directory of prebuilt .apk files.
+func initializeApkDirFlag(flags *flag.FlagSet) {
+	flags.StringVar(&apkDirFlag, "apk-dir", "", `Install the app from the prebuilt .apk files in the given directory, instead of building the app from the current project. The best matching .apk for each device is chosen based on the ABIs and the screen densities read from the .apk files. Cannot be used when the arguments are provided.`)
 }
 
 var cmdMadb = &cmdline.Command{
 	Children: []*cmdline.Command{
+		cmdMadbAlias,
+		cmdMadbCache,
 		cmdMadbClearData,
 		cmdMadbExec,
 		cmdMadbExtern,
@@ -92,8 +131,10 @@ var cmdMadb = &cmdline.Command{
 		cmdMadbShell,
 		cmdMadbStart,
 		cmdMadbStop,
+		cmdMadbTag,
 		cmdMadbUninstall,
 		cmdMadbUser,
+		cmdMadbVariants,
 		cmdMadbVersion,
 	},
 	Name:  "madb",
@@ -107,6 +148,7 @@ and provides various features for controlling multiple Android devices concurren
 }
 
 func main() {
+	registerAliases(cmdMadb)
 	cmdline.Main(cmdMadb)
 }
 
@@ -135,8 +177,25 @@ type device struct {
 	Nickname   string
 	Index      int
 	UserID     string
+	// HardwareSerial is the serial number reported by the device itself
+	// (i.e., 'ro.serialno' property), which does not change when the device is
+	// connected over Wi-Fi. This is only resolved when the config or the device
+	// specifiers refer to any hardware serials.
+	HardwareSerial string
+	// Tags and Metadata are the free-form tags and the key/value metadata
+	// attached to this device by 'madb tag'.
+	Tags     []string
+	Metadata map[string]string
 }
 
+// hardwareSerialPrefix is the prefix of the device specifier that refers to a
+// device by its hardware serial (e.g., "serialno:HT4BVWV00023").
+const hardwareSerialPrefix = "serialno:"
+
+// tagPrefix is the prefix of the device specifier that refers to all the
+// devices with the given tag (e.g., "tag:flaky").
+const tagPrefix = "tag:"
+
 // Returns the display name which is intended to be used as the console output prefix.
 // This would be the nickname of the device if there is one; otherwise, the serial number is used.
 func (d device) displayName() string {
@@ -147,19 +206,150 @@ func (d device) displayName() string {
 	return d.Serial
 }
 
+// hardwareSerialSpecifier returns the "serialno:<hardware_serial>" specifier of
+// the device, or an empty string if the hardware serial is not resolved.
+func (d device) hardwareSerialSpecifier() string {
+	if d.HardwareSerial == "" {
+		return ""
+	}
+
+	return hardwareSerialPrefix + d.HardwareSerial
+}
+
+// configKeys returns the keys under which the config entries of this device
+// (e.g., default user IDs, tags and metadata) may be stored, in the order of precedence: the
+// device serial, the hardware serial specifier, and then the qualifiers.
+func (d device) configKeys() []string {
+	keys := []string{d.Serial}
+	if specifier := d.hardwareSerialSpecifier(); specifier != "" {
+		keys = append(keys, specifier)
+	}
+
+	return append(keys, d.Qualifiers...)
+}
+
+// matchesSerial determines whether the given serial string refers to this
+// device, by comparing it against the device serial, qualifiers, and the
+// hardware serial specifier.
+func (d device) matchesSerial(serial string) bool {
+	if d.Serial == serial {
+		return true
+	}
+
+	if serial != "" && d.hardwareSerialSpecifier() == serial {
+		return true
+	}
+
+	return isStringInSlice(serial, d.Qualifiers)
+}
+
+// matchesTagOrMetadata determines whether the given device specifier is a tag
+// specifier (e.g., "tag:flaky") or a metadata specifier (e.g., "rack=3") that
+// matches this device.
+func (d device) matchesTagOrMetadata(specifier string) bool {
+	if strings.HasPrefix(specifier, tagPrefix) {
+		return isStringInSlice(strings.TrimPrefix(specifier, tagPrefix), d.Tags)
+	}
+
+	if key, value, ok := parseMetadataEntry(specifier); ok {
+		v, present := d.Metadata[key]
+		return present && v == value
+	}
+
+	return false
+}
+
 // Runs "adb devices -l" command, and parses the result to get all the device serial numbers.
-func getDevices(cfg *config) ([]device, error) {
+// The hardware serials are resolved only when the config or the given device specifier tokens
+// refer to any of them.
+func getDevices(cfg *config, tokens []string) ([]device, error) {
+	var resolver hardwareSerialResolverFunc
+	if usesHardwareSerials(cfg, tokens) {
+		resolver = getHardwareSerial
+	}
+
+	return getDevicesWithResolver(cfg, resolver)
+}
+
+// getDevicesWithResolver returns the list of currently connected devices, using the given resolver
+// for resolving the hardware serial of each device. The resolver can be nil.
+func getDevicesWithResolver(cfg *config, resolver hardwareSerialResolverFunc) ([]device, error) {
 	sh := gosh.NewShell(nil)
 	defer sh.Cleanup()
 
 	output := sh.Cmd("adb", "devices", "-l").Stdout()
 
-	return parseDevicesOutput(output, cfg)
+	return parseDevicesOutput(output, cfg, resolver)
+}
+
+type hardwareSerialResolverFunc func(serial string) (string, error)
+
+// getHardwareSerial returns the hardware serial number of the given device, by reading the
+// "ro.serialno" property, or the "ro.boot.serialno" property if the former is not available.
+func getHardwareSerial(serial string) (string, error) {
+	sh := gosh.NewShell(nil)
+	defer sh.Cleanup()
+
+	sh.ContinueOnError = true
+
+	cmd := sh.Cmd("adb", "-s", serial, "shell", "getprop ro.serialno; getprop ro.boot.serialno")
+	output := cmd.Stdout()
+
+	if sh.Err != nil {
+		return "", sh.Err
+	}
+
+	return parseHardwareSerial(output)
+}
+
+// parseHardwareSerial takes the output of the "getprop ro.serialno; getprop ro.boot.serialno"
+// shell command, and returns the first valid serial number.
+func parseHardwareSerial(output string) (string, error) {
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && line != "unknown" {
+			return line, nil
+		}
+	}
+
+	return "", fmt.Errorf("Could not find the hardware serial from the device properties.")
+}
+
+// usesHardwareSerials determines whether any of the config entries or the given device specifier
+// tokens refer to a device by its hardware serial.
+func usesHardwareSerials(cfg *config, tokens []string) bool {
+	specifiers := append([]string{}, tokens...)
+	if cfg != nil {
+		for _, serial := range cfg.Names {
+			specifiers = append(specifiers, serial)
+		}
+		for serial := range cfg.UserIDs {
+			specifiers = append(specifiers, serial)
+		}
+		for serial := range cfg.Tags {
+			specifiers = append(specifiers, serial)
+		}
+		for serial := range cfg.Metadata {
+			specifiers = append(specifiers, serial)
+		}
+		for _, members := range cfg.Groups {
+			specifiers = append(specifiers, members...)
+		}
+	}
+
+	for _, specifier := range specifiers {
+		if strings.HasPrefix(specifier, hardwareSerialPrefix) {
+			return true
+		}
+	}
+
+	return false
 }
 
 // Parses the output generated from "adb devices -l" command and return the list of device serial numbers
 // Devices that are currently offline are excluded from the returned list.
-func parseDevicesOutput(output string, cfg *config) ([]device, error) {
+// When the resolver is provided, it is used for resolving the hardware serial of each device.
+func parseDevicesOutput(output string, cfg *config, resolver hardwareSerialResolverFunc) ([]device, error) {
 	lines := strings.Split(output, "\n")
 
 	result := []device{}
@@ -191,31 +381,66 @@ func parseDevicesOutput(output string, cfg *config) ([]device, error) {
 			d.Type = realDevice
 		}
 
+		result = append(result, d)
+	}
+
+	// Resolve the hardware serials, so that the config entries keyed on the hardware serial can be
+	// applied to the devices regardless of how they are connected. The devices are queried in
+	// parallel, since each query runs an adb command.
+	if resolver != nil {
+		errs := make([]error, len(result))
+		var wg sync.WaitGroup
+		for i := range result {
+			wg.Add(1)
+			go func(d *device, err *error) {
+				defer wg.Done()
+				d.HardwareSerial, *err = resolver(d.Serial)
+			}(&result[i], &errs[i])
+		}
+		wg.Wait()
+
+		for i, err := range errs {
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "WARNING: Could not resolve the hardware serial of device %q: %v\n", result[i].Serial, err)
+			}
+		}
+	}
+
+	for i := range result {
+		d := &result[i]
 		if cfg != nil {
 			// Determine whether there is a nickname defined for this device,
 			// so that the console output prefix can display the nickname instead of the serial.
-		NSMLoop:
 			for nickname, serial := range cfg.Names {
-				if d.Serial == serial {
+				if d.matchesSerial(serial) {
 					d.Nickname = nickname
 					break
 				}
+			}
 
-				for _, qualifier := range d.Qualifiers {
-					if qualifier == serial {
-						d.Nickname = nickname
-						break NSMLoop
-					}
+			// Determine whether there is a default user ID set by 'madb user'.
+			for _, key := range d.configKeys() {
+				if userID, ok := cfg.UserIDs[key]; ok {
+					d.UserID = userID
+					break
 				}
 			}
 
-			// Determine whether there is a default user ID set by 'madb user'.
-			if userID, ok := cfg.UserIDs[d.Serial]; ok {
-				d.UserID = userID
+			// Attach the tags and the metadata set by 'madb tag'. They may be stored under a
+			// qualifier, when the tag target was a nickname referring to a qualifier.
+			for _, key := range d.configKeys() {
+				if tags, ok := cfg.Tags[key]; ok {
+					d.Tags = tags
+					break
+				}
+			}
+			for _, key := range d.configKeys() {
+				if metadata, ok := cfg.Metadata[key]; ok {
+					d.Metadata = metadata
+					break
+				}
 			}
 		}
-
-		result = append(result, d)
 	}
 
 	return result, nil
@@ -234,13 +459,13 @@ func getSpecifiedDevices() ([]device, error) {
 		return nil, err
 	}
 
-	devices, err := getDevices(cfg)
+	tokens := strings.Split(devicesFlag, ",")
+	devices, err := getDevices(cfg, tokens)
 	if err != nil {
 		return nil, err
 	}
 
-	tokens := strings.Split(devicesFlag, ",")
-	filtered, err := filterSpecifiedDevices(devices, cfg, allDevicesFlag, allEmulatorsFlag, tokens)
+	filtered, err := filterSpecifiedDevices(devices, cfg, allDevicesFlag, allEmulatorsFlag, tokens, getDeviceProperties)
 	if err != nil {
 		return nil, err
 	}
@@ -255,9 +480,14 @@ func getSpecifiedDevices() ([]device, error) {
 type deviceSpec struct {
 	index int
 	token string
+	// query is set when the token refers to a dynamic group defined by 'madb group define'.
+	query *deviceQuery
 }
 
-func filterSpecifiedDevices(devices []device, cfg *config, allDevices, allEmulators bool, tokens []string) ([]device, error) {
+// filterSpecifiedDevices returns the devices matching the given device specifier tokens.
+// The getprop function is used for evaluating the dynamic groups which refer to
+// the Android system properties of the devices.
+func filterSpecifiedDevices(devices []device, cfg *config, allDevices, allEmulators bool, tokens []string, getprop devicePropertiesFunc) ([]device, error) {
 	// If the tokens only contains one empty string, treat it as an empty slice.
 	if len(tokens) == 1 && tokens[0] == "" {
 		tokens = []string{}
@@ -281,11 +511,17 @@ func filterSpecifiedDevices(devices []device, cfg *config, allDevices, allEmulat
 
 		// Expand all the groups and get the device specs.
 		tokens = expandGroups(tokens, cfg)
-		specs = getDeviceSpecsFromTokens(tokens, cfg)
+		var err error
+		if specs, err = getDeviceSpecsFromTokens(tokens, cfg); err != nil {
+			return nil, err
+		}
 	}
 
+	// The system properties of each device are obtained at most once.
+	getprop = memoizeDeviceProperties(getprop)
+
 	for _, d := range devices {
-		if shouldIncludeDevice(d, specs, allDevices, allEmulators) {
+		if shouldIncludeDevice(d, specs, allDevices, allEmulators, getprop) {
 			result = append(result, d)
 		}
 	}
@@ -295,22 +531,28 @@ func filterSpecifiedDevices(devices []device, cfg *config, allDevices, allEmulat
 
 // getDeviceSpecsFromTokens takes device specifier tokens and turns them into
 // the corresponding deviceSpec structs.
-func getDeviceSpecsFromTokens(tokens []string, cfg *config) []deviceSpec {
+func getDeviceSpecsFromTokens(tokens []string, cfg *config) ([]deviceSpec, error) {
 	specs := make([]deviceSpec, 0, len(tokens)*2)
 
 	for _, token := range tokens {
 		if strings.HasPrefix(token, "@") {
 			index, _ := strconv.Atoi(token[1:])
-			specs = append(specs, deviceSpec{index, ""})
+			specs = append(specs, deviceSpec{index, "", nil})
+		} else if query, ok := cfg.Queries[token]; ok {
+			q, err := parseDeviceQuery(query)
+			if err != nil {
+				return nil, fmt.Errorf("Could not parse the query of the dynamic group %q: %v", token, err)
+			}
+			specs = append(specs, deviceSpec{0, token, q})
 		} else {
-			specs = append(specs, deviceSpec{0, token})
+			specs = append(specs, deviceSpec{0, token, nil})
 		}
 	}
 
-	return specs
+	return specs, nil
 }
 
-func shouldIncludeDevice(d device, specs []deviceSpec, allDevices, allEmulators bool) bool {
+func shouldIncludeDevice(d device, specs []deviceSpec, allDevices, allEmulators bool, getprop devicePropertiesFunc) bool {
 	if allDevices && d.Type == realDevice {
 		return true
 	}
@@ -332,14 +574,15 @@ func shouldIncludeDevice(d device, specs []deviceSpec, allDevices, allEmulators
 			continue
 		}
 
-		if d.Serial == spec.token || d.Nickname == spec.token {
-			return true
-		}
-
-		for _, qualifier := range d.Qualifiers {
-			if qualifier == spec.token {
+		if spec.query != nil {
+			if spec.query.matches(d, getprop) {
 				return true
 			}
+			continue
+		}
+
+		if d.Nickname == spec.token || d.matchesSerial(spec.token) || d.matchesTagOrMetadata(spec.token) {
+			return true
 		}
 	}
 
@@ -351,22 +594,41 @@ type config struct {
 	// Version indicates the version string of madb binary by which this config
 	// was written to the file, in case it has to be migrated to a newer schema.
 	Version string
-	// Names keeps the mapping between device nicknames and their serials.
+	// Names keeps the mapping between device nicknames and their serials. The
+	// serial can also be a qualifier or a hardware serial specifier (e.g.,
+	// "serialno:HT4BVWV00023").
 	Names map[string]string
 	// Groups keeps the device group definitions. A group can contain multiple
 	// devices, each of which is denoted by its name, serial, or index. A group
 	// can also include other groups.
 	Groups map[string][]string
-	// UserIDs keeps the mapping between device serials and their default user
-	// IDs.
+	// UserIDs keeps the mapping between device serials (or hardware serial
+	// specifiers) and their default user IDs.
 	UserIDs map[string]string
+	// Tags keeps the free-form tags attached to each device, keyed on the
+	// device serial (or the hardware serial specifier).
+	Tags map[string][]string
+	// Metadata keeps the key/value metadata attached to each device, keyed on
+	// the device serial (or the hardware serial specifier).
+	Metadata map[string]map[string]string
+	// Queries keeps the dynamic device group definitions. The members of a
+	// dynamic group are determined by evaluating its query against the
+	// currently connected devices, whenever the group is referenced.
+	Queries map[string]string
+	// Aliases keeps the user-defined command aliases set by 'madb alias'. Each
+	// alias is a sequence of madb commands joined by '&&'.
+	Aliases map[string]string
 }
 
 func newConfig() *config {
 	return &config{
-		Names:   make(map[string]string),
-		Groups:  make(map[string][]string),
-		UserIDs: make(map[string]string),
+		Names:    make(map[string]string),
+		Groups:   make(map[string][]string),
+		UserIDs:  make(map[string]string),
+		Tags:     make(map[string][]string),
+		Metadata: make(map[string]map[string]string),
+		Queries:  make(map[string]string),
+		Aliases:  make(map[string]string),
 	}
 }
 
@@ -493,6 +755,18 @@ func readConfig(filename string) (*config, error) {
 	if result.UserIDs == nil {
 		result.UserIDs = make(map[string]string)
 	}
+	if result.Tags == nil {
+		result.Tags = make(map[string][]string)
+	}
+	if result.Metadata == nil {
+		result.Metadata = make(map[string]map[string]string)
+	}
+	if result.Queries == nil {
+		result.Queries = make(map[string]string)
+	}
+	if result.Aliases == nil {
+		result.Aliases = make(map[string]string)
+	}
 
 	return result, nil
 }
@@ -511,8 +785,28 @@ func writeConfig(cfg *config, filename string) error {
 	return encoder.Encode(*cfg)
 }
 
+// configMutex serializes the config updates made by the sub commands running
+// on multiple devices in parallel.
+var configMutex sync.Mutex
+
+// updateConfig reads the config from the given file, applies the given update
+// function, and writes the config back to the file. It is safe to call this
+// function from multiple go-routines.
+func updateConfig(filename string, update func(cfg *config)) error {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+
+	cfg, err := readConfig(filename)
+	if err != nil {
+		return err
+	}
+
+	update(cfg)
+	return writeConfig(cfg, filename)
+}
+
 func isNameInUse(name string, cfg *config) bool {
-	return isDeviceNickname(name, cfg) || isGroupName(name, cfg)
+	return isDeviceNickname(name, cfg) || isGroupName(name, cfg) || isDynamicGroupName(name, cfg)
 }
 
 func isDeviceNickname(name string, cfg *config) bool {
@@ -525,6 +819,11 @@ func isGroupName(name string, cfg *config) bool {
 	return ok
 }
 
+func isDynamicGroupName(name string, cfg *config) bool {
+	_, ok := cfg.Queries[name]
+	return ok
+}
+
 func isValidSerial(serial string) bool {
 	r := regexp.MustCompile(`^([A-Za-z0-9:\-\._]+|@\d+)$`)
 	return r.MatchString(serial)
@@ -535,6 +834,55 @@ func isValidName(name string) bool {
 	return r.MatchString(name)
 }
 
+func isValidTag(tag string) bool {
+	r := regexp.MustCompile(`^[\w\-\.]+$`)
+	return r.MatchString(tag)
+}
+
+// parseMetadataEntry splits a "key=value" string into its key and value.
+// The returned bool indicates whether the given string is a valid metadata entry.
+func parseMetadataEntry(entry string) (string, string, bool) {
+	r := regexp.MustCompile(`^([\w\-\.]+)=([\w\-\.:]*)$`)
+	matches := r.FindStringSubmatch(entry)
+	if matches == nil {
+		return "", "", false
+	}
+
+	return matches[1], matches[2], true
+}
+
+// resolveHardwareSerialSpecifier takes a device specifier of a currently
+// connected device, and returns the "serialno:<hardware_serial>" specifier of
+// that device. It is an error if the specifier does not match exactly one
+// device.
+func resolveHardwareSerialSpecifier(specifier string, cfg *config) (string, error) {
+	if err := startAdbServer(); err != nil {
+		return "", err
+	}
+
+	// The hardware serials are always resolved, so that the device can be specified by its hardware
+	// serial even when it is not used in the config yet.
+	devices, err := getDevicesWithResolver(cfg, getHardwareSerial)
+	if err != nil {
+		return "", err
+	}
+
+	filtered, err := filterSpecifiedDevices(devices, cfg, false, false, []string{specifier}, getDeviceProperties)
+	if err != nil {
+		return "", err
+	}
+
+	if len(filtered) != 1 {
+		return "", fmt.Errorf("The specifier %q must match exactly one connected device, but matched %v devices.", specifier, len(filtered))
+	}
+
+	if filtered[0].HardwareSerial == "" {
+		return "", fmt.Errorf("Could not resolve the hardware serial of device %q.", filtered[0].Serial)
+	}
+
+	return filtered[0].hardwareSerialSpecifier(), nil
+}
+
 // isValidMember takes a member string given as an argument, and returns nil
 // when the member string is valid. Otherwise, an error is returned indicating
 // the reason why the given member string is not valid.
@@ -545,6 +893,13 @@ func isValidDeviceSpecifier(member string) error {
 			return fmt.Errorf("Invalid device specifier %q. '@' sign must be followed by a numeric device index starting from 1.", member)
 		}
 		return nil
+	} else if strings.HasPrefix(member, tagPrefix) {
+		if !isValidTag(strings.TrimPrefix(member, tagPrefix)) {
+			return fmt.Errorf("Invalid device specifier %q. 'tag:' must be followed by a valid tag name.", member)
+		}
+		return nil
+	} else if _, _, ok := parseMetadataEntry(member); ok {
+		return nil
 	} else if !isValidSerial(member) && !isValidName(member) {
 		return fmt.Errorf("Invalid device specifier %q. Not a valid serial or a nickname.", member)
 	}
@@ -556,8 +911,9 @@ type subCommandRunner struct {
 	// init is an optional function that does some initial work that should only
 	// be performed once, before directing the command to all the devices.
 	// The returned string slice becomes the new set of arguments passed into
-	// the sub command.
-	init func(env *cmdline.Env, args []string, properties variantProperties) ([]string, error)
+	// the sub command. The init function may also record some state in the
+	// given properties, which are then passed into the sub command.
+	init func(env *cmdline.Env, args []string, properties *variantProperties) ([]string, error)
 	// subCmd defines the behavior of the sub command which will run on all the
 	// devices in parallel.
 	subCmd func(env *cmdline.Env, args []string, d device, properties variantProperties) error
@@ -570,10 +926,8 @@ var _ cmdline.Runner = (*subCommandRunner)(nil)
 
 // Invokes the sub command on all the devices in parallel.
 func (r subCommandRunner) Run(env *cmdline.Env, args []string) error {
-	prefixFlag = strings.ToLower(prefixFlag)
-	allowed := []string{"name", "serial", "none"}
-	if !isStringInSlice(prefixFlag, allowed) {
-		return fmt.Errorf("The -prefix flag value must be one of %v", strings.Join(allowed, ", "))
+	if err := validatePrefixFlag(); err != nil {
+		return err
 	}
 
 	if err := startAdbServer(); err != nil {
@@ -585,46 +939,54 @@ func (r subCommandRunner) Run(env *cmdline.Env, args []string) error {
 		return err
 	}
 
-	// Extract the properties if needed.
-	properties := variantProperties{}
-	if r.extractProperties && isGradleProject(wd) {
-		properties, err = getProjectPropertiesUsingDefaultCache()
-		if err != nil {
-			return err
-		}
+	_, err = r.runOnDevices(env, args, devices)
+	return err
+}
+
+// validatePrefixFlag checks whether the -prefix flag has one of the allowed values.
+func validatePrefixFlag() error {
+	prefixFlag = strings.ToLower(prefixFlag)
+	allowed := []string{"name", "serial", "none"}
+	if !isStringInSlice(prefixFlag, allowed) {
+		return fmt.Errorf("The -prefix flag value must be one of %v", strings.Join(allowed, ", "))
 	}
 
-	// Run the init function when provided.
-	if r.init != nil {
-		newArgs, err := r.init(env, args, properties)
-		if err != nil {
-			return err
-		}
+	return nil
+}
 
-		args = newArgs
+// runOnDevices extracts the project properties if needed, runs the init
+// function, and then invokes the sub command on the given devices. The devices
+// on which the sub command failed are returned along with the error.
+func (r subCommandRunner) runOnDevices(env *cmdline.Env, args []string, devices []device) ([]device, error) {
+	targets, err := r.initTargets(env, args, devices)
+	if err != nil {
+		return nil, err
 	}
 
+	var mu sync.Mutex
 	var errs []error
 	var errDevices []device
 
 	if sequentialFlag {
-		for _, d := range devices {
-			if err := r.subCmd(env, args, d, properties); err != nil {
+		for i, d := range devices {
+			if err := r.subCmd(env, targets[i].args, d, targets[i].properties); err != nil {
 				errs = append(errs, err)
 				errDevices = append(errDevices, d)
 			}
 		}
 	} else {
 		wg := sync.WaitGroup{}
-		for _, d := range devices {
-			// Capture the current device value, and run the command in a go-routine.
-			deviceCopy := d
+		for i, d := range devices {
+			// Capture the current device and target values, and run the command in a go-routine.
+			deviceCopy, target := d, targets[i]
 
 			wg.Add(1)
 			go func() {
-				if err := r.subCmd(env, args, deviceCopy, properties); err != nil {
+				if err := r.subCmd(env, target.args, deviceCopy, target.properties); err != nil {
+					mu.Lock()
 					errs = append(errs, err)
 					errDevices = append(errDevices, deviceCopy)
+					mu.Unlock()
 				}
 				wg.Done()
 			}()
@@ -639,10 +1001,138 @@ func (r subCommandRunner) Run(env *cmdline.Env, args []string) error {
 		for i := 0; i < len(errs); i++ {
 			buffer.WriteString("\n[" + errDevices[i].displayName() + "]\t" + errs[i].Error())
 		}
-		return fmt.Errorf(buffer.String())
+		return errDevices, errors.New(buffer.String())
 	}
 
-	return nil
+	return nil, nil
+}
+
+// initTargets extracts the project properties if needed and runs the init function, and returns the
+// arguments and the properties with which the sub command is run on each device. All the devices
+// share the same target, unless the -variant-map flag is set.
+func (r subCommandRunner) initTargets(env *cmdline.Env, args []string, devices []device) ([]deviceTarget, error) {
+	var err error
+
+	if r.extractProperties && variantMapFlag != "" {
+		if len(args) != 0 || apkDirFlag != "" {
+			return nil, fmt.Errorf("The -variant-map flag cannot be used with the -apk-dir flag or when the arguments are provided.")
+		}
+		return r.initVariantMapTargets(env, devices)
+	}
+
+	// Extract the properties if needed. When .apk files are given as the arguments or with the
+	// -apk-dir flag, the properties are read from the .apk files instead, and the arguments are
+	// replaced with the extracted ones.
+	properties := variantProperties{}
+	if r.extractProperties && apkDirFlag != "" {
+		if len(args) != 0 {
+			return nil, fmt.Errorf("The -apk-dir flag cannot be used when the arguments are provided.")
+		}
+		properties, err = getPropertiesFromApkDir(apkDirFlag)
+		if err != nil {
+			return nil, err
+		}
+	} else if r.extractProperties && isApkArgs(args) {
+		properties, err = getPropertiesFromApks(args)
+		if err != nil {
+			return nil, err
+		}
+		args = []string{}
+	} else if r.extractProperties && isGradleProject(wd) {
+		properties, err = getProjectPropertiesUsingDefaultCache(variantKey{wd, moduleFlag, variantFlag})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Run the init function when provided.
+	if r.init != nil {
+		newArgs, err := r.init(env, args, &properties)
+		if err != nil {
+			return nil, err
+		}
+
+		args = newArgs
+	}
+
+	targets := make([]deviceTarget, len(devices))
+	for i := range targets {
+		targets[i] = deviceTarget{args, properties}
+	}
+
+	return targets, nil
+}
+
+// forEachUser wraps the given sub command function, so that the sub command is
+// run once for each of the users selected by the -all-users or -users flag. The
+// user ID of the device is replaced with each of the selected users, so that
+// the output prefix shows the user ID as well. When neither flag is set, the
+// sub command is run only once with the default user.
+func forEachUser(subCmd func(env *cmdline.Env, args []string, d device, properties variantProperties) error) func(env *cmdline.Env, args []string, d device, properties variantProperties) error {
+	return func(env *cmdline.Env, args []string, d device, properties variantProperties) error {
+		userIDs, err := getSelectedUserIDs(d, getAndroidUsers)
+		if err != nil {
+			return err
+		}
+
+		if userIDs == nil {
+			return subCmd(env, args, d, properties)
+		}
+
+		var errs []string
+		for _, userID := range userIDs {
+			userDevice := d
+			userDevice.UserID = userID
+			if err := subCmd(env, args, userDevice, properties); err != nil {
+				errs = append(errs, fmt.Sprintf("(user %v) %v", userID, err))
+			}
+		}
+
+		if errs != nil {
+			return errors.New(strings.Join(errs, "\n"))
+		}
+
+		return nil
+	}
+}
+
+// userListerFunc takes a device serial and returns the available users on the device.
+type userListerFunc func(serial string) ([]androidUser, error)
+
+// getSelectedUserIDs returns the user IDs selected by the -all-users or -users
+// flag for the given device. The returned slice is nil when neither flag is set.
+func getSelectedUserIDs(d device, lister userListerFunc) ([]string, error) {
+	if allUsersFlag && usersFlag != "" {
+		return nil, fmt.Errorf("The -all-users and -users flags cannot be used together.")
+	}
+
+	if allUsersFlag {
+		users, err := lister(d.Serial)
+		if err != nil {
+			return nil, err
+		}
+		if len(users) == 0 {
+			return nil, fmt.Errorf("Could not find any users on the device.")
+		}
+
+		userIDs := make([]string, 0, len(users))
+		for _, u := range users {
+			userIDs = append(userIDs, u.ID)
+		}
+		return userIDs, nil
+	}
+
+	if usersFlag != "" {
+		userIDs := removeDuplicates(strings.Split(usersFlag, ","))
+		for _, userID := range userIDs {
+			if id, err := strconv.Atoi(userID); err != nil || id < 0 {
+				return nil, fmt.Errorf("Not a valid user ID in the -users flag: %q", userID)
+			}
+		}
+		return userIDs, nil
+	}
+
+	return nil, nil
 }
 
 func runGoshCommandForDevice(cmd *gosh.Cmd, d device, printUserID bool) error {
@@ -650,18 +1140,13 @@ func runGoshCommandForDevice(cmd *gosh.Cmd, d device, printUserID bool) error {
 }
 
 func runGoshCommandForDeviceWithWriters(cmd *gosh.Cmd, d device, printUserID bool, stdout, stderr io.Writer) error {
-	prefix := ""
-	if prefixFlag != "none" {
-		name := d.Serial
-		if prefixFlag == "name" {
-			name = d.displayName()
-		}
-		if printUserID && d.UserID != "" {
-			name = name + ":" + d.UserID
-		}
-		prefix = "[" + name + "]\t"
+	// While the installation progress is reported, the output is printed through the progress
+	// reporter so that it does not break the status display.
+	if reporter := installProgressReporter; reporter != nil {
+		stdout, stderr = progressMessageWriter{reporter, stdout}, progressMessageWriter{reporter, stderr}
 	}
 
+	prefix := devicePrefix(d, printUserID)
 	prefixedStdout := textutil.PrefixLineWriter(stdout, prefix)
 	prefixedStderr := textutil.PrefixLineWriter(stderr, prefix)
 	cmd.AddStdoutWriter(prefixedStdout)
@@ -673,6 +1158,30 @@ func runGoshCommandForDeviceWithWriters(cmd *gosh.Cmd, d device, printUserID boo
 	return cmd.Shell().Err
 }
 
+// devicePrefix returns the console output prefix of the given device, as specified by the "-prefix"
+// flag.
+func devicePrefix(d device, printUserID bool) string {
+	if prefixFlag == "none" {
+		return ""
+	}
+
+	name := d.Serial
+	if prefixFlag == "name" {
+		name = d.displayName()
+	}
+	if printUserID && d.UserID != "" {
+		name = name + ":" + d.UserID
+	}
+
+	return "[" + name + "]\t"
+}
+
+// printDeviceMessage prints a message about the given device to the standard output, along with the
+// console output prefix of the device.
+func printDeviceMessage(d device, format string, args ...interface{}) {
+	printMessage(os.Stdout, "%v%v\n", devicePrefix(d, true), fmt.Sprintf(format, args...))
+}
+
 func initMadbCommand(env *cmdline.Env, args []string, properties variantProperties, flutterPassthrough bool, activityNameRequired bool) ([]string, error) {
 	var numRequiredArgs int
 	var requiredArgsStr string
@@ -694,21 +1203,23 @@ func initMadbCommand(env *cmdline.Env, args []string, properties variantProperti
 		return nil, fmt.Errorf("You mush provide either zero arguments or exactly %v.", requiredArgsStr)
 	}
 
-	// Try to extract the application ID and the main activity name from the Gradle scripts.
-	if isGradleProject(wd) {
+	// Try to extract the application ID and the main activity name from the .apk files or the Gradle
+	// scripts.
+	if properties.fromApkFiles || isGradleProject(wd) {
 		args = []string{properties.AppID, properties.Activity}[:numRequiredArgs]
 	}
 
 	return args, nil
 }
 
-func getProjectPropertiesUsingDefaultCache() (variantProperties, error) {
+func getProjectPropertiesUsingDefaultCache(key variantKey) (variantProperties, error) {
 	cacheFile, err := getDefaultCacheFilePath()
 	if err != nil {
 		return variantProperties{}, err
 	}
 
-	key := variantKey{wd, moduleFlag, variantFlag}
+	removeLegacyCacheFile()
+
 	return getProjectProperties(extractPropertiesFromGradle, key, clearCacheFlag, cacheFile)
 }
 
@@ -721,6 +1232,52 @@ type variantProperties struct {
 	Activity       string
 	AbiFilters     []string
 	VariantOutputs []variantOutput
+	// SplitOutputs are the config split .apk files for specific ABIs, densities, or languages, which
+	// are installed along with the base .apk. Always empty when the properties are extracted using the
+	// variant API of Android Gradle Plugin 7 and above.
+	SplitOutputs []variantOutput
+	// FeatureModules are the dynamic feature modules of the app, whose .apk files are installed
+	// along with the base .apk.
+	FeatureModules []featureModule
+	// BundleTask and BundleFilePath are the Gradle task which builds the Android App Bundle (.aab)
+	// and the path of the resulting bundle file. These are empty when app bundles are not supported
+	// by the Android Gradle Plugin.
+	BundleTask     string
+	BundleFilePath string
+	// LaunchableActivities lists all the activities with the MAIN action and the LAUNCHER category
+	// found in the merged manifest. Activity is the first one of them.
+	LaunchableActivities []string
+	// LeanbackActivities lists all the activities with the MAIN action and the LEANBACK_LAUNCHER
+	// category, which are launched on the Android TV devices.
+	LeanbackActivities []string
+	// AdditionalModules are the properties of the other application modules, when multiple modules
+	// are specified with the -module flag. The properties of the first module are at the top level.
+	AdditionalModules []variantProperties
+	// fromApkFiles indicates that the properties are read from the .apk files given as the command
+	// arguments, rather than extracted from the Gradle scripts. This is never cached.
+	fromApkFiles bool
+	// chooseActivityPerDevice indicates that 'madb start' should choose the activity to be launched
+	// for each device based on its form factor. This is set by the init function of 'madb start'.
+	chooseActivityPerDevice bool
+}
+
+// modules returns the properties of each application module, starting with the first module.
+func (p variantProperties) modules() []variantProperties {
+	first := p
+	first.AdditionalModules = nil
+	return append([]variantProperties{first}, p.AdditionalModules...)
+}
+
+// isMultiModule determines whether the given -module flag value specifies multiple application
+// modules of the project in the given directory. "all" is treated as a module name when the project
+// has a module directory named "all".
+func isMultiModule(dir, module string) bool {
+	if module == "all" {
+		stat, err := os.Stat(filepath.Join(dir, module))
+		return err != nil || !stat.IsDir()
+	}
+
+	return strings.Contains(module, ",")
 }
 
 type variantOutput struct {
@@ -730,6 +1287,12 @@ type variantOutput struct {
 	Filters        []filter
 }
 
+type featureModule struct {
+	ProjectPath    string
+	AssembleTask   string
+	VariantOutputs []variantOutput
+}
+
 type filter struct {
 	FilterType string
 	Identifier string
@@ -738,8 +1301,9 @@ type filter struct {
 type propertyExtractorFunc func(variantKey) (variantProperties, error)
 
 // getProjectProperties returns the project properties for the given build variant.
-// It returns the cached values when the variant is found in the cache file, unless the clearCache
-// argument is true. Otherwise, it calls extractPropertiesFromGradle to extract those properties by
+// It returns the cached values when the variant is found in the cache file and none of the Gradle
+// scripts, Gradle properties, or manifests of the project have changed since then, unless the
+// clearCache argument is true. Otherwise, it calls extractPropertiesFromGradle to extract those properties by
 // running Gradle scripts.
 func getProjectProperties(extractor propertyExtractorFunc, key variantKey, clearCache bool, cacheFile string) (variantProperties, error) {
 	if clearCache {
@@ -751,9 +1315,13 @@ func getProjectProperties(extractor propertyExtractorFunc, key variantKey, clear
 			return variantProperties{}, err
 		}
 
-		if properties, ok := cache[key]; ok {
-			fmt.Println("NOTE: Cached IDs are being used. Use '-clear-cache' flag to clear the cache and extract the IDs from Gradle scripts again.")
-			return properties, nil
+		if entry, ok := cache[key]; ok {
+			if entry.isUpToDate() {
+				fmt.Println("NOTE: Cached IDs are being used. Use '-clear-cache' flag to clear the cache and extract the IDs from Gradle scripts again.")
+				return entry.Properties, nil
+			}
+
+			fmt.Println("NOTE: The project files have changed since the IDs were cached.")
 		}
 	}
 
@@ -776,9 +1344,18 @@ func isFlutterProject(dir string) bool {
 	return err == nil
 }
 
+// gradleBuildFiles lists the names of the Gradle build scripts, using either the Groovy DSL or the
+// Kotlin DSL.
+var gradleBuildFiles = []string{"build.gradle", "build.gradle.kts"}
+
 func isGradleProject(dir string) bool {
-	_, err := os.Stat(filepath.Join(dir, "build.gradle"))
-	return err == nil
+	for _, name := range gradleBuildFiles {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return true
+		}
+	}
+
+	return false
 }
 
 // Looks for the Gradle wrapper script file ("gradlew"), starting from the current directory.
@@ -814,6 +1391,37 @@ func findGradleWrapper(dir string) (string, error) {
 }
 
 func extractPropertiesFromGradle(key variantKey) (variantProperties, error) {
+	cmdArgs := []string{}
+
+	// Specify the project directory. If the module name is explicitly set, combine it with the base directory.
+	// When multiple modules are specified, run the script from the base directory, so that the
+	// properties of all the modules are extracted at once.
+	if isMultiModule(key.Dir, key.Module) {
+		cmdArgs = append(cmdArgs, "-p", key.Dir, "-PmadbModules="+key.Module)
+	} else {
+		cmdArgs = append(cmdArgs, "-p", filepath.Join(key.Dir, key.Module))
+	}
+
+	// Specify the variant
+	if key.Variant != "" {
+		cmdArgs = append(cmdArgs, "-PmadbVariant="+key.Variant)
+	}
+
+	// Specify the tasks
+	cmdArgs = append(cmdArgs, "madbExtractVariantProperties")
+
+	// Run the gradle wrapper to extract the application ID and the main activity name from the build scripts.
+	result := variantProperties{}
+	if err := runGradleInitScript(key.Dir, cmdArgs, &result); err != nil {
+		return variantProperties{}, err
+	}
+
+	return result, nil
+}
+
+// runGradleInitScript runs the Gradle wrapper found from the given directory with the madb init
+// script and the given arguments, and decodes the JSON result written by the init script.
+func runGradleInitScript(dir string, args []string, result interface{}) error {
 	sh := gosh.NewShell(nil)
 	defer sh.Cleanup()
 
@@ -823,9 +1431,9 @@ func extractPropertiesFromGradle(key variantKey) (variantProperties, error) {
 	sh.PropagateChildOutput = true
 	sh.ContinueOnError = true
 
-	wrapper, err := findGradleWrapper(key.Dir)
+	wrapper, err := findGradleWrapper(dir)
 	if err != nil {
-		return variantProperties{}, err
+		return err
 	}
 
 	// Write the init script in a temp file.
@@ -836,36 +1444,24 @@ func extractPropertiesFromGradle(key variantKey) (variantProperties, error) {
 	// Create a temporary file in which Gradle can write the results.
 	outputFile := sh.MakeTempFile()
 
-	// Run the gradle wrapper to extract the application ID and the main activity name from the build scripts.
 	cmdArgs := []string{"--daemon", "-q", "-I", initScript.Name(), "-PmadbOutputFile=" + outputFile.Name()}
-
-	// Specify the project directory. If the module name is explicitly set, combine it with the base directory.
-	cmdArgs = append(cmdArgs, "-p", filepath.Join(key.Dir, key.Module))
-
-	// Specify the variant
-	if key.Variant != "" {
-		cmdArgs = append(cmdArgs, "-PmadbVariant="+key.Variant)
-	}
-
-	// Specify the tasks
-	cmdArgs = append(cmdArgs, "madbExtractVariantProperties")
+	cmdArgs = append(cmdArgs, args...)
 
 	cmd := sh.Cmd(wrapper, cmdArgs...)
 	cmd.Run()
 
 	if err = sh.Err; err != nil {
-		return variantProperties{}, err
+		return err
 	}
 
 	// Read what is written in the temporary file.
 	// The file must be in JSON format.
-	result := variantProperties{}
 	decoder := json.NewDecoder(outputFile)
-	if err = decoder.Decode(&result); err != nil {
-		return variantProperties{}, fmt.Errorf("Could not extract the application ID and the main activity name: %v", err)
+	if err = decoder.Decode(result); err != nil {
+		return fmt.Errorf("Could not read the result of the Gradle script: %v", err)
 	}
 
-	return result, nil
+	return nil
 }
 
 // expandKeywords takes a command line argument and a device configuration, and returns a new
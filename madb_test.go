@@ -12,9 +12,13 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"v.io/x/lib/cmdline"
 	"v.io/x/lib/gosh"
 )
 
@@ -43,7 +47,7 @@ emulator-5554       device product:sdk_phone_armv7 model:sdk_phone_armv7 device:
 
 `
 
-	got, err := parseDevicesOutput(output, nil)
+	got, err := parseDevicesOutput(output, nil, nil)
 	if err != nil {
 		t.Fatalf("failed to parse the output: %v", err)
 	}
@@ -76,7 +80,7 @@ emulator-5554       device product:sdk_phone_armv7 model:sdk_phone_armv7 device:
 
 `
 
-	got, err = parseDevicesOutput(output, nil)
+	got, err = parseDevicesOutput(output, nil, nil)
 	if err != nil {
 		t.Fatalf("failed to parse the output: %v", err)
 	}
@@ -90,7 +94,7 @@ deviceid01       offline usb:3-3.4.3 product:bullhead model:Nexus_5X device:bull
 deviceid02       device product:sdk_phone_armv7 model:sdk_phone_armv7 device:generic
 
 `
-	got, err = parseDevicesOutput(output, nil)
+	got, err = parseDevicesOutput(output, nil, nil)
 	if err != nil {
 		t.Fatalf("failed to parse the output: %v", err)
 	}
@@ -127,7 +131,7 @@ emulator-5554       device product:sdk_phone_armv7 model:sdk_phone_armv7 device:
 		},
 	}
 
-	got, err = parseDevicesOutput(output, cfg)
+	got, err = parseDevicesOutput(output, cfg, nil)
 	if err != nil {
 		t.Fatalf("failed to parse the output: %v", err)
 	}
@@ -154,6 +158,168 @@ emulator-5554       device product:sdk_phone_armv7 model:sdk_phone_armv7 device:
 	if !reflect.DeepEqual(got, want) {
 		t.Fatalf("unmatched results: got %v, want %v", got, want)
 	}
+
+	// In case some nicknames and user IDs are keyed on the hardware serials.
+	output = `List of devices attached
+192.168.0.10:5555   device product:bullhead model:Nexus_5X device:bullhead
+emulator-5554       device product:sdk_phone_armv7 model:sdk_phone_armv7 device:generic
+
+`
+
+	cfg = &config{
+		Names: map[string]string{
+			"MyPhone": "serialno:deviceid01",
+		},
+		UserIDs: map[string]string{
+			"serialno:deviceid01": "10",
+		},
+		Tags: map[string][]string{
+			"serialno:deviceid01": []string{"flaky"},
+		},
+		Metadata: map[string]map[string]string{
+			"emulator-5554": map[string]string{"rack": "3"},
+		},
+	}
+
+	resolver := func(serial string) (string, error) {
+		if serial == "192.168.0.10:5555" {
+			return "deviceid01", nil
+		}
+		return serial, nil
+	}
+
+	got, err = parseDevicesOutput(output, cfg, resolver)
+	if err != nil {
+		t.Fatalf("failed to parse the output: %v", err)
+	}
+
+	want = []device{
+		device{
+			Serial:         "192.168.0.10:5555",
+			Type:           realDevice,
+			Qualifiers:     []string{"product:bullhead", "model:Nexus_5X", "device:bullhead"},
+			Nickname:       "MyPhone",
+			Index:          1,
+			UserID:         "10",
+			HardwareSerial: "deviceid01",
+			Tags:           []string{"flaky"},
+		},
+		device{
+			Serial:         "emulator-5554",
+			Type:           emulator,
+			Qualifiers:     []string{"product:sdk_phone_armv7", "model:sdk_phone_armv7", "device:generic"},
+			Nickname:       "",
+			Index:          2,
+			UserID:         "",
+			HardwareSerial: "emulator-5554",
+			Metadata:       map[string]string{"rack": "3"},
+		},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unmatched results: got %v, want %v", got, want)
+	}
+
+	// The hardware serials of the devices should be resolved in parallel. The resolver below blocks
+	// until it is called for both devices.
+	arrived := make(chan struct{}, 2)
+	release := make(chan struct{})
+	go func() {
+		<-arrived
+		<-arrived
+		close(release)
+	}()
+	parallelResolver := func(serial string) (string, error) {
+		arrived <- struct{}{}
+		select {
+		case <-release:
+		case <-time.After(5 * time.Second):
+			return "", fmt.Errorf("the hardware serials are not resolved in parallel")
+		}
+		return resolver(serial)
+	}
+
+	if got, err = parseDevicesOutput(output, cfg, parallelResolver); err != nil {
+		t.Fatalf("failed to parse the output: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unmatched results: got %v, want %v", got, want)
+	}
+
+	// In case some user IDs, tags and metadata are keyed on the qualifiers.
+	output = `List of devices attached
+deviceid01          device usb:3-3.4.3 product:bullhead model:Nexus_5X device:bullhead
+emulator-5554       device product:sdk_phone_armv7 model:sdk_phone_armv7 device:generic
+
+`
+
+	cfg = &config{
+		UserIDs: map[string]string{
+			"model:sdk_phone_armv7": "10",
+		},
+		Tags: map[string][]string{
+			"model:Nexus_5X": []string{"phone"},
+			"emulator-5554":  []string{"flaky"},
+			"device:generic": []string{"generic"},
+		},
+		Metadata: map[string]map[string]string{
+			"usb:3-3.4.3": map[string]string{"rack": "3"},
+		},
+	}
+
+	got, err = parseDevicesOutput(output, cfg, nil)
+	if err != nil {
+		t.Fatalf("failed to parse the output: %v", err)
+	}
+
+	want = []device{
+		device{
+			Serial:     "deviceid01",
+			Type:       realDevice,
+			Qualifiers: []string{"usb:3-3.4.3", "product:bullhead", "model:Nexus_5X", "device:bullhead"},
+			Index:      1,
+			Tags:       []string{"phone"},
+			Metadata:   map[string]string{"rack": "3"},
+		},
+		device{
+			Serial:     "emulator-5554",
+			Type:       emulator,
+			Qualifiers: []string{"product:sdk_phone_armv7", "model:sdk_phone_armv7", "device:generic"},
+			Index:      2,
+			UserID:     "10",
+			// The entry keyed on the device serial takes precedence over the qualifiers.
+			Tags: []string{"flaky"},
+		},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unmatched results: got %v, want %v", got, want)
+	}
+}
+
+func TestParseHardwareSerial(t *testing.T) {
+	tests := []struct {
+		output string
+		want   string
+	}{
+		{"HT4BVWV00023\r\nHT4BVWV00023\r\n", "HT4BVWV00023"},
+		{"\r\n01023f5e2fd2accf\r\n", "01023f5e2fd2accf"},
+		{"unknown\nEMULATOR30X4X10X0\n", "EMULATOR30X4X10X0"},
+	}
+
+	for i, test := range tests {
+		got, err := parseHardwareSerial(test.output)
+		if err != nil {
+			t.Fatalf("error occurred while parsing the output for tests[%v]: %v", i, err)
+		}
+		if got != test.want {
+			t.Fatalf("unmatched results for tests[%v]: got %v, want %v", i, got, test.want)
+		}
+	}
+
+	if _, err := parseHardwareSerial("\r\n\r\n"); err == nil {
+		t.Fatalf("expected an error but succeeded.")
+	}
 }
 
 func TestGetSpecifiedDevices(t *testing.T) {
@@ -165,6 +331,8 @@ func TestGetSpecifiedDevices(t *testing.T) {
 		Nickname:   "MyPhone",
 		Index:      1,
 		UserID:     "",
+		Tags:       []string{"flaky"},
+		Metadata:   map[string]string{"owner": "alice", "rack": "3"},
 	}
 
 	d2 := device{
@@ -192,6 +360,7 @@ func TestGetSpecifiedDevices(t *testing.T) {
 		Nickname:   "SecondPhone",
 		Index:      4,
 		UserID:     "",
+		Metadata:   map[string]string{"rack": "3"},
 	}
 
 	e2 := device{
@@ -203,7 +372,18 @@ func TestGetSpecifiedDevices(t *testing.T) {
 		UserID:     "",
 	}
 
-	allDevices := []device{d1, d2, e1, d3, e2}
+	// A device connected over TCP/IP, which is identified by its hardware serial.
+	d4 := device{
+		Serial:         "192.168.0.10:5555",
+		Type:           realDevice,
+		Qualifiers:     []string{"product:angler", "model:Nexus_6P", "device:angler"},
+		Nickname:       "",
+		Index:          6,
+		UserID:         "",
+		HardwareSerial: "deviceid04",
+	}
+
+	allDevices := []device{d1, d2, e1, d3, e2, d4}
 
 	type deviceFlags struct {
 		allDevices   bool
@@ -217,15 +397,23 @@ func TestGetSpecifiedDevices(t *testing.T) {
 	}{
 		{deviceFlags{false, false, ""}, allDevices},                                         // Nothing is specified
 		{deviceFlags{true, true, ""}, allDevices},                                           // Both -d and -e are specified
-		{deviceFlags{true, false, ""}, []device{d1, d2, d3}},                                // Only -d is specified
+		{deviceFlags{true, false, ""}, []device{d1, d2, d3, d4}},                            // Only -d is specified
 		{deviceFlags{false, true, ""}, []device{e1, e2}},                                    // Only -e is specified
 		{deviceFlags{false, false, "device:bullhead"}, []device{d1, d3}},                    // Device qualifier
 		{deviceFlags{false, false, "ARMv7,SecondPhone"}, []device{e1, d3}},                  // Nicknames
 		{deviceFlags{false, false, "@2,@4"}, []device{d2, d3}},                              // Device Indices
+		{deviceFlags{false, false, "serialno:deviceid04"}, []device{d4}},                    // Hardware serial
+		{deviceFlags{false, false, "tag:flaky"}, []device{d1}},                              // Tag
+		{deviceFlags{false, false, "rack=3"}, []device{d1, d3}},                             // Metadata
+		{deviceFlags{false, false, "owner=bob"}, []device{}},                                // Unmatched metadata
 		{deviceFlags{false, false, "NormalGroup"}, []device{d1, d2, e1}},                    // Normal group
+		{deviceFlags{false, false, "Modern"}, []device{d2, d3}},                             // Dynamic group
+		{deviceFlags{false, false, "ModernOrFlaky"}, []device{d1, d2, d3}},                  // Dynamic group
+		{deviceFlags{false, false, "GroupWithDynamic"}, []device{d2, e1, d3}},               // Static group including a dynamic group
 		{deviceFlags{false, false, "SelfRefGroup"}, []device{d2}},                           // Self referencing group
+		{deviceFlags{false, false, "WirelessGroup"}, []device{d2, d4}},                      // Group with a hardware serial
 		{deviceFlags{false, false, "CyclicGroup1"}, []device{d1, d2, d3}},                   // Cyclic group inclusion
-		{deviceFlags{true, false, "ARMv7"}, []device{d1, d2, e1, d3}},                       // Combinations
+		{deviceFlags{true, false, "ARMv7"}, []device{d1, d2, e1, d3, d4}},                   // Combinations
 		{deviceFlags{false, true, "model:Nexus_9"}, []device{d2, e1, e2}},                   // Combinations
 		{deviceFlags{false, false, "@1,SecondPhone"}, []device{d1, d3}},                     // Combinations
 		{deviceFlags{false, false, "SecondPhone,NormalGroup,@1"}, []device{d1, d2, e1, d3}}, // Combinations
@@ -233,17 +421,36 @@ func TestGetSpecifiedDevices(t *testing.T) {
 
 	cfg := &config{
 		Groups: map[string][]string{
-			"NormalGroup":  []string{"deviceid01", "deviceid02", "@3"},
-			"SelfRefGroup": []string{"deviceid02", "SelfRefGroup"},
-			"CyclicGroup1": []string{"CyclicGroup2", "@1"},
-			"CyclicGroup2": []string{"@2", "CyclicGroup3"},
-			"CyclicGroup3": []string{"deviceid03", "CyclicGroup1"},
+			"NormalGroup":      []string{"deviceid01", "deviceid02", "@3"},
+			"SelfRefGroup":     []string{"deviceid02", "SelfRefGroup"},
+			"WirelessGroup":    []string{"serialno:deviceid04", "@2"},
+			"CyclicGroup1":     []string{"CyclicGroup2", "@1"},
+			"CyclicGroup2":     []string{"@2", "CyclicGroup3"},
+			"CyclicGroup3":     []string{"deviceid03", "CyclicGroup1"},
+			"GroupWithDynamic": []string{"Modern", "@3"},
+		},
+		Queries: map[string]string{
+			"Modern":        "sdk>=31 & type=RealDevice",
+			"ModernOrFlaky": "sdk >= 31 & type = RealDevice | tag = flaky",
 		},
 	}
 
+	// Fake system properties of the devices.
+	sdks := map[string]string{
+		"deviceid01":        "25",
+		"deviceid02":        "31",
+		"emulator-5554":     "33",
+		"deviceid03":        "34",
+		"emulator-5555":     "24",
+		"192.168.0.10:5555": "30",
+	}
+	getprop := func(serial string) (map[string]string, error) {
+		return map[string]string{"ro.build.version.sdk": sdks[serial]}, nil
+	}
+
 	for i, test := range tests {
 		tokens := strings.Split(test.flags.devices, ",")
-		got, err := filterSpecifiedDevices(allDevices, cfg, test.flags.allDevices, test.flags.allEmulators, tokens)
+		got, err := filterSpecifiedDevices(allDevices, cfg, test.flags.allDevices, test.flags.allEmulators, tokens, getprop)
 		if err != nil {
 			t.Fatalf(err.Error())
 		}
@@ -254,6 +461,72 @@ func TestGetSpecifiedDevices(t *testing.T) {
 	}
 }
 
+func TestGetSelectedUserIDs(t *testing.T) {
+	defer func() {
+		allUsersFlag, usersFlag = false, ""
+	}()
+
+	lister := func(serial string) ([]androidUser, error) {
+		return []androidUser{{ID: "0", Name: "Owner"}, {ID: "10", Name: "Work profile"}}, nil
+	}
+
+	tests := []struct {
+		allUsers    bool
+		users       string
+		want        []string
+		errExpected bool
+	}{
+		{false, "", nil, false},
+		{true, "", []string{"0", "10"}, false},
+		{false, "0,10,0", []string{"0", "10"}, false},
+		{false, "0,work", nil, true},
+		{false, "-1", nil, true},
+		{true, "0", nil, true},
+	}
+
+	for i, test := range tests {
+		allUsersFlag, usersFlag = test.allUsers, test.users
+		got, err := getSelectedUserIDs(device{Serial: "deviceid01"}, lister)
+		if test.errExpected != (err != nil) {
+			t.Fatalf("error expected for tests[%v]: %v, got: %v", i, test.errExpected, err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Fatalf("unmatched results for tests[%v]: got %v, want %v", i, got, test.want)
+		}
+	}
+}
+
+func TestForEachUser(t *testing.T) {
+	defer func() {
+		usersFlag = ""
+	}()
+
+	var got []string
+	subCmd := forEachUser(func(env *cmdline.Env, args []string, d device, properties variantProperties) error {
+		got = append(got, d.UserID)
+		return nil
+	})
+
+	d := device{Serial: "deviceid01", UserID: "10"}
+
+	// Without the flags, the sub command runs only for the default user.
+	if err := subCmd(nil, nil, d, variantProperties{}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"10"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unmatched results: got %v, want %v", got, want)
+	}
+
+	got = nil
+	usersFlag = "0,11"
+	if err := subCmd(nil, nil, d, variantProperties{}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"0", "11"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unmatched results: got %v, want %v", got, want)
+	}
+}
+
 func TestIsFlutterProject(t *testing.T) {
 	testCases := []struct {
 		projectDir string
@@ -282,6 +555,9 @@ func TestIsGradleProject(t *testing.T) {
 		{"testMultiPlatform/android", true},
 		{"testMultiPlatform/android/app", true},
 		{"testMultiPlatform/flutter", false},
+		{"testKotlinDslMultiFlavor", true},
+		{"testKotlinDslMultiFlavor/app", true},
+		{"testKotlinDslMultiFlavor/app/src", false},
 	}
 
 	for i, testCase := range testCases {
@@ -292,11 +568,47 @@ func TestIsGradleProject(t *testing.T) {
 	}
 }
 
+type extractPropertiesTest struct {
+	key  variantKey
+	want variantProperties
+}
+
+// checkExtractedProperties extracts the properties of the test projects under testdata/projects,
+// and compares them against the expected values. The activity lists are only compared when they are
+// specified in the expected values.
+func checkExtractedProperties(t *testing.T, tests []extractPropertiesTest) {
+	for i, test := range tests {
+		test.key.Dir = filepath.Join("testdata", "projects", test.key.Dir)
+		got, err := extractPropertiesFromGradle(test.key)
+		if err != nil {
+			t.Fatalf("error occurred while extracting properties for testCases[%v]: %v", i, err)
+		}
+
+		if got.AppID != test.want.AppID || got.Activity != test.want.Activity {
+			t.Fatalf("unmatched results for testCases[%v]: got %v, want %v", i, got, test.want)
+		}
+
+		if test.want.LaunchableActivities != nil && !reflect.DeepEqual(got.LaunchableActivities, test.want.LaunchableActivities) {
+			t.Fatalf("unmatched launchable activities for testCases[%v]: got %v, want %v", i, got.LaunchableActivities, test.want.LaunchableActivities)
+		}
+
+		if test.want.LeanbackActivities != nil && !reflect.DeepEqual(got.LeanbackActivities, test.want.LeanbackActivities) {
+			t.Fatalf("unmatched leanback activities for testCases[%v]: got %v, want %v", i, got.LeanbackActivities, test.want.LeanbackActivities)
+		}
+
+		if len(got.AdditionalModules) != len(test.want.AdditionalModules) {
+			t.Fatalf("unmatched additional modules for testCases[%v]: got %v, want %v", i, got.AdditionalModules, test.want.AdditionalModules)
+		}
+		for j, module := range test.want.AdditionalModules {
+			if got.AdditionalModules[j].AppID != module.AppID || got.AdditionalModules[j].Activity != module.Activity {
+				t.Fatalf("unmatched additional modules for testCases[%v]: got %v, want %v", i, got.AdditionalModules, test.want.AdditionalModules)
+			}
+		}
+	}
+}
+
 func TestExtractPropertiesFromGradle(t *testing.T) {
-	tests := []struct {
-		key  variantKey
-		want variantProperties
-	}{
+	tests := []extractPropertiesTest{
 		{
 			variantKey{"testMultiPlatform/android", "", ""},
 			variantProperties{AppID: "io.v.testProjectId", Activity: "io.v.testProjectPackage.LauncherActivity"},
@@ -325,18 +637,108 @@ func TestExtractPropertiesFromGradle(t *testing.T) {
 			variantKey{"testApplicationIdFallback", "", ""},
 			variantProperties{AppID: "io.v.testProjectPackage", Activity: "io.v.testProjectPackage.LauncherActivity"},
 		},
+		{
+			variantKey{"testMultiModule", "client,server", ""},
+			variantProperties{
+				AppID:    "io.v.testProjectId.client",
+				Activity: "io.v.testProjectPackage.client.LauncherActivity",
+				AdditionalModules: []variantProperties{
+					{AppID: "io.v.testProjectId.server", Activity: "io.v.testProjectPackage.server.ServerActivity"},
+				},
+			},
+		},
+		{
+			variantKey{"testMultiModule", "server,client", "debug"},
+			variantProperties{
+				AppID:    "io.v.testProjectId.server",
+				Activity: "io.v.testProjectPackage.server.ServerActivity",
+				AdditionalModules: []variantProperties{
+					{AppID: "io.v.testProjectId.client", Activity: "io.v.testProjectPackage.client.LauncherActivity"},
+				},
+			},
+		},
+		{
+			variantKey{"testMultiModule", "all", ""},
+			variantProperties{
+				AppID:    "io.v.testProjectId.client",
+				Activity: "io.v.testProjectPackage.client.LauncherActivity",
+				AdditionalModules: []variantProperties{
+					{AppID: "io.v.testProjectId.server", Activity: "io.v.testProjectPackage.server.ServerActivity"},
+				},
+			},
+		},
+		{
+			variantKey{"testMultiModule", "server", ""},
+			variantProperties{AppID: "io.v.testProjectId.server", Activity: "io.v.testProjectPackage.server.ServerActivity"},
+		},
+	}
+
+	checkExtractedProperties(t, tests)
+}
+
+// TestExtractPropertiesFromKotlinDslGradle tests the Kotlin DSL projects. Unlike the other test
+// projects, these use Android Gradle Plugin 7.4.2 and Gradle 7.6, since the Kotlin DSL requires
+// Gradle 5 or above. The properties are therefore extracted using the variant API.
+func TestExtractPropertiesFromKotlinDslGradle(t *testing.T) {
+	tests := []extractPropertiesTest{
+		{
+			variantKey{"testKotlinDslMultiFlavor", "", ""},
+			variantProperties{
+				AppID:    "io.v.testProjectId.lite.debug",
+				Activity: "io.v.testProjectPackage.LauncherActivity",
+				LaunchableActivities: []string{
+					"io.v.testProjectPackage.LauncherActivity",
+					"io.v.testProjectPackage.ThirdActivityAlias",
+				},
+				LeanbackActivities: []string{"io.v.testProjectPackage.SecondActivity"},
+			},
+		},
+		{
+			variantKey{"testKotlinDslMultiFlavor", "app", "liteDebug"},
+			variantProperties{AppID: "io.v.testProjectId.lite.debug", Activity: "io.v.testProjectPackage.LauncherActivity"},
+		},
+		{
+			variantKey{"testKotlinDslMultiFlavor/app", "", "proRelease"},
+			variantProperties{AppID: "io.v.testProjectId.pro", Activity: "io.v.testProjectPackage.LauncherActivity"},
+		},
+		{
+			variantKey{"testKotlinDslApplicationIdFallback", "", ""},
+			variantProperties{AppID: "io.v.testProjectPackage", Activity: "io.v.testProjectPackage.LauncherActivity"},
+		},
+	}
+
+	checkExtractedProperties(t, tests)
+}
+
+func TestIsMultiModule(t *testing.T) {
+	dir, err := ioutil.TempDir("", "madb_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		module string
+		want   bool
+	}{
+		{"", false},
+		{"app", false},
+		{"client,server", true},
+		{"all", true},
 	}
 
 	for i, test := range tests {
-		test.key.Dir = filepath.Join("testdata", "projects", test.key.Dir)
-		got, err := extractPropertiesFromGradle(test.key)
-		if err != nil {
-			t.Fatalf("error occurred while extracting properties for testCases[%v]: %v", i, err)
+		if got := isMultiModule(dir, test.module); got != test.want {
+			t.Fatalf("unmatched results for tests[%v]: got %v, want %v", i, got, test.want)
 		}
+	}
 
-		if got.AppID != test.want.AppID || got.Activity != test.want.Activity {
-			t.Fatalf("unmatched results for testCases[%v]: got %v, want %v", i, got, test.want)
-		}
+	// "all" is treated as a module name when there is a module directory with that name.
+	if err := os.Mkdir(filepath.Join(dir, "all"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if isMultiModule(dir, "all") {
+		t.Fatalf("the module named \"all\" is treated as all the modules.")
 	}
 }
 
@@ -594,40 +996,56 @@ func TestConfigMigration(t *testing.T) {
 			"testdata/configs/newFormat",
 			map[string]string{"config": "config"},
 			config{
-				Version: "v2.0.0",
-				Names:   map[string]string{"nickname01": "serial01", "nickname02": "serial02"},
-				Groups:  map[string][]string{},
-				UserIDs: map[string]string{"serial01": "10"},
+				Version:  "v2.0.0",
+				Names:    map[string]string{"nickname01": "serial01", "nickname02": "serial02"},
+				Groups:   map[string][]string{},
+				UserIDs:  map[string]string{"serial01": "10"},
+				Tags:     map[string][]string{},
+				Metadata: map[string]map[string]string{},
+				Queries:  map[string]string{},
+				Aliases:  map[string]string{},
 			},
 		},
 		{
 			"testdata/configs/oldFormatBoth",
 			map[string]string{"": "config", "nicknames": "nicknames.bak", "users": "users.bak"},
 			config{
-				Version: version,
-				Names:   map[string]string{"nickname01": "serial01", "nickname02": "serial02"},
-				Groups:  map[string][]string{},
-				UserIDs: map[string]string{"serial01": "10"},
+				Version:  version,
+				Names:    map[string]string{"nickname01": "serial01", "nickname02": "serial02"},
+				Groups:   map[string][]string{},
+				UserIDs:  map[string]string{"serial01": "10"},
+				Tags:     map[string][]string{},
+				Metadata: map[string]map[string]string{},
+				Queries:  map[string]string{},
+				Aliases:  map[string]string{},
 			},
 		},
 		{
 			"testdata/configs/oldFormatNicknamesOnly",
 			map[string]string{"": "config", "nicknames": "nicknames.bak"},
 			config{
-				Version: version,
-				Names:   map[string]string{"nickname01": "serial01", "nickname02": "serial02"},
-				Groups:  map[string][]string{},
-				UserIDs: map[string]string{},
+				Version:  version,
+				Names:    map[string]string{"nickname01": "serial01", "nickname02": "serial02"},
+				Groups:   map[string][]string{},
+				UserIDs:  map[string]string{},
+				Tags:     map[string][]string{},
+				Metadata: map[string]map[string]string{},
+				Queries:  map[string]string{},
+				Aliases:  map[string]string{},
 			},
 		},
 		{
 			"testdata/configs/oldFormatUsersOnly",
 			map[string]string{"": "config", "users": "users.bak"},
 			config{
-				Version: version,
-				Names:   map[string]string{},
-				Groups:  map[string][]string{},
-				UserIDs: map[string]string{"serial01": "10"},
+				Version:  version,
+				Names:    map[string]string{},
+				Groups:   map[string][]string{},
+				UserIDs:  map[string]string{"serial01": "10"},
+				Tags:     map[string][]string{},
+				Metadata: map[string]map[string]string{},
+				Queries:  map[string]string{},
+				Aliases:  map[string]string{},
 			},
 		},
 	}
@@ -700,3 +1118,31 @@ func TestConfigMigration(t *testing.T) {
 		}
 	}
 }
+
+func TestUpdateConfig(t *testing.T) {
+	filename := tempFilename(t)
+	defer os.Remove(filename)
+
+	// Run the updates concurrently, and make sure none of them are lost.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := updateConfig(filename, func(cfg *config) {
+				cfg.UserIDs[fmt.Sprintf("SERIAL%v", i)] = strconv.Itoa(i)
+			}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	cfg, err := readConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(cfg.UserIDs), 10; got != want {
+		t.Fatalf("unmatched results: got %v, want %v", got, want)
+	}
+}
@@ -14,6 +14,10 @@ import (
 	"v.io/x/lib/cmdline"
 )
 
+func init() {
+	initializeHardwareSerialFlag(&cmdMadbNameSet.Flags)
+}
+
 var cmdMadbName = &cmdline.Command{
 	Children:         []*cmdline.Command{cmdMadbNameSet, cmdMadbNameUnset, cmdMadbNameList, cmdMadbNameClearAll},
 	Name:             "name",
@@ -53,6 +57,19 @@ the device within madb commands.
 There can only be one nickname for a device serial.
 When the 'madb name set' command is invoked with a device serial with an already
 assigned nickname, the old one will be replaced with the newly provided one.
+
+When a device is connected over Wi-Fi (e.g., after running 'adb tcpip'), its
+device serial becomes the network address of the device, such as
+'192.168.0.10:5555', which can change over time. To keep the nickname attached
+to the device regardless of how it is connected, the nickname can be given to
+the hardware serial of the device instead:
+
+    madb name set -hardware-serial 192.168.0.10:5555 MyTablet
+
+which resolves the hardware serial of the currently connected device (e.g.,
+'HT4BVWV00023') and assigns the nickname to 'serialno:HT4BVWV00023'. The
+'serialno:<hardware_serial>' specifier can also be given directly, in which case
+the device does not have to be connected.
 `,
 	ArgsName: "<device_serial> <nickname>",
 	ArgsLong: `
@@ -86,6 +103,13 @@ func runMadbNameSet(env *cmdline.Env, args []string, filename string) error {
 		return fmt.Errorf("The provided nickname %q is already in use.", nickname)
 	}
 
+	// Key the nickname on the hardware serial, if requested.
+	if hardwareSerialFlag {
+		if serial, err = resolveHardwareSerialSpecifier(serial, cfg); err != nil {
+			return err
+		}
+	}
+
 	// If the serial number already has an assigned nickname, delete it first.
 	// Need to do this check, because the nickname-serial map should be a one-to-one mapping.
 	if name, present := reverseMap(cfg.Names)[serial]; present {
@@ -0,0 +1,266 @@
+// Copyright 2016 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"v.io/x/lib/gosh"
+)
+
+var skipChecksFlag bool
+
+// initializeSkipChecksFlag sets up the flag for skipping the pre-install compatibility checks.
+func initializeSkipChecksFlag(flags *flag.FlagSet) {
+	flags.BoolVar(&skipChecksFlag, "skip-checks", false, `Skip the compatibility checks performed before installing the app (i.e., the SDK versions, the ABIs, the free space, and the signature).`)
+}
+
+// minTargetSdkVersion is the minimum target SDK version of the apps that can be installed on the
+// devices running Android 14 (API level 34) and above.
+const minTargetSdkVersion = 23
+
+// preInstallProblem is a problem found by the pre-install checks, which would make the installation
+// fail.
+type preInstallProblem struct {
+	// Reason describes what is wrong in a human-readable form.
+	Reason string
+	// Remedy describes how the problem can be fixed.
+	Remedy string
+}
+
+// newPreInstallProblem returns a problem with the given reason, which would make the installation
+// fail with the given failure code. The remedy is the same as the one reported for the failure.
+func newPreInstallProblem(code string, reason string) preInstallProblem {
+	return preInstallProblem{reason, installFailureDescriptions[code].Remedy}
+}
+
+// deviceInstallInfo contains the device information used by the pre-install checks.
+type deviceInstallInfo struct {
+	SdkVersion int
+	Abis       []string
+	// FreeSpace is the free space of the "/data" partition in bytes. Negative if unknown.
+	FreeSpace int64
+	// InstalledSignatures are the signature hashes of the installed app. Empty if the app is not
+	// installed, or the signatures are unknown.
+	InstalledSignatures []string
+}
+
+// checkInstallCompatibility checks whether the app described by the given .apk information can be
+// installed on the device, and returns all the problems found. The size is the total size of the
+// .apk files to be installed.
+func checkInstallCompatibility(apk apkInfo, size int64, device deviceInstallInfo) []preInstallProblem {
+	problems := []preInstallProblem{}
+
+	if apk.MinSdkVersion > device.SdkVersion {
+		problems = append(problems, newPreInstallProblem("INSTALL_FAILED_OLDER_SDK",
+			fmt.Sprintf("The app requires API level %v or higher (minSdkVersion), but the device is running API level %v.", apk.MinSdkVersion, device.SdkVersion)))
+	}
+
+	if device.SdkVersion >= 34 && apk.TargetSdkVersion != 0 && apk.TargetSdkVersion < minTargetSdkVersion {
+		problems = append(problems, newPreInstallProblem("INSTALL_FAILED_DEPRECATED_SDK_VERSION",
+			fmt.Sprintf("The app targets API level %v (targetSdkVersion), but the device running API level %v blocks the apps targeting API level below %v.", apk.TargetSdkVersion, device.SdkVersion, minTargetSdkVersion)))
+	}
+
+	if len(apk.Abis) > 0 {
+		supported := false
+		for _, abi := range apk.Abis {
+			if isStringInSlice(abi, device.Abis) {
+				supported = true
+				break
+			}
+		}
+
+		if !supported {
+			problems = append(problems, newPreInstallProblem("INSTALL_FAILED_NO_MATCHING_ABIS",
+				fmt.Sprintf("The app contains native libraries only for %v, but the device supports %v.", strings.Join(apk.Abis, ", "), strings.Join(device.Abis, ", "))))
+		}
+	}
+
+	// The installation needs more space than the .apk files themselves, for copying the .apk files
+	// and for the optimized code.
+	if required := size * 2; device.FreeSpace >= 0 && device.FreeSpace < required {
+		problems = append(problems, newPreInstallProblem("INSTALL_FAILED_INSUFFICIENT_STORAGE",
+			fmt.Sprintf("The device has only %v of free space in /data, but at least %v is needed.", formatBytes(device.FreeSpace), formatBytes(required))))
+	}
+
+	// The signature mismatch is resolved during the installation, when the existing app is to be
+	// uninstalled by the "-on-signature-mismatch" flag.
+	if apk.SignatureHash != "" && len(device.InstalledSignatures) > 0 && !isStringInSlice(apk.SignatureHash, device.InstalledSignatures) && onSignatureMismatchFlag != "uninstall" {
+		problems = append(problems, newPreInstallProblem("INSTALL_FAILED_UPDATE_INCOMPATIBLE",
+			"The app is signed with a different key from the one installed on the device."))
+	}
+
+	return problems
+}
+
+// runPreInstallChecks runs the pre-install checks for the given .apk files on the given device, and
+// returns an error describing all the problems found. The first .apk must be the base .apk. When
+// the information needed for the checks cannot be obtained, the checks are skipped with a warning.
+func runPreInstallChecks(d device, appID string, apks []string, deviceAbis []string) error {
+	apk, err := readApkInfo(apks[0])
+	if err != nil {
+		printMessage(os.Stderr, "WARNING: Skipping the pre-install checks for device %q: %v\n", d.displayName(), err)
+		return nil
+	}
+
+	size := int64(0)
+	for _, filename := range apks {
+		stat, err := os.Stat(filename)
+		if err != nil {
+			return err
+		}
+		size += stat.Size()
+	}
+
+	info, err := getDeviceInstallInfo(d, appID, deviceAbis)
+	if err != nil {
+		printMessage(os.Stderr, "WARNING: Skipping the pre-install checks for device %q: %v\n", d.displayName(), err)
+		return nil
+	}
+
+	problems := checkInstallCompatibility(apk, size, info)
+	if len(problems) == 0 {
+		return nil
+	}
+
+	buffer := bytes.Buffer{}
+	buffer.WriteString(fmt.Sprintf("The app cannot be installed on device %q:", d.displayName()))
+	for _, problem := range problems {
+		buffer.WriteString(fmt.Sprintf("\n - %v\n   %v", problem.Reason, problem.Remedy))
+	}
+	buffer.WriteString("\n(Use '-skip-checks' flag to attempt the installation anyway.)")
+
+	return fmt.Errorf("%v", buffer.String())
+}
+
+// getDeviceInstallInfo gathers the device information used by the pre-install checks.
+func getDeviceInstallInfo(d device, appID string, deviceAbis []string) (deviceInstallInfo, error) {
+	props, err := getDeviceProperties(d.Serial)
+	if err != nil {
+		return deviceInstallInfo{}, err
+	}
+
+	sdkVersion, err := strconv.Atoi(props["ro.build.version.sdk"])
+	if err != nil {
+		return deviceInstallInfo{}, fmt.Errorf("Could not determine the SDK version of the device: %v", err)
+	}
+
+	sh := gosh.NewShell(nil)
+	defer sh.Cleanup()
+
+	sh.ContinueOnError = true
+
+	dfOutput := sh.Cmd("adb", "-s", d.Serial, "shell", "df", "/data").Stdout()
+	dumpOutput := sh.Cmd("adb", "-s", d.Serial, "shell", "dumpsys", "package", appID).Stdout()
+
+	if sh.Err != nil {
+		return deviceInstallInfo{}, sh.Err
+	}
+
+	// The free space is left unknown when the output cannot be parsed.
+	freeSpace, err := parseFreeSpace(dfOutput)
+	if err != nil {
+		freeSpace = -1
+	}
+
+	return deviceInstallInfo{
+		SdkVersion:          sdkVersion,
+		Abis:                deviceAbis,
+		FreeSpace:           freeSpace,
+		InstalledSignatures: parseInstalledSignatures(dumpOutput),
+	}, nil
+}
+
+// parseFreeSpace takes the output of "adb shell df /data" command, and returns the free space in
+// bytes. The newer devices print the sizes in 1K blocks under the "Available" column, while the
+// older devices print the human-readable sizes (e.g., "1.2G") under the "Free" column.
+func parseFreeSpace(output string) (int64, error) {
+	lines := []string{}
+	for _, line := range strings.Split(output, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) < 2 {
+		return 0, fmt.Errorf("Could not parse the df output.")
+	}
+
+	header := strings.Fields(lines[0])
+	column := -1
+	for i, name := range header {
+		if name == "Available" || name == "Free" {
+			column = i
+			break
+		}
+	}
+
+	values := strings.Fields(lines[len(lines)-1])
+	if column < 0 || column >= len(values) {
+		return 0, fmt.Errorf("Could not parse the df output.")
+	}
+
+	value := values[column]
+	unit := int64(1)
+	if isStringInSlice("1K-blocks", header) {
+		unit = 1024
+	}
+
+	// Handle the human-readable sizes with the unit suffixes.
+	suffixes := map[string]int64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40}
+	if multiplier, ok := suffixes[strings.ToUpper(value[len(value)-1:])]; ok {
+		unit = multiplier
+		value = value[:len(value)-1]
+	}
+
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Could not parse the df output: %v", err)
+	}
+
+	return int64(number * float64(unit)), nil
+}
+
+// parseInstalledSignatures takes the output of "adb shell dumpsys package <app_id>" command, and
+// extracts the signature hashes of the installed app. Returns nil if the app is not installed.
+func parseInstalledSignatures(output string) []string {
+	// The signatures are printed as either "PackageSignatures{<id> [<hash>, ...]}" in the older
+	// versions of Android, or "PackageSignatures{<id> version:<n>, signatures:[<hash>, ...], ...}".
+	exp := regexp.MustCompile(`PackageSignatures\{[0-9a-f]+ (?:version:\d+, signatures:)?\[([0-9a-f, ]*)\]`)
+	matches := exp.FindStringSubmatch(output)
+	if matches == nil {
+		return nil
+	}
+
+	result := []string{}
+	for _, hash := range strings.Split(matches[1], ",") {
+		if hash = strings.TrimSpace(hash); hash != "" {
+			result = append(result, hash)
+		}
+	}
+
+	return result
+}
+
+// formatBytes formats the given number of bytes in a human-readable form (e.g., "1.5 MB").
+func formatBytes(n int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	value := float64(n)
+	i := 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+
+	if i == 0 {
+		return fmt.Sprintf("%v B", n)
+	}
+	return fmt.Sprintf("%.1f %v", value, units[i])
+}
@@ -0,0 +1,123 @@
+// Copyright 2016 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCheckInstallCompatibility(t *testing.T) {
+	apk := apkInfo{
+		PackageName:      "com.example.app",
+		MinSdkVersion:    21,
+		TargetSdkVersion: 28,
+		Abis:             []string{"arm64-v8a"},
+		SignatureHash:    "2a0d4c43",
+	}
+	device := deviceInstallInfo{
+		SdkVersion:          28,
+		Abis:                []string{"arm64-v8a", "armeabi-v7a"},
+		FreeSpace:           1 << 30,
+		InstalledSignatures: []string{"2a0d4c43"},
+	}
+
+	if problems := checkInstallCompatibility(apk, 10<<20, device); len(problems) != 0 {
+		t.Fatalf("unexpected problems: %v", problems)
+	}
+
+	tests := []struct {
+		modify func(apk *apkInfo, device *deviceInstallInfo)
+		size   int64
+	}{
+		{func(apk *apkInfo, device *deviceInstallInfo) { device.SdkVersion = 19 }, 10 << 20},
+		{func(apk *apkInfo, device *deviceInstallInfo) { apk.TargetSdkVersion = 22; device.SdkVersion = 34 }, 10 << 20},
+		{func(apk *apkInfo, device *deviceInstallInfo) { device.Abis = []string{"x86_64", "x86"} }, 10 << 20},
+		{func(apk *apkInfo, device *deviceInstallInfo) {}, 600 << 20},
+		{func(apk *apkInfo, device *deviceInstallInfo) { device.InstalledSignatures = []string{"1f2e3d4c"} }, 10 << 20},
+	}
+
+	for i, test := range tests {
+		a, d := apk, device
+		test.modify(&a, &d)
+		problems := checkInstallCompatibility(a, test.size, d)
+		if len(problems) != 1 {
+			t.Fatalf("unexpected problems for tests[%v]: got %v, want exactly one problem", i, problems)
+		}
+		if problems[0].Remedy == "" {
+			t.Fatalf("no remedy for tests[%v]: %v", i, problems[0])
+		}
+	}
+
+	// The signature mismatch is not a problem when the existing app is to be uninstalled.
+	defer func(value string) {
+		onSignatureMismatchFlag = value
+	}(onSignatureMismatchFlag)
+	onSignatureMismatchFlag = "uninstall"
+	d := device
+	d.InstalledSignatures = []string{"1f2e3d4c"}
+	if problems := checkInstallCompatibility(apk, 10<<20, d); len(problems) != 0 {
+		t.Fatalf("unexpected problems: %v", problems)
+	}
+
+	// The unknown information should not be reported as a problem.
+	device.FreeSpace = -1
+	device.InstalledSignatures = nil
+	apk.SignatureHash = ""
+	if problems := checkInstallCompatibility(apk, 600<<30, device); len(problems) != 0 {
+		t.Fatalf("unexpected problems: %v", problems)
+	}
+}
+
+func TestParseFreeSpace(t *testing.T) {
+	tests := []struct {
+		output string
+		want   int64
+	}{
+		{
+			"Filesystem      1K-blocks    Used Available Use% Mounted on\r\n/dev/block/dm-0  25367912 4419344  20817496  18% /data\r\n",
+			20817496 * 1024,
+		},
+		{
+			"Filesystem               Size     Used     Free   Blksize\n/data                    5.8G     1.2G     4.5G   4096\n",
+			int64(4.5 * (1 << 30)),
+		},
+		{
+			"Filesystem Size Used Free Blksize\n/data 806M 400M 406M 4096\n",
+			406 << 20,
+		},
+	}
+
+	for i, test := range tests {
+		got, err := parseFreeSpace(test.output)
+		if err != nil {
+			t.Fatalf("unexpected error for tests[%v]: %v", i, err)
+		}
+		if got != test.want {
+			t.Fatalf("unmatched results for tests[%v]: got %v, want %v", i, got, test.want)
+		}
+	}
+
+	if _, err := parseFreeSpace("/system/bin/sh: df: not found"); err == nil {
+		t.Fatalf("expected an error but succeeded.")
+	}
+}
+
+func TestParseInstalledSignatures(t *testing.T) {
+	tests := []struct {
+		output string
+		want   []string
+	}{
+		{"    signatures=PackageSignatures{9fe2d60 version:2, signatures:[2a0d4c43], past signatures:[]}", []string{"2a0d4c43"}},
+		{"    signatures=PackageSignatures{42a5b7f0 [41a6b8c0, 1f2e3d4c]}", []string{"41a6b8c0", "1f2e3d4c"}},
+		{"Unable to find package: com.example.app", nil},
+	}
+
+	for i, test := range tests {
+		if got := parseInstalledSignatures(test.output); !reflect.DeepEqual(got, test.want) {
+			t.Fatalf("unmatched results for tests[%v]: got %v, want %v", i, got, test.want)
+		}
+	}
+}
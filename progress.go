@@ -0,0 +1,401 @@
+// Copyright 2016 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"v.io/x/lib/gosh"
+)
+
+var progressFlag bool
+
+// initializeProgressFlag sets up the flag for reporting the installation progress.
+func initializeProgressFlag(flags *flag.FlagSet) {
+	flags.BoolVar(&progressFlag, "progress", false, `Report the installation progress of each device (i.e., the bytes pushed, the percentage, the throughput, and the phase). On a terminal, the progress of all the devices is shown as a status display updated in place. Otherwise, the progress lines are printed periodically. When this flag is not specified, "adb install" is used as is.`)
+}
+
+// setUpInstallProgress sets up the progress reporter shared by all the devices, if requested.
+func setUpInstallProgress() {
+	installProgressReporter = nil
+	if progressFlag {
+		installProgressReporter = newProgressReporter(os.Stdout, isTerminal(os.Stdout))
+	}
+}
+
+// The phases of installing the app on a device. The "install" phase is used instead of the "push"
+// and "verify/dexopt" phases, when the progress of pushing the .apk files cannot be tracked.
+const (
+	phaseWaiting    = "waiting"
+	phasePush       = "push"
+	phaseInstall    = "verify/dexopt"
+	phaseAdbInstall = "install"
+	phaseDone       = "done"
+	phaseFailed     = "failed"
+)
+
+const (
+	// ttyRefreshInterval is the minimum interval between the redraws of the status display.
+	ttyRefreshInterval = 100 * time.Millisecond
+	// progressLineInterval is the minimum interval between the progress lines of a device, when the
+	// output is not a terminal.
+	progressLineInterval = 2 * time.Second
+)
+
+// installProgress is the installation progress of a device.
+type installProgress struct {
+	Name        string
+	Phase       string
+	BytesPushed int64
+	TotalBytes  int64
+	// PushStarted is when the .apk files started to be pushed, which is used for computing the
+	// throughput.
+	PushStarted time.Time
+	// PushElapsed is the time taken to push all the .apk files. Zero while pushing.
+	PushElapsed time.Duration
+
+	lastPrinted      time.Time
+	lastPrintedPhase string
+}
+
+// throughput returns the push throughput in bytes per second.
+func (p *installProgress) throughput(now time.Time) float64 {
+	elapsed := p.PushElapsed
+	if elapsed == 0 && !p.PushStarted.IsZero() {
+		elapsed = now.Sub(p.PushStarted)
+	}
+	if elapsed <= 0 {
+		return 0
+	}
+
+	return float64(p.BytesPushed) / elapsed.Seconds()
+}
+
+// format formats the progress in a single line.
+func (p *installProgress) format(now time.Time) string {
+	result := fmt.Sprintf("%-13v", p.Phase)
+	if p.TotalBytes > 0 && p.Phase != phaseWaiting {
+		percentage := float64(p.BytesPushed) * 100 / float64(p.TotalBytes)
+		result += fmt.Sprintf(" %3.0f%%  %v / %v  %v/s", percentage, formatBytes(p.BytesPushed), formatBytes(p.TotalBytes), formatBytes(int64(p.throughput(now))))
+	}
+
+	return strings.TrimSpace(result)
+}
+
+// progressReporter reports the installation progress of multiple devices. On a terminal, the
+// progress of all the devices is rendered as a multi-line status display, which is redrawn in place.
+// Otherwise, a progress line is printed for a device whenever its phase changes, and periodically
+// while pushing the .apk files.
+type progressReporter struct {
+	mu       sync.Mutex
+	out      io.Writer
+	tty      bool
+	devices  []*installProgress
+	drawn    int
+	lastDraw time.Time
+	now      func() time.Time
+}
+
+// newProgressReporter creates a progress reporter which writes to the given output.
+func newProgressReporter(out io.Writer, tty bool) *progressReporter {
+	return &progressReporter{out: out, tty: tty, now: time.Now}
+}
+
+// isTerminal determines whether the given file is a terminal.
+func isTerminal(f *os.File) bool {
+	stat, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	return stat.Mode()&os.ModeCharDevice != 0
+}
+
+// installProgressReporter is the progress reporter shared by all the devices, which is set up by
+// the init functions of the commands installing the app. Nil when the progress is not reported.
+var installProgressReporter *progressReporter
+
+// progressForDevice returns the progress of the given device, adding a new one if needed.
+func (r *progressReporter) progressForDevice(name string) *installProgress {
+	for _, p := range r.devices {
+		if p.Name == name {
+			return p
+		}
+	}
+
+	p := &installProgress{Name: name, Phase: phaseWaiting}
+	r.devices = append(r.devices, p)
+	return p
+}
+
+// update applies the given change to the progress of the given device, and reports it.
+func (r *progressReporter) update(name string, change func(p *installProgress)) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	p := r.progressForDevice(name)
+	change(p)
+
+	now := r.now()
+	if r.tty {
+		// Always redraw when the phase changes, so that the final states are shown.
+		if p.Phase != p.lastPrintedPhase || now.Sub(r.lastDraw) >= ttyRefreshInterval {
+			p.lastPrintedPhase = p.Phase
+			r.draw(now)
+		}
+		return
+	}
+
+	if p.Phase != p.lastPrintedPhase || now.Sub(p.lastPrinted) >= progressLineInterval {
+		p.lastPrinted, p.lastPrintedPhase = now, p.Phase
+		fmt.Fprintf(r.out, "[%v]\t%v\n", p.Name, p.format(now))
+	}
+}
+
+// draw redraws the status display, by moving the cursor up to the beginning of the previously drawn
+// display and overwriting the lines.
+func (r *progressReporter) draw(now time.Time) {
+	if r.drawn > 0 {
+		fmt.Fprintf(r.out, "\x1b[%dA", r.drawn)
+	}
+
+	for _, p := range r.devices {
+		fmt.Fprintf(r.out, "\x1b[2K[%v]\t%v\n", p.Name, p.format(now))
+	}
+
+	r.drawn = len(r.devices)
+	r.lastDraw = now
+}
+
+// printMessage prints the given message to the given writer. On a terminal, the status display is
+// erased before printing the message and redrawn below it, so that the message does not break the
+// display.
+func (r *progressReporter) printMessage(w io.Writer, message string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.tty || r.drawn == 0 {
+		fmt.Fprint(w, message)
+		return
+	}
+
+	// The display must start on a new line when it is redrawn.
+	if !strings.HasSuffix(message, "\n") {
+		message += "\n"
+	}
+
+	fmt.Fprintf(r.out, "\x1b[%dA\x1b[J", r.drawn)
+	fmt.Fprint(w, message)
+	r.drawn = 0
+	r.draw(r.now())
+}
+
+// progressMessageWriter is an io.Writer which prints the written output through the progress
+// reporter.
+type progressMessageWriter struct {
+	reporter *progressReporter
+	w        io.Writer
+}
+
+func (pw progressMessageWriter) Write(b []byte) (int, error) {
+	pw.reporter.printMessage(pw.w, string(b))
+	return len(b), nil
+}
+
+// printMessage prints a message to the given writer. While the installation progress is reported,
+// the message is printed through the progress reporter.
+func printMessage(w io.Writer, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	if installProgressReporter != nil {
+		installProgressReporter.printMessage(w, message)
+		return
+	}
+
+	fmt.Fprint(w, message)
+}
+
+// setPhase sets the phase of the given device.
+func (r *progressReporter) setPhase(name, phase string) {
+	r.update(name, func(p *installProgress) {
+		if phase != phasePush && p.Phase == phasePush {
+			p.PushElapsed = r.now().Sub(p.PushStarted)
+		}
+		p.Phase = phase
+	})
+}
+
+// startPush starts the push phase of the given device with the total number of bytes to be pushed.
+func (r *progressReporter) startPush(name string, total int64) {
+	r.update(name, func(p *installProgress) {
+		p.Phase, p.TotalBytes, p.BytesPushed = phasePush, total, 0
+		p.PushStarted, p.PushElapsed = r.now(), 0
+	})
+}
+
+// addBytes adds the given number of bytes pushed to the given device.
+func (r *progressReporter) addBytes(name string, n int64) {
+	r.update(name, func(p *installProgress) {
+		p.BytesPushed += n
+	})
+}
+
+// progressReader is an io.Reader which reports the number of bytes read as the bytes pushed to a
+// device.
+type progressReader struct {
+	r        io.Reader
+	reporter *progressReporter
+	name     string
+}
+
+func (pr progressReader) Read(b []byte) (int, error) {
+	n, err := pr.r.Read(b)
+	if n > 0 {
+		pr.reporter.addBytes(pr.name, int64(n))
+	}
+
+	return n, err
+}
+
+// progressName returns the name of the given device shown in the progress, which is the same as the
+// output prefix of the device.
+func progressName(d device) string {
+	name := d.displayName()
+	if prefixFlag == "serial" {
+		name = d.Serial
+	}
+	if d.UserID != "" {
+		name = name + ":" + d.UserID
+	}
+
+	return name
+}
+
+// runSessionInstallCommand installs the given .apk files on the given device using an install
+// session, so that the progress of pushing the .apk files can be tracked. The install session
+// consists of "pm install-create", "pm install-write" for each .apk file, and "pm install-commit",
+// which is the same mechanism used by "adb install-multiple". Install sessions are supported on API
+// level 21 and above. Returns the failure parsed from the output, if any.
+func runSessionInstallCommand(d device, apks []string, installArgs []string) (*installFailure, error) {
+	reporter := installProgressReporter
+	name := progressName(d)
+
+	total := int64(0)
+	sizes := make([]int64, len(apks))
+	for i, apk := range apks {
+		stat, err := os.Stat(apk)
+		if err != nil {
+			return nil, err
+		}
+		sizes[i] = stat.Size()
+		total += sizes[i]
+	}
+
+	sh := gosh.NewShell(nil)
+	defer sh.Cleanup()
+
+	sh.ContinueOnError = true
+
+	// Create an install session.
+	cmdArgs := []string{"-s", d.Serial, "shell", "pm", "install-create", "-r"}
+	cmdArgs = append(cmdArgs, installArgs...)
+	if d.UserID != "" {
+		cmdArgs = append(cmdArgs, "--user", d.UserID)
+	}
+	cmdArgs = append(cmdArgs, "-S", strconv.FormatInt(total, 10))
+	output := sh.Cmd("adb", cmdArgs...).Stdout()
+	if sh.Err != nil {
+		reporter.setPhase(name, phaseFailed)
+		return nil, sh.Err
+	}
+	if failure := parseInstallFailure(output); failure != nil {
+		reporter.setPhase(name, phaseFailed)
+		return failure, nil
+	}
+
+	session, err := parseInstallSessionID(output)
+	if err != nil {
+		reporter.setPhase(name, phaseFailed)
+		return nil, err
+	}
+
+	// Stream each .apk file to the session, counting the bytes pushed.
+	reporter.startPush(name, total)
+	for i, apk := range apks {
+		f, err := os.Open(apk)
+		if err != nil {
+			abandonInstallSession(d, session)
+			reporter.setPhase(name, phaseFailed)
+			return nil, err
+		}
+
+		splitName := fmt.Sprintf("%d_%v", i, filepath.Base(apk))
+		cmd := sh.Cmd("adb", "-s", d.Serial, "exec-in", "pm", "install-write", "-S", strconv.FormatInt(sizes[i], 10), session, splitName, "-")
+		cmd.SetStdinReader(progressReader{f, reporter, name})
+		output = cmd.Stdout()
+		f.Close()
+
+		failure := parseInstallFailure(output)
+		if sh.Err != nil || failure != nil {
+			abandonInstallSession(d, session)
+			reporter.setPhase(name, phaseFailed)
+			return failure, sh.Err
+		}
+	}
+
+	// Commit the session, which verifies the app and optimizes its code.
+	reporter.setPhase(name, phaseInstall)
+	output = sh.Cmd("adb", "-s", d.Serial, "shell", "pm", "install-commit", session).Stdout()
+	if sh.Err != nil {
+		reporter.setPhase(name, phaseFailed)
+		return nil, sh.Err
+	}
+	if failure := parseInstallFailure(output); failure != nil {
+		reporter.setPhase(name, phaseFailed)
+		return failure, nil
+	}
+	if !strings.Contains(output, "Success") {
+		reporter.setPhase(name, phaseFailed)
+		return nil, fmt.Errorf("Unexpected output from the install session: %v", strings.TrimSpace(output))
+	}
+
+	reporter.setPhase(name, phaseDone)
+	return nil, nil
+}
+
+// parseInstallSessionID takes the output of "adb shell pm install-create" command, and extracts the
+// session ID.
+func parseInstallSessionID(output string) (string, error) {
+	// The output is in the form "Success: created install session [<session_id>]".
+	exp := regexp.MustCompile(`created install session \[(\d+)\]`)
+	matches := exp.FindStringSubmatch(output)
+	if matches == nil {
+		return "", fmt.Errorf("Could not create an install session: %v", strings.TrimSpace(output))
+	}
+
+	return matches[1], nil
+}
+
+// abandonInstallSession abandons the given install session, so that the partially written .apk
+// files are removed from the device.
+func abandonInstallSession(d device, session string) {
+	sh := gosh.NewShell(nil)
+	defer sh.Cleanup()
+
+	sh.ContinueOnError = true
+	sh.Cmd("adb", "-s", d.Serial, "shell", "pm", "install-abandon", session).Run()
+}
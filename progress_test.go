@@ -0,0 +1,210 @@
+// Copyright 2016 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"v.io/x/lib/gosh"
+)
+
+// fakeClock is a clock for the tests, which only advances when requested.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func TestInstallProgressFormat(t *testing.T) {
+	start := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		progress installProgress
+		now      time.Time
+		want     string
+	}{
+		{
+			installProgress{Phase: phaseWaiting},
+			start,
+			"waiting",
+		},
+		{
+			installProgress{Phase: phasePush, BytesPushed: 5 << 20, TotalBytes: 20 << 20, PushStarted: start},
+			start.Add(2 * time.Second),
+			"push           25%  5.0 MB / 20.0 MB  2.5 MB/s",
+		},
+		{
+			// The throughput is fixed once the push is finished.
+			installProgress{Phase: phaseInstall, BytesPushed: 20 << 20, TotalBytes: 20 << 20, PushStarted: start, PushElapsed: 4 * time.Second},
+			start.Add(time.Minute),
+			"verify/dexopt 100%  20.0 MB / 20.0 MB  5.0 MB/s",
+		},
+		{
+			installProgress{Phase: phaseAdbInstall},
+			start,
+			"install",
+		},
+	}
+
+	for i, test := range tests {
+		if got := test.progress.format(test.now); got != test.want {
+			t.Fatalf("unmatched results for tests[%v]: got %q, want %q", i, got, test.want)
+		}
+	}
+}
+
+func TestProgressReporterLines(t *testing.T) {
+	clock := &fakeClock{time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)}
+	out := bytes.Buffer{}
+	r := newProgressReporter(&out, false)
+	r.now = clock.now
+
+	r.startPush("Nexus5X", 4<<20)
+	clock.advance(time.Second)
+	r.addBytes("Nexus5X", 1<<20) // Throttled.
+	clock.advance(time.Second)
+	r.addBytes("Nexus5X", 1<<20)
+	r.startPush("emulator-5554", 4<<20)
+	clock.advance(time.Second)
+	r.addBytes("Nexus5X", 2<<20) // Throttled.
+	r.setPhase("Nexus5X", phaseInstall)
+	r.setPhase("Nexus5X", phaseDone)
+
+	want := []string{
+		"[Nexus5X]\tpush            0%  0 B / 4.0 MB  0 B/s",
+		"[Nexus5X]\tpush           50%  2.0 MB / 4.0 MB  1.0 MB/s",
+		"[emulator-5554]\tpush            0%  0 B / 4.0 MB  0 B/s",
+		"[Nexus5X]\tverify/dexopt 100%  4.0 MB / 4.0 MB  1.3 MB/s",
+		"[Nexus5X]\tdone          100%  4.0 MB / 4.0 MB  1.3 MB/s",
+	}
+	if got := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unmatched results: got %q, want %q", got, want)
+	}
+}
+
+func TestProgressReporterTerminal(t *testing.T) {
+	clock := &fakeClock{time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)}
+	out := bytes.Buffer{}
+	r := newProgressReporter(&out, true)
+	r.now = clock.now
+
+	r.setPhase("Nexus5X", phaseAdbInstall)
+	r.setPhase("emulator-5554", phaseAdbInstall)
+	r.setPhase("Nexus5X", phaseDone)
+
+	want := "\x1b[2K[Nexus5X]\tinstall\n" +
+		"\x1b[1A\x1b[2K[Nexus5X]\tinstall\n\x1b[2K[emulator-5554]\tinstall\n" +
+		"\x1b[2A\x1b[2K[Nexus5X]\tdone\n\x1b[2K[emulator-5554]\tinstall\n"
+	if got := out.String(); got != want {
+		t.Fatalf("unmatched results: got %q, want %q", got, want)
+	}
+
+	// The redraws are throttled while the phase does not change.
+	out.Reset()
+	r.startPush("emulator-5554", 100)
+	r.addBytes("emulator-5554", 10)
+	if got := strings.Count(out.String(), "\x1b[2A"); got != 1 {
+		t.Fatalf("unmatched number of redraws: got %v, want 1", got)
+	}
+	clock.advance(ttyRefreshInterval)
+	r.addBytes("emulator-5554", 10)
+	if got := strings.Count(out.String(), "\x1b[2A"); got != 2 {
+		t.Fatalf("unmatched number of redraws: got %v, want 2", got)
+	}
+}
+
+func TestProgressReporterMessage(t *testing.T) {
+	clock := &fakeClock{time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)}
+	out := bytes.Buffer{}
+	r := newProgressReporter(&out, true)
+	r.now = clock.now
+
+	// The message is printed as is, when nothing is drawn yet.
+	r.printMessage(&out, "first\n")
+	r.setPhase("Nexus5X", phaseAdbInstall)
+	r.setPhase("emulator-5554", phaseAdbInstall)
+
+	// The status display is erased and redrawn below the message.
+	out.Reset()
+	r.printMessage(&out, "second\n")
+	want := "\x1b[2A\x1b[J" + "second\n" +
+		"\x1b[2K[Nexus5X]\tinstall\n\x1b[2K[emulator-5554]\tinstall\n"
+	if got := out.String(); got != want {
+		t.Fatalf("unmatched results: got %q, want %q", got, want)
+	}
+
+	// The messages are printed as is, when the output is not a terminal.
+	out.Reset()
+	r = newProgressReporter(&out, false)
+	r.setPhase("Nexus5X", phaseAdbInstall)
+	r.printMessage(&out, "third\n")
+	if got, want := out.String(), "[Nexus5X]\tinstall\nthird\n"; got != want {
+		t.Fatalf("unmatched results: got %q, want %q", got, want)
+	}
+}
+
+func TestProgressReporterCommandOutput(t *testing.T) {
+	clock := &fakeClock{time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)}
+	out := bytes.Buffer{}
+	r := newProgressReporter(&out, true)
+	r.now = clock.now
+
+	defer func(reporter *progressReporter, prefix string) {
+		installProgressReporter, prefixFlag = reporter, prefix
+	}(installProgressReporter, prefixFlag)
+	installProgressReporter, prefixFlag = r, "serial"
+
+	// One device is still pushing the .apk files, while the other device is done and runs a command.
+	r.startPush("deviceid01", 100)
+	r.setPhase("emulator-5554", phaseDone)
+
+	sh := gosh.NewShell(nil)
+	defer sh.Cleanup()
+
+	out.Reset()
+	d := device{Serial: "emulator-5554", Type: emulator, Index: 2}
+	if err := runGoshCommandForDeviceWithWriters(sh.FuncCmd(helloFunc), d, true, &out, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	// The output is printed above the status display, which is redrawn below it.
+	want := "\x1b[2A\x1b[J" + "[emulator-5554]\tHello, World!\n" +
+		"\x1b[2K[deviceid01]\tpush            0%  0 B / 100 B  0 B/s\n\x1b[2K[emulator-5554]\tdone\n"
+	if got := out.String(); got != want {
+		t.Fatalf("unmatched results: got %q, want %q", got, want)
+	}
+
+	// The display is intact, so that the next redraw overwrites exactly the display lines.
+	out.Reset()
+	clock.advance(ttyRefreshInterval)
+	r.addBytes("deviceid01", 50)
+	want = "\x1b[2A\x1b[2K[deviceid01]\tpush           50%  50 B / 100 B  500 B/s\n\x1b[2K[emulator-5554]\tdone\n"
+	if got := out.String(); got != want {
+		t.Fatalf("unmatched results: got %q, want %q", got, want)
+	}
+}
+
+func TestParseInstallSessionID(t *testing.T) {
+	got, err := parseInstallSessionID("Success: created install session [1234567]\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "1234567"; got != want {
+		t.Fatalf("unmatched results: got %v, want %v", got, want)
+	}
+
+	if _, err := parseInstallSessionID("Error: java.lang.SecurityException"); err == nil {
+		t.Fatalf("error expected for an invalid output")
+	}
+}
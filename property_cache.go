@@ -5,26 +5,55 @@
 package main
 
 import (
-	"encoding/gob"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 )
 
+// propertyCacheVersion is the schema version of the property cache file. It
+// should be incremented whenever the format of the cache entries changes, so
+// that the cache files written by older versions of madb are discarded.
+const propertyCacheVersion = 6
+
 // variantKey specifies a build variant in an Android Gradle project.
 type variantKey struct {
-	// Dir indicates the project directory where "build.gradle" resides.
+	// Dir indicates the project directory where "build.gradle" or "build.gradle.kts" resides.
 	Dir string
-	// Module indicates the name of the sub-module. Can be an empty string.
+	// Module indicates the name of the sub-module. Can be an empty string, or a comma-separated list
+	// of sub-modules or "all" when multiple modules are specified. "all" refers to a sub-module
+	// when there is a module directory named "all".
 	Module string
 	// Variant is the name of the build variant in an Android application module.
 	// When there are no product flavors, there are only two build variants: "debug" and "release".
 	Variant string
 }
 
+// propertyCacheEntry is a single cache entry, which holds the variant properties along with the
+// fingerprints of the project files from which the properties were extracted.
+type propertyCacheEntry struct {
+	Key variantKey
+	// Fingerprints maps the paths of the project files, relative to the project directory, to the
+	// SHA-256 hashes of their contents. A missing file is recorded with an empty hash.
+	Fingerprints map[string]string
+	Properties   variantProperties
+}
+
 // propertyCache is a map used for caching the variant properties extracted from the Gradle scripts,
 // so that apps can be launched more quickly without running Gradle tasks.
-type propertyCache map[variantKey]variantProperties
+type propertyCache map[variantKey]propertyCacheEntry
+
+// propertyCacheFile is the JSON representation of the property cache file.
+type propertyCacheFile struct {
+	Version int
+	Entries []propertyCacheEntry
+}
 
 func getPropertyCache(cacheFile string) (propertyCache, error) {
 	return readPropertyCacheMap(cacheFile)
@@ -42,17 +71,28 @@ func clearPropertyCacheEntry(key variantKey, cacheFile string) error {
 }
 
 // Adds a new entry in the property cache located at cacheFile and save the cache back to the file.
+// The fingerprints of the project files are computed at this point.
 func writePropertyCacheEntry(key variantKey, props variantProperties, cacheFile string) error {
 	cache, err := getPropertyCache(cacheFile)
 	if err != nil {
 		return err
 	}
 
-	cache[key] = props
+	cache[key] = propertyCacheEntry{
+		Key:          key,
+		Fingerprints: computeFingerprints(key, props),
+		Properties:   props,
+	}
 	return writePropertyCacheMap(cache, cacheFile)
 }
 
-// Reads the property cache map from the given file using gob-encoding.
+// isUpToDate determines whether none of the project files have changed since this entry was
+// written to the cache.
+func (e propertyCacheEntry) isUpToDate() bool {
+	return reflect.DeepEqual(e.Fingerprints, computeFingerprints(e.Key, e.Properties))
+}
+
+// Reads the property cache map from the given file in JSON format.
 func readPropertyCacheMap(filename string) (propertyCache, error) {
 	f, err := os.Open(filename)
 	if err != nil {
@@ -66,12 +106,12 @@ func readPropertyCacheMap(filename string) (propertyCache, error) {
 	}
 	defer f.Close()
 
-	decoder := gob.NewDecoder(f)
-	result := propertyCache{}
+	decoder := json.NewDecoder(f)
+	content := propertyCacheFile{}
 
 	// Decoding might fail when the cache file is somehow corrupted, or when the cache schema is
 	// updated. In such cases, move on after resetting the cache file instead of exiting the app.
-	if err := decoder.Decode(&result); err != nil {
+	if err := decoder.Decode(&content); err != nil || content.Version != propertyCacheVersion {
 		fmt.Fprintln(os.Stderr, "WARNING: Could not decode the property cache file. Resetting the cache.")
 		if err := os.Remove(f.Name()); err != nil {
 			return nil, err
@@ -80,19 +120,119 @@ func readPropertyCacheMap(filename string) (propertyCache, error) {
 		return propertyCache{}, nil
 	}
 
+	result := propertyCache{}
+	for _, entry := range content.Entries {
+		result[entry.Key] = entry
+	}
+
 	return result, nil
 }
 
-// Writes the property cache map to the given file using gob-encoding.
+// Writes the property cache map to the given file in JSON format. The entries are sorted by their
+// keys, so that the file can be easily inspected.
 func writePropertyCacheMap(cache propertyCache, filename string) error {
-	f, err := os.Create(filename)
+	content := propertyCacheFile{
+		Version: propertyCacheVersion,
+		Entries: sortedCacheEntries(cache),
+	}
+
+	bytes, err := json.MarshalIndent(content, "", "  ")
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
-	encoder := gob.NewEncoder(f)
-	return encoder.Encode(cache)
+	return ioutil.WriteFile(filename, append(bytes, '\n'), 0644)
+}
+
+// sortedCacheEntries returns all the entries of the given cache, sorted by their keys.
+func sortedCacheEntries(cache propertyCache) []propertyCacheEntry {
+	entries := make([]propertyCacheEntry, 0, len(cache))
+	for _, entry := range cache {
+		entries = append(entries, entry)
+	}
+
+	sort.Sort(byVariantKey(entries))
+	return entries
+}
+
+// byVariantKey implements sort.Interface for sorting the cache entries by their keys.
+type byVariantKey []propertyCacheEntry
+
+func (a byVariantKey) Len() int      { return len(a) }
+func (a byVariantKey) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byVariantKey) Less(i, j int) bool {
+	x, y := a[i].Key, a[j].Key
+	if x.Dir != y.Dir {
+		return x.Dir < y.Dir
+	}
+	if x.Module != y.Module {
+		return x.Module < y.Module
+	}
+	return x.Variant < y.Variant
+}
+
+// fingerprintedFiles lists the names of the files in each project or module directory, which can
+// affect the extracted variant properties.
+var fingerprintedFiles = []string{
+	"build.gradle",
+	"build.gradle.kts",
+	"settings.gradle",
+	"settings.gradle.kts",
+	"gradle.properties",
+}
+
+// computeFingerprints computes the SHA-256 hashes of the project files which can affect the variant
+// properties. These include the Gradle scripts and properties in the project directory and the
+// module directories, as well as the Android manifests of all the source sets in the modules.
+func computeFingerprints(key variantKey, props variantProperties) map[string]string {
+	dirs := []string{key.Dir}
+	if key.Module != "" && !isMultiModule(key.Dir, key.Module) {
+		dirs = append(dirs, filepath.Join(key.Dir, key.Module))
+	}
+
+	// The application module directories are derived from the Gradle project paths (e.g., ":app"),
+	// assuming the default project layout.
+	for _, module := range props.modules() {
+		if module.ProjectPath != "" && module.ProjectPath != ":" {
+			moduleDir := filepath.Join(key.Dir, filepath.FromSlash(strings.Replace(strings.TrimPrefix(module.ProjectPath, ":"), ":", "/", -1)))
+			if info, err := os.Stat(moduleDir); err == nil && info.IsDir() && !isStringInSlice(moduleDir, dirs) {
+				dirs = append(dirs, moduleDir)
+			}
+		}
+	}
+
+	result := map[string]string{}
+	for _, dir := range dirs {
+		files := []string{}
+		for _, name := range fingerprintedFiles {
+			files = append(files, filepath.Join(dir, name))
+		}
+
+		manifests, _ := filepath.Glob(filepath.Join(dir, "src", "*", "AndroidManifest.xml"))
+		files = append(files, manifests...)
+
+		for _, file := range files {
+			rel, err := filepath.Rel(key.Dir, file)
+			if err != nil {
+				rel = file
+			}
+			result[filepath.ToSlash(rel)] = hashFile(file)
+		}
+	}
+
+	return result
+}
+
+// hashFile returns the hex-encoded SHA-256 hash of the given file, or an empty string if the file
+// cannot be read.
+func hashFile(filename string) string {
+	bytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return ""
+	}
+
+	sum := sha256.Sum256(bytes)
+	return hex.EncodeToString(sum[:])
 }
 
 func getDefaultCacheFilePath() (string, error) {
@@ -101,5 +241,16 @@ func getDefaultCacheFilePath() (string, error) {
 		return "", err
 	}
 
-	return filepath.Join(configDir, "id_cache"), nil
+	return filepath.Join(configDir, "property_cache.json"), nil
+}
+
+// removeLegacyCacheFile removes the gob-encoded cache file used by the older versions of madb, if
+// it exists.
+func removeLegacyCacheFile() {
+	configDir, err := getConfigDir()
+	if err != nil {
+		return
+	}
+
+	os.Remove(filepath.Join(configDir, "id_cache"))
 }
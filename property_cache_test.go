@@ -0,0 +1,208 @@
+// Copyright 2016 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPropertyCacheReadWrite(t *testing.T) {
+	cacheFile := tempFilename(t)
+	defer os.Remove(cacheFile)
+
+	props := variantProperties{
+		ProjectPath: ":app",
+		VariantName: "debug",
+		AppID:       "com.example.app",
+		Activity:    "com.example.app.MainActivity",
+		AbiFilters:  []string{"x86"},
+		VariantOutputs: []variantOutput{
+			{Name: "debug", OutputFilePath: "/path/to/app-debug.apk", VersionCode: 1},
+		},
+	}
+
+	if err := writePropertyCacheEntry(variantKey{"dir2", "", ""}, props, cacheFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := writePropertyCacheEntry(variantKey{"dir1", "app", "debug"}, props, cacheFile); err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := readPropertyCacheMap(cacheFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := len(cache), 2; got != want {
+		t.Fatalf("unmatched number of entries: got %v, want %v", got, want)
+	}
+	for key, entry := range cache {
+		if entry.Key != key {
+			t.Fatalf("unmatched key: got %v, want %v", entry.Key, key)
+		}
+		if !reflect.DeepEqual(entry.Properties, props) {
+			t.Fatalf("unmatched properties: got %v, want %v", entry.Properties, props)
+		}
+	}
+
+	// A cache file with a different schema version should be reset.
+	if err := ioutil.WriteFile(cacheFile, []byte(`{"Version": 0, "Entries": []}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if cache, err = readPropertyCacheMap(cacheFile); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(cache), 0; got != want {
+		t.Fatalf("unmatched number of entries: got %v, want %v", got, want)
+	}
+}
+
+func TestGetProjectPropertiesInvalidation(t *testing.T) {
+	cacheFile := tempFilename(t)
+	defer os.Remove(cacheFile)
+
+	projectDir, err := ioutil.TempDir("", "madb_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(projectDir)
+
+	manifestDir := filepath.Join(projectDir, "app", "src", "main")
+	if err := os.MkdirAll(manifestDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile := func(name, content string) {
+		if err := ioutil.WriteFile(filepath.Join(projectDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeFile("build.gradle", "// root")
+	writeFile("settings.gradle", "include ':app'")
+	writeFile("app/build.gradle", "applicationId 'com.example.app'")
+	writeFile("app/src/main/AndroidManifest.xml", "<manifest/>")
+
+	called := false
+	extractor := func(key variantKey) (variantProperties, error) {
+		called = true
+		return variantProperties{ProjectPath: ":app", AppID: "com.example.app"}, nil
+	}
+
+	key := variantKey{projectDir, "", ""}
+
+	testCases := []struct {
+		update     func()
+		wantCalled bool
+	}{
+		// The first run should invoke the extractor.
+		{func() {}, true},
+		// Nothing has changed.
+		{func() {}, false},
+		// The app module build script has changed.
+		{func() { writeFile("app/build.gradle", "applicationIdSuffix '.debug'") }, true},
+		// A new Gradle properties file has been added.
+		{func() { writeFile("gradle.properties", "android.useAndroidX=true") }, true},
+		// A new manifest for a different source set has been added.
+		{func() {
+			os.MkdirAll(filepath.Join(projectDir, "app", "src", "debug"), 0755)
+			writeFile("app/src/debug/AndroidManifest.xml", "<manifest/>")
+		}, true},
+		// Nothing has changed again.
+		{func() {}, false},
+	}
+
+	for i, test := range testCases {
+		test.update()
+
+		called = false
+		if _, err := getProjectProperties(extractor, key, false, cacheFile); err != nil {
+			t.Fatal(err)
+		}
+
+		if called != test.wantCalled {
+			t.Fatalf("unmatched results for testCases[%v]: extractor called %v, want %v", i, called, test.wantCalled)
+		}
+	}
+}
+
+func TestGetProjectPropertiesInvalidationMultiModule(t *testing.T) {
+	cacheFile := tempFilename(t)
+	defer os.Remove(cacheFile)
+
+	projectDir, err := ioutil.TempDir("", "madb_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(projectDir)
+
+	writeFile := func(name, content string) {
+		filename := filepath.Join(projectDir, name)
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeFile("build.gradle", "// root")
+	writeFile("settings.gradle", "include ':client', ':server'")
+	writeFile("client/build.gradle", "applicationId 'com.example.client'")
+	writeFile("server/build.gradle", "applicationId 'com.example.server'")
+
+	called := false
+	extractor := func(key variantKey) (variantProperties, error) {
+		called = true
+		return variantProperties{
+			ProjectPath: ":client",
+			AppID:       "com.example.client",
+			AdditionalModules: []variantProperties{
+				{ProjectPath: ":server", AppID: "com.example.server"},
+			},
+		}, nil
+	}
+
+	key := variantKey{projectDir, "client,server", ""}
+
+	testCases := []struct {
+		update     func()
+		wantCalled bool
+	}{
+		// The first run should invoke the extractor.
+		{func() {}, true},
+		// Nothing has changed.
+		{func() {}, false},
+		// The build script of the additional module has changed.
+		{func() { writeFile("server/build.gradle", "applicationIdSuffix '.debug'") }, true},
+		// A new manifest has been added to the additional module.
+		{func() { writeFile("server/src/main/AndroidManifest.xml", "<manifest/>") }, true},
+		// Nothing has changed again.
+		{func() {}, false},
+	}
+
+	for i, test := range testCases {
+		test.update()
+
+		called = false
+		got, err := getProjectProperties(extractor, key, false, cacheFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if called != test.wantCalled {
+			t.Fatalf("unmatched results for testCases[%v]: extractor called %v, want %v", i, called, test.wantCalled)
+		}
+
+		modules := got.modules()
+		if len(modules) != 2 || modules[0].AppID != "com.example.client" || modules[1].AppID != "com.example.server" || modules[0].AdditionalModules != nil {
+			t.Fatalf("unmatched modules for testCases[%v]: got %v", i, modules)
+		}
+	}
+}
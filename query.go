@@ -0,0 +1,271 @@
+// Copyright 2016 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"v.io/x/lib/gosh"
+)
+
+// deviceQuery is a parsed query of a dynamic device group. The query is in the
+// disjunctive normal form; a device matches the query if all the terms in any
+// of the clauses match the device.
+type deviceQuery struct {
+	clauses [][]queryTerm
+}
+
+// queryTerm is a single comparison within a device query, such as "sdk>=31".
+type queryTerm struct {
+	key   string
+	op    string
+	value string
+}
+
+// queryOperators lists the supported comparison operators. The two-character
+// operators must come first, so that they are matched before their prefixes.
+var queryOperators = []string{">=", "<=", "!=", "=", ">", "<"}
+
+// propertyAliases maps the short property names that can be used in the device
+// queries to the corresponding Android system properties.
+var propertyAliases = map[string]string{
+	"sdk":          "ro.build.version.sdk",
+	"release":      "ro.build.version.release",
+	"abi":          "ro.product.cpu.abi",
+	"manufacturer": "ro.product.manufacturer",
+	"brand":        "ro.product.brand",
+}
+
+// parseDeviceQuery parses the given query string. A query consists of one or
+// more terms in the form of '<key><op><value>' joined by '&' (and) or '|' (or),
+// where '&' takes precedence over '|'.
+func parseDeviceQuery(query string) (*deviceQuery, error) {
+	result := &deviceQuery{}
+
+	for _, clause := range strings.Split(query, "|") {
+		terms := []queryTerm{}
+		for _, termStr := range strings.Split(clause, "&") {
+			term, err := parseQueryTerm(strings.TrimSpace(termStr))
+			if err != nil {
+				return nil, err
+			}
+			terms = append(terms, term)
+		}
+		result.clauses = append(result.clauses, terms)
+	}
+
+	return result, nil
+}
+
+func parseQueryTerm(term string) (queryTerm, error) {
+	for _, op := range queryOperators {
+		index := strings.Index(term, op)
+		if index == -1 {
+			continue
+		}
+
+		key := strings.TrimSpace(term[:index])
+		value := strings.TrimSpace(term[index+len(op):])
+
+		r := regexp.MustCompile(`^[\w\-\.]+$`)
+		if !r.MatchString(key) {
+			return queryTerm{}, fmt.Errorf("Invalid property name %q in the query term %q.", key, term)
+		}
+		if value == "" || strings.ContainsAny(value, "<>=!") {
+			return queryTerm{}, fmt.Errorf("Invalid value %q in the query term %q.", value, term)
+		}
+
+		return queryTerm{key, op, value}, nil
+	}
+
+	return queryTerm{}, fmt.Errorf("Invalid query term %q. A term must be in the form of '<key><op><value>', where <op> is one of %v.", term, strings.Join(queryOperators, " "))
+}
+
+// matches determines whether the given device matches this query. The getprop
+// function is used for looking up the Android system properties of the device,
+// and is only called when the query refers to any of them.
+func (q *deviceQuery) matches(d device, getprop devicePropertiesFunc) bool {
+	for _, clause := range q.clauses {
+		matched := true
+		for _, term := range clause {
+			if !term.matches(d, getprop) {
+				matched = false
+				break
+			}
+		}
+
+		if matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t queryTerm) matches(d device, getprop devicePropertiesFunc) bool {
+	// 'tag' is a special key which checks whether the device has the given tag.
+	if t.key == "tag" {
+		has := isStringInSlice(t.value, d.Tags)
+		switch t.op {
+		case "=":
+			return has
+		case "!=":
+			return !has
+		default:
+			return false
+		}
+	}
+
+	actual, ok := lookupDeviceProperty(d, t.key, getprop)
+	if !ok {
+		return false
+	}
+
+	// Compare the values numerically when both of them are numbers.
+	// Otherwise, compare them as strings.
+	cmp := strings.Compare(actual, t.value)
+	if a, err := strconv.ParseFloat(actual, 64); err == nil {
+		if b, err := strconv.ParseFloat(t.value, 64); err == nil {
+			switch {
+			case a < b:
+				cmp = -1
+			case a > b:
+				cmp = 1
+			default:
+				cmp = 0
+			}
+		}
+	}
+
+	switch t.op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case ">=":
+		return cmp >= 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case "<":
+		return cmp < 0
+	}
+
+	return false
+}
+
+// lookupDeviceProperty returns the value of the given property of the device.
+// The properties known without talking to the device (e.g., the device type,
+// qualifiers and metadata) are looked up first, and then the Android system
+// properties obtained from getprop.
+func lookupDeviceProperty(d device, key string, getprop devicePropertiesFunc) (string, bool) {
+	switch key {
+	case "type":
+		return string(d.Type), true
+	case "serial":
+		return d.Serial, true
+	case "name":
+		return d.displayName(), true
+	case "index":
+		return strconv.Itoa(d.Index), true
+	}
+
+	if value, ok := d.Metadata[key]; ok {
+		return value, true
+	}
+
+	for _, qualifier := range d.Qualifiers {
+		if strings.HasPrefix(qualifier, key+":") {
+			return strings.TrimPrefix(qualifier, key+":"), true
+		}
+	}
+
+	if alias, ok := propertyAliases[key]; ok {
+		key = alias
+	}
+
+	if getprop == nil {
+		return "", false
+	}
+
+	props, err := getprop(d.Serial)
+	if err != nil {
+		return "", false
+	}
+
+	value, ok := props[key]
+	return value, ok
+}
+
+// devicePropertiesFunc takes a device serial and returns the Android system
+// properties of the device.
+type devicePropertiesFunc func(serial string) (map[string]string, error)
+
+// getDeviceProperties runs "adb shell getprop" on the given device and returns
+// all the system properties.
+func getDeviceProperties(serial string) (map[string]string, error) {
+	sh := gosh.NewShell(nil)
+	defer sh.Cleanup()
+
+	sh.ContinueOnError = true
+	output := sh.Cmd("adb", "-s", serial, "shell", "getprop").Stdout()
+	if sh.Err != nil {
+		return nil, fmt.Errorf("Could not get the system properties of device %q: %v", serial, sh.Err)
+	}
+
+	return parseDeviceProperties(output), nil
+}
+
+// parseDeviceProperties parses the output of "adb shell getprop" command, where
+// each line is in the form of "[<key>]: [<value>]".
+func parseDeviceProperties(output string) map[string]string {
+	result := make(map[string]string)
+
+	r := regexp.MustCompile(`^\[(.+?)\]: \[(.*)\]$`)
+	for _, line := range strings.Split(output, "\n") {
+		matches := r.FindStringSubmatch(strings.TrimSpace(line))
+		if matches != nil {
+			result[matches[1]] = matches[2]
+		}
+	}
+
+	return result
+}
+
+// memoizeDeviceProperties wraps the given devicePropertiesFunc so that the
+// properties of each device are obtained at most once. Any errors are reported
+// as warnings, only once per device.
+func memoizeDeviceProperties(fn devicePropertiesFunc) devicePropertiesFunc {
+	if fn == nil {
+		return nil
+	}
+
+	var mu sync.Mutex
+	cache := make(map[string]map[string]string)
+
+	return func(serial string) (map[string]string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if props, ok := cache[serial]; ok {
+			return props, nil
+		}
+
+		props, err := fn(serial)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: %v\n", err)
+			props = map[string]string{}
+		}
+
+		cache[serial] = props
+		return props, nil
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2016 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDeviceQuery(t *testing.T) {
+	tests := []struct {
+		input string
+		want  *deviceQuery
+	}{
+		{
+			"sdk>=31",
+			&deviceQuery{[][]queryTerm{{{"sdk", ">=", "31"}}}},
+		},
+		{
+			"sdk>=31 & type=RealDevice",
+			&deviceQuery{[][]queryTerm{{{"sdk", ">=", "31"}, {"type", "=", "RealDevice"}}}},
+		},
+		{
+			" model = Nexus_5X | tag!=flaky & ro.build.type<user ",
+			&deviceQuery{[][]queryTerm{
+				{{"model", "=", "Nexus_5X"}},
+				{{"tag", "!=", "flaky"}, {"ro.build.type", "<", "user"}},
+			}},
+		},
+		// The following queries should not be accepted.
+		{"", nil},
+		{"sdk", nil},
+		{"sdk>=", nil},
+		{">=31", nil},
+		{"sdk>=31 &", nil},
+		{"sdk=>31", nil},
+		{"sdk >= 31 | | type=Emulator", nil},
+	}
+
+	for i, test := range tests {
+		got, err := parseDeviceQuery(test.input)
+		if test.want == nil {
+			if err == nil {
+				t.Fatalf("expected an error for tests[%v] but succeeded.", i)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("error occurred while parsing the query for tests[%v]: %v", i, err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Fatalf("unmatched results for tests[%v]: got %v, want %v", i, got, test.want)
+		}
+	}
+}
+
+func TestDeviceQueryMatches(t *testing.T) {
+	d := device{
+		Serial:     "deviceid01",
+		Type:       realDevice,
+		Qualifiers: []string{"usb:3-3.4.3", "product:bullhead", "model:Nexus_5X", "device:bullhead"},
+		Nickname:   "MyPhone",
+		Index:      1,
+		Tags:       []string{"flaky"},
+		Metadata:   map[string]string{"rack": "3"},
+	}
+
+	called := 0
+	getprop := func(serial string) (map[string]string, error) {
+		called++
+		return map[string]string{
+			"ro.build.version.sdk":     "27",
+			"ro.build.version.release": "8.1.0",
+			"ro.build.type":            "userdebug",
+		}, nil
+	}
+
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"type=RealDevice", true},
+		{"type=Emulator", false},
+		{"name=MyPhone & index=1", true},
+		{"model=Nexus_5X", true},
+		{"rack>=3", true},
+		{"rack>3", false},
+		{"tag=flaky", true},
+		{"tag!=flaky", false},
+		{"sdk>=26", true},
+		{"sdk>=100", false},
+		{"sdk<100", true},     // Compared numerically
+		{"release>=8", true},  // Compared as strings
+		{"release<10", false}, // Compared as strings
+		{"ro.build.type!=user", true},
+		{"unknown=1", false},
+		{"unknown!=1", false},
+		{"sdk>=100 | tag=flaky", true},
+		{"sdk>=100 & tag=flaky | type=Emulator", false},
+	}
+
+	for i, test := range tests {
+		q, err := parseDeviceQuery(test.query)
+		if err != nil {
+			t.Fatalf("error occurred while parsing the query for tests[%v]: %v", i, err)
+		}
+
+		if got := q.matches(d, memoizeDeviceProperties(getprop)); got != test.want {
+			t.Fatalf("unmatched results for tests[%v] %q: got %v, want %v", i, test.query, got, test.want)
+		}
+	}
+
+	// The system properties should not be obtained unless needed.
+	called = 0
+	q, _ := parseDeviceQuery("type=RealDevice & model=Nexus_5X")
+	q.matches(d, getprop)
+	if called != 0 {
+		t.Fatalf("the system properties were obtained unnecessarily.")
+	}
+}
+
+func TestParseDeviceProperties(t *testing.T) {
+	output := `[dalvik.vm.heapsize]: [512m]
+[ro.build.version.release]: [8.1.0]
+[ro.build.version.sdk]: [27]
+[ro.product.model]: [Nexus 5X]
+[ro.empty]: []
+`
+
+	got := parseDeviceProperties(output)
+	want := map[string]string{
+		"dalvik.vm.heapsize":       "512m",
+		"ro.build.version.release": "8.1.0",
+		"ro.build.version.sdk":     "27",
+		"ro.product.model":         "Nexus 5X",
+		"ro.empty":                 "",
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unmatched results: got %v, want %v", got, want)
+	}
+}
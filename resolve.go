@@ -39,12 +39,12 @@ func runMadbResolve(env *cmdline.Env, args []string, filename string) error {
 		return err
 	}
 
-	devices, err := getDevices(cfg)
+	devices, err := getDevices(cfg, args)
 	if err != nil {
 		return err
 	}
 
-	filtered, err := filterSpecifiedDevices(devices, cfg, false, false, args)
+	filtered, err := filterSpecifiedDevices(devices, cfg, false, false, args, getDeviceProperties)
 	if err != nil {
 		return err
 	}
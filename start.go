@@ -6,6 +6,7 @@ package main
 
 import (
 	"fmt"
+	"os"
 	"strings"
 
 	"v.io/x/lib/cmdline"
@@ -15,17 +16,24 @@ import (
 var (
 	forceStopFlag    bool
 	forceInstallFlag bool
+	activityFlag     string
 )
 
 func init() {
 	initializePropertyCacheFlags(&cmdMadbStart.Flags)
+	initializeUsersFlags(&cmdMadbStart.Flags)
 	initializeBuildFlags(&cmdMadbStart.Flags)
+	initializeApkDirFlag(&cmdMadbStart.Flags)
+	initializeSkipChecksFlag(&cmdMadbStart.Flags)
+	initializeInstallFailureFlags(&cmdMadbStart.Flags)
+	initializeProgressFlag(&cmdMadbStart.Flags)
 	cmdMadbStart.Flags.BoolVar(&forceStopFlag, "force-stop", true, `Force stop the target app before starting the activity.`)
 	cmdMadbStart.Flags.BoolVar(&forceInstallFlag, "force-install", false, `Force install the target app before starting the activity.`)
+	cmdMadbStart.Flags.StringVar(&activityFlag, "activity", "", `The launcher activity to start, when the app has more than one launcher activity. Can be either a fully-qualified name or a simple name. Only takes effect when no arguments are provided.`)
 }
 
 var cmdMadbStart = &cmdline.Command{
-	Runner: subCommandRunner{initMadbStart, runMadbStartForDevice, true},
+	Runner: subCommandRunner{initMadbStart, forEachUser(runMadbStartForDevice), true},
 	Name:   "start",
 	Short:  "Launch your app on all devices",
 	Long: `
@@ -36,18 +44,32 @@ for you. "madb start" will build the project first. After the project build is c
 command will install the best matching .apk for each device, only if one or more of the following
 conditions are met:
  - the app is not found on the device
- - the installed app is outdated (determined by comparing the last update time of the
-   installed app and the last modification time of the local .apk file)
+ - the version code of the installed app is different from that of the local .apk file
+ - the installed .apk file is different from the local .apk file (determined by comparing their
+   SHA-256 hashes, including the .apk files of the dynamic feature modules), or the installed app is
+   older than the local .apk file when the hash cannot be computed on the device
  - "-force-install" flag is set
 
+The decision and its reason are reported for each device.
+
 If you would like to run the same version of the app repeatedly (e.g., for QA testing), you can
 explicitly turn off the build flag by providing "-build=false" to skip the build step.
 
+To install the app from its Android App Bundle (.aab), provide the "-bundle" flag. In this case,
+the bundle is built instead of the .apk files, and the APKs generated by bundletool for each device
+are installed. (See 'madb help install' for more details.)
+
+When the installation fails because the installed app is signed with a different key (e.g., a debug
+build installed over a release build), provide "-on-signature-mismatch=uninstall" flag to uninstall
+the existing app and retry the installation automatically. Similarly, "-allow-downgrade" flag allows
+installing an app with a lower version code.
+
 To run your app as a specific user on a particular device, use 'madb user set' command to set the
-default user ID for that device. (See 'madb help user' for more details.)
+default user ID for that device. (See 'madb help user' for more details.) To run your app as
+multiple users at once, use the '-all-users' or '-users' flag.
 
 `,
-	ArgsName: "[<application_id> <activity_name>]",
+	ArgsName: "[<application_id> <activity_name> | <apk_file> ...]",
 	ArgsLong: `
 <application_id> is usually the package name where the activities are defined.
 (See: http://tools.android.com/tech-docs/new-build-system/applicationid-vs-packagename)
@@ -59,21 +81,44 @@ a fully-qualified name (e.g., com.yourcompany.yourapp.MainActivity).
 If either <application_id> or <activity_name> is provided, the other must be provided as well.
 
 
+If .apk files are provided instead, the application ID and the launcher activities are read directly
+from the manifest of the base .apk file, and the .apk files are installed first if the installed app
+is outdated. (See 'madb help install' for more details.)
+
 If no arguments are specified, madb automatically determines which app to launch, based on the build
 scripts found in the current working directory.
 
 1) If the working directory contains a Flutter project (i.e., has "flutter.yaml"), this command will
 run "flutter start --device-id <device serial>" for all the specified devices.
 
-2) If the working directory contains a Gradle Android project (i.e., has "build.gradle"), this
-command will run a small Gradle script to extract the application ID and the main activity name.
-In this case, the extracted IDs are cached, so that "madb start" can be repeated without even
-running the Gradle script again. The IDs can be re-extracted by clearing the cache by providing
-"-clear-cache" flag.
+2) If the working directory contains a Gradle Android project (i.e., has "build.gradle" or
+"build.gradle.kts"), this command will run a small Gradle script to extract the application ID and
+the main activity name. In this case, the extracted IDs are cached, so that "madb start" can be
+repeated without even running the Gradle script again. The IDs are re-extracted automatically when
+any of the Gradle scripts, Gradle properties, or Android manifests of the project change, and can
+also be re-extracted by clearing the cache by providing "-clear-cache" flag. The "-variant-map"
+flag can be used to launch different build variants or modules on different devices, in the same way
+as "madb install". When multiple modules are given to the "-module" flag, the apps of all the
+modules are installed, and the app of the first module is launched.
+
+The main activity is chosen among the launcher activities (i.e., the activities and activity aliases
+with the MAIN action and the LAUNCHER category) found in the merged manifest of the build variant,
+which includes the activities contributed by the libraries. When there are multiple launcher
+activities, the first one is chosen unless the "-activity" flag is provided.
+
+On Android TV devices, the leanback launcher activity (i.e., the activity with the MAIN action and
+the LEANBACK_LAUNCHER category) is launched instead, if the app has one. A device is considered an
+Android TV device when it has the "android.software.leanback" feature, or when its
+"ro.build.characteristics" system property contains "tv".
 `,
 }
 
-func initMadbStart(env *cmdline.Env, args []string, properties variantProperties) ([]string, error) {
+func initMadbStart(env *cmdline.Env, args []string, properties *variantProperties) ([]string, error) {
+	if err := validateInstallFailureFlags(); err != nil {
+		return nil, err
+	}
+	setUpInstallProgress()
+
 	// If the "-build" flag is set, call the init function of the install command, which would run
 	// the relevant Gradle build tasks to build the project.
 	if buildFlag {
@@ -84,7 +129,70 @@ func initMadbStart(env *cmdline.Env, args []string, properties variantProperties
 		args = newArgs
 	}
 
-	return initMadbCommand(env, args, properties, true, true)
+	if activityFlag != "" && len(args) != 0 {
+		return nil, fmt.Errorf("The -activity flag cannot be used when the arguments are provided.")
+	}
+
+	newArgs, err := initMadbCommand(env, args, *properties, true, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// Choose the launcher activity, if the activity name was extracted from the Gradle scripts. When
+	// the "-activity" flag is not provided, the activity is chosen for each device based on its form
+	// factor.
+	if len(args) == 0 && len(newArgs) == 2 {
+		activity, err := chooseLauncherActivity(*properties, activityFlag)
+		if err != nil {
+			return nil, err
+		}
+		newArgs[1] = activity
+		properties.chooseActivityPerDevice = activityFlag == ""
+	}
+
+	return newArgs, nil
+}
+
+// chooseLauncherActivity returns the launcher activity to be started among the launchable
+// activities of the given variant properties. When the activity is not specified, the first
+// launchable activity is returned. Otherwise, the activity is matched against the launchable
+// activities by either the fully-qualified name or the simple name.
+func chooseLauncherActivity(properties variantProperties, activity string) (string, error) {
+	candidates := properties.LaunchableActivities
+	for _, leanback := range properties.LeanbackActivities {
+		if !isStringInSlice(leanback, candidates) {
+			candidates = append(candidates, leanback)
+		}
+	}
+
+	if activity == "" {
+		if len(properties.LaunchableActivities) > 1 {
+			fmt.Printf("NOTE: Multiple launcher activities were found (%v). The first activity %q is chosen automatically. Use '-activity' flag to choose another one.\n", strings.Join(properties.LaunchableActivities, ", "), properties.Activity)
+		}
+		return properties.Activity, nil
+	}
+
+	// When the launchable activities are unknown, use the given activity name as is.
+	if len(candidates) == 0 {
+		return activity, nil
+	}
+
+	simpleName := strings.TrimPrefix(activity, ".")
+	matches := []string{}
+	for _, candidate := range candidates {
+		if candidate == activity || strings.HasSuffix(candidate, "."+simpleName) {
+			matches = append(matches, candidate)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("The activity %q is not one of the launcher activities: %v", activity, strings.Join(candidates, ", "))
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("The activity %q is ambiguous. Use one of the fully-qualified names: %v", activity, strings.Join(matches, ", "))
+	}
 }
 
 func runMadbStartForDevice(env *cmdline.Env, args []string, d device, properties variantProperties) error {
@@ -101,6 +209,11 @@ func runMadbStartForDevice(env *cmdline.Env, args []string, d device, properties
 	if len(args) == 2 {
 		appID, activity := args[0], args[1]
 
+		// Launch the leanback launcher activity instead on the Android TV devices.
+		if properties.chooseActivityPerDevice {
+			activity = chooseActivityForDevice(d, properties, getDeviceFeatures, getDeviceProperties)
+		}
+
 		// In case the activity name is a simple name (i.e. without the package name), add a dot in
 		// the front. This is a shorthand syntax to prepend the activity name with the package name
 		// provided in the manifest.
@@ -136,3 +249,79 @@ func runMadbStartForDevice(env *cmdline.Env, args []string, d device, properties
 
 	return fmt.Errorf("No arguments are provided and failed to extract the properties from the build scripts.")
 }
+
+// deviceFeaturesFunc takes a device serial and returns the features of the device.
+type deviceFeaturesFunc func(serial string) ([]string, error)
+
+// chooseActivityForDevice returns the activity to be launched on the given device. The first
+// leanback launcher activity is chosen for the Android TV devices, and the default activity is
+// chosen for all the other devices.
+func chooseActivityForDevice(d device, properties variantProperties, getFeatures deviceFeaturesFunc, getprop devicePropertiesFunc) string {
+	if len(properties.LeanbackActivities) == 0 {
+		return properties.Activity
+	}
+
+	if isLeanbackDevice(d, getFeatures, getprop) {
+		return properties.LeanbackActivities[0]
+	}
+
+	// The default activity could be a leanback activity for the TV-only apps. In such cases, there
+	// is nothing better to choose for the other devices.
+	return properties.Activity
+}
+
+// isLeanbackDevice determines whether the given device is an Android TV device, based on the
+// device features and the "ro.build.characteristics" system property.
+func isLeanbackDevice(d device, getFeatures deviceFeaturesFunc, getprop devicePropertiesFunc) bool {
+	if features, err := getFeatures(d.Serial); err == nil {
+		if isStringInSlice("android.software.leanback", features) {
+			return true
+		}
+	} else {
+		fmt.Fprintf(os.Stderr, "WARNING: %v\n", err)
+	}
+
+	props, err := getprop(d.Serial)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "WARNING: %v\n", err)
+		return false
+	}
+
+	return isStringInSlice("tv", strings.Split(props["ro.build.characteristics"], ","))
+}
+
+// getDeviceFeatures runs "adb shell pm list features" on the given device and returns all the
+// features of the device.
+func getDeviceFeatures(serial string) ([]string, error) {
+	sh := gosh.NewShell(nil)
+	defer sh.Cleanup()
+
+	sh.ContinueOnError = true
+	output := sh.Cmd("adb", "-s", serial, "shell", "pm", "list", "features").Stdout()
+	if sh.Err != nil {
+		return nil, fmt.Errorf("Could not get the features of device %q: %v", serial, sh.Err)
+	}
+
+	return parseDeviceFeatures(output), nil
+}
+
+// parseDeviceFeatures parses the output of "adb shell pm list features" command, where each line
+// is in the form of "feature:<name>" or "feature:<name>=<version>".
+func parseDeviceFeatures(output string) []string {
+	result := []string{}
+
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "feature:") {
+			continue
+		}
+
+		feature := strings.TrimPrefix(line, "feature:")
+		if index := strings.Index(feature, "="); index != -1 {
+			feature = feature[:index]
+		}
+		result = append(result, feature)
+	}
+
+	return result
+}
@@ -0,0 +1,165 @@
+// Copyright 2016 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestChooseLauncherActivity(t *testing.T) {
+	properties := variantProperties{
+		Activity: "io.v.testProjectPackage.LauncherActivity",
+		LaunchableActivities: []string{
+			"io.v.testProjectPackage.LauncherActivity",
+			"io.v.testProjectPackage.settings.SettingsActivity",
+			"io.v.testProjectPackage.SettingsActivity",
+			"io.v.testProjectPackage.SettingsAlias",
+		},
+	}
+
+	tests := []struct {
+		activity string
+		want     string
+		wantErr  bool
+	}{
+		{"", "io.v.testProjectPackage.LauncherActivity", false},
+		{"io.v.testProjectPackage.settings.SettingsActivity", "io.v.testProjectPackage.settings.SettingsActivity", false},
+		{"SettingsAlias", "io.v.testProjectPackage.SettingsAlias", false},
+		{".SettingsAlias", "io.v.testProjectPackage.SettingsAlias", false},
+		{"settings.SettingsActivity", "io.v.testProjectPackage.settings.SettingsActivity", false},
+		{"SettingsActivity", "", true},
+		{"UnknownActivity", "", true},
+	}
+
+	for i, test := range tests {
+		got, err := chooseLauncherActivity(properties, test.activity)
+		if test.wantErr {
+			if err == nil {
+				t.Fatalf("expected an error for tests[%v] but succeeded.", i)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("error occurred for tests[%v]: %v", i, err)
+		}
+		if got != test.want {
+			t.Fatalf("unmatched results for tests[%v]: got %v, want %v", i, got, test.want)
+		}
+	}
+
+	// When the launchable activities are unknown, the given activity should be used as is.
+	if got, err := chooseLauncherActivity(variantProperties{}, "io.v.Other"); err != nil || got != "io.v.Other" {
+		t.Fatalf("unmatched results: got (%v, %v), want (%v, <nil>)", got, err, "io.v.Other")
+	}
+}
+
+func TestInitMadbStartChooseActivityPerDevice(t *testing.T) {
+	defer func(build bool, activity string) {
+		buildFlag, activityFlag = build, activity
+	}(buildFlag, activityFlag)
+	buildFlag = false
+
+	newProperties := func() variantProperties {
+		return variantProperties{
+			AppID:                "io.v.testProjectId",
+			Activity:             "io.v.testProjectPackage.LauncherActivity",
+			LaunchableActivities: []string{"io.v.testProjectPackage.LauncherActivity"},
+			LeanbackActivities:   []string{"io.v.testProjectPackage.TvActivity"},
+			fromApkFiles:         true,
+		}
+	}
+
+	tests := []struct {
+		args     []string
+		activity string
+		want     bool
+	}{
+		{[]string{}, "", true},
+		{[]string{}, "TvActivity", false},
+		{[]string{"io.v.testProjectId", "LauncherActivity"}, "", false},
+	}
+
+	for i, test := range tests {
+		activityFlag = test.activity
+		properties := newProperties()
+		if _, err := initMadbStart(nil, test.args, &properties); err != nil {
+			t.Fatalf("error occurred for tests[%v]: %v", i, err)
+		}
+		if got := properties.chooseActivityPerDevice; got != test.want {
+			t.Fatalf("unmatched results for tests[%v]: got %v, want %v", i, got, test.want)
+		}
+	}
+}
+
+func TestParseDeviceFeatures(t *testing.T) {
+	output := `feature:reqGlEsVersion=0x30002
+feature:android.hardware.touchscreen
+feature:android.software.leanback
+feature:android.software.live_tv
+`
+
+	got := parseDeviceFeatures(output)
+	want := []string{"reqGlEsVersion", "android.hardware.touchscreen", "android.software.leanback", "android.software.live_tv"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unmatched results: got %v, want %v", got, want)
+	}
+}
+
+func TestChooseActivityForDevice(t *testing.T) {
+	features := map[string][]string{
+		"phone":    []string{"android.hardware.touchscreen"},
+		"tv":       []string{"android.software.leanback"},
+		"tvLegacy": []string{},
+	}
+	props := map[string]map[string]string{
+		"phone":    {"ro.build.characteristics": "nosdcard"},
+		"tv":       {"ro.build.characteristics": "tv"},
+		"tvLegacy": {"ro.build.characteristics": "tv,nosdcard"},
+	}
+
+	getFeatures := func(serial string) ([]string, error) {
+		if f, ok := features[serial]; ok {
+			return f, nil
+		}
+		return nil, fmt.Errorf("unknown device %v", serial)
+	}
+	getprop := func(serial string) (map[string]string, error) {
+		if p, ok := props[serial]; ok {
+			return p, nil
+		}
+		return nil, fmt.Errorf("unknown device %v", serial)
+	}
+
+	properties := variantProperties{
+		Activity:             "io.v.MainActivity",
+		LaunchableActivities: []string{"io.v.MainActivity"},
+		LeanbackActivities:   []string{"io.v.TvActivity"},
+	}
+
+	tests := []struct {
+		serial string
+		want   string
+	}{
+		{"phone", "io.v.MainActivity"},
+		{"tv", "io.v.TvActivity"},
+		{"tvLegacy", "io.v.TvActivity"},
+		{"unknown", "io.v.MainActivity"},
+	}
+
+	for i, test := range tests {
+		if got := chooseActivityForDevice(device{Serial: test.serial}, properties, getFeatures, getprop); got != test.want {
+			t.Fatalf("unmatched results for tests[%v]: got %v, want %v", i, got, test.want)
+		}
+	}
+
+	// Without any leanback activities, the default activity should be chosen for all devices.
+	properties.LeanbackActivities = nil
+	if got, want := chooseActivityForDevice(device{Serial: "tv"}, properties, getFeatures, getprop), "io.v.MainActivity"; got != want {
+		t.Fatalf("unmatched results: got %v, want %v", got, want)
+	}
+}
@@ -13,17 +13,19 @@ import (
 
 func init() {
 	initializePropertyCacheFlags(&cmdMadbStop.Flags)
+	initializeUsersFlags(&cmdMadbStop.Flags)
 }
 
 var cmdMadbStop = &cmdline.Command{
-	Runner: subCommandRunner{initMadbStop, runMadbStopForDevice, true},
+	Runner: subCommandRunner{initMadbStop, forEachUser(runMadbStopForDevice), true},
 	Name:   "stop",
 	Short:  "Stop your app on all devices",
 	Long: `
 Stops your app on all devices.
 
 To stop your app for a specific user on a particular device, use 'madb user set' command to set the
-default user ID for that device. (See 'madb help user' for more details.)
+default user ID for that device. (See 'madb help user' for more details.) To stop your app for
+multiple users at once, use the '-all-users' or '-users' flag.
 
 `,
 	ArgsName: "[<application_id>]",
@@ -38,15 +40,15 @@ the build scripts found in the current working directory.
 1) If the working directory contains a Flutter project (i.e., has "flutter.yaml"), this command will
 run "flutter stop --device-id <device serial>" for all the specified devices.
 
-2) If the working directory contains a Gradle Android project (i.e., has "build.gradle"), run a
-small Gradle script to extract the application ID. In this case, the extracted ID is cached, so
-that "madb stop" can be repeated without even running the Gradle script again. The ID can be
-re-extracted by clearing the cache by providing "-clear-cache" flag.
+2) If the working directory contains a Gradle Android project (i.e., has "build.gradle" or
+"build.gradle.kts"), run a small Gradle script to extract the application ID. In this case, the
+extracted ID is cached, so that "madb stop" can be repeated without even running the Gradle script
+again. The ID can be re-extracted by clearing the cache by providing "-clear-cache" flag.
 `,
 }
 
-func initMadbStop(env *cmdline.Env, args []string, properties variantProperties) ([]string, error) {
-	return initMadbCommand(env, args, properties, true, false)
+func initMadbStop(env *cmdline.Env, args []string, properties *variantProperties) ([]string, error) {
+	return initMadbCommand(env, args, *properties, true, false)
 }
 
 func runMadbStopForDevice(env *cmdline.Env, args []string, d device, properties variantProperties) error {
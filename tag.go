@@ -0,0 +1,286 @@
+// Copyright 2016 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/olekukonko/tablewriter"
+
+	"v.io/x/lib/cmdline"
+)
+
+func init() {
+	initializeHardwareSerialFlag(&cmdMadbTagAdd.Flags)
+	initializeHardwareSerialFlag(&cmdMadbTagRemove.Flags)
+}
+
+var cmdMadbTag = &cmdline.Command{
+	Children:         []*cmdline.Command{cmdMadbTagAdd, cmdMadbTagRemove, cmdMadbTagList, cmdMadbTagClearAll},
+	Name:             "tag",
+	DontInheritFlags: true,
+	Short:            "Manage device tags and metadata",
+	Long: `
+Manages free-form tags and key/value metadata attached to devices.
+
+Tags and metadata can be used for keeping track of various information about
+the devices (e.g., the owner of the device, or where the device is located), and
+for selecting devices in the other madb commands. Use 'tag:<tag>' to specify all
+the devices with the given tag, and '<key>=<value>' to specify all the devices
+with the given metadata. For example, the following command:
+
+    madb -n tag:flaky,rack=3 exec reboot
+
+will reboot all the devices tagged 'flaky' and all the devices on rack 3.
+`,
+}
+
+var cmdMadbTagAdd = &cmdline.Command{
+	Runner: subCommandRunnerWithFilepath{runMadbTagAdd, getDefaultConfigFilePath},
+	Name:   "add",
+	Short:  "Add tags and metadata to the given device.",
+	Long: `
+Adds tags and key/value metadata to the specified device.
+
+For example, running the following command:
+
+    madb tag add MyPhone owner=alice rack=3 flaky
+
+will attach the 'flaky' tag to the device 'MyPhone', along with the metadata
+'owner=alice' and 'rack=3'. When a metadata key already exists for the device,
+its value will be replaced with the newly provided one.
+
+The tags and metadata are stored under the device serial, even when the device
+is specified by its nickname. Provide the "-hardware-serial" flag to store them
+under the hardware serial of the device instead. (See 'madb help name set' for
+more details.)
+
+A device qualifier (e.g., 'model:Nexus_5X'), or a nickname referring to a device
+qualifier, can also be given instead of a device serial. In that case, the tags
+and metadata are stored under the qualifier, and they apply to all the devices
+with the qualifier.
+`,
+	ArgsName: "<device_serial | qualifier | nickname> <tag | key=value> [<tag | key=value> ...]",
+	ArgsLong: `
+<device_serial | qualifier | nickname> is a device serial or a qualifier obtained from 'adb devices -l', or a nickname set by 'madb name'.
+<tag> is a string consisting of alpha-numeric characters, '-', '.', and '_'.
+<key=value> is a metadata entry, where the key follows the same rules as the tag.
+`,
+}
+
+func runMadbTagAdd(env *cmdline.Env, args []string, filename string) error {
+	// Check if the arguments are valid.
+	if len(args) < 2 {
+		return env.UsageErrorf("There must be at least two arguments.")
+	}
+
+	for _, entry := range args[1:] {
+		if _, _, ok := parseMetadataEntry(entry); !ok && !isValidTag(entry) {
+			return env.UsageErrorf("Not a valid tag or metadata entry: %v", entry)
+		}
+	}
+
+	cfg, err := readConfig(filename)
+	if err != nil {
+		return err
+	}
+
+	serial, err := resolveTagTarget(args[0], cfg)
+	if err != nil {
+		return err
+	}
+
+	// Key the tags and metadata on the hardware serial, if requested.
+	if hardwareSerialFlag {
+		if serial, err = resolveHardwareSerialSpecifier(serial, cfg); err != nil {
+			return err
+		}
+	}
+
+	for _, entry := range args[1:] {
+		if key, value, ok := parseMetadataEntry(entry); ok {
+			if cfg.Metadata[serial] == nil {
+				cfg.Metadata[serial] = make(map[string]string)
+			}
+			cfg.Metadata[serial][key] = value
+		} else if !isStringInSlice(entry, cfg.Tags[serial]) {
+			cfg.Tags[serial] = append(cfg.Tags[serial], entry)
+		}
+	}
+
+	sort.Strings(cfg.Tags[serial])
+
+	return writeConfig(cfg, filename)
+}
+
+var cmdMadbTagRemove = &cmdline.Command{
+	Runner: subCommandRunnerWithFilepath{runMadbTagRemove, getDefaultConfigFilePath},
+	Name:   "remove",
+	Short:  "Remove tags and metadata from the given device.",
+	Long: `
+Removes tags and metadata from the specified device. A metadata entry is removed
+by providing its key.
+
+For example, running the following command:
+
+    madb tag remove MyPhone owner flaky
+
+will remove the 'flaky' tag and the 'owner' metadata from the device 'MyPhone'.
+
+Provide the "-hardware-serial" flag to remove the tags and metadata stored under
+the hardware serial of the device, which were added with the same flag.
+`,
+	ArgsName: "<device_serial | qualifier | nickname> <tag | key> [<tag | key> ...]",
+	ArgsLong: `
+<device_serial | qualifier | nickname> is a device serial or a qualifier obtained from 'adb devices -l', or a nickname set by 'madb name'.
+<tag | key> is a tag or a metadata key previously added by 'madb tag add'.
+`,
+}
+
+func runMadbTagRemove(env *cmdline.Env, args []string, filename string) error {
+	// Check if the arguments are valid.
+	if len(args) < 2 {
+		return env.UsageErrorf("There must be at least two arguments.")
+	}
+
+	cfg, err := readConfig(filename)
+	if err != nil {
+		return err
+	}
+
+	serial, err := resolveTagTarget(args[0], cfg)
+	if err != nil {
+		return err
+	}
+
+	// The tags and metadata added with the "-hardware-serial" flag are keyed on the hardware serial.
+	if hardwareSerialFlag {
+		if serial, err = resolveHardwareSerialSpecifier(serial, cfg); err != nil {
+			return err
+		}
+	}
+
+	for _, entry := range args[1:] {
+		found := false
+
+		if isStringInSlice(entry, cfg.Tags[serial]) {
+			cfg.Tags[serial] = subtractSlices(cfg.Tags[serial], []string{entry})
+			found = true
+		}
+
+		if _, ok := cfg.Metadata[serial][entry]; ok {
+			delete(cfg.Metadata[serial], entry)
+			found = true
+		}
+
+		if !found {
+			return fmt.Errorf("The device %q does not have the tag or metadata %q.", args[0], entry)
+		}
+	}
+
+	// Remove the empty entries, so that they don't remain in the config file.
+	if len(cfg.Tags[serial]) == 0 {
+		delete(cfg.Tags, serial)
+	}
+	if len(cfg.Metadata[serial]) == 0 {
+		delete(cfg.Metadata, serial)
+	}
+
+	return writeConfig(cfg, filename)
+}
+
+// resolveTagTarget takes the device argument given to the 'madb tag' commands,
+// and returns the serial under which the tags and metadata should be stored.
+// Nicknames are resolved into their corresponding serials or qualifiers. The
+// entries stored under a qualifier are applied to all the devices with the
+// qualifier when the devices are listed.
+func resolveTagTarget(target string, cfg *config) (string, error) {
+	if serial, ok := cfg.Names[target]; ok {
+		return serial, nil
+	}
+
+	if !isValidSerial(target) || strings.HasPrefix(target, "@") {
+		return "", fmt.Errorf("Not a valid device serial or nickname: %v", target)
+	}
+
+	return target, nil
+}
+
+var cmdMadbTagList = &cmdline.Command{
+	Runner: subCommandRunnerWithFilepath{runMadbTagList, getDefaultConfigFilePath},
+	Name:   "list",
+	Short:  "List all the existing tags and metadata.",
+	Long: `
+Lists all the currently stored tags and metadata of devices.
+`,
+}
+
+func runMadbTagList(env *cmdline.Env, args []string, filename string) error {
+	cfg, err := readConfig(filename)
+	if err != nil {
+		return err
+	}
+
+	tw := tablewriter.NewWriter(os.Stdout)
+	tw.SetHeader([]string{"Serial", "Nickname", "Tags", "Metadata"})
+	tw.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+	tw.SetAutoFormatHeaders(false)
+	tw.SetAlignment(tablewriter.ALIGN_LEFT)
+
+	serials := make(map[string]bool)
+	for serial := range cfg.Tags {
+		serials[serial] = true
+	}
+	for serial := range cfg.Metadata {
+		serials[serial] = true
+	}
+
+	nicknames := reverseMap(cfg.Names)
+
+	data := make([][]string, 0, len(serials))
+	for serial := range serials {
+		entries := make([]string, 0, len(cfg.Metadata[serial]))
+		for key, value := range cfg.Metadata[serial] {
+			entries = append(entries, key+"="+value)
+		}
+		sort.Strings(entries)
+
+		data = append(data, []string{serial, nicknames[serial], strings.Join(cfg.Tags[serial], " "), strings.Join(entries, " ")})
+	}
+
+	sort.Sort(byFirstElement(data))
+
+	for _, row := range data {
+		tw.Append(row)
+	}
+	tw.Render()
+
+	return nil
+}
+
+var cmdMadbTagClearAll = &cmdline.Command{
+	Runner: subCommandRunnerWithFilepath{runMadbTagClearAll, getDefaultConfigFilePath},
+	Name:   "clear-all",
+	Short:  "Clear all the existing tags and metadata.",
+	Long: `
+Clears all the currently stored tags and metadata of devices.
+
+This command clears the tags and metadata regardless of whether the device is currently connected or not.
+`,
+}
+
+func runMadbTagClearAll(env *cmdline.Env, args []string, filename string) error {
+	cfg, err := readConfig(filename)
+	if err != nil {
+		return err
+	}
+
+	cfg.Tags = make(map[string][]string)
+	cfg.Metadata = make(map[string]map[string]string)
+	return writeConfig(cfg, filename)
+}
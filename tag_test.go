@@ -0,0 +1,163 @@
+// Copyright 2016 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestMadbTagAdd(t *testing.T) {
+	filename := tempFilename(t)
+	defer os.Remove(filename)
+
+	var cfg *config
+	var err error
+
+	// Add tags and metadata by the device serial.
+	if err = runMadbTagAdd(nil, []string{"SERIAL1", "owner=alice", "rack=3", "flaky"}, filename); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg, err = readConfig(filename); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cfg.Tags, map[string][]string{"SERIAL1": []string{"flaky"}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unmatched results: got %v, want %v", got, want)
+	}
+	if got, want := cfg.Metadata, map[string]map[string]string{"SERIAL1": map[string]string{"owner": "alice", "rack": "3"}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unmatched results: got %v, want %v", got, want)
+	}
+
+	// Add tags and metadata by the nickname. The existing metadata value should
+	// be replaced, and the tags should be kept sorted without duplicates.
+	if err = runMadbNameSet(nil, []string{"SERIAL1", "MyPhone"}, filename); err != nil {
+		t.Fatal(err)
+	}
+	if err = runMadbTagAdd(nil, []string{"MyPhone", "rack=4", "slow", "flaky", "battery"}, filename); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg, err = readConfig(filename); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cfg.Tags, map[string][]string{"SERIAL1": []string{"battery", "flaky", "slow"}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unmatched results: got %v, want %v", got, want)
+	}
+	if got, want := cfg.Metadata, map[string]map[string]string{"SERIAL1": map[string]string{"owner": "alice", "rack": "4"}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unmatched results: got %v, want %v", got, want)
+	}
+
+	// Add a tag by a nickname referring to a device qualifier. The tag should be
+	// stored under the qualifier.
+	if err = runMadbNameSet(nil, []string{"model:Nexus_9", "Tablet"}, filename); err != nil {
+		t.Fatal(err)
+	}
+	if err = runMadbTagAdd(nil, []string{"Tablet", "tablet"}, filename); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg, err = readConfig(filename); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cfg.Tags["model:Nexus_9"], []string{"tablet"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unmatched results: got %v, want %v", got, want)
+	}
+
+	// Try an invalid device and see if it fails.
+	if err = runMadbTagAdd(nil, []string{"@1", "flaky"}, filename); err == nil {
+		t.Fatalf("expected an error but succeeded.")
+	}
+}
+
+func TestMadbTagRemove(t *testing.T) {
+	filename := tempFilename(t)
+	defer os.Remove(filename)
+
+	// Set up some tags and metadata first.
+	runMadbNameSet(nil, []string{"SERIAL1", "MyPhone"}, filename)
+	runMadbTagAdd(nil, []string{"SERIAL1", "owner=alice", "rack=3", "flaky"}, filename)
+	runMadbTagAdd(nil, []string{"SERIAL2", "flaky"}, filename)
+
+	var cfg *config
+	var err error
+
+	// Remove a tag and a metadata by the nickname.
+	if err = runMadbTagRemove(nil, []string{"MyPhone", "flaky", "owner"}, filename); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg, err = readConfig(filename); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cfg.Tags, map[string][]string{"SERIAL2": []string{"flaky"}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unmatched results: got %v, want %v", got, want)
+	}
+	if got, want := cfg.Metadata, map[string]map[string]string{"SERIAL1": map[string]string{"rack": "3"}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unmatched results: got %v, want %v", got, want)
+	}
+
+	// When the tag is not found.
+	if err = runMadbTagRemove(nil, []string{"SERIAL2", "slow"}, filename); err == nil {
+		t.Fatalf("expected an error but succeeded.")
+	}
+}
+
+func ExampleMadbTagList() {
+	filename := tempFilename(nil)
+	defer os.Remove(filename)
+
+	// Set up some tags and metadata first.
+	runMadbNameSet(nil, []string{"SERIAL1", "MyPhone"}, filename)
+	runMadbTagAdd(nil, []string{"SERIAL1", "owner=alice", "rack=3", "flaky"}, filename)
+	runMadbTagAdd(nil, []string{"SERIAL2", "slow", "flaky"}, filename)
+	runMadbTagAdd(nil, []string{"SERIAL3", "rack=3"}, filename)
+
+	// Call the list command.
+	runMadbTagList(nil, []string{}, filename)
+
+	// Output:
+	// +---------+----------+------------+--------------------+
+	// | Serial  | Nickname | Tags       | Metadata           |
+	// +---------+----------+------------+--------------------+
+	// | SERIAL1 | MyPhone  | flaky      | owner=alice rack=3 |
+	// | SERIAL2 |          | flaky slow |                    |
+	// | SERIAL3 |          |            | rack=3             |
+	// +---------+----------+------------+--------------------+
+}
+
+func TestMadbTagClearAll(t *testing.T) {
+	filename := tempFilename(t)
+	defer os.Remove(filename)
+
+	// Set up some tags and metadata first.
+	runMadbTagAdd(nil, []string{"SERIAL1", "owner=alice", "flaky"}, filename)
+	runMadbTagAdd(nil, []string{"SERIAL2", "slow"}, filename)
+
+	// Set up some nicknames. These should be preserved after running the
+	// "tag clear-all" command.
+	runMadbNameSet(nil, []string{"SERIAL1", "NICKNAME1"}, filename)
+
+	runMadbTagClearAll(nil, []string{}, filename)
+
+	cfg, err := readConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Make sure that the tags and metadata are all deleted.
+	if got, want := cfg.Tags, map[string][]string{}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unmatched results: got %v, want %v", got, want)
+	}
+	if got, want := cfg.Metadata, map[string]map[string]string{}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unmatched results: got %v, want %v", got, want)
+	}
+
+	// Make sure that the nicknames are preserved.
+	if got, want := cfg.Names, map[string]string{"NICKNAME1": "SERIAL1"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unmatched results: got %v, want %v", got, want)
+	}
+}
@@ -17,38 +17,43 @@ var (
 
 func init() {
 	initializePropertyCacheFlags(&cmdMadbUninstall.Flags)
+	initializeUsersFlags(&cmdMadbUninstall.Flags)
 	cmdMadbUninstall.Flags.BoolVar(&keepDataFlag, "keep-data", false, `Keep the application data and cache directories. Equivalent to '-k' flag in 'adb uninstall' command.`)
 }
 
 var cmdMadbUninstall = &cmdline.Command{
-	Runner: subCommandRunner{initMadbUninstall, runMadbUninstallForDevice, true},
+	Runner: subCommandRunner{initMadbUninstall, forEachUser(runMadbUninstallForDevice), true},
 	Name:   "uninstall",
 	Short:  "Uninstall your app from all devices",
 	Long: `
 Uninstall your app from all devices.
 
 To uninstall your app for a specific user on a particular device, use 'madb user set' command to set
-the default user ID for that device. (See 'madb help user' for more details.)
+the default user ID for that device. (See 'madb help user' for more details.) To uninstall your
+app for multiple users at once, use the '-all-users' or '-users' flag.
 
 `,
-	ArgsName: "[<application_id>]",
+	ArgsName: "[<application_id> | <apk_file>]",
 	ArgsLong: `
 <application_id> is usually the package name where the activities are defined.
 (See: http://tools.android.com/tech-docs/new-build-system/applicationid-vs-packagename)
 
+<apk_file> is the path to an .apk file of the app to be uninstalled. The application ID is read
+directly from the manifest of the .apk file.
+
 
 If the application_id is not specified, madb automatically determines which app to uninstall, based
 on the build scripts found in the current working directory.
 
-If the working directory contains a Gradle Android project (i.e., has "build.gradle"), run a small
-Gradle script to extract the application ID. In this case, the extracted ID is cached, so that
-"madb uninstall" can be repeated without even running the Gradle script again. The ID can be
-re-extracted by clearing the cache by providing "-clear-cache" flag.
+If the working directory contains a Gradle Android project (i.e., has "build.gradle" or
+"build.gradle.kts"), run a small Gradle script to extract the application ID. In this case, the
+extracted ID is cached, so that "madb uninstall" can be repeated without even running the Gradle
+script again. The ID can be re-extracted by clearing the cache by providing "-clear-cache" flag.
 `,
 }
 
-func initMadbUninstall(env *cmdline.Env, args []string, properties variantProperties) ([]string, error) {
-	return initMadbCommand(env, args, properties, false, false)
+func initMadbUninstall(env *cmdline.Env, args []string, properties *variantProperties) ([]string, error) {
+	return initMadbCommand(env, args, *properties, false, false)
 }
 
 func runMadbUninstallForDevice(env *cmdline.Env, args []string, d device, properties variantProperties) error {
@@ -5,22 +5,44 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"regexp"
 	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/olekukonko/tablewriter"
 
 	"v.io/x/lib/cmdline"
+	"v.io/x/lib/gosh"
 )
 
-// TODO(youngseokyoon): add a helper command that wraps "madb exec shell pm list users" to show all available users.
+var setDefaultFlag bool
+
+func init() {
+	initializeHardwareSerialFlag(&cmdMadbUserSet.Flags)
+	cmdMadbUserCreate.Flags.BoolVar(&setDefaultFlag, "set-default", false, `Set the created user as the default user of each device.`)
+	cmdMadbUserCreateWorkProfile.Flags.BoolVar(&setDefaultFlag, "set-default", false, `Set the created work profile as the default user of each device.`)
+}
+
 var cmdMadbUser = &cmdline.Command{
-	Children:         []*cmdline.Command{cmdMadbUserSet, cmdMadbUserUnset, cmdMadbUserList, cmdMadbUserClearAll},
-	Name:             "user",
-	DontInheritFlags: true,
-	Short:            "Manage default user settings for each device",
+	Children: []*cmdline.Command{
+		cmdMadbUserSet,
+		cmdMadbUserUnset,
+		cmdMadbUserList,
+		cmdMadbUserListAvailable,
+		cmdMadbUserClearAll,
+		cmdMadbUserCreate,
+		cmdMadbUserCreateWorkProfile,
+		cmdMadbUserRemove,
+		cmdMadbUserSwitch,
+	},
+	Name:  "user",
+	Short: "Manage default user settings for each device",
 	Long: `
 Manages default user settings for each device.
 
@@ -43,47 +65,67 @@ Below is the list of madb commands which are affected by the default user ID set
     madb stop
     madb uninstall
 
-For more details on how to obtain the user ID from an Android device, see 'madb user help set'.
+To see all the available users on the devices, use 'madb user list-available' command. The users
+and work profiles can also be created, removed, and switched on all the specified devices using the
+'madb user create', 'madb user create-work-profile', 'madb user remove', and 'madb user switch'
+commands.
 `,
 }
 
 var cmdMadbUserSet = &cmdline.Command{
-	Runner: subCommandRunnerWithFilepath{runMadbUserSet, getDefaultConfigFilePath},
-	Name:   "set",
-	Short:  "Set a default user ID to be used for the given device.",
+	Runner:           subCommandRunnerWithFilepath{runMadbUserSet, getDefaultConfigFilePath},
+	Name:             "set",
+	DontInheritFlags: true,
+	Short:            "Set a default user ID to be used for the given devices.",
 	Long: `
-Sets a default user ID to be used for the specified device, when there are multiple user accounts on
-a single device.
+Sets a default user ID to be used for the specified devices, when there are multiple user accounts
+on a single device.
 
-The user IDs can be obtained using the 'adb [<device_serial>] shell pm list users' command.
-Alternatively, you can use 'madb exec' if you want to specify the device with a nickname.
+The available users and their IDs can be obtained using the 'madb user list-available' command.
 For example, running the following command:
 
-    madb -n=MyPhone exec shell pm list users
+    madb -n=MyPhone user list-available
 
 will list the available users and their IDs on the MyPhone device.
 Consider the following example output:
 
-    [MyPhone]       Users:
-    [MyPhone]               UserInfo{0:John Doe:13} running
-    [MyPhone]               UserInfo{10:Work profile:30} running
+    +---------+---------+--------------+---------+---------+
+    | Device  | User ID | User Name    | Running | Default |
+    +---------+---------+--------------+---------+---------+
+    | MyPhone | 0       | John Doe     | yes     |         |
+    | MyPhone | 10      | Work profile | yes     |         |
+    +---------+---------+--------------+---------+---------+
 
-There are two available users, "John Doe" and "Work profile". Each user is assigned a "user ID",
-which appears on the left of the user name. In this case, the user ID of "John Doe" is "0", and the
-user ID of the "Work profile" is "10".
+There are two available users, "John Doe" and "Work profile". Each user is assigned a "user ID".
+In this case, the user ID of "John Doe" is "0", and the user ID of the "Work profile" is "10".
 
-To use the "Work profile" as the default user when running madb commands on this device, run the
-following command:
+To use the "Work profile" as the default user when running madb commands on this device, run
+either of the following commands:
 
     madb user set MyPhone 10
+    madb user set MyPhone "Work profile"
 
 and then madb will use "Work profile" as the default user for device "MyPhone" in any of the
 subsequence madb commands.
+
+The device can be specified in any form accepted by the '-n' flag, including device indices and
+device groups. When the specifier refers to multiple devices, the default user is set for all of
+them. When the user is specified by its name, the user ID is looked up on each connected device.
+
+When the device is specified by a device qualifier (e.g., 'model:Nexus_9'), or by a nickname
+referring to a qualifier, the default user ID is stored under the qualifier and applied to all the
+devices with the qualifier.
+
+If the device is connected over Wi-Fi, provide the "-hardware-serial" flag to store the default user
+ID under the hardware serial of the device, so that the setting is still applied when the network
+address of the device changes. (See 'madb help name set' for more details.)
 `,
-	ArgsName: "<device_serial> <user_id>",
+	ArgsName: "<device_specifier> <user_id | user_name>",
 	ArgsLong: `
-<device_serial> is the unique serial number for the device, which can be obtained from 'adb devices'.
-<user_id> is one of the user IDs obtained from 'adb shell pm list users' command.
+<device_specifier> can be anything that is accepted in the '-n' flag (see 'madb help'), such as a
+device serial, nickname, index, or a device group name.
+<user_id> is one of the user IDs obtained from 'madb user list-available' command.
+<user_name> is one of the user names obtained from 'madb user list-available' command.
 `,
 }
 
@@ -93,17 +135,20 @@ func runMadbUserSet(env *cmdline.Env, args []string, filename string) error {
 		return fmt.Errorf("There must be exactly two arguments.")
 	}
 
-	// TODO(youngseokyoon): make it possible to specify the device using its nickname or index.
-	// Validate the device serial
-	serial := args[0]
-	if !isValidSerial(serial) {
-		return fmt.Errorf("Not a valid device serial: %v", serial)
+	// Validate the device specifier.
+	specifier := args[0]
+	if err := isValidDeviceSpecifier(specifier); err != nil {
+		return err
 	}
 
-	// Validate the user ID.
-	userID := args[1]
-	if id, err := strconv.Atoi(userID); err != nil || id < 0 {
-		return fmt.Errorf("Not a valid user ID: %v", userID)
+	// Validate the user ID. When the argument is not a number, it is considered as a user name.
+	user := args[1]
+	isUserID := false
+	if id, err := strconv.Atoi(user); err == nil {
+		if id < 0 {
+			return fmt.Errorf("Not a valid user ID: %v", user)
+		}
+		isUserID = true
 	}
 
 	cfg, err := readConfig(filename)
@@ -111,24 +156,140 @@ func runMadbUserSet(env *cmdline.Env, args []string, filename string) error {
 		return err
 	}
 
-	// Add the <device_serial, user_id> mapping for the specified device.
-	cfg.UserIDs[serial] = userID
+	// When both the device and the user can be determined without talking to the devices,
+	// add the <device_serial, user_id> mapping directly.
+	if serial, ok := offlineDeviceKey(specifier, cfg); ok && isUserID && !hardwareSerialFlag {
+		cfg.UserIDs[serial] = user
+		return writeConfig(cfg, filename)
+	}
+
+	devices, err := resolveConnectedDevices(specifier, cfg)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	var errDevices []device
+
+	for _, d := range devices {
+		userID := user
+		if !isUserID {
+			users, err := getAndroidUsers(d.Serial)
+			if err == nil {
+				userID, err = findUserIDByName(user, users)
+			}
+			if err != nil {
+				errs = append(errs, err)
+				errDevices = append(errDevices, d)
+				continue
+			}
+		}
+
+		key, err := userConfigKey(d)
+		if err != nil {
+			errs = append(errs, err)
+			errDevices = append(errDevices, d)
+			continue
+		}
+
+		cfg.UserIDs[key] = userID
+	}
+
+	// Don't change anything unless the default user can be set for all the devices.
+	if errs != nil {
+		buffer := bytes.Buffer{}
+		buffer.WriteString("Could not set the default user for the following devices:")
+		for i := 0; i < len(errs); i++ {
+			buffer.WriteString("\n[" + errDevices[i].displayName() + "]\t" + errs[i].Error())
+		}
+		return errors.New(buffer.String())
+	}
+
 	return writeConfig(cfg, filename)
 }
 
+// offlineDeviceKey returns the key of the device in the config, when it can be
+// determined from the given device specifier without talking to the devices.
+// That is the case when the specifier is a nickname, a device serial, or a
+// device qualifier. The user IDs stored under a qualifier are applied to all
+// the devices with the qualifier when the devices are listed.
+func offlineDeviceKey(specifier string, cfg *config) (string, bool) {
+	if serial, ok := cfg.Names[specifier]; ok {
+		return serial, true
+	}
+
+	if strings.HasPrefix(specifier, "@") || strings.HasPrefix(specifier, tagPrefix) ||
+		isGroupName(specifier, cfg) || isDynamicGroupName(specifier, cfg) {
+		return "", false
+	}
+
+	if _, _, ok := parseMetadataEntry(specifier); ok {
+		return "", false
+	}
+
+	return specifier, true
+}
+
+// resolveConnectedDevices returns all the connected devices matching the given
+// device specifier. It is an error if no devices match the specifier.
+func resolveConnectedDevices(specifier string, cfg *config) ([]device, error) {
+	if err := startAdbServer(); err != nil {
+		return nil, err
+	}
+
+	devices, err := getDevices(cfg, []string{specifier})
+	if err != nil {
+		return nil, err
+	}
+
+	filtered, err := filterSpecifiedDevices(devices, cfg, false, false, []string{specifier}, getDeviceProperties)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(filtered) == 0 {
+		return nil, fmt.Errorf("No connected devices matching the device specifier %q.", specifier)
+	}
+
+	return filtered, nil
+}
+
+// userConfigKey returns the key under which the default user ID of the given
+// device should be stored. This is the device serial, or the hardware serial
+// specifier when the "-hardware-serial" flag is set.
+func userConfigKey(d device) (string, error) {
+	if !hardwareSerialFlag {
+		return d.Serial, nil
+	}
+
+	if d.HardwareSerial != "" {
+		return d.hardwareSerialSpecifier(), nil
+	}
+
+	hardwareSerial, err := getHardwareSerial(d.Serial)
+	if err != nil {
+		return "", err
+	}
+
+	return hardwareSerialPrefix + hardwareSerial, nil
+}
+
 var cmdMadbUserUnset = &cmdline.Command{
-	Runner: subCommandRunnerWithFilepath{runMadbUserUnset, getDefaultConfigFilePath},
-	Name:   "unset",
-	Short:  "Unset the default user ID set by the 'madb user set' command.",
+	Runner:           subCommandRunnerWithFilepath{runMadbUserUnset, getDefaultConfigFilePath},
+	Name:             "unset",
+	DontInheritFlags: true,
+	Short:            "Unset the default user ID set by the 'madb user set' command.",
 	Long: `
-Unsets the default user ID assigned by the 'madb user set' command for the specified device.
+Unsets the default user ID assigned by the 'madb user set' command for the specified devices.
 
-Running this command without any device specifiers will unset the default users only for the
-currently available devices and emulators, while keeping the default user IDs for the other devices.
+When the device specifier refers to connected devices (e.g., a device index or a device group), the
+default user IDs are unset for all the matching devices, whether they are stored under the device
+serial or the hardware serial.
 `,
-	ArgsName: "<device_serial>",
+	ArgsName: "<device_specifier>",
 	ArgsLong: `
-<device_serial> is the unique serial number for the device, which can be obtained from 'adb devices'.
+<device_specifier> can be anything that is accepted in the '-n' flag (see 'madb help'), such as a
+device serial, nickname, index, or a device group name.
 `,
 }
 
@@ -138,11 +299,10 @@ func runMadbUserUnset(env *cmdline.Env, args []string, filename string) error {
 		return fmt.Errorf("There must be exactly one argument.")
 	}
 
-	// TODO(youngseokyoon): make it possible to specify the device using its nickname or index.
-	// Validate the device serial
-	serial := args[0]
-	if !isValidSerial(serial) {
-		return fmt.Errorf("Not a valid device serial: %v", serial)
+	// Validate the device specifier.
+	specifier := args[0]
+	if err := isValidDeviceSpecifier(specifier); err != nil {
+		return err
 	}
 
 	cfg, err := readConfig(filename)
@@ -150,14 +310,29 @@ func runMadbUserUnset(env *cmdline.Env, args []string, filename string) error {
 		return err
 	}
 
-	delete(cfg.UserIDs, serial)
+	if serial, ok := offlineDeviceKey(specifier, cfg); ok {
+		delete(cfg.UserIDs, serial)
+		return writeConfig(cfg, filename)
+	}
+
+	devices, err := resolveConnectedDevices(specifier, cfg)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range devices {
+		delete(cfg.UserIDs, d.Serial)
+		delete(cfg.UserIDs, d.hardwareSerialSpecifier())
+	}
+
 	return writeConfig(cfg, filename)
 }
 
 var cmdMadbUserList = &cmdline.Command{
-	Runner: subCommandRunnerWithFilepath{runMadbUserList, getDefaultConfigFilePath},
-	Name:   "list",
-	Short:  "List all the existing default user IDs.",
+	Runner:           subCommandRunnerWithFilepath{runMadbUserList, getDefaultConfigFilePath},
+	Name:             "list",
+	DontInheritFlags: true,
+	Short:            "List all the existing default user IDs.",
 	Long: `
 Lists all the currently stored default user IDs for devices.
 `,
@@ -190,10 +365,136 @@ func runMadbUserList(env *cmdline.Env, args []string, filename string) error {
 	return nil
 }
 
+var cmdMadbUserListAvailable = &cmdline.Command{
+	Runner: cmdline.RunnerFunc(runMadbUserListAvailable),
+	Name:   "list-available",
+	Short:  "List all the available users on the devices.",
+	Long: `
+Lists all the available users on the specified devices, by running 'pm list users' command on each
+device. The users currently set as the default user by 'madb user set' are marked in the "Default"
+column.
+
+The device specifier flags (e.g., '-n', '-d', '-e') can be used for choosing the devices.
+`,
+}
+
+func runMadbUserListAvailable(env *cmdline.Env, args []string) error {
+	if err := startAdbServer(); err != nil {
+		return err
+	}
+
+	devices, err := getSpecifiedDevices()
+	if err != nil {
+		return err
+	}
+
+	users := make(map[string][]androidUser)
+	for _, d := range devices {
+		deviceUsers, err := getAndroidUsers(d.Serial)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: %v\n", err)
+			continue
+		}
+		users[d.Serial] = deviceUsers
+	}
+
+	printAvailableUsers(os.Stdout, devices, users)
+	return nil
+}
+
+// printAvailableUsers prints the available users of the given devices in a table.
+func printAvailableUsers(w io.Writer, devices []device, users map[string][]androidUser) {
+	tw := tablewriter.NewWriter(w)
+	tw.SetHeader([]string{"Device", "User ID", "User Name", "Running", "Default"})
+	tw.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+	tw.SetAutoFormatHeaders(false)
+	tw.SetAlignment(tablewriter.ALIGN_LEFT)
+
+	for _, d := range devices {
+		for _, u := range users[d.Serial] {
+			running, isDefault := "", ""
+			if u.Running {
+				running = "yes"
+			}
+			if u.ID == d.UserID {
+				isDefault = "*"
+			}
+			tw.Append([]string{d.displayName(), u.ID, u.Name, running, isDefault})
+		}
+	}
+	tw.Render()
+}
+
+// androidUser represents a user account on an Android device.
+type androidUser struct {
+	ID      string
+	Name    string
+	Flags   string
+	Running bool
+}
+
+// getAndroidUsers runs "pm list users" command on the given device, and returns the available users.
+func getAndroidUsers(serial string) ([]androidUser, error) {
+	sh := gosh.NewShell(nil)
+	defer sh.Cleanup()
+
+	sh.ContinueOnError = true
+	output := sh.Cmd("adb", "-s", serial, "shell", "pm", "list", "users").Stdout()
+	if sh.Err != nil {
+		return nil, fmt.Errorf("Could not list the users of device %q: %v", serial, sh.Err)
+	}
+
+	return parseUserList(output), nil
+}
+
+// parseUserList parses the output of "pm list users" command, where each user is
+// represented as "UserInfo{<id>:<name>:<flags>}", optionally followed by "running".
+func parseUserList(output string) []androidUser {
+	result := []androidUser{}
+
+	r := regexp.MustCompile(`UserInfo\{(\d+):(.*):([0-9a-fA-F]+)\}(\s+running)?`)
+	for _, line := range strings.Split(output, "\n") {
+		matches := r.FindStringSubmatch(line)
+		if matches == nil {
+			continue
+		}
+
+		result = append(result, androidUser{
+			ID:      matches[1],
+			Name:    matches[2],
+			Flags:   matches[3],
+			Running: matches[4] != "",
+		})
+	}
+
+	return result
+}
+
+// findUserIDByName returns the ID of the user with the given name. It is an
+// error if there is no such user, or there are multiple users with the name.
+func findUserIDByName(name string, users []androidUser) (string, error) {
+	ids := []string{}
+	for _, u := range users {
+		if u.Name == name {
+			ids = append(ids, u.ID)
+		}
+	}
+
+	switch len(ids) {
+	case 0:
+		return "", fmt.Errorf("There is no user named %q.", name)
+	case 1:
+		return ids[0], nil
+	default:
+		return "", fmt.Errorf("There are multiple users named %q with the IDs %v.", name, strings.Join(ids, ", "))
+	}
+}
+
 var cmdMadbUserClearAll = &cmdline.Command{
-	Runner: subCommandRunnerWithFilepath{runMadbUserClearAll, getDefaultConfigFilePath},
-	Name:   "clear-all",
-	Short:  "Clear all the existing default user settings.",
+	Runner:           subCommandRunnerWithFilepath{runMadbUserClearAll, getDefaultConfigFilePath},
+	Name:             "clear-all",
+	DontInheritFlags: true,
+	Short:            "Clear all the existing default user settings.",
 	Long: `
 Clears all the currently stored default user IDs for devices.
 
@@ -210,3 +511,264 @@ func runMadbUserClearAll(env *cmdline.Env, args []string, filename string) error
 	cfg.UserIDs = make(map[string]string)
 	return writeConfig(cfg, filename)
 }
+
+var cmdMadbUserCreate = &cmdline.Command{
+	Runner: subCommandRunner{subCmd: runMadbUserCreateForDevice},
+	Name:   "create",
+	Short:  "Create a new user on all devices.",
+	Long: `
+Creates a new user with the given name on all the specified devices, by running 'pm create-user'
+command on each device.
+
+When the "-set-default" flag is provided, the created user is set as the default user of each
+device, as if 'madb user set' command is run with the created user ID.
+`,
+	ArgsName: "<user_name>",
+	ArgsLong: `
+<user_name> is the name of the new user.
+`,
+}
+
+func runMadbUserCreateForDevice(env *cmdline.Env, args []string, d device, properties variantProperties) error {
+	if len(args) != 1 {
+		return fmt.Errorf("There must be exactly one argument.")
+	}
+
+	return createUserForDevice(d, createUserArgs(args[0]))
+}
+
+// createUserArgs returns the 'pm create-user' command for creating a user with the given name.
+func createUserArgs(name string) []string {
+	// 'adb shell' joins its arguments into a single command line, so the name must be quoted.
+	return []string{"pm", "create-user", shellQuote(name)}
+}
+
+var cmdMadbUserCreateWorkProfile = &cmdline.Command{
+	Runner: subCommandRunner{subCmd: runMadbUserCreateWorkProfileForDevice},
+	Name:   "create-work-profile",
+	Short:  "Create a new work profile on all devices.",
+	Long: `
+Creates a new managed profile (i.e., work profile) on all the specified devices, by running
+'pm create-user --profileOf <parent_user_id> --managed' command on each device. The parent of the
+work profile is the default user of each device set by 'madb user set', or the system user (0) when
+the default user is not set. The created work profile is started right away.
+
+Note that the created work profile does not have a profile owner. To test apps that require a device
+policy controller, install and set the profile owner app for the created profile separately.
+
+When the "-set-default" flag is provided, the created work profile is set as the default user of
+each device, as if 'madb user set' command is run with the created user ID.
+`,
+	ArgsName: "[<profile_name>]",
+	ArgsLong: `
+<profile_name> is the name of the new work profile. If not provided, "Work profile" is used.
+`,
+}
+
+func runMadbUserCreateWorkProfileForDevice(env *cmdline.Env, args []string, d device, properties variantProperties) error {
+	if len(args) > 1 {
+		return fmt.Errorf("There must be at most one argument.")
+	}
+
+	name := "Work profile"
+	if len(args) == 1 {
+		name = args[0]
+	}
+
+	parent := d.UserID
+	if parent == "" {
+		parent = "0"
+	}
+
+	return createUserForDevice(d, createWorkProfileArgs(parent, name))
+}
+
+// createWorkProfileArgs returns the 'pm create-user' command for creating a work profile with the
+// given name under the given parent user.
+func createWorkProfileArgs(parent, name string) []string {
+	return []string{"pm", "create-user", "--profileOf", parent, "--managed", shellQuote(name)}
+}
+
+// shellQuote quotes the given string so that the device shell treats it as a single argument,
+// by enclosing it in single quotes and escaping the single quotes within the string.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// createUserForDevice runs the given 'pm create-user' command on the device,
+// and records the created user ID as the default user if requested. When the
+// created user is a managed profile, it is started right away.
+func createUserForDevice(d device, pmArgs []string) error {
+	sh := gosh.NewShell(nil)
+	defer sh.Cleanup()
+
+	sh.ContinueOnError = true
+
+	var output bytes.Buffer
+	cmd := sh.Cmd("adb", append([]string{"-s", d.Serial, "shell"}, pmArgs...)...)
+	if err := runGoshCommandForDeviceWithWriters(cmd, d, false, io.MultiWriter(os.Stdout, &output), os.Stderr); err != nil {
+		return err
+	}
+
+	userID, err := parseCreatedUserID(output.String())
+	if err != nil {
+		return err
+	}
+
+	if isStringInSlice("--managed", pmArgs) {
+		cmd := sh.Cmd("adb", "-s", d.Serial, "shell", "am", "start-user", userID)
+		if err := runGoshCommandForDevice(cmd, d, false); err != nil {
+			return err
+		}
+	}
+
+	if setDefaultFlag {
+		filename, err := getDefaultConfigFilePath()
+		if err != nil {
+			return err
+		}
+
+		key, err := userConfigKey(d)
+		if err != nil {
+			return err
+		}
+
+		return updateConfig(filename, func(cfg *config) {
+			cfg.UserIDs[key] = userID
+		})
+	}
+
+	return nil
+}
+
+// parseCreatedUserID parses the output of 'pm create-user' command, which looks
+// like "Success: created user id 10", and returns the created user ID.
+func parseCreatedUserID(output string) (string, error) {
+	r := regexp.MustCompile(`Success: created user id (\d+)`)
+	matches := r.FindStringSubmatch(output)
+	if matches == nil {
+		return "", fmt.Errorf("Could not create the user: %v", strings.TrimSpace(output))
+	}
+
+	return matches[1], nil
+}
+
+var cmdMadbUserRemove = &cmdline.Command{
+	Runner: subCommandRunner{subCmd: runMadbUserRemoveForDevice},
+	Name:   "remove",
+	Short:  "Remove a user from all devices.",
+	Long: `
+Removes the given user from all the specified devices, by running 'pm remove-user' command on each
+device. When the removed user is the default user of a device, the default user setting of that
+device is unset as well.
+
+The system user (0) cannot be removed.
+`,
+	ArgsName: "<user_id | user_name>",
+	ArgsLong: `
+<user_id> is one of the user IDs obtained from 'madb user list-available' command.
+<user_name> is one of the user names obtained from 'madb user list-available' command.
+`,
+}
+
+func runMadbUserRemoveForDevice(env *cmdline.Env, args []string, d device, properties variantProperties) error {
+	if len(args) != 1 {
+		return fmt.Errorf("There must be exactly one argument.")
+	}
+
+	userID, err := resolveUserIDForDevice(args[0], d)
+	if err != nil {
+		return err
+	}
+
+	if userID == "0" {
+		return fmt.Errorf("The system user (0) cannot be removed.")
+	}
+
+	sh := gosh.NewShell(nil)
+	defer sh.Cleanup()
+
+	sh.ContinueOnError = true
+
+	cmd := sh.Cmd("adb", "-s", d.Serial, "shell", "pm", "remove-user", userID)
+	if err := runGoshCommandForDevice(cmd, d, false); err != nil {
+		return err
+	}
+
+	// Unset the default user, if the removed user was the default.
+	if d.UserID == userID {
+		filename, err := getDefaultConfigFilePath()
+		if err != nil {
+			return err
+		}
+
+		return updateConfig(filename, func(cfg *config) {
+			unsetDefaultUser(cfg, d, userID)
+		})
+	}
+
+	return nil
+}
+
+// unsetDefaultUser removes the default user settings of the given device which refer to the given
+// user, under any of the keys the setting may be stored (e.g., the hardware serial or a qualifier).
+func unsetDefaultUser(cfg *config, d device, userID string) {
+	for _, key := range d.configKeys() {
+		if cfg.UserIDs[key] == userID {
+			delete(cfg.UserIDs, key)
+		}
+	}
+}
+
+var cmdMadbUserSwitch = &cmdline.Command{
+	Runner: subCommandRunner{subCmd: runMadbUserSwitchForDevice},
+	Name:   "switch",
+	Short:  "Switch the foreground user on all devices.",
+	Long: `
+Switches the foreground user to the given user on all the specified devices, by running
+'am switch-user' command on each device.
+`,
+	ArgsName: "<user_id | user_name>",
+	ArgsLong: `
+<user_id> is one of the user IDs obtained from 'madb user list-available' command.
+<user_name> is one of the user names obtained from 'madb user list-available' command.
+`,
+}
+
+func runMadbUserSwitchForDevice(env *cmdline.Env, args []string, d device, properties variantProperties) error {
+	if len(args) != 1 {
+		return fmt.Errorf("There must be exactly one argument.")
+	}
+
+	userID, err := resolveUserIDForDevice(args[0], d)
+	if err != nil {
+		return err
+	}
+
+	sh := gosh.NewShell(nil)
+	defer sh.Cleanup()
+
+	sh.ContinueOnError = true
+
+	cmd := sh.Cmd("adb", "-s", d.Serial, "shell", "am", "switch-user", userID)
+	return runGoshCommandForDevice(cmd, d, false)
+}
+
+// resolveUserIDForDevice returns the given argument as is when it is a user ID.
+// Otherwise, the argument is considered as a user name, and the ID of the user
+// with that name is looked up on the given device.
+func resolveUserIDForDevice(user string, d device) (string, error) {
+	if id, err := strconv.Atoi(user); err == nil {
+		if id < 0 {
+			return "", fmt.Errorf("Not a valid user ID: %v", user)
+		}
+		return user, nil
+	}
+
+	users, err := getAndroidUsers(d.Serial)
+	if err != nil {
+		return "", err
+	}
+
+	return findUserIDByName(user, users)
+}
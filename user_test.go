@@ -53,8 +53,22 @@ func TestMadbUserSet(t *testing.T) {
 		t.Fatalf("unmatched results: got %v, want %v", got, want)
 	}
 
-	// Try some invalid ids and see if they fail.
-	invalidIds := []string{"-1", "NAME"}
+	// Set by nickname. The user ID should be stored under the serial of the nickname.
+	runMadbNameSet(nil, []string{"SERIAL3", "NICKNAME3"}, filename)
+	if err = runMadbUserSet(nil, []string{"NICKNAME3", "10"}, filename); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg, err = readConfig(filename); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cfg.UserIDs, map[string]string{"SERIAL1": "20", "SERIAL2": "10", "SERIAL3": "10"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unmatched results: got %v, want %v", got, want)
+	}
+
+	// Try some invalid ids and see if they fail. The non-numeric values are user names, which are
+	// looked up on the device (see TestFindUserIDByName).
+	invalidIds := []string{"-1"}
 	for _, id := range invalidIds {
 		if err = runMadbUserSet(nil, []string{"SERIAL", id}, filename); err == nil {
 			t.Fatalf("expected an error but succeeded.")
@@ -84,6 +98,121 @@ func TestMadbUserUnset(t *testing.T) {
 	if got, want := cfg.UserIDs, map[string]string{"SERIAL2": "0", "SERIAL3": "10"}; !reflect.DeepEqual(got, want) {
 		t.Fatalf("unmatched results: got %v, want %v", got, want)
 	}
+
+	// Unset by nickname.
+	runMadbNameSet(nil, []string{"SERIAL3", "NICKNAME3"}, filename)
+	if err = runMadbUserUnset(nil, []string{"NICKNAME3"}, filename); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err = readConfig(filename); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cfg.UserIDs, map[string]string{"SERIAL2": "0"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unmatched results: got %v, want %v", got, want)
+	}
+}
+
+func TestOfflineDeviceKey(t *testing.T) {
+	cfg := &config{
+		Names:   map[string]string{"MyPhone": "deviceid01", "MyTablet": "serialno:deviceid02", "Nexus9": "model:Nexus_9"},
+		Groups:  map[string][]string{"Phones": []string{"MyPhone"}},
+		Queries: map[string]string{"Modern": "sdk>=31"},
+	}
+
+	tests := []struct {
+		specifier string
+		want      string
+		ok        bool
+	}{
+		{"deviceid03", "deviceid03", true},
+		{"192.168.0.10:5555", "192.168.0.10:5555", true},
+		{"serialno:deviceid04", "serialno:deviceid04", true},
+		{"MyPhone", "deviceid01", true},
+		{"MyTablet", "serialno:deviceid02", true},
+		{"model:Nexus_9", "model:Nexus_9", true},
+		{"Nexus9", "model:Nexus_9", true},
+		{"@1", "", false},
+		{"Phones", "", false},
+		{"Modern", "", false},
+		{"tag:flaky", "", false},
+		{"rack=3", "", false},
+	}
+
+	for i, test := range tests {
+		got, ok := offlineDeviceKey(test.specifier, cfg)
+		if got != test.want || ok != test.ok {
+			t.Fatalf("unmatched results for tests[%v]: got (%v, %v), want (%v, %v)", i, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestParseUserList(t *testing.T) {
+	output := `Users:
+	UserInfo{0:John Doe:13} running
+	UserInfo{10:Work profile:30} running
+	UserInfo{11:Guest: Kids:404}
+`
+
+	got := parseUserList(output)
+	want := []androidUser{
+		{ID: "0", Name: "John Doe", Flags: "13", Running: true},
+		{ID: "10", Name: "Work profile", Flags: "30", Running: true},
+		{ID: "11", Name: "Guest: Kids", Flags: "404", Running: false},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unmatched results: got %v, want %v", got, want)
+	}
+}
+
+func TestFindUserIDByName(t *testing.T) {
+	users := []androidUser{
+		{ID: "0", Name: "John Doe"},
+		{ID: "10", Name: "Work profile"},
+		{ID: "11", Name: "Guest"},
+		{ID: "12", Name: "Guest"},
+	}
+
+	if got, err := findUserIDByName("Work profile", users); err != nil || got != "10" {
+		t.Fatalf("unmatched results: got (%v, %v), want (%v, <nil>)", got, err, "10")
+	}
+
+	// Unknown or ambiguous user names should fail.
+	for _, name := range []string{"Jane Doe", "Guest"} {
+		if _, err := findUserIDByName(name, users); err == nil {
+			t.Fatalf("expected an error for %q but succeeded.", name)
+		}
+	}
+}
+
+func ExampleMadbUserListAvailable() {
+	devices := []device{
+		device{Serial: "deviceid01", Nickname: "MyPhone", Index: 1, UserID: "10"},
+		device{Serial: "deviceid02", Index: 2},
+	}
+
+	users := map[string][]androidUser{
+		"deviceid01": []androidUser{
+			{ID: "0", Name: "John Doe", Flags: "13", Running: true},
+			{ID: "10", Name: "Work profile", Flags: "30", Running: true},
+		},
+		"deviceid02": []androidUser{
+			{ID: "0", Name: "Jane Doe", Flags: "13", Running: true},
+			{ID: "11", Name: "Guest", Flags: "404", Running: false},
+		},
+	}
+
+	printAvailableUsers(os.Stdout, devices, users)
+
+	// Output:
+	// +------------+---------+--------------+---------+---------+
+	// | Device     | User ID | User Name    | Running | Default |
+	// +------------+---------+--------------+---------+---------+
+	// | MyPhone    | 0       | John Doe     | yes     |         |
+	// | MyPhone    | 10      | Work profile | yes     | *       |
+	// | deviceid02 | 0       | Jane Doe     | yes     |         |
+	// | deviceid02 | 11      | Guest        |         |         |
+	// +------------+---------+--------------+---------+---------+
 }
 
 func ExampleMadbUserList() {
@@ -108,6 +237,26 @@ func ExampleMadbUserList() {
 	// +---------+---------+
 }
 
+func TestUnsetDefaultUser(t *testing.T) {
+	cfg := newConfig()
+	cfg.UserIDs = map[string]string{
+		"deviceid01":          "10",
+		"serialno:deviceid01": "10",
+		"model:Nexus_5X":      "10",
+		"usb:3-3.4.1":         "11",
+		"deviceid02":          "10",
+	}
+
+	d := device{Serial: "deviceid01", HardwareSerial: "deviceid01", Qualifiers: []string{"usb:3-3.4.1", "model:Nexus_5X"}}
+	unsetDefaultUser(cfg, d, "10")
+
+	// The settings of the other users or the other devices should be kept.
+	want := map[string]string{"usb:3-3.4.1": "11", "deviceid02": "10"}
+	if !reflect.DeepEqual(cfg.UserIDs, want) {
+		t.Fatalf("unmatched results: got %v, want %v", cfg.UserIDs, want)
+	}
+}
+
 func TestMadbUserClearAll(t *testing.T) {
 	filename := tempFilename(t)
 	defer os.Remove(filename)
@@ -140,3 +289,34 @@ func TestMadbUserClearAll(t *testing.T) {
 		t.Fatalf("unmatched results: got %v, want %v", got, want)
 	}
 }
+
+func TestParseCreatedUserID(t *testing.T) {
+	if got, err := parseCreatedUserID("Success: created user id 12\n"); err != nil || got != "12" {
+		t.Fatalf("unmatched results: got (%v, %v), want (%v, <nil>)", got, err, "12")
+	}
+
+	// Failure outputs should result in an error.
+	for _, output := range []string{"Error: couldn't create User.\n", ""} {
+		if _, err := parseCreatedUserID(output); err == nil {
+			t.Fatalf("expected an error for %q but succeeded.", output)
+		}
+	}
+}
+
+func TestCreateUserArgs(t *testing.T) {
+	tests := []struct {
+		got  []string
+		want []string
+	}{
+		{createUserArgs("Guest"), []string{"pm", "create-user", "'Guest'"}},
+		{createUserArgs("John's phone"), []string{"pm", "create-user", `'John'\''s phone'`}},
+		{createWorkProfileArgs("0", "Work profile"), []string{"pm", "create-user", "--profileOf", "0", "--managed", "'Work profile'"}},
+		{createWorkProfileArgs("10", `"Bob's" work`), []string{"pm", "create-user", "--profileOf", "10", "--managed", `'"Bob'\''s" work'`}},
+	}
+
+	for i, test := range tests {
+		if !reflect.DeepEqual(test.got, test.want) {
+			t.Fatalf("unmatched results for tests[%v]: got %v, want %v", i, test.got, test.want)
+		}
+	}
+}
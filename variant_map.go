@@ -0,0 +1,204 @@
+// Copyright 2016 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"v.io/x/lib/cmdline"
+)
+
+var variantMapFlag string
+
+// variantMapEntry maps the devices matching a device specifier to an application module and a
+// build variant.
+type variantMapEntry struct {
+	// Specifier is a device specifier as used in the -n flag (e.g., a group name or "tag:wear").
+	Specifier string
+	// Module and Variant are the module and the build variant to be used for the matching devices.
+	// The module is empty when it is not specified in the entry.
+	Module  string
+	Variant string
+	// hasModule indicates that the entry specifies the module, in which case the -module and the
+	// -variant flags are not applied to the matching devices.
+	hasModule bool
+}
+
+// parseVariantMap parses the value of the -variant-map flag. The value is a comma-separated list of
+// "<device_specifier>=<target>" entries, where the target is either "<variant>" for a build variant
+// of the default module, ":<module>" for the default build variant of a module, or
+// ":<module>:<variant>".
+func parseVariantMap(value string) ([]variantMapEntry, error) {
+	entries := []variantMapEntry{}
+	for _, token := range strings.Split(value, ",") {
+		token = strings.TrimSpace(token)
+		if token == "" {
+			continue
+		}
+
+		// The device specifier may contain '=' (e.g., "rack=3"), but the target may not.
+		i := strings.LastIndex(token, "=")
+		if i <= 0 || i == len(token)-1 {
+			return nil, fmt.Errorf("Invalid variant map entry %q. The entry must be in the form of '<device_specifier>=<target>'.", token)
+		}
+
+		specifier, target := strings.TrimSpace(token[:i]), strings.TrimSpace(token[i+1:])
+		if err := isValidDeviceSpecifier(specifier); err != nil {
+			return nil, err
+		}
+
+		entry := variantMapEntry{Specifier: specifier}
+		if strings.HasPrefix(target, ":") {
+			parts := strings.SplitN(target[1:], ":", 2)
+			entry.Module, entry.hasModule = parts[0], true
+			if len(parts) == 2 {
+				entry.Variant = parts[1]
+			}
+			if entry.Module == "" {
+				return nil, fmt.Errorf("Invalid variant map entry %q. The module name is empty.", token)
+			}
+		} else {
+			entry.Variant = target
+		}
+
+		entries = append(entries, entry)
+	}
+
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("The -variant-map flag does not contain any entries.")
+	}
+
+	return entries, nil
+}
+
+// key returns the variant key of the entry. The -module and the -variant flags given as the default
+// key fill in the parts not specified by the entry.
+func (e variantMapEntry) key(defaultKey variantKey) variantKey {
+	if e.hasModule {
+		return variantKey{defaultKey.Dir, e.Module, e.Variant}
+	}
+
+	return variantKey{defaultKey.Dir, defaultKey.Module, e.Variant}
+}
+
+// getDeviceVariantKeys returns the variant key to be used for each of the given devices. The first
+// entry matching a device determines its variant, and the devices matching none of the entries use
+// the default key.
+func getDeviceVariantKeys(devices []device, entries []variantMapEntry, defaultKey variantKey, cfg *config, getprop devicePropertiesFunc) ([]variantKey, error) {
+	keys := make([]variantKey, len(devices))
+	mapped := make([]bool, len(devices))
+	for i := range devices {
+		keys[i] = defaultKey
+	}
+
+	// The system properties of each device are obtained at most once.
+	getprop = memoizeDeviceProperties(getprop)
+
+	for _, entry := range entries {
+		matched, err := filterSpecifiedDevices(devices, cfg, false, false, []string{entry.Specifier}, getprop)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, d := range devices {
+			if mapped[i] {
+				continue
+			}
+
+			for _, m := range matched {
+				if m.Serial == d.Serial {
+					keys[i], mapped[i] = entry.key(defaultKey), true
+					break
+				}
+			}
+		}
+	}
+
+	return keys, nil
+}
+
+// describeVariantKey describes the module and the build variant of the given key in a
+// human-readable form.
+func describeVariantKey(key variantKey) string {
+	variant, module := "the default variant", "the default module"
+	if key.Variant != "" {
+		variant = fmt.Sprintf("variant %q", key.Variant)
+	}
+	if key.Module != "" {
+		module = fmt.Sprintf("module %q", key.Module)
+	}
+
+	return variant + " of " + module
+}
+
+// deviceTarget is the set of arguments and the project properties with which the sub command is
+// run on a device.
+type deviceTarget struct {
+	args       []string
+	properties variantProperties
+}
+
+// initVariantMapTargets determines the build variant of each device from the -variant-map flag,
+// and extracts the properties and runs the init function once for each of the variants needed.
+// Returns the target of each device.
+func (r subCommandRunner) initVariantMapTargets(env *cmdline.Env, devices []device) ([]deviceTarget, error) {
+	entries, err := parseVariantMap(variantMapFlag)
+	if err != nil {
+		return nil, err
+	}
+
+	configFile, err := getDefaultConfigFilePath()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := readConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := getDeviceVariantKeys(devices, entries, variantKey{wd, moduleFlag, variantFlag}, cfg, getDeviceProperties)
+	if err != nil {
+		return nil, err
+	}
+
+	// Group the devices by their variants, keeping the order in which the variants first appear.
+	uniqueKeys := []variantKey{}
+	names := map[variantKey][]string{}
+	for i, key := range keys {
+		if _, ok := names[key]; !ok {
+			uniqueKeys = append(uniqueKeys, key)
+		}
+		names[key] = append(names[key], devices[i].displayName())
+	}
+
+	initialized := map[variantKey]deviceTarget{}
+	for _, key := range uniqueKeys {
+		printMessage(os.Stdout, "Using %v for devices: %v\n", describeVariantKey(key), strings.Join(names[key], ", "))
+
+		properties, err := getProjectPropertiesUsingDefaultCache(key)
+		if err != nil {
+			return nil, err
+		}
+
+		args := []string{}
+		if r.init != nil {
+			if args, err = r.init(env, args, &properties); err != nil {
+				return nil, err
+			}
+		}
+
+		initialized[key] = deviceTarget{args, properties}
+	}
+
+	targets := make([]deviceTarget, len(devices))
+	for i, key := range keys {
+		targets[i] = initialized[key]
+	}
+
+	return targets, nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2016 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseVariantMap(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []variantMapEntry
+		wantErr bool
+	}{
+		{
+			"Tablets=tabletDebug, tag:wear=:wear",
+			[]variantMapEntry{
+				{"Tablets", "", "tabletDebug", false},
+				{"tag:wear", "wear", "", true},
+			},
+			false,
+		},
+		{
+			"rack=3=:apps/tv:release",
+			[]variantMapEntry{
+				{"rack=3", "apps/tv", "release", true},
+			},
+			false,
+		},
+		{"Tablets", nil, true},
+		{"Tablets=", nil, true},
+		{"=debug", nil, true},
+		{"Tablets=:", nil, true},
+		{"Invalid!=debug", nil, true},
+		{",", nil, true},
+	}
+
+	for i, test := range tests {
+		got, err := parseVariantMap(test.value)
+		if test.wantErr {
+			if err == nil {
+				t.Fatalf("error expected for tests[%v]", i)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("unexpected error for tests[%v]: %v", i, err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Fatalf("unmatched results for tests[%v]: got %v, want %v", i, got, test.want)
+		}
+	}
+}
+
+func TestGetDeviceVariantKeys(t *testing.T) {
+	cfg := newConfig()
+	cfg.Groups["Tablets"] = []string{"model:Nexus_9", "emulator-5556"}
+	cfg.Queries["Modern"] = "sdk>=31"
+
+	devices := []device{
+		device{Serial: "deviceid01", Type: realDevice, Qualifiers: []string{"model:Nexus_5X"}, Nickname: "MyPhone", Index: 1},
+		device{Serial: "deviceid02", Type: realDevice, Qualifiers: []string{"model:Nexus_9"}, Index: 2},
+		device{Serial: "emulator-5554", Type: emulator, Tags: []string{"wear"}, Index: 3},
+		device{Serial: "emulator-5556", Type: emulator, Index: 4},
+	}
+
+	getprop := func(serial string) (map[string]string, error) {
+		if serial == "emulator-5556" {
+			return map[string]string{"ro.build.version.sdk": "33"}, nil
+		}
+		return map[string]string{"ro.build.version.sdk": "25"}, nil
+	}
+
+	entries := []variantMapEntry{
+		{"Tablets", "", "tabletDebug", false},
+		{"tag:wear", "wear", "", true},
+		// The devices mapped by the previous entries are not affected.
+		{"Modern", "modern", "release", true},
+	}
+
+	defaultKey := variantKey{"/project", "app", "debug"}
+	got, err := getDeviceVariantKeys(devices, entries, defaultKey, cfg, getprop)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []variantKey{
+		{"/project", "app", "debug"},
+		{"/project", "app", "tabletDebug"},
+		{"/project", "wear", ""},
+		{"/project", "app", "tabletDebug"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unmatched results: got %v, want %v", got, want)
+	}
+}
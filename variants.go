@@ -0,0 +1,167 @@
+// Copyright 2016 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/olekukonko/tablewriter"
+
+	"v.io/x/lib/cmdline"
+)
+
+var variantsFormatFlag string
+
+func init() {
+	cmdMadbVariants.Flags.StringVar(&variantsFormatFlag, "format", "table", `Specify the output format. You can choose from the following options:
+    table - Display the variants in a human-readable table.
+    json  - Print the modules and their variants in JSON format, which can be used for scripting.`)
+}
+
+var cmdMadbVariants = &cmdline.Command{
+	Runner:           cmdline.RunnerFunc(runMadbVariants),
+	Name:             "variants",
+	DontInheritFlags: true,
+	Short:            "List the application modules, product flavors, and build variants",
+	Long: `
+Lists all the application modules of the Gradle Android project in the current
+directory, along with their product flavor dimensions and build variants. For
+each build variant, the build type, the product flavors, and the application ID
+are shown.
+
+The listed module and variant names can be given to the "-module" and the
+"-variant" flags of the other madb commands (e.g., 'madb install', 'madb start').
+The default module and variant, which are chosen automatically when these flags
+are not specified, are marked as "(default)" in the table. In JSON format, they
+are indicated by the "Default" fields.
+
+This command runs a small Gradle script to list the variants, and the results
+are not cached.
+`,
+}
+
+// moduleVariants is the list of build variants of an application module.
+type moduleVariants struct {
+	// Module is the module directory relative to the project directory, which can be given to the
+	// -module flag. Empty if the project itself is the application module.
+	Module           string
+	ProjectPath      string
+	FlavorDimensions []string
+	Variants         []variantInfo
+	Default          bool
+}
+
+// variantInfo describes a build variant of an application module.
+type variantInfo struct {
+	Name      string
+	BuildType string
+	// Flavors are the product flavors of the variant, in the order of the flavor dimensions.
+	Flavors []string
+	AppID   string
+	Default bool
+}
+
+func runMadbVariants(env *cmdline.Env, args []string) error {
+	if len(args) != 0 {
+		return env.UsageErrorf("There must be no arguments.")
+	}
+
+	allowed := []string{"table", "json"}
+	if !isStringInSlice(variantsFormatFlag, allowed) {
+		return fmt.Errorf("The -format flag value must be one of %v", strings.Join(allowed, ", "))
+	}
+
+	if !isGradleProject(wd) {
+		return fmt.Errorf("The current directory is not a Gradle Android project.")
+	}
+
+	modules, err := listVariantsFromGradle(wd)
+	if err != nil {
+		return err
+	}
+
+	if variantsFormatFlag == "json" {
+		bytes, err := json.MarshalIndent(modules, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(string(bytes))
+		return nil
+	}
+
+	printVariantsTable(os.Stdout, modules)
+	return nil
+}
+
+// listVariantsFromGradle runs a Gradle script to list the application modules and their build
+// variants of the Gradle project in the given directory.
+func listVariantsFromGradle(dir string) ([]moduleVariants, error) {
+	modules := []moduleVariants{}
+	if err := runGradleInitScript(dir, []string{"-p", dir, "madbListVariants"}, &modules); err != nil {
+		return nil, err
+	}
+
+	markDefaultVariants(modules)
+	return modules, nil
+}
+
+// markDefaultVariants marks the module and the variants chosen automatically when the -module and
+// the -variant flags are not specified, which are the first ones listed by the Gradle script.
+func markDefaultVariants(modules []moduleVariants) {
+	for i := range modules {
+		modules[i].Default = i == 0
+		for j := range modules[i].Variants {
+			modules[i].Variants[j].Default = j == 0
+		}
+	}
+}
+
+// printVariantsTable prints the given modules and their variants in a table.
+func printVariantsTable(w io.Writer, modules []moduleVariants) {
+	tw := tablewriter.NewWriter(w)
+	tw.SetHeader([]string{"Module", "Variant", "Build Type", "Product Flavors", "App ID"})
+	tw.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+	tw.SetAutoFormatHeaders(false)
+	tw.SetAlignment(tablewriter.ALIGN_LEFT)
+
+	for _, m := range modules {
+		module := m.Module
+		if module == "" {
+			module = "."
+		}
+		if m.Default {
+			module += " (default)"
+		}
+
+		for _, v := range m.Variants {
+			name := v.Name
+			if v.Default {
+				name += " (default)"
+			}
+			tw.Append([]string{module, name, v.BuildType, formatFlavors(m.FlavorDimensions, v.Flavors), v.AppID})
+		}
+	}
+	tw.Render()
+}
+
+// formatFlavors formats the product flavors of a variant along with their flavor dimensions (e.g.,
+// "tier=pro, mode=demo"). The dimensions are omitted when they are unknown.
+func formatFlavors(dimensions []string, flavors []string) string {
+	result := make([]string, len(flavors))
+	for i, flavor := range flavors {
+		if len(dimensions) == len(flavors) {
+			result[i] = dimensions[i] + "=" + flavor
+		} else {
+			result[i] = flavor
+		}
+	}
+
+	return strings.Join(result, ", ")
+}
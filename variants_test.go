@@ -0,0 +1,148 @@
+// Copyright 2016 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestListVariantsFromGradle(t *testing.T) {
+	modules, err := listVariantsFromGradle(filepath.Join("testdata", "projects", "testAndroidMultiFlavor"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(modules) != 1 || modules[0].Module != "app" || modules[0].ProjectPath != ":app" {
+		t.Fatalf("unmatched modules: got %v", modules)
+	}
+
+	want := map[string]string{
+		"liteDebug":   "io.v.testProjectId.lite.debug",
+		"liteRelease": "io.v.testProjectId.lite",
+		"proDebug":    "io.v.testProjectId.pro.debug",
+		"proRelease":  "io.v.testProjectId.pro",
+	}
+	got := map[string]string{}
+	for _, v := range modules[0].Variants {
+		got[v.Name] = v.AppID
+	}
+	if len(got) != len(want) {
+		t.Fatalf("unmatched variants: got %v, want %v", got, want)
+	}
+	for name, appID := range want {
+		if got[name] != appID {
+			t.Fatalf("unmatched application ID for variant %q: got %q, want %q", name, got[name], appID)
+		}
+	}
+}
+
+// TestListVariantsFromKotlinDslGradle tests a Kotlin DSL project, whose variants are listed using
+// the variant API.
+func TestListVariantsFromKotlinDslGradle(t *testing.T) {
+	modules, err := listVariantsFromGradle(filepath.Join("testdata", "projects", "testKotlinDslMultiFlavor"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(modules) != 1 || modules[0].Module != "app" || modules[0].ProjectPath != ":app" || !modules[0].Default {
+		t.Fatalf("unmatched modules: got %v", modules)
+	}
+	if want := []string{"tier"}; !reflect.DeepEqual(modules[0].FlavorDimensions, want) {
+		t.Fatalf("unmatched flavor dimensions: got %v, want %v", modules[0].FlavorDimensions, want)
+	}
+
+	want := []variantInfo{
+		{Name: "liteDebug", BuildType: "debug", Flavors: []string{"lite"}, AppID: "io.v.testProjectId.lite.debug", Default: true},
+		{Name: "liteRelease", BuildType: "release", Flavors: []string{"lite"}, AppID: "io.v.testProjectId.lite"},
+		{Name: "proDebug", BuildType: "debug", Flavors: []string{"pro"}, AppID: "io.v.testProjectId.pro.debug"},
+		{Name: "proRelease", BuildType: "release", Flavors: []string{"pro"}, AppID: "io.v.testProjectId.pro"},
+	}
+	if got := modules[0].Variants; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unmatched variants: got %v, want %v", got, want)
+	}
+}
+
+func TestFormatFlavors(t *testing.T) {
+	tests := []struct {
+		dimensions []string
+		flavors    []string
+		want       string
+	}{
+		{[]string{"tier", "mode"}, []string{"pro", "demo"}, "tier=pro, mode=demo"},
+		{[]string{}, []string{"lite"}, "lite"},
+		{[]string{}, []string{}, ""},
+	}
+
+	for i, test := range tests {
+		if got := formatFlavors(test.dimensions, test.flavors); got != test.want {
+			t.Fatalf("unmatched results for tests[%v]: got %q, want %q", i, got, test.want)
+		}
+	}
+}
+
+func TestPrintVariantsTable(t *testing.T) {
+	modules := []moduleVariants{
+		{
+			Module:           "client",
+			ProjectPath:      ":client",
+			FlavorDimensions: []string{"tier"},
+			Variants: []variantInfo{
+				{Name: "liteDebug", BuildType: "debug", Flavors: []string{"lite"}, AppID: "com.example.client.lite.debug"},
+				{Name: "proRelease", BuildType: "release", Flavors: []string{"pro"}, AppID: "com.example.client.pro"},
+			},
+		},
+		{
+			Module:      "server",
+			ProjectPath: ":server",
+			Variants: []variantInfo{
+				{Name: "debug", BuildType: "debug", AppID: "com.example.server"},
+			},
+		},
+	}
+	markDefaultVariants(modules)
+
+	if !modules[0].Default || modules[1].Default || !modules[0].Variants[0].Default || modules[0].Variants[1].Default || !modules[1].Variants[0].Default {
+		t.Fatalf("unmatched default flags: got %v", modules)
+	}
+
+	buffer := bytes.Buffer{}
+	printVariantsTable(&buffer, modules)
+
+	rows := [][]string{
+		{"client (default)", "liteDebug (default)", "debug", "tier=lite", "com.example.client.lite.debug"},
+		{"client (default)", "proRelease", "release", "tier=pro", "com.example.client.pro"},
+		{"server", "debug (default)", "debug", "", "com.example.server"},
+	}
+	lines := strings.Split(buffer.String(), "\n")
+	for _, row := range rows {
+		found := false
+		for _, line := range lines {
+			cells := strings.Split(line, "|")
+			if len(cells) != len(row)+2 {
+				continue
+			}
+
+			matched := true
+			for i, cell := range row {
+				if strings.TrimSpace(cells[i+1]) != cell {
+					matched = false
+					break
+				}
+			}
+			if matched {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			t.Fatalf("row %v not found in the table:\n%v", row, buffer.String())
+		}
+	}
+}